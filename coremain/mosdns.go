@@ -21,6 +21,7 @@ package coremain
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
@@ -33,8 +34,19 @@ import (
 	"io"
 	"net/http"
 	"net/http/pprof"
+	"sync"
+	"time"
 )
 
+// drainTimeout bounds how long the shutdown waits for plugins to drain.
+const drainTimeout = 5 * time.Second
+
+// drainer is implemented by plugins that can finish their in-flight work
+// before they are closed.
+type drainer interface {
+	Drain(ctx context.Context) error
+}
+
 type Mosdns struct {
 	logger *zap.Logger // non-nil logger.
 
@@ -95,6 +107,7 @@ func NewMosdns(cfg *Config) (*Mosdns, error) {
 			defer done()
 			<-closeSignal
 			m.logger.Info("starting shutdown sequences")
+			m.drainPlugins()
 			for tag, p := range m.plugins {
 				if closer, _ := p.(io.Closer); closer != nil {
 					m.logger.Info("closing plugin", zap.String("tag", tag))
@@ -122,6 +135,29 @@ func NewMosdns(cfg *Config) (*Mosdns, error) {
 	return m, nil
 }
 
+// drainPlugins drains all plugins that implement drainer concurrently.
+// It returns once they are drained or drainTimeout elapsed.
+func (m *Mosdns) drainPlugins() {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for tag, p := range m.plugins {
+		d, _ := p.(drainer)
+		if d == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.logger.Info("draining plugin", zap.String("tag", tag))
+			if err := d.Drain(ctx); err != nil {
+				m.logger.Warn("failed to drain plugin", zap.String("tag", tag), zap.Error(err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 // NewTestMosdnsWithPlugins returns a mosdns instance for testing.
 func NewTestMosdnsWithPlugins(p map[string]any) *Mosdns {
 	return &Mosdns{
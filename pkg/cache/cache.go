@@ -20,6 +20,8 @@
 package cache
 
 import (
+	"bytes"
+	"encoding/binary"
 	"sync/atomic"
 	"time"
 
@@ -40,16 +42,59 @@ type Value interface {
 	any
 }
 
+// L2 is a second tier cache behind the in-process cache, e.g. one that is
+// shared by multiple instances. Entries are keyed by the hash of their Key.
+// The payload v carries the full key as well, so a key whose hash collides
+// with the one of an entry misses instead of getting its value.
+// Implementations must be concurrent safe. Get should be fast, it is
+// called in the query path on every miss.
+type L2 interface {
+	Get(h uint64) (v []byte, expirationTime time.Time, ok bool)
+	Set(h uint64, v []byte, expirationTime time.Time)
+}
+
 type Cache[K Key, V Value] struct {
 	opts Opts
 
 	closed    atomic.Bool
-	ristretto *ristretto.Cache[uint64, *elem[V]]
+	ristretto *ristretto.Cache[uint64, *elem[K, V]]
+
+	expiredDels atomic.Uint64 // Del calls issued by Get for expired entries.
+	collisions  atomic.Uint64
 }
 
 type Opts struct {
 	Size            int
 	CleanerInterval time.Duration
+
+	// CostFunc returns the cost of v, usually its size in bytes. v is
+	// always a V. If set, Size limits the total cost instead of the
+	// number of entries.
+	CostFunc func(v any) int64
+
+	// MaxTTL caps the lifetime of entries. Entries that are stored with
+	// an expiration time later than now + MaxTTL expire at now + MaxTTL.
+	// Zero means no cap.
+	MaxTTL time.Duration
+
+	// SyncWrites makes Store wait until the entry is applied, so it is
+	// visible to Get and counted by Len as soon as Store returns.
+	// By default, Store returns immediately and entries are applied by
+	// ristretto asynchronously in batches. A Get right after a Store may
+	// miss, and stores may be dropped under contention. This is fine for
+	// a cache and much cheaper under high write rates. Mostly for tests.
+	SyncWrites bool
+
+	// L2, if set, is consulted on misses and populated on stores. Hits
+	// in L2 are stored into the cache. L2MarshalKey converts keys to
+	// bytes that are equal iff the keys are equal. L2Marshal and
+	// L2Unmarshal convert values to and from bytes. They are all required
+	// with L2. key is always a K, v is always a V, and L2Unmarshal must
+	// return a V.
+	L2           L2
+	L2MarshalKey func(key any) ([]byte, error)
+	L2Marshal    func(v any) ([]byte, error)
+	L2Unmarshal  func(b []byte) (any, error)
 }
 
 func (opts *Opts) init() {
@@ -57,19 +102,29 @@ func (opts *Opts) init() {
 	utils.SetDefaultNum(&opts.CleanerInterval, defaultCleanerInterval)
 }
 
-type elem[V Value] struct {
+type elem[K Key, V Value] struct {
+	// key is the full key. Entries are stored by the hash of their keys,
+	// a different key with the same hash must not hit this entry.
+	key            K
 	v              V
 	expirationTime time.Time
+
+	// deleted is set by the first Get that finds the entry expired, so
+	// only one Del is issued for it no matter how many Gets race on it.
+	deleted atomic.Bool
 }
 
 func New[K Key, V Value](opts Opts) *Cache[K, V] {
 	opts.init()
 
-	rc, err := ristretto.NewCache[uint64, *elem[V]](&ristretto.Config[uint64, *elem[V]]{
+	rc, err := ristretto.NewCache[uint64, *elem[K, V]](&ristretto.Config[uint64, *elem[K, V]]{
 		NumCounters: int64(opts.Size) * 100,
 		MaxCost:     int64(opts.Size),
 		BufferItems: 64,
 		Metrics:     true,
+		// Costs are entry counts or the sizes reported by CostFunc.
+		// Ristretto's per-item overhead must not be counted into them.
+		IgnoreInternalCost: true,
 	})
 	if err != nil {
 		panic(err)
@@ -92,13 +147,62 @@ func (c *Cache[K, V]) Close() error {
 func (c *Cache[K, V]) Get(key K) (v V, expirationTime time.Time, ok bool) {
 	h := key.Sum()
 	if e, found := c.ristretto.Get(h); found {
-		if e.expirationTime.Before(time.Now()) {
-			c.ristretto.Del(h)
+		if e.key != key {
+			// Hash collision. The L2 entry of h, if any, most likely
+			// belongs to e.key as well.
+			c.collisions.Add(1)
 			return
 		}
+		if e.expirationTime.Before(time.Now()) {
+			if e.deleted.CompareAndSwap(false, true) {
+				c.ristretto.Del(h)
+				c.expiredDels.Add(1)
+			}
+			return c.getL2(key, h)
+		}
 		return e.v, e.expirationTime, true
 	}
-	return
+	return c.getL2(key, h)
+}
+
+// Collisions returns the number of Get calls that missed because another
+// key with the same hash was cached.
+func (c *Cache[K, V]) Collisions() uint64 {
+	return c.collisions.Load()
+}
+
+// getL2 looks up h, the hash of key, in the L2 cache, if any, and stores
+// a hit into the in-process cache.
+func (c *Cache[K, V]) getL2(key K, h uint64) (v V, expirationTime time.Time, ok bool) {
+	if c.opts.L2 == nil {
+		return
+	}
+	b, exp, found := c.opts.L2.Get(h)
+	if !found || exp.Before(time.Now()) {
+		return
+	}
+	kb, err := c.opts.L2MarshalKey(key)
+	if err != nil {
+		return
+	}
+	gotKey, vb, valid := splitL2Payload(b)
+	if !valid {
+		return
+	}
+	if !bytes.Equal(gotKey, kb) {
+		c.collisions.Add(1)
+		return
+	}
+	a, err := c.opts.L2Unmarshal(vb)
+	if err != nil {
+		return
+	}
+	v, ok = a.(V)
+	if !ok {
+		return
+	}
+	c.store(key, h, v, exp)
+	return v, exp, true
 }
 
 func (c *Cache[K, V]) Range(f func(key K, v V, expirationTime time.Time) error) error {
@@ -110,21 +214,75 @@ func (c *Cache[K, V]) Store(key K, v V, expirationTime time.Time) {
 	if now.After(expirationTime) {
 		return
 	}
+	if c.opts.MaxTTL > 0 {
+		if maxExp := now.Add(c.opts.MaxTTL); expirationTime.After(maxExp) {
+			expirationTime = maxExp
+		}
+	}
 
-	e := &elem[V]{
+	h := key.Sum()
+	c.store(key, h, v, expirationTime)
+	if c.opts.L2 != nil {
+		kb, err := c.opts.L2MarshalKey(key)
+		if err != nil {
+			return
+		}
+		vb, err := c.opts.L2Marshal(v)
+		if err != nil {
+			return
+		}
+		c.opts.L2.Set(h, appendL2Payload(nil, kb, vb), expirationTime)
+	}
+}
+
+// appendL2Payload appends the L2 payload of the marshaled key and value
+// to b. The payload is the uvarint length of key, key and then v.
+func appendL2Payload(b, key, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	return append(b, v...)
+}
+
+// splitL2Payload splits a payload made by appendL2Payload. ok is false if
+// b is malformed.
+func splitL2Payload(b []byte) (key, v []byte, ok bool) {
+	n, l := binary.Uvarint(b)
+	if l <= 0 || n > uint64(len(b)-l) {
+		return nil, nil, false
+	}
+	b = b[l:]
+	return b[:n], b[n:], true
+}
+
+// store stores v into the in-process cache. h is the hash of key.
+func (c *Cache[K, V]) store(key K, h uint64, v V, expirationTime time.Time) {
+	e := &elem[K, V]{
+		key:            key,
 		v:              v,
 		expirationTime: expirationTime,
 	}
-	h := key.Sum()
 	ttl := time.Until(expirationTime)
-	c.ristretto.SetWithTTL(h, e, 1, ttl)
-	c.ristretto.Wait()
+	cost := int64(1)
+	if c.opts.CostFunc != nil {
+		cost = max(c.opts.CostFunc(v), 1)
+	}
+	c.ristretto.SetWithTTL(h, e, cost, ttl)
+	if c.opts.SyncWrites {
+		c.ristretto.Wait()
+	}
 }
 
 func (c *Cache[K, V]) Len() int {
 	return int(c.ristretto.Metrics.KeysAdded() - c.ristretto.Metrics.KeysEvicted())
 }
 
+// Cost returns the total cost of the entries in the cache. It is the
+// total size reported by Opts.CostFunc, or equals Len if it is not set.
+func (c *Cache[K, V]) Cost() int64 {
+	cost := int64(c.ristretto.Metrics.CostAdded() - c.ristretto.Metrics.CostEvicted())
+	return max(cost, 0)
+}
+
 func (c *Cache[K, V]) Flush() {
 	c.ristretto.Clear()
 }
@@ -32,11 +32,28 @@ func BenchmarkCacheStore(b *testing.B) {
 	}
 }
 
+func BenchmarkCacheStoreHotKey(b *testing.B) {
+	for _, sync := range []bool{false, true} {
+		b.Run(fmt.Sprintf("sync_writes_%v", sync), func(b *testing.B) {
+			c := New[benchKey, []byte](Opts{Size: 1000, SyncWrites: sync})
+			defer c.Close()
+
+			val := []byte("value")
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c.Store("hot_key", val, time.Now().Add(time.Hour))
+				}
+			})
+		})
+	}
+}
+
 func BenchmarkCacheGet(b *testing.B) {
 	sizes := []int{1000, 10000, 100000}
 	for _, size := range sizes {
 		b.Run(fmt.Sprintf("size_%d", size), func(b *testing.B) {
-			c := New[benchKey, []byte](Opts{Size: size})
+			c := New[benchKey, []byte](Opts{Size: size, SyncWrites: true})
 			defer c.Close()
 
 			for i := 0; i < size; i++ {
@@ -95,3 +112,19 @@ func BenchmarkCacheMixed(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkCacheGetExpired(b *testing.B) {
+	c := New[benchKey, []byte](Opts{Size: 1000, SyncWrites: true})
+	defer c.Close()
+
+	e := &elem[benchKey, []byte]{key: "expired_key", v: []byte("value"), expirationTime: time.Now().Add(-time.Second)}
+	c.ristretto.SetWithTTL(benchKey("expired_key").Sum(), e, 1, time.Hour)
+	c.ristretto.Wait()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Get("expired_key")
+		}
+	})
+}
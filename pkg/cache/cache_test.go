@@ -20,6 +20,7 @@
 package cache
 
 import (
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -33,7 +34,8 @@ func (t testKey) Sum() uint64 {
 
 func Test_Cache(t *testing.T) {
 	c := New[testKey, int](Opts{
-		Size: 1024,
+		Size:       1024,
+		SyncWrites: true,
 	})
 	defer c.Close()
 
@@ -76,6 +78,7 @@ func Test_memCache_cleaner(t *testing.T) {
 	c := New[testKey, int](Opts{
 		Size:            1024,
 		CleanerInterval: time.Millisecond * 10,
+		SyncWrites:      true,
 	})
 	defer c.Close()
 	for i := 0; i < 64; i++ {
@@ -102,7 +105,8 @@ func Test_memCache_cleaner(t *testing.T) {
 
 func Test_memCache_race(t *testing.T) {
 	c := New[testKey, int](Opts{
-		Size: 1024,
+		Size:       1024,
+		SyncWrites: true,
 	})
 	defer c.Close()
 
@@ -120,3 +124,227 @@ func Test_memCache_race(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func Test_Cache_Cost(t *testing.T) {
+	c := New[testKey, []byte](Opts{
+		Size:       1 << 20,
+		CostFunc:   func(v any) int64 { return int64(len(v.([]byte))) },
+		SyncWrites: true,
+	})
+	defer c.Close()
+
+	const n, size = 100, 512
+	for i := 0; i < n; i++ {
+		c.Store(testKey(i), make([]byte, size), time.Now().Add(time.Second*10))
+	}
+	if cost := c.Cost(); cost != n*size {
+		t.Fatalf("want cost %d, got %d", n*size, cost)
+	}
+
+	// Replacing a value updates its cost.
+	c.Store(testKey(0), make([]byte, size*2), time.Now().Add(time.Second*10))
+	if cost := c.Cost(); cost != (n+1)*size {
+		t.Fatalf("want cost %d, got %d", (n+1)*size, cost)
+	}
+
+	c.Flush()
+	if cost := c.Cost(); cost < 0 || cost > (n+1)*size {
+		t.Fatalf("invalid cost %d after flush", cost)
+	}
+
+	// Without a CostFunc, cost equals Len.
+	c2 := New[testKey, int](Opts{Size: 1024, SyncWrites: true})
+	defer c2.Close()
+	for i := 0; i < 10; i++ {
+		c2.Store(testKey(i), i, time.Now().Add(time.Second*10))
+	}
+	if cost, l := c2.Cost(), c2.Len(); cost != int64(l) {
+		t.Fatalf("want cost %d, got %d", l, cost)
+	}
+}
+
+func Test_Cache_MaxTTL(t *testing.T) {
+	c := New[testKey, int](Opts{MaxTTL: time.Minute, SyncWrites: true})
+	defer c.Close()
+
+	start := time.Now()
+	c.Store(1, 1, start.Add(time.Hour*24*7))
+	c.Store(2, 2, start.Add(time.Second*10))
+
+	_, exp, ok := c.Get(1)
+	if !ok {
+		t.Fatal("entry 1 should be cached")
+	}
+	if exp.After(time.Now().Add(time.Minute)) || exp.Before(start.Add(time.Minute)) {
+		t.Fatalf("expiration time should be clamped to %s, got %s", start.Add(time.Minute), exp)
+	}
+
+	// Shorter TTLs are kept.
+	_, exp, ok = c.Get(2)
+	if !ok || !exp.Equal(start.Add(time.Second*10)) {
+		t.Fatalf("expiration time should not be changed, got %s", exp)
+	}
+}
+
+func Test_Cache_ExpiredGetDelOnce(t *testing.T) {
+	c := New[testKey, int](Opts{Size: 1024, SyncWrites: true})
+	defer c.Close()
+
+	// Store an entry that ristretto still holds but we consider expired.
+	e := &elem[testKey, int]{key: 1, v: 1, expirationTime: time.Now().Add(-time.Second)}
+	c.ristretto.SetWithTTL(testKey(1).Sum(), e, 1, time.Hour)
+	c.ristretto.Wait()
+
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 100; j++ {
+				if _, _, ok := c.Get(testKey(1)); ok {
+					t.Error("expired entry should not be returned")
+					return
+				}
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := c.expiredDels.Load(); n != 1 {
+		t.Fatalf("expected 1 Del for the expired entry, got %d", n)
+	}
+}
+
+// collidingKey hashes all keys to the same value.
+type collidingKey string
+
+func (collidingKey) Sum() uint64 {
+	return 42
+}
+
+func Test_Cache_HashCollision(t *testing.T) {
+	c := New[collidingKey, string](Opts{SyncWrites: true})
+	defer c.Close()
+
+	exp := time.Now().Add(time.Minute)
+	c.Store("a.example.", "a", exp)
+	if v, _, ok := c.Get("a.example."); !ok || v != "a" {
+		t.Fatalf("want a hit of a, got %v %v", v, ok)
+	}
+	if v, _, ok := c.Get("b.example."); ok {
+		t.Fatalf("a colliding key should miss, got %v", v)
+	}
+	if n := c.Collisions(); n != 1 {
+		t.Fatalf("want 1 collision, got %d", n)
+	}
+
+	// The colliding key replaces the entry.
+	c.Store("b.example.", "b", exp)
+	if v, _, ok := c.Get("b.example."); !ok || v != "b" {
+		t.Fatalf("want a hit of b, got %v %v", v, ok)
+	}
+	if v, _, ok := c.Get("a.example."); ok {
+		t.Fatalf("a colliding key should miss, got %v", v)
+	}
+}
+
+// mapL2 is an in-memory L2.
+type mapL2 struct {
+	sync.Mutex
+	m map[uint64]mapL2Entry
+}
+
+type mapL2Entry struct {
+	b   []byte
+	exp time.Time
+}
+
+func (l *mapL2) Get(h uint64) ([]byte, time.Time, bool) {
+	l.Lock()
+	defer l.Unlock()
+	e, ok := l.m[h]
+	return e.b, e.exp, ok
+}
+
+func (l *mapL2) Set(h uint64, v []byte, exp time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	l.m[h] = mapL2Entry{b: v, exp: exp}
+}
+
+func Test_Cache_L2(t *testing.T) {
+	l2 := &mapL2{m: make(map[uint64]mapL2Entry)}
+	opts := Opts{
+		SyncWrites:   true,
+		L2:           l2,
+		L2MarshalKey: func(key any) ([]byte, error) { return strconv.AppendInt(nil, int64(key.(testKey)), 10), nil },
+		L2Marshal:    func(v any) ([]byte, error) { return []byte(v.(string)), nil },
+		L2Unmarshal:  func(b []byte) (any, error) { return string(b), nil },
+	}
+	c1 := New[testKey, string](opts)
+	defer c1.Close()
+	c2 := New[testKey, string](opts) // A peer that shares the L2.
+	defer c2.Close()
+
+	exp := time.Now().Add(time.Minute)
+	c1.Store(1, "v1", exp)
+	if _, ok := l2.m[testKey(1).Sum()]; !ok {
+		t.Fatal("store should populate the L2")
+	}
+
+	// A miss in the L1 of c2 falls through to the L2.
+	if _, ok := c2.ristretto.Get(testKey(1).Sum()); ok {
+		t.Fatal("entry should not be in the L1 of c2")
+	}
+	v, gotExp, ok := c2.Get(1)
+	if !ok || v != "v1" || !gotExp.Equal(exp) {
+		t.Fatalf("expected a hit from the L2, got %v, %s, %v", v, gotExp, ok)
+	}
+	// The hit is stored into the L1.
+	if e, ok := c2.ristretto.Get(testKey(1).Sum()); !ok || e.v != "v1" {
+		t.Fatal("L2 hit should populate the L1")
+	}
+
+	// Expired entries in the L2 are misses.
+	l2.Set(testKey(2).Sum(), appendL2Payload(nil, []byte("2"), []byte("v2")), time.Now().Add(-time.Second))
+	if _, _, ok := c2.Get(2); ok {
+		t.Fatal("expired L2 entry should not be returned")
+	}
+}
+
+func Test_Cache_L2HashCollision(t *testing.T) {
+	l2 := &mapL2{m: make(map[uint64]mapL2Entry)}
+	opts := Opts{
+		SyncWrites:   true,
+		L2:           l2,
+		L2MarshalKey: func(key any) ([]byte, error) { return []byte(key.(collidingKey)), nil },
+		L2Marshal:    func(v any) ([]byte, error) { return []byte(v.(string)), nil },
+		L2Unmarshal:  func(b []byte) (any, error) { return string(b), nil },
+	}
+	c1 := New[collidingKey, string](opts)
+	defer c1.Close()
+	c2 := New[collidingKey, string](opts)
+	defer c2.Close()
+
+	c1.Store("a", "va", time.Now().Add(time.Minute))
+	if v, _, ok := c2.Get("b"); ok {
+		t.Fatalf("a colliding key should miss in the L2, got %v", v)
+	}
+	if n := c2.Collisions(); n != 1 {
+		t.Fatalf("want 1 collision, got %d", n)
+	}
+	if v, _, ok := c2.Get("a"); !ok || v != "va" {
+		t.Fatalf("expected a hit from the L2, got %v, %v", v, ok)
+	}
+
+	// Malformed payloads are misses.
+	l2.Set(collidingKey("a").Sum(), []byte{0xff}, time.Now().Add(time.Minute))
+	c3 := New[collidingKey, string](opts)
+	defer c3.Close()
+	if v, _, ok := c3.Get("a"); ok {
+		t.Fatalf("a malformed payload should miss, got %v", v)
+	}
+}
@@ -20,7 +20,9 @@
 package concurrent_lru
 
 import (
+	"container/heap"
 	"sync"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2/simplelru"
 )
@@ -54,6 +56,18 @@ func (c *ShardedLRU[K, V]) Add(key K, v V) {
 	sl.Add(key, v)
 }
 
+// AddWithExpire adds key with an expiration time. See ConcurrentLRU.AddWithExpire.
+func (c *ShardedLRU[K, V]) AddWithExpire(key K, v V, expire time.Time) {
+	sl := c.getShard(key)
+	sl.AddWithExpire(key, v, expire)
+}
+
+// Update atomically updates key. See ConcurrentLRU.Update.
+func (c *ShardedLRU[K, V]) Update(key K, f func(old V, ok bool) (v V, keep bool)) {
+	sl := c.getShard(key)
+	sl.Update(key, f)
+}
+
 func (c *ShardedLRU[K, V]) Del(key K) {
 	sl := c.getShard(key)
 	sl.Del(key)
@@ -66,6 +80,15 @@ func (c *ShardedLRU[K, V]) Clean(f func(key K, v V) (remove bool)) (removed int)
 	return removed
 }
 
+// RemoveExpired removes expired entries from all shards and returns the
+// number of removed entries.
+func (c *ShardedLRU[K, V]) RemoveExpired() (removed int) {
+	for _, l := range c.l {
+		removed += l.RemoveExpired()
+	}
+	return removed
+}
+
 func (c *ShardedLRU[K, V]) Flush() {
 	for _, l := range c.l {
 		l.Flush()
@@ -86,6 +109,30 @@ func (c *ShardedLRU[K, V]) Len() int {
 	return sum
 }
 
+// Keys returns all keys shard by shard. Keys of each shard are in LRU order,
+// from the oldest to the newest. There is no global order across shards.
+// Shards are inspected one by one, so this is not an atomic snapshot.
+func (c *ShardedLRU[K, V]) Keys() []K {
+	keys := make([]K, 0, c.Len())
+	for _, l := range c.l {
+		keys = append(keys, l.Keys()...)
+	}
+	return keys
+}
+
+// OldestInShard returns the eviction candidate of the shard that key belongs to.
+// Since eviction happens per shard, this is the entry that will be evicted
+// before key.
+func (c *ShardedLRU[K, V]) OldestInShard(key K) (k K, v V, ok bool) {
+	return c.getShard(key).Oldest()
+}
+
+// NewestInShard returns the most recently used entry of the shard that key
+// belongs to.
+func (c *ShardedLRU[K, V]) NewestInShard(key K) (k K, v V, ok bool) {
+	return c.getShard(key).Newest()
+}
+
 func (c *ShardedLRU[K, V]) shardNum() int {
 	return len(c.l)
 }
@@ -95,33 +142,98 @@ func (c *ShardedLRU[K, V]) getShard(key K) *ConcurrentLRU[K, V] {
 }
 
 type ConcurrentLRU[K comparable, V any] struct {
-	mu       sync.RWMutex
-	lru      *lru.LRU[K, V]
-	onEvict  func(key K, v V)
+	mu      sync.RWMutex
+	lru     *lru.LRU[K, V]
+	onEvict func(key K, v V)
+
+	// Expiration times of entries added by AddWithExpire, and a min-heap
+	// of them. Heap items are invalidated lazily: an item is stale if it
+	// does not match expires.
+	expires map[K]time.Time
+	expHeap expireHeap[K]
 }
 
 func NewConcurrentLRU[K comparable, V any](maxSize int, onEvict func(key K, v V)) *ConcurrentLRU[K, V] {
+	c := &ConcurrentLRU[K, V]{
+		onEvict: onEvict,
+		expires: make(map[K]time.Time),
+	}
+
+	// Always called with c.mu held.
 	evictCb := func(key K, v V) {
+		delete(c.expires, key)
 		if onEvict != nil {
 			onEvict(key, v)
 		}
 	}
-	
+
 	l, err := lru.NewLRU[K, V](maxSize, evictCb)
 	if err != nil {
 		panic(err)
 	}
-
-	return &ConcurrentLRU[K, V]{
-		lru:     l,
-		onEvict: onEvict,
-	}
+	c.lru = l
+	return c
 }
 
 func (c *ConcurrentLRU[K, V]) Add(key K, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.expires, key)
+	c.lru.Add(key, v)
+}
+
+// AddWithExpire adds key like Add. The entry will be removed by
+// RemoveExpired once expire has passed. It is not removed otherwise, Get
+// still returns expired entries.
+func (c *ConcurrentLRU[K, V]) AddWithExpire(key K, v V, expire time.Time) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.lru.Add(key, v)
+	c.expires[key] = expire
+	heap.Push(&c.expHeap, expireItem[K]{key: key, expire: expire})
+
+	// Too many stale items, rebuild the heap.
+	if len(c.expHeap) > 2*len(c.expires)+64 {
+		c.expHeap = c.expHeap[:0]
+		for k, e := range c.expires {
+			c.expHeap = append(c.expHeap, expireItem[K]{key: k, expire: e})
+		}
+		heap.Init(&c.expHeap)
+	}
+}
+
+// RemoveExpired removes entries added by AddWithExpire that have expired
+// and returns the number of removed entries. Its cost depends on the number
+// of expired entries, not the size of the cache.
+func (c *ConcurrentLRU[K, V]) RemoveExpired() (removed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for len(c.expHeap) > 0 && !c.expHeap[0].expire.After(now) {
+		item := heap.Pop(&c.expHeap).(expireItem[K])
+		if e, ok := c.expires[item.key]; ok && e.Equal(item.expire) {
+			c.lru.Remove(item.key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Update atomically reads key and stores the value returned by f.
+// ok reports whether key was in the cache, old is its value. If keep is
+// false, key is removed instead. The expiration time of key, if it has one,
+// is kept. f is called with the lock held, it must not call methods of c.
+func (c *ConcurrentLRU[K, V]) Update(key K, f func(old V, ok bool) (v V, keep bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, ok := c.lru.Get(key)
+	v, keep := f(old, ok)
+	if keep {
+		c.lru.Add(key, v)
+	} else if ok {
+		c.lru.Remove(key)
+	}
 }
 
 func (c *ConcurrentLRU[K, V]) Del(key K) {
@@ -150,11 +262,15 @@ func (c *ConcurrentLRU[K, V]) Flush() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.lru.Purge()
+	clear(c.expires)
+	c.expHeap = nil
 }
 
+// Get returns the value of key. It makes key the newest entry, so it takes
+// the write lock.
 func (c *ConcurrentLRU[K, V]) Get(key K) (v V, ok bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.lru.Get(key)
 }
 
@@ -163,3 +279,58 @@ func (c *ConcurrentLRU[K, V]) Len() int {
 	defer c.mu.RUnlock()
 	return c.lru.Len()
 }
+
+// Keys returns keys in LRU order, from the oldest to the newest.
+// It does not update the recency of entries.
+func (c *ConcurrentLRU[K, V]) Keys() []K {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lru.Keys()
+}
+
+// Oldest returns the next entry to be evicted without updating its recency.
+func (c *ConcurrentLRU[K, V]) Oldest() (k K, v V, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lru.GetOldest()
+}
+
+// Newest returns the most recently used entry without updating its recency.
+// It copies all keys, so it is O(n).
+func (c *ConcurrentLRU[K, V]) Newest() (k K, v V, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := c.lru.Keys()
+	if len(keys) == 0 {
+		return k, v, false
+	}
+	k = keys[len(keys)-1]
+	v, ok = c.lru.Peek(k)
+	return k, v, ok
+}
+
+type expireItem[K comparable] struct {
+	key    K
+	expire time.Time
+}
+
+// expireHeap implements heap.Interface. The item that expires first is at
+// the top.
+type expireHeap[K comparable] []expireItem[K]
+
+func (h expireHeap[K]) Len() int           { return len(h) }
+func (h expireHeap[K]) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+func (h expireHeap[K]) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expireHeap[K]) Push(x any) {
+	*h = append(*h, x.(expireItem[K]))
+}
+
+func (h *expireHeap[K]) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = expireItem[K]{}
+	*h = old[:n-1]
+	return item
+}
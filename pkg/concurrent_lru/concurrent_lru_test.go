@@ -21,7 +21,9 @@ package concurrent_lru
 
 import (
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testKey int
@@ -109,3 +111,204 @@ func TestConcurrentLRU(t *testing.T) {
 	mustGet(2, 4)
 	emptyGet(1, 3)
 }
+
+func TestConcurrentLRUInspection(t *testing.T) {
+	c := NewConcurrentLRU[int, int](4, nil)
+	if _, _, ok := c.Oldest(); ok {
+		t.Fatal("empty lru should have no oldest entry")
+	}
+	if _, _, ok := c.Newest(); ok {
+		t.Fatal("empty lru should have no newest entry")
+	}
+
+	for i := 1; i <= 4; i++ {
+		c.Add(i, i*10)
+	}
+	c.Get(1) // 1 becomes the newest.
+
+	if want, got := []int{2, 3, 4, 1}, c.Keys(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("want keys %v, got %v", want, got)
+	}
+	if k, v, ok := c.Oldest(); !ok || k != 2 || v != 20 {
+		t.Fatalf("want oldest 2, got %v %v %v", k, v, ok)
+	}
+	if k, v, ok := c.Newest(); !ok || k != 1 || v != 10 {
+		t.Fatalf("want newest 1, got %v %v %v", k, v, ok)
+	}
+
+	// Inspection must not update recency.
+	c.Add(5, 50)
+	if want, got := []int{3, 4, 1, 5}, c.Keys(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("want keys %v, got %v", want, got)
+	}
+}
+
+func TestConcurrentLRUInspectionRace(t *testing.T) {
+	c := NewConcurrentLRU[int, int](16, nil)
+	for i := 0; i < 16; i++ {
+		c.Add(i, i)
+	}
+
+	// Get moves entries, it must not run concurrently with inspections.
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Get(j % 16)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Keys()
+				c.Newest()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestShardedLRUInspection(t *testing.T) {
+	cache := NewShardedLRU[testKey, int](2, 4, nil)
+	for i := 0; i < 6; i++ {
+		cache.Add(testKey(i), i)
+	}
+	if keys := cache.Keys(); len(keys) != 6 {
+		t.Fatalf("want 6 keys, got %v", keys)
+	}
+	// Shard 0 holds 0, 2, 4.
+	if k, _, ok := cache.OldestInShard(4); !ok || k != 0 {
+		t.Fatalf("want oldest 0, got %v %v", k, ok)
+	}
+	if k, _, ok := cache.NewestInShard(4); !ok || k != 4 {
+		t.Fatalf("want newest 4, got %v %v", k, ok)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	const goroutines, increments = 16, 1000
+	cache := NewShardedLRU[testKey, int](4, 16, nil)
+	incr := func(old int, ok bool) (int, bool) { return old + 1, true }
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				cache.Update(testKey(j%4), incr)
+			}
+		}()
+	}
+	wg.Wait()
+	for k := testKey(0); k < 4; k++ {
+		if v, _ := cache.Get(k); v != goroutines*increments/4 {
+			t.Fatalf("key %d: lost updates, want %d, got %d", k, goroutines*increments/4, v)
+		}
+	}
+
+	// Not keeping the value removes the key.
+	cache.Update(0, func(old int, ok bool) (int, bool) { return 0, false })
+	if _, ok := cache.Get(0); ok {
+		t.Fatal("key 0 should be removed")
+	}
+	cache.Update(0, func(old int, ok bool) (int, bool) {
+		if ok {
+			t.Fatal("key 0 should not exist")
+		}
+		return 0, false
+	})
+	if _, ok := cache.Get(0); ok {
+		t.Fatal("key 0 should not be added")
+	}
+
+	// The expiration time is kept.
+	cache.AddWithExpire(1, 1, time.Now().Add(-time.Second))
+	cache.Update(1, incr)
+	if n := cache.RemoveExpired(); n != 1 {
+		t.Fatalf("want 1 expired entry, got %d", n)
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	var evicted []testKey
+	cache := NewShardedLRU[testKey, int](2, 16, func(key testKey, v int) { evicted = append(evicted, key) })
+
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+	cache.AddWithExpire(1, 1, past)
+	cache.AddWithExpire(2, 2, past)
+	cache.AddWithExpire(3, 3, future)
+	cache.Add(4, 4)
+
+	// Re-adding a key replaces its expiration time.
+	cache.AddWithExpire(2, 2, future)
+	cache.AddWithExpire(4, 4, past)
+	cache.AddWithExpire(5, 5, past)
+	cache.Add(5, 5)
+
+	// Removed keys are not counted.
+	cache.AddWithExpire(6, 6, past)
+	cache.Del(6)
+	evicted = nil
+
+	if n := cache.RemoveExpired(); n != 2 {
+		t.Fatalf("want 2 removed, got %d", n)
+	}
+	if len(evicted) != 2 {
+		t.Fatalf("onEvict should be called for removed keys, got %v", evicted)
+	}
+	for _, k := range []testKey{1, 4} {
+		if _, ok := cache.Get(k); ok {
+			t.Fatalf("key %d should be removed", k)
+		}
+	}
+	for _, k := range []testKey{2, 3, 5} {
+		if _, ok := cache.Get(k); !ok {
+			t.Fatalf("key %d should be kept", k)
+		}
+	}
+	if n := cache.RemoveExpired(); n != 0 {
+		t.Fatalf("want 0 removed, got %d", n)
+	}
+}
+
+func benchmarkExpireCache(size, expired int) (*ConcurrentLRU[int, time.Time], func()) {
+	c := NewConcurrentLRU[int, time.Time](size, nil)
+	future := time.Now().Add(time.Hour)
+	for i := expired; i < size; i++ {
+		c.AddWithExpire(i, future, future)
+	}
+	refill := func() {
+		past := time.Now().Add(-time.Second)
+		for i := 0; i < expired; i++ {
+			c.AddWithExpire(i, past, past)
+		}
+	}
+	return c, refill
+}
+
+func BenchmarkRemoveExpired(b *testing.B) {
+	c, refill := benchmarkExpireCache(100000, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		refill()
+		b.StartTimer()
+		c.RemoveExpired()
+	}
+}
+
+func BenchmarkCleanExpired(b *testing.B) {
+	c, refill := benchmarkExpireCache(100000, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		refill()
+		b.StartTimer()
+		now := time.Now()
+		c.Clean(func(_ int, expire time.Time) bool { return !expire.After(now) })
+	}
+}
@@ -158,3 +158,35 @@ func FakeSOA(name string) *dns.SOA {
 		Minttl:  86400,
 	}
 }
+
+// FitUDPSize makes m fit into size bytes, for responses over udp. Sizes
+// smaller than 512 are treated as 512.
+// Unlike m.Truncate, it tries to keep the answer complete first: it drops
+// the optional records in the additional section, except the OPT record,
+// before dropping any answer or authority record. The TC bit is only set
+// if the answer or authority section still does not fit.
+func FitUDPSize(m *dns.Msg, size int) {
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	if m.Len() <= size {
+		return
+	}
+	m.Compress = true
+	if m.Len() <= size {
+		return
+	}
+
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	clear(m.Extra[len(extra):])
+	m.Extra = extra
+	if m.Len() <= size {
+		return
+	}
+	m.Truncate(size)
+}
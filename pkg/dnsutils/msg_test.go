@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newFitTestMsg(answers, extras int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Response = true
+	for i := 0; i < answers; i++ {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	for i := 0; i < extras; i++ {
+		m.Extra = append(m.Extra, &dns.A{
+			Hdr: dns.RR_Header{Name: fmt.Sprintf("ns%d.example.net.", i), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(198, 51, 100, byte(i)),
+		})
+	}
+	m.SetEdns0(4096, false)
+	return m
+}
+
+func TestFitUDPSize(t *testing.T) {
+	// The size of the msg with 40 answers and only the OPT record in the
+	// additional section. It is larger than 512.
+	answerOnly := newFitTestMsg(40, 0)
+	answerOnly.Compress = true
+	answerOnlyLen := answerOnly.Len()
+
+	tests := []struct {
+		name       string
+		answers    int
+		extras     int
+		size       int
+		wantAnswer int
+		wantExtra  int // including the OPT record.
+		wantTC     bool
+	}{
+		{"fits", 10, 20, 4096, 10, 21, false},
+		{"drop_extra", 40, 20, answerOnlyLen, 40, 1, false},
+		{"min_size", 10, 20, 100, 10, 1, false},
+		{"truncate_answer", 60, 20, 512, -1, 1, true},
+		{"truncate_answer_large", 300, 0, 1232, -1, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newFitTestMsg(tt.answers, tt.extras)
+			FitUDPSize(m, tt.size)
+
+			if l, limit := m.Len(), max(tt.size, dns.MinMsgSize); l > limit {
+				t.Fatalf("msg length %d exceeds %d", l, limit)
+			}
+			if m.Truncated != tt.wantTC {
+				t.Fatalf("want TC %v, got %v", tt.wantTC, m.Truncated)
+			}
+			if tt.wantAnswer >= 0 && len(m.Answer) != tt.wantAnswer {
+				t.Fatalf("want %d answers, got %d", tt.wantAnswer, len(m.Answer))
+			}
+			if tt.wantAnswer < 0 && len(m.Answer) >= tt.answers {
+				t.Fatalf("answers should be truncated, got %d", len(m.Answer))
+			}
+			if len(m.Extra) != tt.wantExtra {
+				t.Fatalf("want %d extra records, got %d", tt.wantExtra, len(m.Extra))
+			}
+			if m.IsEdns0() == nil {
+				t.Fatal("OPT record is dropped")
+			}
+		})
+	}
+}
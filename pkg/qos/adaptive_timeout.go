@@ -26,6 +26,16 @@ import (
 	"time"
 )
 
+// Modes of AdaptiveTimeout, see TimeoutConfig.Mode.
+const (
+	TimeoutModeRTT        = "rtt"
+	TimeoutModePercentile = "percentile"
+)
+
+// timeoutRateDecay is the weight of the latest request in
+// AdaptiveTimeout.TimeoutRate.
+const timeoutRateDecay = 0.05
+
 type AdaptiveTimeout struct {
 	mu sync.RWMutex
 
@@ -33,11 +43,21 @@ type AdaptiveTimeout struct {
 	minTimeout     time.Duration
 	maxTimeout     time.Duration
 	congestionMult float64
+	minSamples     int64
+
+	// Only in TimeoutModePercentile.
+	window     *LatencyWindow
+	percentile float64
 
 	srtt                time.Duration
 	rttVar              time.Duration
+	timeoutRate         float64
 	samples             atomic.Int64
 	consecutiveTimeouts atomic.Int64
+
+	idleReset    time.Duration
+	lastActivity time.Time // zero if nothing was recorded since the last reset.
+	now          func() time.Time
 }
 
 type TimeoutConfig struct {
@@ -45,6 +65,30 @@ type TimeoutConfig struct {
 	MinTimeout     time.Duration
 	MaxTimeout     time.Duration
 	CongestionMult float64
+
+	// MinSamples is the number of samples required before GetTimeout may
+	// return a timeout shorter than BaseTimeout. It prevents a few fast
+	// early samples from tightening the timeout prematurely. Default is 4.
+	MinSamples int
+
+	// Mode is how the timeout is computed from the samples.
+	// TimeoutModeRTT uses srtt + 4*rttvar (Jacobson/Karels).
+	// TimeoutModePercentile uses the Percentile of the latencies of the
+	// last WindowSize requests, so e.g. 0.999 means that about 0.1% of
+	// requests time out. Timeouts are counted as samples of the timeout
+	// that fired. CongestionMult is not used in this mode.
+	// Default is TimeoutModeRTT.
+	Mode string
+
+	// Percentile is in (0, 1]. Default is 0.99.
+	Percentile float64
+	// WindowSize defaults to 100.
+	WindowSize int
+
+	// IdleReset resets the estimate to BaseTimeout if nothing was recorded
+	// for longer than IdleReset, because the samples may no longer reflect
+	// the network by the time requests resume. Zero disables it.
+	IdleReset time.Duration
 }
 
 func NewAdaptiveTimeout(cfg TimeoutConfig) *AdaptiveTimeout {
@@ -60,22 +104,41 @@ func NewAdaptiveTimeout(cfg TimeoutConfig) *AdaptiveTimeout {
 	if cfg.CongestionMult <= 1.0 {
 		cfg.CongestionMult = 4.0
 	}
+	if cfg.MinSamples <= 0 {
+		cfg.MinSamples = 4
+	}
 
-	return &AdaptiveTimeout{
+	a := &AdaptiveTimeout{
 		baseTimeout:    cfg.BaseTimeout,
 		minTimeout:     cfg.MinTimeout,
 		maxTimeout:     cfg.MaxTimeout,
 		congestionMult: cfg.CongestionMult,
+		minSamples:     int64(cfg.MinSamples),
 		srtt:           cfg.BaseTimeout,
 		rttVar:         cfg.BaseTimeout / 2,
+		idleReset:      cfg.IdleReset,
+		now:            time.Now,
 	}
+	if cfg.Mode == TimeoutModePercentile {
+		if cfg.Percentile <= 0 || cfg.Percentile > 1 {
+			cfg.Percentile = 0.99
+		}
+		a.window = NewLatencyWindow(cfg.WindowSize)
+		a.percentile = cfg.Percentile
+	}
+	return a
 }
 
 func (a *AdaptiveTimeout) RecordSuccess(duration time.Duration) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	a.lastActivity = a.now()
 	a.consecutiveTimeouts.Store(0)
+	a.updateTimeoutRate(false)
+	if a.window != nil {
+		a.window.Record(duration)
+	}
 
 	if a.samples.Load() == 0 {
 		a.srtt = duration
@@ -96,23 +159,96 @@ func (a *AdaptiveTimeout) RecordSuccess(duration time.Duration) {
 	a.samples.Add(1)
 }
 
+// RecordTimeout is a shorthand for RecordFailure(true, 0).
 func (a *AdaptiveTimeout) RecordTimeout() {
+	a.RecordFailure(true, 0)
+}
+
+// RecordFailure records a failed request that took duration. Only
+// timeouts are a sign of congestion and inflate the timeout. Other
+// failures, e.g. connection refused, end a run of consecutive timeouts
+// without inflating it. duration is not used by the estimation for now.
+func (a *AdaptiveTimeout) RecordFailure(isTimeout bool, duration time.Duration) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	a.lastActivity = a.now()
+	a.updateTimeoutRate(isTimeout)
+	if !isTimeout {
+		a.consecutiveTimeouts.Store(0)
+		return
+	}
 	count := a.consecutiveTimeouts.Add(1)
 
+	if a.window != nil {
+		// The request took at least the timeout.
+		a.window.Record(max(duration, a.getTimeout()))
+		return
+	}
+
 	if count >= 3 {
 		multiplier := math.Min(a.congestionMult, 1.0+float64(count)*0.5)
 		a.srtt = time.Duration(float64(a.srtt) * multiplier)
 	}
 }
 
-func (a *AdaptiveTimeout) GetTimeout() time.Duration {
+// updateTimeoutRate must be called with a.mu held.
+func (a *AdaptiveTimeout) updateTimeoutRate(isTimeout bool) {
+	v := 0.0
+	if isTimeout {
+		v = 1
+	}
+	a.timeoutRate = timeoutRateDecay*v + (1-timeoutRateDecay)*a.timeoutRate
+}
+
+// TimeoutRate returns the decayed rate of timeouts among recent requests,
+// in [0, 1].
+func (a *AdaptiveTimeout) TimeoutRate() float64 {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
+	return a.timeoutRate
+}
+
+func (a *AdaptiveTimeout) GetTimeout() time.Duration {
+	a.mu.RLock()
+	if !a.idle() {
+		defer a.mu.RUnlock()
+		return a.getTimeout()
+	}
+	a.mu.RUnlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.idle() {
+		a.reset()
+		// Start over from exactly BaseTimeout. The first sample replaces
+		// both srtt and rttVar anyway.
+		a.rttVar = 0
+	}
+	return a.getTimeout()
+}
 
-	timeout := a.srtt + 4*a.rttVar
+// idle reports whether nothing was recorded for longer than a.idleReset.
+// It must be called with a.mu held.
+func (a *AdaptiveTimeout) idle() bool {
+	return a.idleReset > 0 && !a.lastActivity.IsZero() && a.now().Sub(a.lastActivity) > a.idleReset
+}
+
+// getTimeout must be called with a.mu held.
+func (a *AdaptiveTimeout) getTimeout() time.Duration {
+	var timeout time.Duration
+	if a.window != nil {
+		if int64(a.window.Len()) < a.minSamples {
+			timeout = a.baseTimeout
+		} else {
+			timeout = a.window.Percentile(a.percentile)
+		}
+	} else {
+		timeout = a.srtt + 4*a.rttVar
+		if a.samples.Load() < a.minSamples && timeout < a.baseTimeout {
+			timeout = a.baseTimeout
+		}
+	}
 
 	if timeout < a.minTimeout {
 		return a.minTimeout
@@ -127,11 +263,20 @@ func (a *AdaptiveTimeout) GetTimeout() time.Duration {
 func (a *AdaptiveTimeout) Reset() {
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	a.reset()
+}
 
+// reset must be called with a.mu held.
+func (a *AdaptiveTimeout) reset() {
 	a.srtt = a.baseTimeout
 	a.rttVar = a.baseTimeout / 2
+	a.timeoutRate = 0
 	a.samples.Store(0)
+	if a.window != nil {
+		a.window.Reset()
+	}
 	a.consecutiveTimeouts.Store(0)
+	a.lastActivity = time.Time{}
 }
 
 func (a *AdaptiveTimeout) GetStats() (srtt time.Duration, rttVar time.Duration, samples int64, timeouts int64) {
@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTimeoutMinSamples(t *testing.T) {
+	base := time.Second * 2
+	a := NewAdaptiveTimeout(TimeoutConfig{
+		BaseTimeout: base,
+		MinTimeout:  time.Millisecond * 10,
+		MinSamples:  4,
+	})
+
+	for i := 1; i < 4; i++ {
+		a.RecordSuccess(time.Millisecond * 5)
+		if got := a.GetTimeout(); got != base {
+			t.Fatalf("after %d samples, want base timeout %s, got %s", i, base, got)
+		}
+	}
+
+	a.RecordSuccess(time.Millisecond * 5)
+	if got := a.GetTimeout(); got >= base {
+		t.Fatalf("timeout should tighten after enough samples, got %s", got)
+	}
+
+	a.Reset()
+	if got := a.GetTimeout(); got < base {
+		t.Fatalf("want at least base timeout after reset, got %s", got)
+	}
+}
+
+func TestAdaptiveTimeoutRecordFailure(t *testing.T) {
+	a := NewAdaptiveTimeout(TimeoutConfig{BaseTimeout: time.Second})
+	initial := a.GetTimeout()
+
+	// Connection refused errors don't inflate the timeout.
+	for i := 0; i < 10; i++ {
+		a.RecordFailure(false, time.Millisecond)
+	}
+	if got := a.GetTimeout(); got != initial {
+		t.Fatalf("non-timeout failures should not change the timeout, want %s, got %s", initial, got)
+	}
+
+	// They break a run of timeouts.
+	a.RecordTimeout()
+	a.RecordTimeout()
+	a.RecordFailure(false, time.Millisecond)
+	a.RecordTimeout()
+	if _, _, _, timeouts := a.GetStats(); timeouts != 1 {
+		t.Fatalf("want 1 consecutive timeout, got %d", timeouts)
+	}
+	if got := a.GetTimeout(); got != initial {
+		t.Fatalf("timeout should not be inflated yet, want %s, got %s", initial, got)
+	}
+
+	// Consecutive timeouts do.
+	a.RecordFailure(true, time.Second)
+	a.RecordFailure(true, time.Second)
+	if got := a.GetTimeout(); got <= initial {
+		t.Fatalf("consecutive timeouts should inflate the timeout, got %s", got)
+	}
+}
+
+func TestAdaptiveTimeoutPercentile(t *testing.T) {
+	base := time.Second * 2
+	a := NewAdaptiveTimeout(TimeoutConfig{
+		BaseTimeout: base,
+		MaxTimeout:  time.Second * 5,
+		Mode:        TimeoutModePercentile,
+		Percentile:  0.99,
+		WindowSize:  1000,
+	})
+
+	if got := a.GetTimeout(); got != base {
+		t.Fatalf("want base timeout without samples, got %s", got)
+	}
+
+	// 1ms, 2ms, ..., 1000ms in a scrambled order.
+	for i := 0; i < 1000; i++ {
+		a.RecordSuccess(time.Duration(i*7%1000+1) * time.Millisecond)
+	}
+	if got, want := a.GetTimeout(), 990*time.Millisecond; got != want {
+		t.Fatalf("want p99 timeout %s, got %s", want, got)
+	}
+
+	// Timeouts count as samples of the timeout that fired, so a run of
+	// them raises the timeout, up to MaxTimeout.
+	for i := 0; i < 1000; i++ {
+		a.RecordTimeout()
+	}
+	if got := a.GetTimeout(); got != time.Millisecond*990 {
+		t.Fatalf("timeouts at the current timeout should keep it, got %s", got)
+	}
+	for i := 0; i < 1000; i++ {
+		a.RecordFailure(true, time.Second*10)
+	}
+	if got := a.GetTimeout(); got != time.Second*5 {
+		t.Fatalf("want the timeout clamped to max, got %s", got)
+	}
+
+	a.Reset()
+	if got := a.GetTimeout(); got != base {
+		t.Fatalf("want base timeout after reset, got %s", got)
+	}
+}
+
+func TestAdaptiveTimeoutIdleReset(t *testing.T) {
+	base := time.Second * 2
+	a := NewAdaptiveTimeout(TimeoutConfig{
+		BaseTimeout: base,
+		MinTimeout:  time.Millisecond * 10,
+		MinSamples:  4,
+		IdleReset:   time.Minute,
+	})
+	now := time.Unix(1000, 0)
+	a.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		a.RecordSuccess(time.Millisecond * 5)
+	}
+	if got := a.GetTimeout(); got >= base {
+		t.Fatalf("timeout should tighten after enough samples, got %s", got)
+	}
+
+	now = now.Add(time.Second * 30)
+	if got := a.GetTimeout(); got >= base {
+		t.Fatalf("estimate should be kept before the idle threshold, got %s", got)
+	}
+
+	now = now.Add(time.Minute)
+	if got := a.GetTimeout(); got != base {
+		t.Fatalf("want base timeout after being idle, got %s", got)
+	}
+	if s := a.samples.Load(); s != 0 {
+		t.Fatalf("want samples reset after being idle, got %d", s)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Bulkhead limits the number of concurrent operations.
+// Blocked Acquire calls are granted in FIFO order.
+type Bulkhead struct {
+	sem     chan struct{}
+	waiting atomic.Int64
+}
+
+// NewBulkhead returns a Bulkhead that allows capacity concurrent
+// acquisitions. capacity < 1 is treated as 1.
+func NewBulkhead(capacity int) *Bulkhead {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Bulkhead{sem: make(chan struct{}, capacity)}
+}
+
+// Acquire blocks until a slot is available or ctx is done.
+// If it returns nil, the caller must call Release.
+func (b *Bulkhead) Acquire(ctx context.Context) error {
+	if b.TryAcquire() {
+		return nil
+	}
+	b.waiting.Add(1)
+	defer b.waiting.Add(-1)
+	select {
+	case b.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// TryAcquire acquires a slot without blocking. It reports whether it
+// succeeded. If so, the caller must call Release.
+func (b *Bulkhead) TryAcquire() bool {
+	select {
+	case b.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release releases a slot acquired by Acquire or TryAcquire.
+func (b *Bulkhead) Release() {
+	select {
+	case <-b.sem:
+	default:
+		panic("qos: Bulkhead.Release without a matching Acquire")
+	}
+}
+
+// InFlight returns the number of outstanding acquisitions.
+func (b *Bulkhead) InFlight() int {
+	return len(b.sem)
+}
+
+// Waiting returns the number of Acquire calls that are blocked.
+func (b *Bulkhead) Waiting() int {
+	return int(b.waiting.Load())
+}
+
+// Capacity returns the maximum number of concurrent acquisitions.
+func (b *Bulkhead) Capacity() int {
+	return cap(b.sem)
+}
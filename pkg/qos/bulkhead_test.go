@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it is true or one second has passed.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition was not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBulkheadFairness(t *testing.T) {
+	const n = 5
+	b := NewBulkhead(1)
+	if err := b.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if b.TryAcquire() {
+		t.Fatal("TryAcquire should fail when the bulkhead is full")
+	}
+
+	order := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			if err := b.Acquire(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+		}()
+		waitFor(t, func() bool { return b.Waiting() == i+1 })
+	}
+
+	for i := 0; i < n; i++ {
+		b.Release()
+		if got := <-order; got != i {
+			t.Fatalf("waiter %d acquired at position %d", got, i)
+		}
+	}
+	if b.InFlight() != 1 || b.Waiting() != 0 {
+		t.Fatalf("unexpected in flight %d, waiting %d", b.InFlight(), b.Waiting())
+	}
+	b.Release()
+	if b.InFlight() != 0 {
+		t.Fatalf("unexpected in flight %d", b.InFlight())
+	}
+}
+
+func TestBulkheadCancellation(t *testing.T) {
+	b := NewBulkhead(2)
+	if b.Capacity() != 2 {
+		t.Fatalf("unexpected capacity %d", b.Capacity())
+	}
+	for i := 0; i < 2; i++ {
+		if !b.TryAcquire() {
+			t.Fatal("TryAcquire should succeed")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- b.Acquire(ctx) }()
+	waitFor(t, func() bool { return b.Waiting() == 1 })
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// The canceled waiter does not hold a slot.
+	b.Release()
+	if b.InFlight() != 1 || b.Waiting() != 0 {
+		t.Fatalf("unexpected in flight %d, waiting %d", b.InFlight(), b.Waiting())
+	}
+	if err := b.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -20,6 +20,7 @@
 package qos
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"sync/atomic"
@@ -51,6 +52,59 @@ func (s CircuitState) String() string {
 	}
 }
 
+// TransitionReason is why a CircuitBreaker changed its state.
+type TransitionReason int
+
+const (
+	// TransitionMaxFailures means too many consecutive calls failed.
+	TransitionMaxFailures TransitionReason = iota
+	// TransitionLatency means the latency percentile exceeded the threshold.
+	TransitionLatency
+	// TransitionHalfOpenFailure means a call failed while half-open.
+	TransitionHalfOpenFailure
+	// TransitionResetTimeout means the breaker was open for ResetTimeout.
+	TransitionResetTimeout
+	// TransitionHalfOpenSuccess means enough calls succeeded while half-open.
+	TransitionHalfOpenSuccess
+	// TransitionReset means Reset was called.
+	TransitionReset
+	// TransitionFailureRate means the failure rate of recent calls
+	// reached the threshold.
+	TransitionFailureRate
+)
+
+func (r TransitionReason) String() string {
+	switch r {
+	case TransitionMaxFailures:
+		return "max_failures"
+	case TransitionLatency:
+		return "latency"
+	case TransitionHalfOpenFailure:
+		return "half_open_failure"
+	case TransitionResetTimeout:
+		return "reset_timeout"
+	case TransitionHalfOpenSuccess:
+		return "half_open_success"
+	case TransitionReset:
+		return "reset"
+	case TransitionFailureRate:
+		return "failure_rate"
+	default:
+		return "unknown"
+	}
+}
+
+// StateChange describes a state transition of a CircuitBreaker.
+// Failures and Successes are the counters right before the transition.
+type StateChange struct {
+	From      CircuitState
+	To        CircuitState
+	Reason    TransitionReason
+	Failures  int64
+	Successes int64
+	Time      time.Time
+}
+
 type CircuitBreaker struct {
 	mu sync.RWMutex
 
@@ -61,16 +115,63 @@ type CircuitBreaker struct {
 	state           CircuitState
 	failures        atomic.Int64
 	successCount    atomic.Int64
-	lastFailureTime atomic.Value
+	lastFailureTime atomic.Value // time.Time
 	halfOpenSuccess atomic.Int64
 
+	// Optional, nil if latency based tripping is disabled.
+	latencyWindow     *LatencyWindow
+	latencyThreshold  time.Duration
+	latencyPercentile float64
+	latencyMinSamples int
+
+	// Optional, nil if failure rate based tripping is disabled.
+	rateWindow    *failureRateWindow
+	rateThreshold float64
+	minRequests   int
+	volumeRatio   float64
+	now           func() time.Time
+
 	onStateChange atomic.Pointer[func(CircuitState, CircuitState)]
+	onTransition  atomic.Pointer[func(StateChange)]
 }
 
 type CircuitBreakerConfig struct {
 	MaxFailures      int
 	ResetTimeout     time.Duration
 	HalfOpenAttempts int
+
+	// LatencyThreshold enables latency based tripping. The breaker also opens
+	// if the LatencyPercentile of the latencies of recent calls exceeds
+	// LatencyThreshold, even if those calls succeeded. Zero disables it.
+	LatencyThreshold time.Duration
+	// LatencyPercentile is in (0, 1]. Default is 0.99.
+	LatencyPercentile float64
+	// LatencyWindowSize is the number of recent calls that are considered.
+	// Default is 100.
+	LatencyWindowSize int
+	// LatencyMinSamples is the minimum number of samples in the window
+	// before the percentile is evaluated. Default is 20.
+	LatencyMinSamples int
+
+	// FailureRateThreshold enables failure rate based tripping, which
+	// replaces MaxFailures. The breaker opens if the rate of failed calls
+	// in the last FailureRateWindow reaches FailureRateThreshold, once
+	// there are enough calls in the window to judge. It is in (0, 1].
+	// Zero disables it.
+	FailureRateThreshold float64
+	// FailureRateWindow is the length of the window. Default is 10s.
+	FailureRateWindow time.Duration
+	// MinRequests is the minimum number of calls in the window before the
+	// failure rate is evaluated. Default is 20.
+	MinRequests int
+	// AdaptiveVolumeRatio scales the minimum number of calls with the
+	// traffic. The window then needs max(MinRequests, AdaptiveVolumeRatio
+	// * V) calls, where V is the average number of calls per window in the
+	// recent windows. At low traffic MinRequests applies, at high traffic
+	// a short burst of failures is no longer judged by a sample that is
+	// tiny compared to the usual volume, e.g. right after the breaker
+	// closed. Zero disables it.
+	AdaptiveVolumeRatio float64
 }
 
 func NewCircuitBreaker(cfg CircuitBreakerConfig) *CircuitBreaker {
@@ -84,12 +185,49 @@ func NewCircuitBreaker(cfg CircuitBreakerConfig) *CircuitBreaker {
 		cfg.HalfOpenAttempts = 3
 	}
 
-	return &CircuitBreaker{
+	cb := &CircuitBreaker{
 		maxFailures:      cfg.MaxFailures,
 		resetTimeout:     cfg.ResetTimeout,
 		halfOpenAttempts: cfg.HalfOpenAttempts,
 		state:            StateClosed,
 	}
+
+	if cfg.LatencyThreshold > 0 {
+		if cfg.LatencyPercentile <= 0 || cfg.LatencyPercentile > 1 {
+			cfg.LatencyPercentile = 0.99
+		}
+		if cfg.LatencyWindowSize <= 0 {
+			cfg.LatencyWindowSize = 100
+		}
+		if cfg.LatencyMinSamples <= 0 {
+			cfg.LatencyMinSamples = 20
+		}
+		if cfg.LatencyMinSamples > cfg.LatencyWindowSize {
+			cfg.LatencyMinSamples = cfg.LatencyWindowSize
+		}
+		cb.latencyWindow = NewLatencyWindow(cfg.LatencyWindowSize)
+		cb.latencyThreshold = cfg.LatencyThreshold
+		cb.latencyPercentile = cfg.LatencyPercentile
+		cb.latencyMinSamples = cfg.LatencyMinSamples
+	}
+
+	if cfg.FailureRateThreshold > 0 {
+		if cfg.FailureRateThreshold > 1 {
+			cfg.FailureRateThreshold = 1
+		}
+		if cfg.FailureRateWindow <= 0 {
+			cfg.FailureRateWindow = 10 * time.Second
+		}
+		if cfg.MinRequests <= 0 {
+			cfg.MinRequests = 20
+		}
+		cb.rateWindow = newFailureRateWindow(cfg.FailureRateWindow)
+		cb.rateThreshold = cfg.FailureRateThreshold
+		cb.minRequests = cfg.MinRequests
+		cb.volumeRatio = max(cfg.AdaptiveVolumeRatio, 0)
+		cb.now = time.Now
+	}
+	return cb
 }
 
 func (cb *CircuitBreaker) Execute(fn func() error) error {
@@ -97,31 +235,65 @@ func (cb *CircuitBreaker) Execute(fn func() error) error {
 		return ErrCircuitBreakerOpen
 	}
 
+	start := time.Now()
 	err := fn()
-	cb.afterExecute(err != nil)
+	cb.afterExecute(err != nil, time.Since(start))
 	return err
 }
 
-func (cb *CircuitBreaker) beforeExecute() bool {
-	state := cb.State()
+// ExecuteContext is like Execute, but a call that failed after ctx was
+// canceled is not recorded, since the caller gave up on it and the error
+// says nothing about the callee.
+func (cb *CircuitBreaker) ExecuteContext(ctx context.Context, fn func() error) error {
+	if cb.beforeExecute() {
+		return ErrCircuitBreakerOpen
+	}
 
-	if state == StateOpen {
-		if cb.shouldAttemptReset() {
-			cb.transitionTo(StateHalfOpen)
-			return false
-		}
-		return true
+	start := time.Now()
+	err := fn()
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return err
 	}
+	cb.afterExecute(err != nil, time.Since(start))
+	return err
+}
 
-	return false
+func (cb *CircuitBreaker) beforeExecute() bool {
+	if cb.State() != StateOpen {
+		return false
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state != StateOpen { // changed by another call
+		return false
+	}
+	if cb.shouldAttemptReset() {
+		cb.transitionTo(StateHalfOpen, TransitionResetTimeout)
+		return false
+	}
+	return true
 }
 
-func (cb *CircuitBreaker) afterExecute(failed bool) {
+func (cb *CircuitBreaker) afterExecute(failed bool, latency time.Duration) {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 
 	state := cb.state
 
+	if cb.latencyWindow != nil {
+		cb.latencyWindow.Record(latency)
+		if state == StateClosed && cb.latencyExceeded() {
+			cb.lastFailureTime.Store(time.Now())
+			cb.transitionTo(StateOpen, TransitionLatency)
+			return
+		}
+	}
+
+	if cb.rateWindow != nil && state == StateClosed {
+		cb.rateWindow.record(cb.now(), failed)
+	}
+
 	if failed {
 		cb.failures.Add(1)
 		cb.recordFailure()
@@ -131,7 +303,7 @@ func (cb *CircuitBreaker) afterExecute(failed bool) {
 		if state == StateHalfOpen {
 			cb.halfOpenSuccess.Add(1)
 			if cb.halfOpenSuccess.Load() >= int64(cb.halfOpenAttempts) {
-				cb.transitionTo(StateClosed)
+				cb.transitionTo(StateClosed, TransitionHalfOpenSuccess)
 			}
 		} else {
 			cb.failures.Store(0)
@@ -140,16 +312,28 @@ func (cb *CircuitBreaker) afterExecute(failed bool) {
 }
 
 func (cb *CircuitBreaker) recordFailure() {
-	now := time.Now()
-	cb.lastFailureTime.Store(&now)
+	cb.lastFailureTime.Store(time.Now())
 
-	if cb.state == StateClosed && cb.failures.Load() >= int64(cb.maxFailures) {
-		cb.transitionTo(StateOpen)
+	if cb.state == StateClosed && cb.rateWindow != nil {
+		if cb.rateWindow.exceeded(cb.rateThreshold, cb.minRequests, cb.volumeRatio) {
+			cb.transitionTo(StateOpen, TransitionFailureRate)
+		}
+	} else if cb.state == StateClosed && cb.failures.Load() >= int64(cb.maxFailures) {
+		cb.transitionTo(StateOpen, TransitionMaxFailures)
 	} else if cb.state == StateHalfOpen {
-		cb.transitionTo(StateOpen)
+		cb.transitionTo(StateOpen, TransitionHalfOpenFailure)
 	}
 }
 
+// latencyExceeded reports whether the latency percentile of the window
+// exceeds the threshold. cb.latencyWindow must not be nil.
+func (cb *CircuitBreaker) latencyExceeded() bool {
+	if cb.latencyWindow.Len() < cb.latencyMinSamples {
+		return false
+	}
+	return cb.latencyWindow.Percentile(cb.latencyPercentile) > cb.latencyThreshold
+}
+
 func (cb *CircuitBreaker) shouldAttemptReset() bool {
 	lastFailure := cb.lastFailureTime.Load()
 	if lastFailure == nil {
@@ -164,8 +348,17 @@ func (cb *CircuitBreaker) shouldAttemptReset() bool {
 	return time.Since(last) >= cb.resetTimeout
 }
 
-func (cb *CircuitBreaker) transitionTo(newState CircuitState) {
+// transitionTo must be called with cb.mu held.
+func (cb *CircuitBreaker) transitionTo(newState CircuitState, reason TransitionReason) {
 	oldState := cb.state
+	change := StateChange{
+		From:      oldState,
+		To:        newState,
+		Reason:    reason,
+		Failures:  cb.failures.Load(),
+		Successes: cb.successCount.Load(),
+		Time:      time.Now(),
+	}
 	cb.state = newState
 
 	if newState == StateClosed {
@@ -174,10 +367,20 @@ func (cb *CircuitBreaker) transitionTo(newState CircuitState) {
 	} else if newState == StateOpen {
 		cb.halfOpenSuccess.Store(0)
 	}
+	if newState != StateHalfOpen && cb.latencyWindow != nil {
+		// Start over, samples from the previous state shouldn't trip the breaker again.
+		cb.latencyWindow.Reset()
+	}
+	if cb.rateWindow != nil {
+		cb.rateWindow.reset()
+	}
 
 	if fn := cb.onStateChange.Load(); fn != nil {
 		(*fn)(oldState, newState)
 	}
+	if fn := cb.onTransition.Load(); fn != nil {
+		(*fn)(change)
+	}
 }
 
 func (cb *CircuitBreaker) State() CircuitState {
@@ -186,6 +389,15 @@ func (cb *CircuitBreaker) State() CircuitState {
 	return cb.state
 }
 
+// Allow reports whether a call would be let through now, which is the
+// case unless cb is open and its ResetTimeout has not elapsed yet. It does
+// not change the state, the next call half-opens cb.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	return cb.state != StateOpen || cb.shouldAttemptReset()
+}
+
 func (cb *CircuitBreaker) Failures() int64 {
 	return cb.failures.Load()
 }
@@ -198,13 +410,27 @@ func (cb *CircuitBreaker) SetStateChangeCallback(fn func(CircuitState, CircuitSt
 	cb.onStateChange.Store(&fn)
 }
 
+// SetStateChangeListener is like SetStateChangeCallback, but fn also
+// receives the reason and the counters of the transition. Both callbacks
+// can be set. fn is called with the breaker locked, it must not call
+// methods of the breaker.
+func (cb *CircuitBreaker) SetStateChangeListener(fn func(StateChange)) {
+	cb.onTransition.Store(&fn)
+}
+
 func (cb *CircuitBreaker) Reset() {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 
-	cb.state = StateClosed
+	if cb.state != StateClosed {
+		cb.transitionTo(StateClosed, TransitionReset)
+		return
+	}
 	cb.failures.Store(0)
 	cb.halfOpenSuccess.Store(0)
+	if cb.rateWindow != nil {
+		cb.rateWindow.reset()
+	}
 }
 
 func (cb *CircuitBreaker) Stats() (state CircuitState, failures int64, successes int64) {
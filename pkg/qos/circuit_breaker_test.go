@@ -0,0 +1,293 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerLatencyTrip(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		LatencyThreshold:  time.Millisecond * 5,
+		LatencyPercentile: 0.9,
+		LatencyWindowSize: 10,
+		LatencyMinSamples: 10,
+	})
+
+	fast := func() error { return nil }
+	slow := func() error {
+		time.Sleep(time.Millisecond * 10)
+		return nil
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := cb.Execute(fast); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := cb.State(); s != StateClosed {
+		t.Fatalf("fast calls should not trip the breaker, state: %s", s)
+	}
+
+	// Slow but successful calls trip the breaker once the p90 exceeds the threshold.
+	for i := 0; i < 10 && cb.State() == StateClosed; i++ {
+		if err := cb.Execute(slow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := cb.State(); s != StateOpen {
+		t.Fatalf("slow calls should trip the breaker, state: %s", s)
+	}
+	if err := cb.Execute(fast); !errors.Is(err, ErrCircuitBreakerOpen) {
+		t.Fatalf("expected ErrCircuitBreakerOpen, got %v", err)
+	}
+	if f := cb.Failures(); f != 0 {
+		t.Fatalf("slow calls should not be counted as failures, got %d", f)
+	}
+}
+
+func TestCircuitBreakerStateChangeListener(t *testing.T) {
+	var changes []StateChange
+	var simple int
+	newBreaker := func(cfg CircuitBreakerConfig) *CircuitBreaker {
+		changes = changes[:0]
+		cb := NewCircuitBreaker(cfg)
+		cb.SetStateChangeListener(func(c StateChange) { changes = append(changes, c) })
+		cb.SetStateChangeCallback(func(_, _ CircuitState) { simple++ })
+		return cb
+	}
+	errFailed := errors.New("failed")
+	fail := func() error { return errFailed }
+	ok := func() error { return nil }
+	expect := func(want ...StateChange) {
+		t.Helper()
+		if len(changes) != len(want) {
+			t.Fatalf("want %d changes, got %+v", len(want), changes)
+		}
+		for i, c := range changes {
+			w := want[i]
+			if c.From != w.From || c.To != w.To || c.Reason != w.Reason ||
+				c.Failures != w.Failures || c.Successes != w.Successes || c.Time.IsZero() {
+				t.Fatalf("change %d: want %+v, got %+v", i, w, c)
+			}
+		}
+	}
+
+	// Max failures, then reset timeout, half-open failure, reset timeout
+	// again and half-open success.
+	cb := newBreaker(CircuitBreakerConfig{
+		MaxFailures:      2,
+		ResetTimeout:     time.Millisecond * 10,
+		HalfOpenAttempts: 2,
+	})
+	cb.Execute(ok)
+	cb.Execute(fail)
+	cb.Execute(fail)
+	time.Sleep(time.Millisecond * 10)
+	cb.Execute(fail)
+	time.Sleep(time.Millisecond * 10)
+	cb.Execute(ok)
+	cb.Execute(ok)
+	expect(
+		StateChange{From: StateClosed, To: StateOpen, Reason: TransitionMaxFailures, Failures: 2, Successes: 1},
+		StateChange{From: StateOpen, To: StateHalfOpen, Reason: TransitionResetTimeout, Failures: 2, Successes: 1},
+		StateChange{From: StateHalfOpen, To: StateOpen, Reason: TransitionHalfOpenFailure, Failures: 3, Successes: 1},
+		StateChange{From: StateOpen, To: StateHalfOpen, Reason: TransitionResetTimeout, Failures: 3, Successes: 1},
+		StateChange{From: StateHalfOpen, To: StateClosed, Reason: TransitionHalfOpenSuccess, Failures: 3, Successes: 3},
+	)
+	if simple != 5 {
+		t.Fatalf("the simple callback should also be called, got %d calls", simple)
+	}
+
+	// Manual reset.
+	cb = newBreaker(CircuitBreakerConfig{MaxFailures: 1})
+	cb.Execute(fail)
+	cb.Reset()
+	expect(
+		StateChange{From: StateClosed, To: StateOpen, Reason: TransitionMaxFailures, Failures: 1},
+		StateChange{From: StateOpen, To: StateClosed, Reason: TransitionReset, Failures: 1},
+	)
+
+	// Latency.
+	cb = newBreaker(CircuitBreakerConfig{
+		LatencyThreshold:  time.Millisecond,
+		LatencyWindowSize: 1,
+		LatencyMinSamples: 1,
+	})
+	cb.Execute(func() error {
+		time.Sleep(time.Millisecond * 2)
+		return nil
+	})
+	expect(StateChange{From: StateClosed, To: StateOpen, Reason: TransitionLatency})
+}
+
+func TestLatencyWindowPercentile(t *testing.T) {
+	w := NewLatencyWindow(4)
+	if p := w.Percentile(0.99); p != 0 {
+		t.Fatalf("empty window should return 0, got %s", p)
+	}
+	for i := 1; i <= 6; i++ {
+		w.Record(time.Duration(i))
+	}
+	// Window holds 3, 4, 5, 6.
+	if l := w.Len(); l != 4 {
+		t.Fatalf("expected 4 samples, got %d", l)
+	}
+	if p := w.Percentile(0.5); p != 4 {
+		t.Fatalf("expected p50 4, got %d", p)
+	}
+	if p := w.Percentile(1); p != 6 {
+		t.Fatalf("expected p100 6, got %d", p)
+	}
+	if time.Since(w.LastRecord()) > time.Second {
+		t.Fatalf("unexpected time of the newest sample %s", w.LastRecord())
+	}
+	w.Reset()
+	if !w.LastRecord().IsZero() {
+		t.Fatal("reset window should have no newest sample")
+	}
+}
+
+func TestCircuitBreakerAdaptiveVolume(t *testing.T) {
+	fail := func() error { return errors.New("failed") }
+	ok := func() error { return nil }
+
+	// failuresToTrip warms a breaker up with callsPerSecond successful
+	// calls for a minute, lets the window expire, then counts the failed
+	// calls until it opens.
+	failuresToTrip := func(callsPerSecond int) int {
+		cb := NewCircuitBreaker(CircuitBreakerConfig{
+			FailureRateThreshold: 0.5,
+			FailureRateWindow:    time.Second * 10,
+			MinRequests:          5,
+			AdaptiveVolumeRatio:  0.1,
+		})
+		now := time.Unix(1700000000, 0)
+		cb.now = func() time.Time { return now }
+
+		for i := 0; i < 60; i++ {
+			for j := 0; j < callsPerSecond; j++ {
+				cb.Execute(ok)
+			}
+			now = now.Add(time.Second)
+		}
+		if s := cb.State(); s != StateClosed {
+			t.Fatalf("successful calls should not trip the breaker, state: %s", s)
+		}
+
+		now = now.Add(time.Second * 10)
+		for n := 1; n <= callsPerSecond*10; n++ {
+			cb.Execute(fail)
+			if cb.State() == StateOpen {
+				return n
+			}
+		}
+		t.Fatalf("the breaker was not opened at %d calls per second", callsPerSecond)
+		return 0
+	}
+
+	low := failuresToTrip(1)
+	high := failuresToTrip(100)
+	if low != 5 {
+		t.Fatalf("at low traffic MinRequests should apply, tripped after %d failures", low)
+	}
+	// The volume is about 1000 calls per window, so about 100 calls are
+	// required.
+	if high < 50 || high > 100 {
+		t.Fatalf("at high traffic the minimum volume should scale, tripped after %d failures", high)
+	}
+}
+
+func TestCircuitBreakerFailureRate(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		MaxFailures:          2,
+		FailureRateThreshold: 0.5,
+		MinRequests:          10,
+	})
+	now := time.Unix(1700000000, 0)
+	cb.now = func() time.Time { return now }
+
+	// Consecutive failures below the volume don't trip the breaker, even
+	// though MaxFailures is exceeded.
+	for i := 0; i < 4; i++ {
+		cb.Execute(func() error { return errors.New("failed") })
+	}
+	if s := cb.State(); s != StateClosed {
+		t.Fatalf("MaxFailures should be ignored, state: %s", s)
+	}
+	for i := 0; i < 5; i++ {
+		cb.Execute(func() error { return nil })
+	}
+	cb.Execute(func() error { return errors.New("failed") })
+	if s := cb.State(); s != StateOpen {
+		t.Fatalf("5 of 10 calls failed, the breaker should be open, state: %s", s)
+	}
+}
+
+func TestCircuitBreakerExecuteContext(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{MaxFailures: 1})
+	errFailed := errors.New("failed")
+
+	// Failures of canceled calls are not recorded.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cb.ExecuteContext(ctx, func() error { return errFailed }); err != errFailed {
+		t.Fatalf("expected the error of the call, got %v", err)
+	}
+	if s := cb.State(); s != StateClosed {
+		t.Fatalf("a canceled call should not trip the breaker, state: %s", s)
+	}
+
+	if err := cb.ExecuteContext(context.Background(), func() error { return errFailed }); err != errFailed {
+		t.Fatalf("expected the error of the call, got %v", err)
+	}
+	if s := cb.State(); s != StateOpen {
+		t.Fatalf("the breaker should be open, state: %s", s)
+	}
+	if err := cb.ExecuteContext(context.Background(), func() error { return nil }); !errors.Is(err, ErrCircuitBreakerOpen) {
+		t.Fatalf("expected ErrCircuitBreakerOpen, got %v", err)
+	}
+}
+
+func TestCircuitBreakerAllow(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{MaxFailures: 1, ResetTimeout: time.Millisecond * 50})
+	if !cb.Allow() {
+		t.Fatal("a closed breaker should allow calls")
+	}
+	cb.Execute(func() error { return errors.New("failed") })
+	if cb.Allow() {
+		t.Fatal("an open breaker should not allow calls")
+	}
+
+	// Allow does not half-open the breaker, the next call does.
+	time.Sleep(time.Millisecond * 60)
+	if !cb.Allow() || cb.State() != StateOpen {
+		t.Fatalf("the breaker should allow a trial call, state: %s", cb.State())
+	}
+	if err := cb.Execute(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if s := cb.State(); s != StateHalfOpen {
+		t.Fatalf("the trial call should half-open the breaker, state: %s", s)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import "time"
+
+const (
+	failureRateBuckets = 10
+
+	// volumeEWMAAlpha is the weight of a new sample of the volume of the
+	// window. A sample is taken every bucket, so the average reflects
+	// roughly the last failureRateBuckets windows.
+	volumeEWMAAlpha = 1.0 / failureRateBuckets
+)
+
+type rateBucket struct {
+	epoch    int64
+	calls    int64
+	failures int64
+}
+
+// failureRateWindow counts calls and failures in a sliding time window,
+// which is divided into failureRateBuckets buckets. It also keeps an EWMA
+// of the number of calls per window, the volume.
+// It is not safe for concurrent use.
+type failureRateWindow struct {
+	bucketDur time.Duration
+	buckets   [failureRateBuckets]rateBucket
+	lastEpoch int64
+	volume    float64
+}
+
+func newFailureRateWindow(window time.Duration) *failureRateWindow {
+	bucketDur := window / failureRateBuckets
+	if bucketDur <= 0 {
+		bucketDur = 1
+	}
+	return &failureRateWindow{bucketDur: bucketDur}
+}
+
+func (w *failureRateWindow) record(now time.Time, failed bool) {
+	epoch := now.UnixNano() / int64(w.bucketDur)
+	if epoch != w.lastEpoch {
+		// A new bucket. Sample the volume of the window before it.
+		calls, _ := w.sum(w.lastEpoch)
+		w.volume += volumeEWMAAlpha * (float64(calls) - w.volume)
+		w.lastEpoch = epoch
+	}
+
+	b := &w.buckets[epoch%failureRateBuckets]
+	if b.epoch != epoch {
+		*b = rateBucket{epoch: epoch}
+	}
+	b.calls++
+	if failed {
+		b.failures++
+	}
+}
+
+// sum returns the number of calls and failures in the window that ends
+// with the bucket of epoch.
+func (w *failureRateWindow) sum(epoch int64) (calls, failures int64) {
+	for _, b := range w.buckets {
+		if b.epoch <= epoch && b.epoch > epoch-failureRateBuckets {
+			calls += b.calls
+			failures += b.failures
+		}
+	}
+	return calls, failures
+}
+
+// exceeded reports whether the failure rate of the window reaches
+// threshold. It is only evaluated if the window has at least
+// max(minRequests, volumeRatio * volume) calls.
+func (w *failureRateWindow) exceeded(threshold float64, minRequests int, volumeRatio float64) bool {
+	calls, failures := w.sum(w.lastEpoch)
+	minCalls := max(float64(minRequests), volumeRatio*w.volume)
+	if calls == 0 || float64(calls) < minCalls {
+		return false
+	}
+	return float64(failures)/float64(calls) >= threshold
+}
+
+// reset clears the counters but keeps the volume, which describes the
+// traffic rather than the state of the breaker.
+func (w *failureRateWindow) reset() {
+	w.buckets = [failureRateBuckets]rateBucket{}
+}
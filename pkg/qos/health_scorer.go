@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"math"
+	"time"
+)
+
+// HealthScorer combines the state of a CircuitBreaker, the timeout rate
+// of an AdaptiveTimeout and the latency of a LatencyWindow into a single
+// health score, so operators have one number to alert on.
+//
+// Each component is in [0, 1], 1 being healthy:
+//   - breaker: 1 if closed, 0.5 if half-open, 0 if open.
+//   - timeout: 1 - AdaptiveTimeout.TimeoutRate.
+//   - latency: 1 if the latency is at most LatencyBaseline, or
+//     LatencyBaseline / latency otherwise. The latency is the mean of the
+//     LatencyWindow, or the smoothed rtt of the AdaptiveTimeout if there
+//     is no window.
+//
+// The score is 100 times the weighted geometric mean of the components,
+//
+//	score = 100 * (breaker^wb * timeout^wt * latency^wl)^(1 / (wb+wt+wl))
+//
+// so a single failed component, e.g. an open breaker, drives the score
+// to 0, no matter how healthy the others are. Missing sources count as
+// healthy. It is concurrent safe.
+type HealthScorer struct {
+	breaker *CircuitBreaker
+	timeout *AdaptiveTimeout
+	latency *LatencyWindow
+
+	baseline      time.Duration
+	breakerWeight float64
+	timeoutWeight float64
+	latencyWeight float64
+}
+
+type HealthScorerConfig struct {
+	// All optional.
+	Breaker       *CircuitBreaker
+	Timeout       *AdaptiveTimeout
+	LatencyWindow *LatencyWindow
+
+	// LatencyBaseline is the latency that is considered healthy.
+	// Default is 100ms.
+	LatencyBaseline time.Duration
+
+	// Weights of the components. Zero ignores a component, negative
+	// values use the defaults, which are 1 for all components.
+	// If all weights are zero, the defaults are used.
+	BreakerWeight float64
+	TimeoutWeight float64
+	LatencyWeight float64
+}
+
+// HealthScore is a health score and its components, see HealthScorer.
+type HealthScore struct {
+	Score   float64 // in [0, 100]
+	Breaker float64 // in [0, 1]
+	Timeout float64 // in [0, 1]
+	Latency float64 // in [0, 1]
+}
+
+func NewHealthScorer(cfg HealthScorerConfig) *HealthScorer {
+	if cfg.LatencyBaseline <= 0 {
+		cfg.LatencyBaseline = 100 * time.Millisecond
+	}
+	for _, w := range []*float64{&cfg.BreakerWeight, &cfg.TimeoutWeight, &cfg.LatencyWeight} {
+		if *w < 0 {
+			*w = 1
+		}
+	}
+	if cfg.BreakerWeight+cfg.TimeoutWeight+cfg.LatencyWeight == 0 {
+		cfg.BreakerWeight, cfg.TimeoutWeight, cfg.LatencyWeight = 1, 1, 1
+	}
+
+	return &HealthScorer{
+		breaker:       cfg.Breaker,
+		timeout:       cfg.Timeout,
+		latency:       cfg.LatencyWindow,
+		baseline:      cfg.LatencyBaseline,
+		breakerWeight: cfg.BreakerWeight,
+		timeoutWeight: cfg.TimeoutWeight,
+		latencyWeight: cfg.LatencyWeight,
+	}
+}
+
+// Score returns the health score in [0, 100].
+func (h *HealthScorer) Score() float64 {
+	return h.Breakdown().Score
+}
+
+// Breakdown returns the health score and its components.
+func (h *HealthScorer) Breakdown() HealthScore {
+	s := HealthScore{
+		Breaker: h.breakerScore(),
+		Timeout: h.timeoutScore(),
+		Latency: h.latencyScore(),
+	}
+	// 0^0 is 1, so components with zero weight are ignored.
+	p := math.Pow(s.Breaker, h.breakerWeight) *
+		math.Pow(s.Timeout, h.timeoutWeight) *
+		math.Pow(s.Latency, h.latencyWeight)
+	s.Score = 100 * math.Pow(p, 1/(h.breakerWeight+h.timeoutWeight+h.latencyWeight))
+	return s
+}
+
+func (h *HealthScorer) breakerScore() float64 {
+	if h.breaker == nil {
+		return 1
+	}
+	switch h.breaker.State() {
+	case StateOpen:
+		return 0
+	case StateHalfOpen:
+		return 0.5
+	default:
+		return 1
+	}
+}
+
+func (h *HealthScorer) timeoutScore() float64 {
+	if h.timeout == nil {
+		return 1
+	}
+	return 1 - h.timeout.TimeoutRate()
+}
+
+func (h *HealthScorer) latencyScore() float64 {
+	var latency time.Duration
+	if h.latency != nil {
+		latency = h.latency.Mean()
+	} else if h.timeout != nil {
+		srtt, _, samples, _ := h.timeout.GetStats()
+		if samples > 0 {
+			latency = srtt
+		}
+	}
+	if latency <= h.baseline {
+		return 1
+	}
+	return float64(h.baseline) / float64(latency)
+}
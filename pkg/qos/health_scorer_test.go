@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthScorer(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{MaxFailures: 1})
+	at := NewAdaptiveTimeout(TimeoutConfig{})
+	lw := NewLatencyWindow(10)
+	h := NewHealthScorer(HealthScorerConfig{
+		Breaker:         cb,
+		Timeout:         at,
+		LatencyWindow:   lw,
+		LatencyBaseline: 50 * time.Millisecond,
+	})
+
+	// All healthy.
+	for i := 0; i < 10; i++ {
+		at.RecordSuccess(10 * time.Millisecond)
+		lw.Record(10 * time.Millisecond)
+	}
+	if s := h.Score(); s < 99 {
+		t.Fatalf("want a score of ~100 when all healthy, got %.2f", s)
+	}
+
+	// Slow, latency is twice the baseline.
+	for i := 0; i < 10; i++ {
+		lw.Record(100 * time.Millisecond)
+	}
+	b := h.Breakdown()
+	if b.Latency != 0.5 || b.Breaker != 1 {
+		t.Fatalf("unexpected breakdown %+v", b)
+	}
+	if b.Score < 50 || b.Score > 90 {
+		t.Fatalf("want a degraded score, got %+v", b)
+	}
+
+	// Timeouts.
+	for i := 0; i < 100; i++ {
+		at.RecordTimeout()
+	}
+	if b := h.Breakdown(); b.Timeout > 0.01 || b.Score > 20 {
+		t.Fatalf("want a near zero score when all requests time out, got %+v", b)
+	}
+
+	// Breaker open.
+	at.Reset()
+	lw.Reset()
+	cb.Execute(func() error { return errors.New("failed") })
+	if cb.State() != StateOpen {
+		t.Fatal("breaker should be open")
+	}
+	if s := h.Score(); s > 1 {
+		t.Fatalf("want a score of ~0 when the breaker is open, got %.2f", s)
+	}
+
+	// Zero weight ignores the breaker.
+	h = NewHealthScorer(HealthScorerConfig{Breaker: cb, Timeout: at, TimeoutWeight: 1})
+	if s := h.Score(); s < 99 {
+		t.Fatalf("want a score of ~100 when the breaker is ignored, got %.2f", s)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// LatencyWindow keeps the most recent latency samples in a ring buffer.
+type LatencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+	last    time.Time // of the newest sample, zero if empty.
+}
+
+func NewLatencyWindow(size int) *LatencyWindow {
+	if size <= 0 {
+		size = 100
+	}
+	return &LatencyWindow{
+		samples: make([]time.Duration, size),
+	}
+}
+
+func (w *LatencyWindow) Record(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.samples[w.next] = d
+	w.last = time.Now()
+	w.next++
+	if w.next == len(w.samples) {
+		w.next = 0
+		w.full = true
+	}
+}
+
+// Len returns the number of samples in the window.
+func (w *LatencyWindow) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.len()
+}
+
+func (w *LatencyWindow) len() int {
+	if w.full {
+		return len(w.samples)
+	}
+	return w.next
+}
+
+// LastRecord returns the time the newest sample was recorded. It returns
+// the zero time if the window is empty.
+func (w *LatencyWindow) LastRecord() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
+
+// Percentile returns the p-th (0 < p <= 1) percentile of the samples
+// using the nearest-rank method. It returns 0 if the window is empty.
+func (w *LatencyWindow) Percentile(p float64) time.Duration {
+	w.mu.Lock()
+	s := slices.Clone(w.samples[:w.len()])
+	w.mu.Unlock()
+
+	if len(s) == 0 {
+		return 0
+	}
+	slices.Sort(s)
+
+	rank := int(math.Ceil(p*float64(len(s)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(s) {
+		rank = len(s) - 1
+	}
+	return s[rank]
+}
+
+// Mean returns the average of the samples. It returns 0 if the window
+// is empty.
+func (w *LatencyWindow) Mean() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := w.len()
+	if n == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range w.samples[:n] {
+		sum += d
+	}
+	return sum / time.Duration(n)
+}
+
+func (w *LatencyWindow) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.next = 0
+	w.full = false
+	w.last = time.Time{}
+}
@@ -32,11 +32,21 @@ var (
 	ErrQueueFull = errors.New("request queue is full")
 )
 
+// Enqueue sweeps expired requests at most sweepsPerMaxWait times per
+// QueueConfig.MaxWaitTime, unless the queue is full.
+const sweepsPerMaxWait = 4
+
 type Request struct {
 	Execute  func(context.Context) error
 	Priority int
 	Timer    time.Time
-	index    int // index in the heap, maintained by heap.Interface
+
+	// OnDrop, if not nil, is called when the request is removed from the
+	// queue because it waited longer than QueueConfig.MaxWaitTime. It is
+	// called without the queue's lock held.
+	OnDrop func()
+
+	index int // index in the heap, maintained by heap.Interface
 }
 
 // requestHeap implements heap.Interface for priority queue
@@ -72,12 +82,19 @@ func (h *requestHeap) Pop() any {
 }
 
 type RequestQueue struct {
+	name string
+
 	mu sync.Mutex
 
 	heap        requestHeap
 	maxSize     int
 	maxWaitTime time.Duration
 
+	bandCaps map[int]int // Optional, nil if no band has a capacity.
+	bandLens map[int]int // Queued requests of bands in bandCaps.
+
+	lastSweep time.Time
+
 	droppedCount   atomic.Int64
 	processedCount atomic.Int64
 }
@@ -85,6 +102,16 @@ type RequestQueue struct {
 type QueueConfig struct {
 	MaxSize     int
 	MaxWaitTime time.Duration
+
+	// Name is the "name" label of the metrics of the queue, see Collector.
+	Name string
+
+	// BandCapacities limits the number of queued requests per priority.
+	// Keys are priorities, values are capacities. Priorities that are
+	// not in it are only limited by MaxSize. Capping the bands of low
+	// priorities below MaxSize reserves room for higher priorities, so
+	// a flood of low priority requests cannot starve them.
+	BandCapacities map[int]int
 }
 
 func NewRequestQueue(cfg QueueConfig) *RequestQueue {
@@ -95,51 +122,144 @@ func NewRequestQueue(cfg QueueConfig) *RequestQueue {
 		cfg.MaxWaitTime = 30 * time.Second
 	}
 
-	return &RequestQueue{
+	q := &RequestQueue{
+		name:        cfg.Name,
 		heap:        make(requestHeap, 0, cfg.MaxSize),
 		maxSize:     cfg.MaxSize,
 		maxWaitTime: cfg.MaxWaitTime,
 	}
+	for p, c := range cfg.BandCapacities {
+		if q.bandCaps == nil {
+			q.bandCaps = make(map[int]int)
+			q.bandLens = make(map[int]int)
+		}
+		q.bandCaps[p] = c
+	}
+	return q
 }
 
 func (q *RequestQueue) Enqueue(req *Request) error {
 	q.mu.Lock()
-	defer q.mu.Unlock()
+	var dropped []*Request
+	defer func() {
+		q.mu.Unlock()
+		notifyDropped(dropped)
+	}()
+
+	// Make room before rejecting req, and sweep from time to time so
+	// expired requests don't pile up behind valid ones.
+	now := time.Now()
+	if q.full(req.Priority) || now.Sub(q.lastSweep) >= q.maxWaitTime/sweepsPerMaxWait {
+		dropped = q.sweep(now)
+	}
 
-	if len(q.heap) >= q.maxSize {
+	if q.full(req.Priority) {
 		q.droppedCount.Add(1)
 		return ErrQueueFull
 	}
+	if _, ok := q.bandCaps[req.Priority]; ok {
+		q.bandLens[req.Priority]++
+	}
 
 	heap.Push(&q.heap, req)
 	return nil
 }
 
+// full reports whether a request of priority cannot be queued.
+// It must be called with q.mu held.
+func (q *RequestQueue) full(priority int) bool {
+	if len(q.heap) >= q.maxSize {
+		return true
+	}
+	c, ok := q.bandCaps[priority]
+	return ok && q.bandLens[priority] >= c
+}
+
+// pop removes the top request. q.heap must not be empty.
+func (q *RequestQueue) pop() *Request {
+	req := heap.Pop(&q.heap).(*Request)
+	if _, ok := q.bandCaps[req.Priority]; ok {
+		q.bandLens[req.Priority]--
+	}
+	return req
+}
+
+// sweep removes expired requests and returns them. The caller must call
+// notifyDropped with them after releasing q.mu.
+// It must be called with q.mu held.
+func (q *RequestQueue) sweep(now time.Time) []*Request {
+	q.lastSweep = now
+	var dropped []*Request
+	valid := q.heap[:0]
+	for _, req := range q.heap {
+		if q.expired(req, now) {
+			dropped = append(dropped, req)
+			if _, ok := q.bandCaps[req.Priority]; ok {
+				q.bandLens[req.Priority]--
+			}
+			continue
+		}
+		valid = append(valid, req)
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	clear(q.heap[len(valid):])
+	q.heap = valid
+	for i, req := range q.heap {
+		req.index = i
+	}
+	heap.Init(&q.heap)
+	q.droppedCount.Add(int64(len(dropped)))
+	return dropped
+}
+
+func (q *RequestQueue) expired(req *Request, now time.Time) bool {
+	return now.Sub(req.Timer) > q.maxWaitTime
+}
+
+func notifyDropped(dropped []*Request) {
+	for _, req := range dropped {
+		req.index = -1
+		if req.OnDrop != nil {
+			req.OnDrop()
+		}
+	}
+}
+
 func (q *RequestQueue) Dequeue(ctx context.Context) (*Request, error) {
 	q.mu.Lock()
-	defer q.mu.Unlock()
+	var dropped []*Request
+	defer func() {
+		q.mu.Unlock()
+		notifyDropped(dropped)
+	}()
 
 	now := time.Now()
 
 	// Remove expired or invalid items from the top of the heap
 	for len(q.heap) > 0 {
-		req := q.heap[0]
-		if now.Sub(req.Timer) > q.maxWaitTime {
-			heap.Pop(&q.heap)
+		req := q.pop()
+		if q.expired(req, now) {
+			q.droppedCount.Add(1)
+			dropped = append(dropped, req)
 			continue
 		}
 		// Found a valid request
-		heap.Pop(&q.heap)
 		return req, nil
 	}
 
 	return nil, nil
 }
 
+// Len returns the number of queued requests that have not expired.
 func (q *RequestQueue) Len() int {
 	q.mu.Lock()
-	defer q.mu.Unlock()
-	return len(q.heap)
+	dropped := q.sweep(time.Now())
+	n := len(q.heap)
+	q.mu.Unlock()
+	notifyDropped(dropped)
+	return n
 }
 
 func (q *RequestQueue) Cap() int {
@@ -162,6 +282,7 @@ func (q *RequestQueue) Clear() {
 		req.Timer = time.Time{}
 	}
 	q.heap = q.heap[:0]
+	clear(q.bandLens)
 }
 
 func (q *RequestQueue) Process(ctx context.Context) error {
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector returns a prometheus.Collector of the metrics of q: the
+// number of queued requests, the capacity, the total numbers of dropped
+// and processed requests, and the age of the oldest queued request.
+// Metrics have a const "name" label of QueueConfig.Name.
+func (q *RequestQueue) Collector() prometheus.Collector {
+	labels := prometheus.Labels{"name": q.name}
+	return &queueCollector{
+		q:         q,
+		length:    prometheus.NewDesc("request_queue_length", "The number of queued requests", nil, labels),
+		capacity:  prometheus.NewDesc("request_queue_capacity", "The max number of queued requests", nil, labels),
+		dropped:   prometheus.NewDesc("request_queue_dropped_total", "The total number of dropped requests", nil, labels),
+		processed: prometheus.NewDesc("request_queue_processed_total", "The total number of processed requests", nil, labels),
+		oldestAge: prometheus.NewDesc("request_queue_oldest_age_seconds", "The age of the oldest queued request, 0 if the queue is empty", nil, labels),
+	}
+}
+
+type queueCollector struct {
+	q *RequestQueue
+
+	length    *prometheus.Desc
+	capacity  *prometheus.Desc
+	dropped   *prometheus.Desc
+	processed *prometheus.Desc
+	oldestAge *prometheus.Desc
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.length
+	ch <- c.capacity
+	ch <- c.dropped
+	ch <- c.processed
+	ch <- c.oldestAge
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.q.snapshot()
+	ch <- prometheus.MustNewConstMetric(c.length, prometheus.GaugeValue, float64(s.len))
+	ch <- prometheus.MustNewConstMetric(c.capacity, prometheus.GaugeValue, float64(c.q.maxSize))
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(s.dropped))
+	ch <- prometheus.MustNewConstMetric(c.processed, prometheus.CounterValue, float64(s.processed))
+	ch <- prometheus.MustNewConstMetric(c.oldestAge, prometheus.GaugeValue, s.oldestAge.Seconds())
+}
+
+type queueSnapshot struct {
+	len       int
+	dropped   int64
+	processed int64
+	oldestAge time.Duration
+}
+
+// snapshot reads the stats of q with a single acquisition of q.mu.
+// Expired requests are swept first, like Len.
+func (q *RequestQueue) snapshot() queueSnapshot {
+	q.mu.Lock()
+	now := time.Now()
+	dropped := q.sweep(now)
+	s := queueSnapshot{
+		len:       len(q.heap),
+		dropped:   q.droppedCount.Load(),
+		processed: q.processedCount.Load(),
+	}
+	for _, req := range q.heap {
+		s.oldestAge = max(s.oldestAge, now.Sub(req.Timer))
+	}
+	q.mu.Unlock()
+	notifyDropped(dropped)
+	return s
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRequestQueueCollector(t *testing.T) {
+	q := NewRequestQueue(QueueConfig{MaxSize: 2, Name: "test"})
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(q.Collector()); err != nil {
+		t.Fatal(err)
+	}
+
+	q.Enqueue(&Request{Timer: time.Now().Add(-time.Second), Execute: func(context.Context) error { return nil }})
+	q.Enqueue(&Request{Timer: time.Now()})
+	if err := q.Enqueue(&Request{Timer: time.Now()}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("want ErrQueueFull, got %v", err)
+	}
+	if err := q.Process(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, mf := range mfs {
+		m := mf.GetMetric()[0]
+		if l := m.GetLabel(); len(l) != 1 || l[0].GetName() != "name" || l[0].GetValue() != "test" {
+			t.Fatalf("%s: unexpected labels %v", mf.GetName(), l)
+		}
+		if g := m.GetGauge(); g != nil {
+			got[mf.GetName()] = g.GetValue()
+		} else {
+			got[mf.GetName()] = m.GetCounter().GetValue()
+		}
+	}
+
+	for name, want := range map[string]float64{
+		"request_queue_length":          1,
+		"request_queue_capacity":        2,
+		"request_queue_dropped_total":   1,
+		"request_queue_processed_total": 1,
+	} {
+		if got[name] != want {
+			t.Fatalf("%s: want %v, got %v", name, want, got[name])
+		}
+	}
+	if age := got["request_queue_oldest_age_seconds"]; age <= 0 || age >= 1 {
+		t.Fatalf("unexpected oldest age %v", age)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRequestQueueBandCapacities(t *testing.T) {
+	const high, low = 0, 10
+	q := NewRequestQueue(QueueConfig{
+		MaxSize:        10,
+		BandCapacities: map[int]int{low: 8},
+	})
+
+	// Flood low priority.
+	accepted := 0
+	for i := 0; i < 100; i++ {
+		if err := q.Enqueue(&Request{Priority: low, Timer: time.Now()}); err == nil {
+			accepted++
+		} else if !errors.Is(err, ErrQueueFull) {
+			t.Fatal(err)
+		}
+	}
+	if accepted != 8 {
+		t.Fatalf("low priority band should accept 8 requests, got %d", accepted)
+	}
+
+	// The reserved slots are still available for high priority.
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(&Request{Priority: high, Timer: time.Now()}); err != nil {
+			t.Fatalf("high priority enqueue %d failed: %v", i, err)
+		}
+	}
+	if err := q.Enqueue(&Request{Priority: high, Timer: time.Now()}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("MaxSize should still apply, got %v", err)
+	}
+
+	// Dequeuing a low priority request frees a slot of its band.
+	for q.Len() > 0 {
+		req, err := q.Dequeue(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Priority == low {
+			break
+		}
+	}
+	if err := q.Enqueue(&Request{Priority: low, Timer: time.Now()}); err != nil {
+		t.Fatalf("low priority enqueue after dequeue failed: %v", err)
+	}
+
+	q.Clear()
+	for i := 0; i < 8; i++ {
+		if err := q.Enqueue(&Request{Priority: low, Timer: time.Now()}); err != nil {
+			t.Fatalf("low priority enqueue after clear failed: %v", err)
+		}
+	}
+}
+
+func TestRequestQueueSweepExpired(t *testing.T) {
+	const maxWait = time.Millisecond * 50
+	q := NewRequestQueue(QueueConfig{
+		MaxSize:        4,
+		MaxWaitTime:    maxWait,
+		BandCapacities: map[int]int{1: 2},
+	})
+
+	var onDrop int
+	for i := 0; i < 4; i++ {
+		req := &Request{Priority: i % 2, Timer: time.Now(), OnDrop: func() { onDrop++ }}
+		if err := q.Enqueue(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := q.Len(); n != 4 {
+		t.Fatalf("want 4 queued requests, got %d", n)
+	}
+
+	time.Sleep(maxWait * 2)
+	if n := q.Len(); n != 0 {
+		t.Fatalf("expired requests should be reclaimed, got %d", n)
+	}
+	if n := q.DroppedCount(); n != 4 || onDrop != 4 {
+		t.Fatalf("want 4 dropped requests, got %d, OnDrop called %d times", n, onDrop)
+	}
+
+	// A band that is full of expired requests makes room for new ones.
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(&Request{Priority: 1, Timer: time.Now().Add(-maxWait * 2)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Enqueue(&Request{Priority: 1, Timer: time.Now()}); err != nil {
+		t.Fatalf("expired requests should not hold band slots: %v", err)
+	}
+	req, err := q.Dequeue(context.Background())
+	if err != nil || req == nil || !req.Timer.After(time.Now().Add(-maxWait)) {
+		t.Fatalf("want the valid request, got %v, %v", req, err)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16 // version(1) + reserved(3) + timestamp(4) + hash(8), see RFC 9018.
+
+	serverCookieVersion = 1
+
+	// RFC 9018 4.3
+	serverCookieMaxAge     = 3600 // seconds
+	serverCookieRefreshAge = 1800 // seconds
+	serverCookieMaxFuture  = 300  // seconds, tolerates clock skew between servers.
+
+	cookieOptUDPSize = 1232
+)
+
+// cookieHandler implements DNS Cookies (RFC 7873).
+// Server cookies use the layout of RFC 9018, but the hash is a truncated
+// HMAC-SHA256 instead of SipHash-2-4. So they are only interoperable between
+// servers that share the same secret and implementation.
+type cookieHandler struct {
+	secret  []byte
+	require bool
+	now     func() time.Time
+}
+
+// newCookieHandler creates a cookieHandler. If secret is empty, a random
+// secret is generated. Server cookies issued with a random secret become
+// invalid after a restart, clients will simply get a fresh one.
+func newCookieHandler(secret []byte, require bool) (*cookieHandler, error) {
+	if len(secret) == 0 {
+		secret = make([]byte, 16)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return &cookieHandler{
+		secret:  secret,
+		require: require,
+		now:     time.Now,
+	}, nil
+}
+
+// handleQuery checks the COOKIE option of q from client.
+// If resp is not nil, it should be sent to the client immediately without
+// calling the Handler (FORMERR or BADCOOKIE).
+// Otherwise, packMsgPayload should be used to pack the response of the Handler.
+// It attaches a server cookie to the response if the client sent a cookie,
+// then packs it with pack.
+func (h *cookieHandler) handleQuery(q *dns.Msg, client netip.Addr, pack func(m *dns.Msg) (*[]byte, error)) (resp *dns.Msg, packMsgPayload func(m *dns.Msg) (*[]byte, error)) {
+	cookie := findCookie(q)
+	if cookie == nil {
+		return nil, pack
+	}
+
+	b, err := hex.DecodeString(cookie.Cookie)
+	// RFC 7873 5.2.2
+	if err != nil || len(b) < clientCookieLen || (len(b) > clientCookieLen && (len(b) < 16 || len(b) > 40)) {
+		resp = new(dns.Msg)
+		resp.SetRcode(q, dns.RcodeFormatError)
+		resp.SetEdns0(cookieOptUDPSize, false)
+		return resp, nil
+	}
+
+	clientCookie, serverCookie := b[:clientCookieLen], b[clientCookieLen:]
+	valid, fresh := h.verify(clientCookie, serverCookie, client)
+	if !fresh {
+		serverCookie = h.serverCookie(clientCookie, client, uint32(h.now().Unix()))
+	}
+	respCookie := &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(clientCookie) + hex.EncodeToString(serverCookie),
+	}
+
+	if !valid && h.require {
+		resp = new(dns.Msg)
+		resp.SetRcode(q, dns.RcodeBadCookie)
+		resp.SetEdns0(cookieOptUDPSize, false)
+		setCookie(resp, respCookie)
+		return resp, nil
+	}
+
+	return nil, func(m *dns.Msg) (*[]byte, error) {
+		setCookie(m, respCookie)
+		return pack(m)
+	}
+}
+
+// verify reports whether serverCookie is valid for clientCookie and client,
+// and whether it is still fresh enough to be sent back as is.
+func (h *cookieHandler) verify(clientCookie, serverCookie []byte, client netip.Addr) (valid, fresh bool) {
+	if len(serverCookie) != serverCookieLen || serverCookie[0] != serverCookieVersion {
+		return false, false
+	}
+	ts := binary.BigEndian.Uint32(serverCookie[4:8])
+	expected := h.serverCookie(clientCookie, client, ts)
+	if !hmac.Equal(expected, serverCookie) {
+		return false, false
+	}
+
+	// Serial number arithmetic, RFC 9018 4.3.
+	age := int32(uint32(h.now().Unix()) - ts)
+	if age > serverCookieMaxAge || age < -serverCookieMaxFuture {
+		return false, false
+	}
+	return true, age <= serverCookieRefreshAge
+}
+
+func (h *cookieHandler) serverCookie(clientCookie []byte, client netip.Addr, ts uint32) []byte {
+	b := make([]byte, serverCookieLen)
+	b[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(b[4:8], ts)
+
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(clientCookie)
+	mac.Write(b[:8])
+	mac.Write(client.Unmap().AsSlice())
+	copy(b[8:], mac.Sum(nil))
+	return b
+}
+
+func findCookie(m *dns.Msg) *dns.EDNS0_COOKIE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// setCookie replaces the COOKIE option of m with c.
+// It adds an OPT to m if m does not have one.
+func setCookie(m *dns.Msg, c *dns.EDNS0_COOKIE) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(cookieOptUDPSize, false)
+		opt = m.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, c)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+func newCookieQuery(cookie string) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	if len(cookie) > 0 {
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+	return q
+}
+
+// exchangeCookie runs q through h and returns the cookie that would be sent
+// back, along with the early response if there is one.
+func exchangeCookie(t *testing.T, h *cookieHandler, q *dns.Msg, client netip.Addr) (*dns.Msg, *dns.EDNS0_COOKIE) {
+	t.Helper()
+	resp, pack := h.handleQuery(q, client, pool.PackBuffer)
+	if resp == nil {
+		resp = new(dns.Msg)
+		resp.SetReply(q)
+		resp.SetEdns0(1232, false)
+		b, err := pack(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(*b); err != nil {
+			t.Fatal(err)
+		}
+		return nil, findCookie(r)
+	}
+	return resp, findCookie(resp)
+}
+
+func TestCookieHandshake(t *testing.T) {
+	h, err := newCookieHandler(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := netip.MustParseAddr("192.0.2.1")
+	clientCookie := "0102030405060708"
+
+	// No cookie, no cookie in response.
+	if early, c := exchangeCookie(t, h, newCookieQuery(""), client); early != nil || c != nil {
+		t.Fatalf("unexpected cookie response, early: %v, cookie: %v", early, c)
+	}
+
+	// Initial query has only a client cookie.
+	early, c := exchangeCookie(t, h, newCookieQuery(clientCookie), client)
+	if early != nil {
+		t.Fatalf("unexpected early response %v", early)
+	}
+	if c == nil || len(c.Cookie) != (clientCookieLen+serverCookieLen)*2 || c.Cookie[:16] != clientCookie {
+		t.Fatalf("invalid cookie in response: %v", c)
+	}
+	fullCookie := c.Cookie
+
+	// Client sends the server cookie back, it is valid and fresh.
+	early, c = exchangeCookie(t, h, newCookieQuery(fullCookie), client)
+	if early != nil || c == nil || c.Cookie != fullCookie {
+		t.Fatalf("expected the same cookie back, early: %v, cookie: %v", early, c)
+	}
+
+	// A server cookie is bound to the client address.
+	serverCookie, err := hex.DecodeString(fullCookie[16:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := h.verify([]byte{1, 2, 3, 4, 5, 6, 7, 8}, serverCookie, netip.MustParseAddr("192.0.2.2")); valid {
+		t.Fatal("server cookie should not be valid for another client")
+	}
+
+	// An old server cookie is refreshed.
+	h.now = func() time.Time { return time.Now().Add(time.Second * (serverCookieRefreshAge + 10)) }
+	_, c = exchangeCookie(t, h, newCookieQuery(fullCookie), client)
+	if c == nil || c.Cookie == fullCookie || c.Cookie[:16] != clientCookie {
+		t.Fatalf("expected a refreshed cookie, got %v", c)
+	}
+
+	// Malformed cookie.
+	early, _ = exchangeCookie(t, h, newCookieQuery("0102"), client)
+	if early == nil || early.Rcode != dns.RcodeFormatError {
+		t.Fatalf("expected a FORMERR response, got %v", early)
+	}
+}
+
+func TestCookieRequire(t *testing.T) {
+	h, err := newCookieHandler([]byte("secret"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := netip.MustParseAddr("2001:db8::1")
+	clientCookie := "0102030405060708"
+
+	// Client cookie only is rejected with a fresh server cookie.
+	early, c := exchangeCookie(t, h, newCookieQuery(clientCookie), client)
+	if early == nil || early.Rcode != dns.RcodeBadCookie {
+		t.Fatalf("expected a BADCOOKIE response, got %v", early)
+	}
+	if c == nil || c.Cookie[:16] != clientCookie {
+		t.Fatalf("invalid cookie in BADCOOKIE response: %v", c)
+	}
+	if _, err := early.Pack(); err != nil { // extended rcode requires the OPT
+		t.Fatal(err)
+	}
+
+	// Retrying with the issued cookie succeeds.
+	early, _ = exchangeCookie(t, h, newCookieQuery(c.Cookie), client)
+	if early != nil {
+		t.Fatalf("unexpected early response %v", early)
+	}
+
+	// A forged server cookie is rejected.
+	early, _ = exchangeCookie(t, h, newCookieQuery(clientCookie+"01000000000000000000000000000000"), client)
+	if early == nil || early.Rcode != dns.RcodeBadCookie {
+		t.Fatalf("expected a BADCOOKIE response, got %v", early)
+	}
+
+	// Queries without cookies are still served.
+	if early, _ := exchangeCookie(t, h, newCookieQuery(""), client); early != nil {
+		t.Fatalf("unexpected early response %v", early)
+	}
+}
@@ -22,8 +22,8 @@ package server
 import (
 	"context"
 	"fmt"
-	"net"
-	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/harlanwei/mosdns-lts/v5/pkg/dnsutils"
@@ -36,14 +36,31 @@ const (
 	defaultQuicIdleTimeout = time.Second * 30
 	streamReadTimeout      = time.Second * 2
 	quicFirstReadTimeout   = time.Second * 2
+	doqDrainLinger         = time.Second
 )
 
 type DoQServerOpts struct {
 	Logger      *zap.Logger
 	IdleTimeout time.Duration
+
+	// Optional. Drainer can be used to gracefully drain the server.
+	Drainer *DoQDrainer
+
+	// PreFilter, if set, may answer queries before the Handler. See PreFilter.
+	PreFilter PreFilter
+
+	// HandlerTimeout, if positive, bounds the time that the Handler may
+	// take to answer a query, so a stuck plugin does not pin the query
+	// forever. Once it is exceeded, the ctx of the Handler is canceled and
+	// the query is dropped, or answered with SERVFAIL if
+	// ServfailOnHandlerTimeout is set.
+	HandlerTimeout           time.Duration
+	ServfailOnHandlerTimeout bool
 }
 
 // ServeDoQ starts a server at l. It returns if l had an Accept() error.
+// If the server is being drained by opts.Drainer, it returns
+// ErrServerDrained once the draining is done.
 // It always returns a non-nil error.
 func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 	logger := opts.Logger
@@ -55,24 +72,71 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 		idleTimeout = defaultQuicIdleTimeout
 	}
 
+	h = withPreFilter(h, opts.PreFilter, logger)
+	h = withHandlerTimeout(h, opts.HandlerTimeout, opts.ServfailOnHandlerTimeout, logger)
+	drainer := opts.Drainer
+	if drainer != nil {
+		drainer.setListener(l)
+	}
+
 	listenerCtx, cancel := context.WithCancelCause(context.Background())
 	defer cancel(errListenerCtxCanceled)
 	for {
 		c, err := l.Accept(listenerCtx)
 		if err != nil {
+			if drainer != nil {
+				if drained := drainer.isDraining(); drained != nil {
+					<-drained
+					return ErrServerDrained
+				}
+			}
 			return fmt.Errorf("unexpected listener err: %w", err)
 		}
 
 		// handle connection
 		connCtx, cancelConn := context.WithCancelCause(listenerCtx)
+		acceptCtx, stopAccept := context.WithCancel(connCtx)
+		dc := &doqConn{c: c, stopAccept: stopAccept}
+		if drainer != nil && !drainer.addConn(dc) {
+			stopAccept()
+			cancelConn(errConnectionCtxCanceled)
+			c.CloseWithError(0, "")
+			continue
+		}
 		go func() {
-			defer c.CloseWithError(0, "")
-			defer cancelConn(errConnectionCtxCanceled)
+			var streamWg sync.WaitGroup
+			var inFlight atomic.Int32
+			defer func() {
+				busy := inFlight.Load() > 0
+				// Let in-flight queries finish before closing the connection.
+				streamWg.Wait()
+				if busy && drainer != nil && drainer.isDraining() != nil {
+					// Closing the connection discards unacknowledged stream data.
+					// Give the responses a chance to be delivered.
+					lingerTimer := time.NewTimer(doqDrainLinger)
+					select {
+					case <-c.Context().Done():
+					case <-connCtx.Done():
+					case <-lingerTimer.C:
+					}
+					lingerTimer.Stop()
+				}
+				c.CloseWithError(0, "")
+				cancelConn(errConnectionCtxCanceled)
+				if drainer != nil {
+					drainer.removeConn(dc)
+				}
+			}()
+			defer stopAccept()
 
-			var clientAddr netip.Addr
-			ta, ok := c.RemoteAddr().(*net.UDPAddr)
-			if ok {
-				clientAddr = ta.AddrPort().Addr()
+			connState := c.ConnectionState()
+			connMeta := QueryMeta{
+				ClientAddr: addrPortOf(c.RemoteAddr()).Addr(),
+				ServerName: connState.TLS.ServerName,
+				Transport:  TransportDoQ,
+				LocalAddr:  addrPortOf(c.LocalAddr()),
+				ConnID:     newConnID(),
+				Used0RTT:   connState.Used0RTT,
 			}
 
 			firstRead := true
@@ -84,7 +148,7 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 				} else {
 					streamAcceptTimeout = idleTimeout
 				}
-				streamAcceptCtx, cancelStreamAccept := context.WithTimeout(connCtx, streamAcceptTimeout)
+				streamAcceptCtx, cancelStreamAccept := context.WithTimeout(acceptCtx, streamAcceptTimeout)
 				stream, err := c.AcceptStream(streamAcceptCtx)
 				cancelStreamAccept()
 				if err != nil {
@@ -93,7 +157,11 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 
 				// Handle stream.
 				// For doq, one stream, one query.
+				streamWg.Add(1)
+				inFlight.Add(1)
 				go func() {
+					defer streamWg.Done()
+					defer inFlight.Add(-1)
 					defer func() {
 						stream.Close()
 						stream.CancelRead(0) // TODO: Needs a proper error code.
@@ -104,12 +172,7 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 					if err != nil {
 						return
 					}
-					queryMeta := QueryMeta{
-						ClientAddr: clientAddr,
-						ServerName: c.ConnectionState().TLS.ServerName,
-					}
-
-					resp := h.Handle(connCtx, req, queryMeta, pool.PackTCPBuffer)
+					resp := h.Handle(connCtx, req, connMeta, pool.PackTCPBuffer)
 					if resp == nil {
 						return
 					}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DoQDrainer tracks the connections of a DoQ server so it can be drained
+// gracefully. A DoQDrainer can only be used by one ServeDoQ call.
+type DoQDrainer struct {
+	mu       sync.Mutex
+	l        *quic.Listener
+	conns    map[*doqConn]struct{}
+	draining bool
+	connGone chan struct{} // closed and renewed when a conn is removed.
+	drained  chan struct{} // closed when Drain returns.
+}
+
+type doqConn struct {
+	c          *quic.Conn
+	stopAccept context.CancelFunc
+}
+
+func NewDoQDrainer() *DoQDrainer {
+	return &DoQDrainer{
+		conns:    make(map[*doqConn]struct{}),
+		connGone: make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+}
+
+// Drain stops accepting new connections and new queries. Existing
+// connections are closed once their in-flight queries are done. Idle
+// connections are closed immediately.
+// If ctx is done before that, remaining connections are closed and
+// ctx.Err() is returned.
+// DoQ has no GOAWAY, clients will see the connection closed and reconnect.
+func (d *DoQDrainer) Drain(ctx context.Context) error {
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		select {
+		case <-d.drained:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	d.draining = true
+	l := d.l
+	for dc := range d.conns {
+		dc.stopAccept()
+	}
+	d.mu.Unlock()
+	defer close(d.drained)
+
+	if l != nil {
+		l.Close()
+	}
+
+	for {
+		d.mu.Lock()
+		remain := len(d.conns)
+		connGone := d.connGone
+		d.mu.Unlock()
+		if remain == 0 {
+			return nil
+		}
+
+		select {
+		case <-connGone:
+		case <-ctx.Done():
+			d.mu.Lock()
+			for dc := range d.conns {
+				dc.c.CloseWithError(0, "")
+			}
+			d.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+func (d *DoQDrainer) setListener(l *quic.Listener) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.l = l
+}
+
+// addConn registers c. It returns false if d is draining, c should be
+// closed by the caller.
+func (d *DoQDrainer) addConn(dc *doqConn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.conns[dc] = struct{}{}
+	return true
+}
+
+func (d *DoQDrainer) removeConn(dc *doqConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.conns[dc]; !ok {
+		return
+	}
+	delete(d.conns, dc)
+	close(d.connGone)
+	d.connGone = make(chan struct{})
+}
+
+// isDraining returns a channel that will be closed once Drain returns,
+// or nil if d is not draining.
+func (d *DoQDrainer) isDraining() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		return nil
+	}
+	return d.drained
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/dnsutils"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// blockingHandler replies to queries once release is closed.
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHandler) Handle(ctx context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	h.started <- struct{}{}
+	select {
+	case <-h.release:
+	case <-ctx.Done():
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	b, _ := packMsgPayload(r)
+	return b
+}
+
+// startTestDoQServer starts a DoQ server with a drainer and returns
+// its address and the ServeDoQ result.
+func startTestDoQServer(t *testing.T, h Handler, d *DoQDrainer) (string, <-chan error) {
+	t.Helper()
+	cert, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+	}, &quic.Config{MaxIdleTimeout: time.Second * 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	errC := make(chan error, 1)
+	go func() {
+		errC <- ServeDoQ(l, h, DoQServerOpts{Drainer: d})
+	}()
+	return l.Addr().String(), errC
+}
+
+func dialTestDoQ(t *testing.T, addr string) *quic.Conn {
+	t.Helper()
+	c, err := quic.DialAddr(context.Background(), addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"doq"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.CloseWithError(0, "") })
+	return c
+}
+
+func TestDoQDrain(t *testing.T) {
+	h := &blockingHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+	d := NewDoQDrainer()
+	addr, serveErr := startTestDoQServer(t, h, d)
+
+	busy := dialTestDoQ(t, addr)
+	idle := dialTestDoQ(t, addr)
+
+	stream, err := busy.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, err := dnsutils.WriteMsgToTCP(stream, q); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	<-h.started
+	// The idle connection must have been accepted before draining.
+	time.Sleep(time.Millisecond * 50)
+
+	drainErr := make(chan error, 1)
+	go func() { drainErr <- d.Drain(context.Background()) }()
+
+	// Idle connections are closed immediately.
+	select {
+	case <-idle.Context().Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("idle connection was not closed")
+	}
+
+	// The in-flight query still gets its response.
+	select {
+	case err := <-drainErr:
+		t.Fatalf("drain returned before the in-flight query was done, %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(h.release)
+	r, _, err := dnsutils.ReadMsgFromTCP(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id {
+		t.Fatalf("unexpected response %v", r)
+	}
+	busy.CloseWithError(0, "")
+
+	if err := <-drainErr; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrServerDrained) {
+			t.Fatalf("expected ErrServerDrained, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("ServeDoQ did not return after draining")
+	}
+}
+
+func TestDoQDrainDeadline(t *testing.T) {
+	h := &blockingHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+	d := NewDoQDrainer()
+	addr, serveErr := startTestDoQServer(t, h, d)
+
+	c := dialTestDoQ(t, addr)
+	stream, err := c.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, err := dnsutils.WriteMsgToTCP(stream, q); err != nil {
+		t.Fatal(err)
+	}
+	<-h.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := d.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("connection was not closed after the drain deadline")
+	}
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrServerDrained) {
+			t.Fatalf("expected ErrServerDrained, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("ServeDoQ did not return after draining")
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+var errHandlerTimeout = errors.New("handler timed out")
+
+// timeoutHandler gives up on queries that next does not answer within
+// timeout, and cancels the ctx of next.
+type timeoutHandler struct {
+	next     Handler
+	timeout  time.Duration
+	servfail bool
+	logger   *zap.Logger
+}
+
+// withHandlerTimeout returns h if timeout <= 0. Otherwise, queries that h
+// does not answer within timeout get a SERVFAIL response if servfail is
+// set, or are dropped.
+func withHandlerTimeout(h Handler, timeout time.Duration, servfail bool, logger *zap.Logger) Handler {
+	if timeout <= 0 {
+		return h
+	}
+	return &timeoutHandler{next: h, timeout: timeout, servfail: servfail, logger: logger}
+}
+
+func (h *timeoutHandler) Handle(ctx context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	ctx, cancel := context.WithTimeoutCause(ctx, h.timeout, errHandlerTimeout)
+	// Not canceled by the goroutine, otherwise an answered query could be
+	// taken as timed out by the select below.
+	defer cancel()
+
+	// q is released by the server once Handle returns, while next may
+	// still be running.
+	qc := q.Copy()
+	done := make(chan *[]byte, 1)
+	go func() {
+		done <- h.next.Handle(ctx, qc, meta, packMsgPayload)
+	}()
+
+	select {
+	case payload := <-done:
+		return payload
+	case <-ctx.Done():
+	}
+	// next may have answered right at the deadline.
+	select {
+	case payload := <-done:
+		return payload
+	default:
+	}
+
+	go func() {
+		if payload := <-done; payload != nil {
+			pool.ReleaseBuf(payload)
+		}
+	}()
+	h.logger.Warn(
+		"query handler timed out",
+		zap.Stringer("client", meta.ClientAddr),
+		zap.Stringer("transport", meta.Transport),
+		zap.Error(context.Cause(ctx)),
+	)
+	if !h.servfail {
+		return nil
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(q, dns.RcodeServerFailure)
+	payload, err := packMsgPayload(resp)
+	if err != nil {
+		h.logger.Error("failed to pack timeout response", zap.Error(err))
+		return nil
+	}
+	return payload
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// TestHandlerTimeoutConcurrent checks that queries answered well within
+// the timeout are never taken as timed out.
+func TestHandlerTimeoutConcurrent(t *testing.T) {
+	// The race needs the handler to finish before Handle selects, which
+	// is much more likely with parallel goroutines.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	h := withHandlerTimeout(new(bigHandler), time.Minute, false, zap.NewNop())
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3000; j++ {
+				payload := h.Handle(context.Background(), q, QueryMeta{}, pool.PackBuffer)
+				if payload == nil {
+					t.Error("an answered query was dropped")
+					return
+				}
+				pool.ReleaseBuf(payload)
+			}
+		}()
+	}
+	wg.Wait()
+}
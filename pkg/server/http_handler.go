@@ -24,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/netip"
 	"strings"
@@ -96,6 +97,10 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	queryMeta := QueryMeta{
 		ClientAddr: clientAddr,
+		Transport:  TransportDoH,
+	}
+	if a, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		queryMeta.LocalAddr = addrPortOf(a)
 	}
 	if u := req.URL; u != nil {
 		queryMeta.UrlPath = u.Path
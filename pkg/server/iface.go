@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
+	"net"
 	"net/netip"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 )
@@ -26,4 +28,74 @@ type QueryMeta struct {
 	ClientAddr netip.Addr
 	ServerName string
 	UrlPath    string
+
+	// Transport is the protocol that the query arrived over.
+	Transport Transport
+
+	// LocalAddr is the server address that received the query. For udp
+	// sockets that receive packets with different dst addresses, it is the
+	// dst address of the query.
+	LocalAddr netip.AddrPort
+
+	// ConnID identifies the connection of the query, so pipelined queries
+	// can be correlated. It is unique within the process. It is zero if
+	// the transport has no connection that the server is aware of, e.g. udp.
+	ConnID uint64
+
+	// Used0RTT is true if the query arrived on a quic connection that
+	// used 0-RTT.
+	Used0RTT bool
+}
+
+type Transport uint8
+
+const (
+	TransportUnknown Transport = iota
+	TransportUDP
+	TransportTCP
+	TransportDoT
+	TransportDoQ
+	TransportDoH
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportUDP:
+		return "udp"
+	case TransportTCP:
+		return "tcp"
+	case TransportDoT:
+		return "dot"
+	case TransportDoQ:
+		return "doq"
+	case TransportDoH:
+		return "doh"
+	default:
+		return "unknown"
+	}
+}
+
+func (t Transport) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+var lastConnID atomic.Uint64
+
+// newConnID returns an id for QueryMeta.ConnID.
+func newConnID() uint64 {
+	return lastConnID.Add(1)
+}
+
+// addrPortOf returns the address of a, or an invalid one if it is unknown.
+func addrPortOf(a net.Addr) netip.AddrPort {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort()
+	case *net.UDPAddr:
+		return a.AddrPort()
+	case nil:
+		return netip.AddrPort{}
+	}
+	ap, _ := netip.ParseAddrPort(a.String())
+	return ap
 }
@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// PreFilter is called with every query before the Handler. If ok is true,
+// resp is sent to the client and the Handler is skipped. If resp is nil,
+// the query is dropped.
+// PreFilter must not keep q after it returns.
+type PreFilter func(q *dns.Msg, meta QueryMeta) (resp *dns.Msg, ok bool)
+
+// preFilterHandler runs f before next.
+type preFilterHandler struct {
+	f      PreFilter
+	next   Handler
+	logger *zap.Logger
+}
+
+func withPreFilter(h Handler, f PreFilter, logger *zap.Logger) Handler {
+	if f == nil {
+		return h
+	}
+	return &preFilterHandler{f: f, next: h, logger: logger}
+}
+
+func (h *preFilterHandler) Handle(ctx context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	resp, ok := h.f(q, meta)
+	if !ok {
+		return h.next.Handle(ctx, q, meta, packMsgPayload)
+	}
+	if resp == nil {
+		return nil
+	}
+
+	// Udp responses are fitted by packMsgPayload, see fitUDPResp.
+	payload, err := packMsgPayload(resp)
+	if err != nil {
+		h.logger.Error("failed to pack pre-filter response", zap.Error(err))
+		return nil
+	}
+	return payload
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// countingHandler replies NXDOMAIN and counts calls.
+type countingHandler struct {
+	calls atomic.Int32
+}
+
+func (h *countingHandler) Handle(ctx context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	h.calls.Add(1)
+	resp := new(dns.Msg)
+	resp.SetRcode(q, dns.RcodeNameError)
+	payload, err := packMsgPayload(resp)
+	if err != nil {
+		return nil
+	}
+	return payload
+}
+
+func chaosPreFilter(q *dns.Msg, meta QueryMeta) (*dns.Msg, bool) {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassCHAOS {
+		return nil, false
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.Answer = append(resp.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{"mosdns"},
+	})
+	return resp, true
+}
+
+func TestServeUDPPreFilter(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		workerPool int
+	}{
+		{"goroutine", 0},
+		{"worker_pool", 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			h := new(countingHandler)
+			go ServeUDP(c, h, UDPServerOpts{WorkerPoolSize: tt.workerPool, PreFilter: chaosPreFilter})
+
+			client := new(dns.Client)
+			addr := c.LocalAddr().String()
+
+			q := new(dns.Msg)
+			q.SetQuestion("version.bind.", dns.TypeTXT)
+			q.Question[0].Qclass = dns.ClassCHAOS
+			r, _, err := client.Exchange(q, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Answer) != 1 || r.Answer[0].(*dns.TXT).Txt[0] != "mosdns" {
+				t.Fatalf("unexpected chaos response: %v", r)
+			}
+			if n := h.calls.Load(); n != 0 {
+				t.Fatalf("handler was called %d times for a pre-filtered query", n)
+			}
+
+			q = new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			r, _, err = client.Exchange(q, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != dns.RcodeNameError {
+				t.Fatalf("want NXDOMAIN from handler, got %s", dns.RcodeToString[r.Rcode])
+			}
+			if n := h.calls.Load(); n != 1 {
+				t.Fatalf("want 1 handler call, got %d", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryRecord describes a query handled by a server, see QueryLog.
+type QueryRecord struct {
+	Time      time.Time     `json:"time"`
+	Qname     string        `json:"qname"`
+	Qtype     uint16        `json:"qtype"`
+	Client    netip.Addr    `json:"client"`
+	Rcode     int           `json:"rcode"` // -1 if the query was dropped.
+	Latency   time.Duration `json:"latency"`
+	Server    string        `json:"server"`
+	Transport Transport     `json:"transport"`
+}
+
+// QueryLog keeps the records of the most recent queries of a server in a
+// ring buffer, for live debugging. Use Wrap to log the queries of a
+// Handler. It is concurrent safe.
+type QueryLog struct {
+	server string
+
+	mu      sync.Mutex
+	records []QueryRecord
+	next    int
+	full    bool
+}
+
+// NewQueryLog returns a QueryLog that keeps the last size queries.
+// server is recorded in QueryRecord.Server.
+func NewQueryLog(size int, server string) *QueryLog {
+	if size <= 0 {
+		size = 1
+	}
+	return &QueryLog{server: server, records: make([]QueryRecord, size)}
+}
+
+// Wrap returns a Handler that records every query handled by h.
+// If l is nil, it returns h.
+func (l *QueryLog) Wrap(h Handler) Handler {
+	if l == nil {
+		return h
+	}
+	return &queryLogHandler{l: l, next: h}
+}
+
+func (l *QueryLog) add(r QueryRecord) {
+	l.mu.Lock()
+	l.records[l.next] = r
+	l.next++
+	if l.next == len(l.records) {
+		l.next = 0
+		l.full = true
+	}
+	l.mu.Unlock()
+}
+
+// RecentQueries returns the records of the most recent queries, the oldest
+// first.
+func (l *QueryLog) RecentQueries() []QueryRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]QueryRecord(nil), l.records[:l.next]...)
+	}
+	s := make([]QueryRecord, 0, len(l.records))
+	s = append(s, l.records[l.next:]...)
+	return append(s, l.records[:l.next]...)
+}
+
+type queryLogHandler struct {
+	l    *QueryLog
+	next Handler
+}
+
+func (h *queryLogHandler) Handle(ctx context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	start := time.Now()
+	resp := h.next.Handle(ctx, q, meta, packMsgPayload)
+
+	r := QueryRecord{
+		Time:      start,
+		Client:    meta.ClientAddr,
+		Rcode:     -1,
+		Latency:   time.Since(start),
+		Server:    h.l.server,
+		Transport: meta.Transport,
+	}
+	if len(q.Question) > 0 {
+		r.Qname = q.Question[0].Name
+		r.Qtype = q.Question[0].Qtype
+	}
+	if resp != nil {
+		r.Rcode = payloadRcode(*resp, meta.Transport)
+	}
+	h.l.add(r)
+	return resp
+}
+
+// payloadRcode returns the rcode in the header of the packed response b
+// of transport t. It does not count the extended rcode in the opt record.
+func payloadRcode(b []byte, t Transport) int {
+	switch t {
+	case TransportTCP, TransportDoT, TransportDoQ:
+		b = b[min(2, len(b)):] // length header
+	}
+	if len(b) < 4 {
+		return -1
+	}
+	return int(b[3] & 0x0f)
+}
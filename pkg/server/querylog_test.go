@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+// rcodeHandler replies NXDOMAIN to every query.
+type rcodeHandler struct{}
+
+func (rcodeHandler) Handle(_ context.Context, q *dns.Msg, _ QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeNameError)
+	b, _ := packMsgPayload(r)
+	return b
+}
+
+func TestQueryLog(t *testing.T) {
+	l := NewQueryLog(3, "test")
+	h := l.Wrap(rcodeHandler{})
+	client := netip.MustParseAddr("192.0.2.1")
+
+	if n := len(l.RecentQueries()); n != 0 {
+		t.Fatalf("want an empty log, got %d records", n)
+	}
+	for i := 0; i < 5; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion(fmt.Sprintf("%d.example.", i), dns.TypeAAAA)
+		meta := QueryMeta{ClientAddr: client, Transport: TransportUDP}
+		packer := pool.PackBuffer
+		if i%2 == 1 {
+			meta.Transport = TransportTCP
+			packer = pool.PackTCPBuffer
+		}
+		h.Handle(context.Background(), q, meta, packer)
+
+		if n := len(l.RecentQueries()); n != min(i+1, 3) {
+			t.Fatalf("want %d records, got %d", min(i+1, 3), n)
+		}
+	}
+
+	// The buffer wrapped, only the last 3 queries are kept, the oldest first.
+	records := l.RecentQueries()
+	for i, r := range records {
+		if want := fmt.Sprintf("%d.example.", i+2); r.Qname != want {
+			t.Fatalf("record %d: want qname %s, got %s", i, want, r.Qname)
+		}
+		if r.Qtype != dns.TypeAAAA || r.Client != client || r.Server != "test" || r.Rcode != dns.RcodeNameError {
+			t.Fatalf("unexpected record %+v", r)
+		}
+		if i > 0 && r.Time.Before(records[i-1].Time) {
+			t.Fatal("records are not in order")
+		}
+	}
+	if records[1].Transport != TransportTCP {
+		t.Fatalf("want transport tcp, got %s", records[1].Transport)
+	}
+}
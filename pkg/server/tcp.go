@@ -24,17 +24,19 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
-	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/harlanwei/mosdns-lts/v5/pkg/dnsutils"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/qos"
 	"go.uber.org/zap"
 )
 
 const (
-	defaultTCPIdleTimeout = time.Second * 10
-	tcpFirstReadTimeout   = time.Second * 2
+	defaultTCPIdleTimeout         = time.Second * 10
+	defaultTCPMaxPipelinedQueries = 128
+	tcpFirstReadTimeout           = time.Second * 2
 )
 
 type TCPServerOpts struct {
@@ -43,6 +45,17 @@ type TCPServerOpts struct {
 
 	// Default is defaultTCPIdleTimeout.
 	IdleTimeout time.Duration
+
+	// MaxQueriesPerConn closes connections after they sent this many
+	// queries. Queries that are being processed are answered first.
+	// Zero means no limit.
+	MaxQueriesPerConn int
+
+	// MaxPipelinedQueries limits the number of queries of a connection
+	// that are processed concurrently. Once reached, the connection is not
+	// read until one of them is answered.
+	// Default is defaultTCPMaxPipelinedQueries.
+	MaxPipelinedQueries int
 }
 
 // ServeTCP starts a server at l. It returns if l had an Accept() error.
@@ -60,6 +73,10 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 	if idleTimeout < firstReadTimeout {
 		firstReadTimeout = idleTimeout
 	}
+	maxPipelined := opts.MaxPipelinedQueries
+	if maxPipelined <= 0 {
+		maxPipelined = defaultTCPMaxPipelinedQueries
+	}
 
 	listenerCtx, cancel := context.WithCancelCause(context.Background())
 	defer cancel(errListenerCtxCanceled)
@@ -71,12 +88,27 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 
 		// handle connection
 		tcpConnCtx, cancelConn := context.WithCancelCause(listenerCtx)
+		connMeta := QueryMeta{
+			ClientAddr: addrPortOf(c.RemoteAddr()).Addr(),
+			Transport:  TransportTCP,
+			LocalAddr:  addrPortOf(c.LocalAddr()),
+			ConnID:     newConnID(),
+		}
+		if _, ok := c.(*tls.Conn); ok {
+			connMeta.Transport = TransportDoT
+		}
 		go func() {
 			defer c.Close()
 			defer cancelConn(errConnectionCtxCanceled)
 
+			pipeline := qos.NewBulkhead(maxPipelined)
+			var wg sync.WaitGroup
 			firstRead := true
-			for {
+			for queries := 1; ; queries++ {
+				// Don't read the next query before it can be processed.
+				if err := pipeline.Acquire(tcpConnCtx); err != nil {
+					return
+				}
 				if firstRead {
 					firstRead = false
 					c.SetReadDeadline(time.Now().Add(firstReadTimeout))
@@ -85,23 +117,22 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 				}
 				req, _, err := dnsutils.ReadMsgFromTCP(c)
 				if err != nil {
+					pipeline.Release()
 					return // read err, close the connection
 				}
 
 				// Try to get server name from tls conn.
-				var serverName string
+				meta := connMeta
 				if tlsConn, ok := c.(*tls.Conn); ok {
-					serverName = tlsConn.ConnectionState().ServerName
+					meta.ServerName = tlsConn.ConnectionState().ServerName
 				}
 
 				// handle query
+				wg.Add(1)
 				go func() {
-					var clientAddr netip.Addr
-					ta, ok := c.RemoteAddr().(*net.TCPAddr)
-					if ok {
-						clientAddr = ta.AddrPort().Addr()
-					}
-					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName}, pool.PackTCPBuffer)
+					defer wg.Done()
+					defer pipeline.Release()
+					r := h.Handle(tcpConnCtx, req, meta, pool.PackTCPBuffer)
 					if r == nil {
 						c.Close() // abort the connection
 						return
@@ -113,6 +144,11 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 						return
 					}
 				}()
+
+				if opts.MaxQueriesPerConn > 0 && queries >= opts.MaxQueriesPerConn {
+					wg.Wait()
+					return
+				}
 			}
 		}()
 	}
@@ -0,0 +1,233 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/dnsutils"
+	"github.com/miekg/dns"
+)
+
+func startTestTCPServer(t *testing.T, h Handler, opts TCPServerOpts) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go ServeTCP(l, h, opts)
+	return l.Addr().String()
+}
+
+// writePipelined writes n queries with ids from 0 to n-1 in one write.
+func writePipelined(t *testing.T, c net.Conn, n int) {
+	t.Helper()
+	var b []byte
+	for i := 0; i < n; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Id = uint16(i)
+		wire, err := q.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(b, byte(len(wire)>>8), byte(len(wire)))
+		b = append(b, wire...)
+	}
+	if _, err := c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeTCPPipeline(t *testing.T) {
+	const n = 32
+	h := new(countingHandler)
+	addr := startTestTCPServer(t, h, TCPServerOpts{MaxPipelinedQueries: 4})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	writePipelined(t, c, n)
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	seen := make(map[uint16]bool)
+	for i := 0; i < n; i++ {
+		r, _, err := dnsutils.ReadMsgFromTCP(c)
+		if err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		if r.Rcode != dns.RcodeNameError || seen[r.Id] {
+			t.Fatalf("unexpected response %v", r)
+		}
+		seen[r.Id] = true
+	}
+	if int(h.calls.Load()) != n {
+		t.Fatalf("want %d handler calls, got %d", n, h.calls.Load())
+	}
+}
+
+// countingListener counts the bytes read from its conns.
+type countingListener struct {
+	net.Listener
+	read atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: c, read: &l.read}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestServeTCPPipelineNotReadAhead(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cl := &countingListener{Listener: l}
+	h := &blockingHandler{started: make(chan struct{}, 2), release: make(chan struct{})}
+	go ServeTCP(cl, h, TCPServerOpts{MaxPipelinedQueries: 1})
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	wire, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePipelined(t, c, 2)
+
+	// The second query stays unread while the first one is processed.
+	<-h.started
+	time.Sleep(time.Millisecond * 50)
+	if n := cl.read.Load(); n != int64(len(wire)+2) {
+		t.Fatalf("want one query of %d bytes read, got %d bytes", len(wire)+2, n)
+	}
+	close(h.release)
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for i := 0; i < 2; i++ {
+		if _, _, err := dnsutils.ReadMsgFromTCP(c); err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+	}
+}
+
+func TestServeTCPIdleTimeout(t *testing.T) {
+	const idleTimeout = time.Millisecond * 100
+	addr := startTestTCPServer(t, new(countingHandler), TCPServerOpts{IdleTimeout: idleTimeout})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	writePipelined(t, c, 1)
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, _, err := dnsutils.ReadMsgFromTCP(c); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, _, err := dnsutils.ReadMsgFromTCP(c); !errors.Is(err, io.EOF) {
+		t.Fatalf("want the connection to be closed, got %v", err)
+	}
+	if d := time.Since(start); d > idleTimeout*10 {
+		t.Fatalf("connection was closed after %s", d)
+	}
+}
+
+func TestServeTCPMaxQueriesPerConn(t *testing.T) {
+	const maxQueries = 3
+	addr := startTestTCPServer(t, new(countingHandler), TCPServerOpts{MaxQueriesPerConn: maxQueries})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	writePipelined(t, c, maxQueries+2)
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for i := 0; i < maxQueries; i++ {
+		if _, _, err := dnsutils.ReadMsgFromTCP(c); err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+	}
+	if _, _, err := dnsutils.ReadMsgFromTCP(c); err == nil {
+		t.Fatal("the connection should be closed after max queries")
+	}
+}
+
+func TestServeTCPQueryMeta(t *testing.T) {
+	h := &metaHandler{metas: make(chan QueryMeta, 4)}
+	addr := startTestTCPServer(t, h, TCPServerOpts{})
+
+	connIDs := make(map[uint64]int)
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePipelined(t, c, 2)
+		for j := 0; j < 2; j++ {
+			if _, _, err := dnsutils.ReadMsgFromTCP(c); err != nil {
+				t.Fatal(err)
+			}
+			meta := <-h.metas
+			if meta.Transport != TransportTCP || meta.LocalAddr.String() != addr {
+				t.Fatalf("unexpected meta %+v", meta)
+			}
+			connIDs[meta.ConnID]++
+		}
+		c.Close()
+	}
+
+	// Pipelined queries share the id of their connection.
+	if len(connIDs) != 2 {
+		t.Fatalf("want 2 connection ids, got %v", connIDs)
+	}
+	for id, n := range connIDs {
+		if id == 0 || n != 2 {
+			t.Fatalf("want 2 queries per connection id, got %v", connIDs)
+		}
+	}
+}
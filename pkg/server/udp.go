@@ -25,7 +25,11 @@ import (
 	"net"
 	"net/netip"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/harlanwei/mosdns-lts/v5/pkg/dnsutils"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -35,9 +39,89 @@ type UDPServerOpts struct {
 	Logger         *zap.Logger
 	WorkerPoolSize int
 	CPUAffinity    bool
+
+	// EnableCookie enables DNS Cookies (RFC 7873). A server cookie will be
+	// attached to the response if the query has a client cookie.
+	EnableCookie bool
+
+	// RequireCookie implies EnableCookie. Queries that have a client cookie
+	// but no valid server cookie will get a BADCOOKIE response with a fresh
+	// server cookie. Queries without any cookie are still served.
+	RequireCookie bool
+
+	// CookieSecret is the secret to compute server cookies. Servers that
+	// share a secret accept each other's cookies. If empty, a random secret
+	// will be used.
+	CookieSecret []byte
+
+	// Transparent indicates c has IP_TRANSPARENT set and receives packets
+	// redirected by TPROXY. Responses are always sent from the original
+	// destination address and port of the query (IP_RECVORIGDSTADDR), which
+	// may not be local. If the original port is not the local port of c, the
+	// response is sent by a transparent socket that is bound to the
+	// original destination for it.
+	// Linux only.
+	Transparent bool
+
+	// PreFilter, if set, may answer queries before the Handler. See PreFilter.
+	PreFilter PreFilter
+
+	// MaxInFlight limits the number of queries that are being processed.
+	// Queries over the limit are shed with a SERVFAIL response instead of
+	// being queued, so memory stays bounded under a flood.
+	// Zero means no limit.
+	MaxInFlight int
+
+	// OnShed, if set, is called for every query that was shed by MaxInFlight.
+	OnShed func()
+
+	// FloodDetector, if set, enables the detection of spoofed-source
+	// query floods. See FloodDetectorOpts.
+	FloodDetector *FloodDetectorOpts
+
+	// ImbalanceMonitor, if set, enables the monitor of the load of the
+	// workers. It requires a worker pool (WorkerPoolSize != 0).
+	// See ImbalanceMonitorOpts.
+	ImbalanceMonitor *ImbalanceMonitorOpts
+
+	// OOBBufferSize is the size of the buffers for the control messages
+	// of packets, which carry their dst addresses on sockets that need
+	// them. Default is 1024.
+	OOBBufferSize int
+
+	// AdvertisedUDPSize is the max udp payload size of responses. It is
+	// advertised in the OPT record of responses. Responses are fitted into
+	// min(the client's EDNS0 udp size, AdvertisedUDPSize), or 512 if the
+	// client does not support EDNS0, see dnsutils.FitUDPSize. Large udp
+	// responses are fragmented and often dropped on the path, clients
+	// should retry over tcp instead. Default is 1232 (DNS Flag Day 2020).
+	AdvertisedUDPSize int
+
+	// HandlerTimeout, if positive, bounds the time that the Handler may
+	// take to answer a query, so a stuck plugin does not pin the query
+	// forever. Once it is exceeded, the ctx of the Handler is canceled and
+	// the query is dropped, or answered with SERVFAIL if
+	// ServfailOnHandlerTimeout is set.
+	HandlerTimeout           time.Duration
+	ServfailOnHandlerTimeout bool
+
+	// Optional. Drainer can be used to gracefully drain the server.
+	Drainer *UDPDrainer
+
+	// BatchSize, if > 1, is the max number of packets that are read by
+	// one syscall (recvmmsg). It reduces the syscall overhead under high
+	// loads. Linux only, it is ignored on other platforms.
+	BatchSize int
 }
 
+const (
+	defaultOOBBufferSize     = 1024
+	defaultAdvertisedUDPSize = 1232
+)
+
 // ServeUDP starts a server at c. It returns if c had a read error.
+// If the server is being drained by opts.Drainer, it returns
+// ErrServerDrained once the draining is done.
 // It always returns a non-nil error.
 // h is required. logger is optional.
 func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
@@ -48,11 +132,40 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 
 	listenerCtx, cancel := context.WithCancelCause(context.Background())
 	defer cancel(errListenerCtxCanceled)
+	drainer := opts.Drainer
+	if drainer != nil {
+		drainer.setConn(c, cancel)
+	}
 
-	oobReader, oobWriter, err := initOobHandler(c)
+	oobReader, oobWriter, err := initOobHandler(c, opts.Transparent)
 	if err != nil {
 		return fmt.Errorf("failed to init oob handler, %w", err)
 	}
+	localAddr := addrPortOf(c.LocalAddr())
+
+	var cookies *cookieHandler
+	if opts.EnableCookie || opts.RequireCookie {
+		cookies, err = newCookieHandler(opts.CookieSecret, opts.RequireCookie)
+		if err != nil {
+			return fmt.Errorf("failed to init cookie handler, %w", err)
+		}
+	}
+
+	var floods *floodDetector
+	if opts.FloodDetector != nil {
+		floods = newFloodDetector(*opts.FloodDetector, logger)
+	}
+
+	h = withPreFilter(h, opts.PreFilter, logger)
+
+	var inFlight *atomic.Int64
+	if opts.MaxInFlight > 0 {
+		inFlight = new(atomic.Int64)
+		h = &inFlightHandler{next: h, inFlight: inFlight}
+	}
+	// Outside of inFlightHandler, queries still count into MaxInFlight
+	// until the Handler really returns.
+	h = withHandlerTimeout(h, opts.HandlerTimeout, opts.ServfailOnHandlerTimeout, logger)
 
 	workerPoolSize := opts.WorkerPoolSize
 	if workerPoolSize <= 0 {
@@ -63,54 +176,76 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 	if opts.WorkerPoolSize != 0 {
 		workerPool = newUDPWorkerPool(workerPoolSize, opts.CPUAffinity, c, h, listenerCtx, logger, oobWriter)
 		defer workerPool.stop()
+		if opts.ImbalanceMonitor != nil {
+			m := newImbalanceMonitor(*opts.ImbalanceMonitor, workerPool.queued, logger)
+			m.start()
+			defer m.stop()
+		}
 	}
 
-	oobPool := make([][]byte, 2)
-	for i := range oobPool {
-		oobPool[i] = make([]byte, 1024)
+	oobSize := opts.OOBBufferSize
+	if oobSize <= 0 {
+		oobSize = defaultOOBBufferSize
 	}
-	oobPoolIdx := 0
 
-	for {
-		rb := pool.GetBuf(dns.MaxMsgSize)
-		n, oobn, _, remoteAddr, err := c.ReadMsgUDPAddrPort(*rb, oobPool[oobPoolIdx])
-		if err != nil {
-			pool.ReleaseBuf(rb)
-			if n == 0 {
-				return fmt.Errorf("unexpected read err: %w", err)
-			}
-			logger.Warn("read err", zap.Error(err))
-			continue
-		}
-
-		// Read OOB data from the CURRENT buffer before switching
-		oobBuf := oobPool[oobPoolIdx]
-		oobPoolIdx = (oobPoolIdx + 1) % len(oobPool)
+	advertisedUDPSize := opts.AdvertisedUDPSize
+	if advertisedUDPSize <= 0 {
+		advertisedUDPSize = defaultAdvertisedUDPSize
+	}
+	advertisedUDPSize = min(max(advertisedUDPSize, dns.MinMsgSize), dns.MaxMsgSize)
 
+	// handlePacket handles the packet in rb[:n]. rb will be released.
+	handlePacket := func(rb *[]byte, n int, dst netip.AddrPort, remoteAddr netip.AddrPort) {
 		q := pool.GetDNSMsg()
 		if err := q.Unpack((*rb)[:n]); err != nil {
 			logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", (*rb)[:n]), zap.Stringer("from", remoteAddr))
 			pool.ReleaseBuf(rb)
 			pool.ReleaseDNSMsg(q)
-			continue
+			return
 		}
 
-		var dstIpFromCm net.IP
-		if oobReader != nil {
-			var err error
-			dstIpFromCm, err = oobReader(oobBuf[:oobn])
-			if err != nil {
-				logger.Error("failed to get dst address from oob", zap.Error(err))
+		if floods != nil {
+			floods.observe(remoteAddr.Addr(), q.Id, time.Now())
+		}
+
+		packMsgPayload := fitUDPResp(pool.PackBuffer, q, advertisedUDPSize)
+		if cookies != nil {
+			var resp *dns.Msg
+			resp, packMsgPayload = cookies.handleQuery(q, remoteAddr.Addr(), packMsgPayload)
+			if resp != nil {
+				pool.ReleaseBuf(rb)
+				pool.ReleaseDNSMsg(q)
+				if payload, err := pool.PackBuffer(resp); err != nil {
+					logger.Error("failed to pack cookie response", zap.Error(err))
+				} else {
+					writeUDPResp(c, *payload, remoteAddr, dst, oobWriter, logger)
+					pool.ReleaseBuf(payload)
+				}
+				return
 			}
 		}
 
-		if workerPool != nil {
-			workerPool.submit(q, remoteAddr, remoteAddr, dstIpFromCm)
+		// Decreased by inFlightHandler.
+		if inFlight != nil && inFlight.Add(1) > int64(opts.MaxInFlight) {
+			inFlight.Add(-1)
 			pool.ReleaseBuf(rb)
+			shedQuery(c, q, remoteAddr, dst, oobWriter, logger)
 			pool.ReleaseDNSMsg(q)
+			if opts.OnShed != nil {
+				opts.OnShed()
+			}
+			return
+		}
+
+		drainer.add()
+		if workerPool != nil {
+			// q will be released by the worker.
+			workerPool.submit(q, udpQueryMeta(remoteAddr, localAddr, dst), remoteAddr, dst, packMsgPayload, drainer.done)
+			pool.ReleaseBuf(rb)
 		} else {
 			go func() {
-				payload := h.Handle(listenerCtx, q, QueryMeta{ClientAddr: remoteAddr.Addr(), FromUDP: true}, pool.PackBuffer)
+				defer drainer.done()
+				payload := h.Handle(listenerCtx, q, udpQueryMeta(remoteAddr, localAddr, dst), packMsgPayload)
 				if payload == nil {
 					pool.ReleaseBuf(rb)
 					pool.ReleaseDNSMsg(q)
@@ -119,30 +254,182 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 				defer pool.ReleaseBuf(payload)
 				pool.ReleaseBuf(rb)
 				pool.ReleaseDNSMsg(q)
+				writeUDPResp(c, *payload, remoteAddr, dst, oobWriter, logger)
+			}()
+		}
+	}
 
-				// Check if this is an IPv4-mapped address on an IPv6-only socket
-				// If oobWriter is nil on an IPv6 socket, it means IPV6_V6ONLY=1 is set
-				localAddr := c.LocalAddr().(*net.UDPAddr)
-				if localAddr.IP.To4() == nil && isIPv4Mapped(remoteAddr.Addr()) && oobWriter == nil {
-					// IPv4-mapped address on IPv6-only socket - drop silently
-					// This shouldn't happen if IPV6_V6ONLY is set correctly, but handle gracefully
-					logger.Debug("dropping IPv4-mapped address on IPv6-only socket", zap.Stringer("client", remoteAddr))
-					return
+	if opts.BatchSize > 1 {
+		// br is nil if the platform does not support it.
+		if br := newUDPBatchReader(c, opts.BatchSize, oobReader, oobSize, logger); br != nil {
+			for {
+				pkts, err := br.read()
+				for _, pkt := range pkts {
+					handlePacket(pkt.b, pkt.n, pkt.dst, pkt.remoteAddr)
 				}
-
-				var oob []byte
-				if oobWriter != nil && dstIpFromCm != nil {
-					oob = oobWriter(dstIpFromCm)
+				if err != nil {
+					if drainer != nil && drainer.stopRead() {
+						return ErrServerDrained
+					}
+					return fmt.Errorf("unexpected read err: %w", err)
 				}
-				if _, _, err := c.WriteMsgUDPAddrPort(*payload, oob, remoteAddr); err != nil {
-					logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Error(err))
+			}
+		}
+	}
+
+	var oobPool *sync.Pool
+	if oobReader != nil {
+		oobPool = &sync.Pool{New: func() any {
+			b := make([]byte, oobSize)
+			return &b
+		}}
+	}
+	for {
+		rb := pool.GetBuf(dns.MaxMsgSize)
+		var oob *[]byte
+		if oobPool != nil {
+			oob = oobPool.Get().(*[]byte)
+		}
+		n, dst, remoteAddr, err := readUDP(c, *rb, oob, oobReader, logger)
+		if oob != nil {
+			oobPool.Put(oob)
+		}
+		if err != nil {
+			pool.ReleaseBuf(rb)
+			if n == 0 {
+				if drainer != nil && drainer.stopRead() {
+					return ErrServerDrained
 				}
-			}()
+				return fmt.Errorf("unexpected read err: %w", err)
+			}
+			logger.Warn("read err", zap.Error(err))
+			continue
 		}
+		handlePacket(rb, n, dst, remoteAddr)
+	}
+}
+
+// udpPacket is a packet read by a udpBatchReader. The packet is in b[:n].
+type udpPacket struct {
+	b          *[]byte
+	n          int
+	dst        netip.AddrPort // from oob, if any.
+	remoteAddr netip.AddrPort
+}
+
+// fitUDPResp wraps pack, so responses to q fit into the udp size that is
+// negotiated with the client, and advertise advertisedSize if they have an
+// OPT record. See UDPServerOpts.AdvertisedUDPSize.
+func fitUDPResp(pack func(m *dns.Msg) (*[]byte, error), q *dns.Msg, advertisedSize int) func(m *dns.Msg) (*[]byte, error) {
+	size := dns.MinMsgSize
+	if opt := q.IsEdns0(); opt != nil {
+		size = max(min(int(opt.UDPSize()), advertisedSize), dns.MinMsgSize)
+	}
+	return func(m *dns.Msg) (*[]byte, error) {
+		if opt := m.IsEdns0(); opt != nil {
+			opt.SetUDPSize(uint16(advertisedSize))
+		}
+		dnsutils.FitUDPSize(m, size)
+		return pack(m)
+	}
+}
+
+// readUDP reads a packet from c into b. If oob is not nil, the dst address
+// of the packet is read from its control messages by oobReader. oob can
+// be reused once readUDP returns. dst is invalid if it is unknown.
+func readUDP(c *net.UDPConn, b []byte, oob *[]byte, oobReader getSrcAddrFromOOB, logger *zap.Logger) (n int, dst netip.AddrPort, remoteAddr netip.AddrPort, err error) {
+	var oobBuf []byte
+	if oob != nil {
+		oobBuf = *oob
+	}
+	n, oobn, _, remoteAddr, err := c.ReadMsgUDPAddrPort(b, oobBuf)
+	if err != nil || oob == nil {
+		return n, netip.AddrPort{}, remoteAddr, err
+	}
+	dst, cmErr := oobReader(oobBuf[:oobn])
+	if cmErr != nil {
+		logger.Error("failed to get dst address from oob", zap.Error(cmErr))
+		return n, netip.AddrPort{}, remoteAddr, nil
+	}
+	return n, dst, remoteAddr, nil
+}
+
+// udpQueryMeta returns the QueryMeta of a query from remoteAddr. The dst
+// address from oob, if any, takes precedence over the socket address. So
+// does its port, if it is known.
+func udpQueryMeta(remoteAddr, localAddr netip.AddrPort, dst netip.AddrPort) QueryMeta {
+	if dst.IsValid() {
+		port := dst.Port()
+		if port == 0 {
+			port = localAddr.Port()
+		}
+		localAddr = netip.AddrPortFrom(dst.Addr(), port)
+	}
+	return QueryMeta{
+		ClientAddr: remoteAddr.Addr(),
+		FromUDP:    true,
+		Transport:  TransportUDP,
+		LocalAddr:  localAddr,
+	}
+}
+
+// shedQuery responds SERVFAIL to q.
+func shedQuery(c *net.UDPConn, q *dns.Msg, remoteAddr netip.AddrPort, dst netip.AddrPort, oobWriter writeSrcAddrToOOB, logger *zap.Logger) {
+	resp := new(dns.Msg)
+	resp.SetRcode(q, dns.RcodeServerFailure)
+	payload, err := pool.PackBuffer(resp)
+	if err != nil {
+		logger.Error("failed to pack shed response", zap.Error(err))
+		return
+	}
+	writeUDPResp(c, *payload, remoteAddr, dst, oobWriter, logger)
+	pool.ReleaseBuf(payload)
+}
+
+// inFlightHandler decreases inFlight once next returns.
+type inFlightHandler struct {
+	next     Handler
+	inFlight *atomic.Int64
+}
+
+func (h *inFlightHandler) Handle(ctx context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	defer h.inFlight.Add(-1)
+	return h.next.Handle(ctx, q, meta, packMsgPayload)
+}
+
+// writeUDPResp writes payload to remoteAddr. If dst is valid, it will be
+// used as the source address. If dst has a port that is not the local port
+// of c, which is only read on transparent sockets, payload is sent by
+// writeUDPFrom instead.
+func writeUDPResp(c *net.UDPConn, payload []byte, remoteAddr netip.AddrPort, dst netip.AddrPort, oobWriter writeSrcAddrToOOB, logger *zap.Logger) {
+	// Check if this is an IPv4-mapped address on an IPv6-only socket
+	// If oobWriter is nil on an IPv6 socket, it means IPV6_V6ONLY=1 is set
+	localAddr := c.LocalAddr().(*net.UDPAddr)
+	if localAddr.IP.To4() == nil && isIPv4Mapped(remoteAddr.Addr()) && oobWriter == nil {
+		// IPv4-mapped address on IPv6-only socket - drop silently
+		// This shouldn't happen if IPV6_V6ONLY is set correctly, but handle gracefully
+		logger.Debug("dropping IPv4-mapped address on IPv6-only socket", zap.Stringer("client", remoteAddr))
+		return
+	}
+
+	if dst.Port() != 0 && int(dst.Port()) != localAddr.Port {
+		// Redirected by TPROXY from another port.
+		if err := writeUDPFrom(dst, payload, remoteAddr); err != nil {
+			logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Stringer("src", dst), zap.Error(err))
+		}
+		return
+	}
+
+	var oob []byte
+	if oobWriter != nil && dst.IsValid() {
+		oob = oobWriter(dst.Addr().AsSlice())
+	}
+	if _, _, err := c.WriteMsgUDPAddrPort(payload, oob, remoteAddr); err != nil {
+		logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Error(err))
 	}
 }
 
-type getSrcAddrFromOOB func(oob []byte) (net.IP, error)
+type getSrcAddrFromOOB func(oob []byte) (netip.AddrPort, error)
 type writeSrcAddrToOOB func(a net.IP) []byte
 
 // isIPv4Mapped checks if an address is an IPv4-mapped IPv6 address (::ffff:x.x.x.x)
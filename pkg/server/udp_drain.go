@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDPDrainer tracks the queries of a udp server so it can be drained
+// gracefully. A UDPDrainer can only be used by one ServeUDP call.
+type UDPDrainer struct {
+	mu          sync.Mutex
+	c           *net.UDPConn
+	cancel      context.CancelCauseFunc // cancels the ctx of the Handler.
+	draining    bool
+	inFlight    int
+	queryDone   chan struct{} // closed and renewed when the last in-flight query is done.
+	readStopped chan struct{} // closed when ServeUDP stopped reading queries.
+	drained     chan struct{} // closed when Drain returns.
+}
+
+func NewUDPDrainer() *UDPDrainer {
+	return &UDPDrainer{
+		queryDone:   make(chan struct{}),
+		readStopped: make(chan struct{}),
+		drained:     make(chan struct{}),
+	}
+}
+
+// Drain stops reading new queries. Queries that were read, including the
+// ones queued in the worker pool, are still answered. ServeUDP returns
+// ErrServerDrained once they are done. The conn is not closed.
+// If ctx is done before that, the ctx of the Handler is canceled and
+// ctx.Err() is returned.
+func (d *UDPDrainer) Drain(ctx context.Context) error {
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		select {
+		case <-d.drained:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	d.draining = true
+	c, cancel := d.c, d.cancel
+	d.mu.Unlock()
+	defer close(d.drained)
+
+	if c == nil {
+		return nil // ServeUDP was not started.
+	}
+	c.SetReadDeadline(time.Now()) // Unblocks the read of ServeUDP.
+
+	select {
+	case <-d.readStopped:
+	case <-ctx.Done():
+		cancel(context.Cause(ctx))
+		return ctx.Err()
+	}
+	for {
+		d.mu.Lock()
+		remain := d.inFlight
+		queryDone := d.queryDone
+		d.mu.Unlock()
+		if remain == 0 {
+			return nil
+		}
+
+		select {
+		case <-queryDone:
+		case <-ctx.Done():
+			cancel(context.Cause(ctx))
+			return ctx.Err()
+		}
+	}
+}
+
+// setConn registers the conn of ServeUDP and the cancel func of the ctx
+// of its Handler.
+func (d *UDPDrainer) setConn(c *net.UDPConn, cancel context.CancelCauseFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.c = c
+	d.cancel = cancel
+	if d.draining {
+		c.SetReadDeadline(time.Now())
+	}
+}
+
+// stopRead is called when ServeUDP stopped reading queries. If d is
+// draining, it blocks until Drain returns and reports true.
+func (d *UDPDrainer) stopRead() bool {
+	d.mu.Lock()
+	draining := d.draining
+	d.mu.Unlock()
+	if draining {
+		close(d.readStopped)
+		<-d.drained
+	}
+	return draining
+}
+
+// add registers an in-flight query. It is a noop if d is nil.
+func (d *UDPDrainer) add() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inFlight++
+}
+
+// done unregisters an in-flight query. It is a noop if d is nil.
+func (d *UDPDrainer) done() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inFlight--
+	if d.inFlight == 0 {
+		close(d.queryDone)
+		d.queryDone = make(chan struct{})
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/netip"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxSequentialIDDelta is the max difference between the IDs of two
+// consecutive queries from a prefix to consider them sequential.
+const maxSequentialIDDelta = 16
+
+// FloodDetectorOpts configures a best-effort detector of spoofed-source
+// query floods. Flood tools usually send queries with sequential IDs from
+// addresses in a small range, while real resolvers randomize IDs. A source
+// prefix that sent many queries with mostly sequential IDs in a window is
+// logged and reported. Queries are never blocked.
+type FloodDetectorOpts struct {
+	// Window is the period in which queries are counted. Default is 10s.
+	Window time.Duration
+
+	// MinQueries is the number of queries from a prefix in a Window before
+	// its IDs are checked. It is at least 2, the first query has no
+	// previous ID. Default is 200.
+	MinQueries int
+
+	// SequentialRatio is the ratio of queries with an ID slightly larger
+	// than the previous one from the same prefix, over which the prefix
+	// is reported. Default is 0.5.
+	SequentialRatio float64
+
+	// Source addresses are grouped by these prefix lengths.
+	// Defaults are 24 and 48.
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+
+	// MaxPrefixes limits the number of prefixes tracked in a Window.
+	// Default is 4096.
+	MaxPrefixes int
+
+	// LogInterval limits the logs of a prefix. Default is 1m.
+	LogInterval time.Duration
+
+	// OnFlood, if set, is called every time a prefix is reported, which is
+	// at most once per prefix per Window.
+	OnFlood func(prefix netip.Prefix)
+}
+
+func (opts *FloodDetectorOpts) init() {
+	if opts.Window <= 0 {
+		opts.Window = time.Second * 10
+	}
+	if opts.MinQueries <= 0 {
+		opts.MinQueries = 200
+	}
+	opts.MinQueries = max(opts.MinQueries, 2)
+	if opts.SequentialRatio <= 0 || opts.SequentialRatio > 1 {
+		opts.SequentialRatio = 0.5
+	}
+	if opts.IPv4PrefixLen <= 0 || opts.IPv4PrefixLen > 32 {
+		opts.IPv4PrefixLen = 24
+	}
+	if opts.IPv6PrefixLen <= 0 || opts.IPv6PrefixLen > 128 {
+		opts.IPv6PrefixLen = 48
+	}
+	if opts.MaxPrefixes <= 0 {
+		opts.MaxPrefixes = 4096
+	}
+	if opts.LogInterval <= 0 {
+		opts.LogInterval = time.Minute
+	}
+}
+
+type prefixStat struct {
+	queries    int
+	sequential int
+	lastID     uint16
+	reported   bool
+}
+
+// floodDetector is not concurrent safe. It is only used by the read loop.
+type floodDetector struct {
+	opts   FloodDetectorOpts
+	logger *zap.Logger
+
+	windowStart time.Time
+	stats       map[netip.Prefix]*prefixStat
+	lastLogged  map[netip.Prefix]time.Time
+}
+
+func newFloodDetector(opts FloodDetectorOpts, logger *zap.Logger) *floodDetector {
+	opts.init()
+	return &floodDetector{
+		opts:       opts,
+		logger:     logger,
+		stats:      make(map[netip.Prefix]*prefixStat),
+		lastLogged: make(map[netip.Prefix]time.Time),
+	}
+}
+
+// observe records a query with id from addr.
+func (d *floodDetector) observe(addr netip.Addr, id uint16, now time.Time) {
+	if now.Sub(d.windowStart) >= d.opts.Window {
+		d.windowStart = now
+		clear(d.stats)
+		for p, t := range d.lastLogged {
+			if now.Sub(t) >= d.opts.LogInterval {
+				delete(d.lastLogged, p)
+			}
+		}
+	}
+
+	addr = addr.Unmap()
+	bits := d.opts.IPv6PrefixLen
+	if addr.Is4() {
+		bits = d.opts.IPv4PrefixLen
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return
+	}
+
+	s := d.stats[prefix]
+	if s == nil {
+		if len(d.stats) >= d.opts.MaxPrefixes {
+			return
+		}
+		s = &prefixStat{lastID: id}
+		d.stats[prefix] = s
+	} else if delta := id - s.lastID; delta >= 1 && delta <= maxSequentialIDDelta {
+		s.sequential++
+	}
+	s.queries++
+	s.lastID = id
+
+	if s.reported || s.queries < d.opts.MinQueries {
+		return
+	}
+	ratio := float64(s.sequential) / float64(s.queries-1)
+	if ratio < d.opts.SequentialRatio {
+		return
+	}
+	s.reported = true
+	if d.opts.OnFlood != nil {
+		d.opts.OnFlood(prefix)
+	}
+	if last, ok := d.lastLogged[prefix]; ok && now.Sub(last) < d.opts.LogInterval {
+		return
+	}
+	d.lastLogged[prefix] = now
+	d.logger.Warn(
+		"possible spoofed query flood",
+		zap.Stringer("prefix", prefix),
+		zap.Int("queries", s.queries),
+		zap.Float64("sequential_id_ratio", ratio),
+		zap.Duration("window", d.opts.Window),
+	)
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestFloodDetector(t *testing.T) {
+	var reported []netip.Prefix
+	d := newFloodDetector(FloodDetectorOpts{
+		Window:     time.Minute,
+		MinQueries: 100,
+		OnFlood:    func(p netip.Prefix) { reported = append(reported, p) },
+	}, zap.NewNop())
+
+	now := time.Now()
+	// A resolver with random IDs from 192.0.2.0/24.
+	for i := 0; i < 1000; i++ {
+		d.observe(netip.MustParseAddr("192.0.2.1"), uint16(rand.Uint32()), now)
+	}
+	if len(reported) != 0 {
+		t.Fatalf("random IDs should not be reported, got %v", reported)
+	}
+
+	// A flood with sequential IDs from spoofed addresses in 198.51.100.0/24.
+	for i := 0; i < 1000; i++ {
+		addr := netip.AddrFrom4([4]byte{198, 51, 100, byte(i)})
+		d.observe(addr, uint16(i), now)
+	}
+	want := netip.MustParsePrefix("198.51.100.0/24")
+	if len(reported) != 1 || reported[0] != want {
+		t.Fatalf("expected %s to be reported once, got %v", want, reported)
+	}
+
+	// It is reported again in the next window.
+	now = now.Add(time.Minute)
+	for i := 0; i < 100; i++ {
+		d.observe(netip.MustParseAddr("::ffff:198.51.100.1"), uint16(i), now)
+	}
+	if len(reported) != 2 || reported[1] != want {
+		t.Fatalf("expected %s to be reported again, got %v", want, reported)
+	}
+}
+
+func TestFloodDetectorMinQueries(t *testing.T) {
+	var reported []netip.Prefix
+	d := newFloodDetector(FloodDetectorOpts{
+		Window:     time.Minute,
+		MinQueries: 1,
+		OnFlood:    func(p netip.Prefix) { reported = append(reported, p) },
+	}, zap.NewNop())
+
+	// A single query has no ratio to check.
+	d.observe(netip.MustParseAddr("192.0.2.1"), 1, time.Now())
+	if len(reported) != 0 {
+		t.Fatalf("a single query should not be reported, got %v", reported)
+	}
+}
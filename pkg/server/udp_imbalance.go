@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ImbalanceMonitorOpts configures a monitor that periodically compares the
+// number of requests queued for each udp worker and reports when one of
+// them has much more than the average, e.g. because it is stuck in slow
+// queries. Workers are fed in turns, so their queues only diverge if they
+// drain at different speeds. It only observes, packets are not steered.
+type ImbalanceMonitorOpts struct {
+	// Interval is the period of the checks. Default is 5s.
+	Interval time.Duration
+
+	// Threshold is the ratio of the queued requests of the busiest worker
+	// to the average, over which an imbalance is reported. Default is 2.
+	Threshold float64
+
+	// MinQueued is the number of queued requests of all workers before
+	// they are compared, so short bursts are not reported. Default is 64.
+	MinQueued int
+
+	// OnImbalance, if set, is called with every reported imbalance.
+	OnImbalance func(ImbalanceReport)
+}
+
+func (opts *ImbalanceMonitorOpts) init() {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second * 5
+	}
+	if opts.Threshold <= 1 {
+		opts.Threshold = 2
+	}
+	if opts.MinQueued <= 0 {
+		opts.MinQueued = 64
+	}
+}
+
+// ImbalanceReport is the queued requests of each worker at a check.
+type ImbalanceReport struct {
+	Queued  []int // indexed by worker id
+	Mean    float64
+	Busiest int     // the id of the busiest worker
+	Ratio   float64 // of the queued requests of the busiest worker to Mean
+}
+
+// imbalanceMonitor compares the lengths of queues. queued returns the
+// current length of each queue, always in the same order.
+type imbalanceMonitor struct {
+	opts   ImbalanceMonitorOpts
+	logger *zap.Logger
+	queued func() []int
+
+	stopOnce sync.Once
+	stopChan chan struct{}
+}
+
+func newImbalanceMonitor(opts ImbalanceMonitorOpts, queued func() []int, logger *zap.Logger) *imbalanceMonitor {
+	opts.init()
+	return &imbalanceMonitor{
+		opts:     opts,
+		logger:   logger,
+		queued:   queued,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// start runs the monitor in a new goroutine until stop is called.
+func (m *imbalanceMonitor) start() {
+	go func() {
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.check()
+			case <-m.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (m *imbalanceMonitor) stop() {
+	m.stopOnce.Do(func() { close(m.stopChan) })
+}
+
+// check compares the queues and reports an imbalance, if any. It reports
+// whether there was one.
+func (m *imbalanceMonitor) check() bool {
+	r := ImbalanceReport{Queued: m.queued()}
+	var total int
+	for i, n := range r.Queued {
+		total += n
+		if n > r.Queued[r.Busiest] {
+			r.Busiest = i
+		}
+	}
+
+	if len(r.Queued) < 2 || total < m.opts.MinQueued {
+		return false
+	}
+	r.Mean = float64(total) / float64(len(r.Queued))
+	r.Ratio = float64(r.Queued[r.Busiest]) / r.Mean
+	if r.Ratio < m.opts.Threshold {
+		return false
+	}
+
+	if m.opts.OnImbalance != nil {
+		m.opts.OnImbalance(r)
+	}
+	m.logger.Warn(
+		"udp workers are imbalanced",
+		zap.Int("busiest_worker", r.Busiest),
+		zap.Float64("ratio", r.Ratio),
+		zap.Float64("mean_queued", r.Mean),
+		zap.Ints("queued", r.Queued),
+	)
+	return true
+}
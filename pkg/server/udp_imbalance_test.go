@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"go.uber.org/zap"
+)
+
+func TestImbalanceMonitor(t *testing.T) {
+	queued := []int{0, 0, 0, 0}
+	var reports []ImbalanceReport
+	m := newImbalanceMonitor(ImbalanceMonitorOpts{
+		Threshold:   2,
+		MinQueued:   100,
+		OnImbalance: func(r ImbalanceReport) { reports = append(reports, r) },
+	}, func() []int { return append([]int(nil), queued...) }, zap.NewNop())
+
+	// Balanced.
+	queued = []int{100, 110, 90, 100}
+	if m.check() {
+		t.Fatalf("balanced workers should not be reported, got %+v", reports)
+	}
+
+	// Too few queued requests to judge.
+	queued = []int{50, 0, 0, 0}
+	if m.check() {
+		t.Fatalf("a short burst should not be reported, got %+v", reports)
+	}
+
+	// Worker 2 is stuck while the others keep up.
+	queued = []int{10, 10, 360, 20}
+	if !m.check() || len(reports) != 1 {
+		t.Fatalf("expected an imbalance report, got %+v", reports)
+	}
+	r := reports[0]
+	if r.Busiest != 2 || r.Mean != 100 || r.Ratio != 3.6 || r.Queued[2] != 360 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	m.start()
+	m.stop()
+	m.stop() // stop is idempotent
+}
+
+// TestImbalanceMonitorStuckWorker checks that a worker pool with a stuck
+// worker is reported.
+func TestImbalanceMonitorStuckWorker(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := &blockingHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+	p := newUDPWorkerPool(4, false, c, h, ctx, zap.NewNop(), nil)
+	defer p.stop()
+
+	// Worker 0 gets stuck in its first query, the others keep up.
+	p.workers[0].requestChan <- udpRequest{q: new(dns.Msg), done: func() {}}
+	<-h.started
+	for i := 0; i < 100; i++ {
+		p.workers[0].requestChan <- udpRequest{q: new(dns.Msg), done: func() {}}
+	}
+
+	var reports []ImbalanceReport
+	m := newImbalanceMonitor(ImbalanceMonitorOpts{
+		OnImbalance: func(r ImbalanceReport) { reports = append(reports, r) },
+	}, p.queued, zap.NewNop())
+	if !m.check() || reports[0].Busiest != 0 || reports[0].Ratio != 4 {
+		t.Fatalf("a stuck worker should be reported, got %+v", reports)
+	}
+}
@@ -22,11 +22,18 @@
 package server
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
+	"syscall"
 
+	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
@@ -36,26 +43,50 @@ var (
 	errCmNoDstAddr = errors.New("control msg does not have dst address")
 )
 
-func getOOBFromCM4(oob []byte) (net.IP, error) {
+func getOOBFromCM4(oob []byte) (netip.AddrPort, error) {
 	var cm ipv4.ControlMessage
 	if err := cm.Parse(oob); err != nil {
-		return nil, err
-	}
-	if cm.Dst == nil {
-		return nil, errCmNoDstAddr
+		return netip.AddrPort{}, err
 	}
-	return cm.Dst, nil
+	return dstFromIP(cm.Dst)
 }
 
-func getOOBFromCM6(oob []byte) (net.IP, error) {
+func getOOBFromCM6(oob []byte) (netip.AddrPort, error) {
 	var cm ipv6.ControlMessage
 	if err := cm.Parse(oob); err != nil {
-		return nil, err
+		return netip.AddrPort{}, err
+	}
+	return dstFromIP(cm.Dst)
+}
+
+// dstFromIP returns ip with port 0, which means the port is unknown.
+func dstFromIP(ip net.IP) (netip.AddrPort, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.AddrPort{}, errCmNoDstAddr
 	}
-	if cm.Dst == nil {
-		return nil, errCmNoDstAddr
+	return netip.AddrPortFrom(addr.Unmap(), 0), nil
+}
+
+// getOrigDstFromCM reads the original dst address and port of a packet
+// from its IP_ORIGDSTADDR or IPV6_ORIGDSTADDR control message.
+func getOrigDstFromCM(oob []byte) (netip.AddrPort, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, m := range msgs {
+		// Both are a sockaddr, the port is in network byte order.
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= unix.SizeofSockaddrInet4:
+			addr := netip.AddrFrom4([4]byte(m.Data[4:8]))
+			return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(m.Data[2:4])), nil
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= unix.SizeofSockaddrInet6:
+			addr := netip.AddrFrom16([16]byte(m.Data[8:24])).Unmap()
+			return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(m.Data[2:4])), nil
+		}
 	}
-	return cm.Dst, nil
+	return netip.AddrPort{}, errCmNoDstAddr
 }
 
 func srcIP2Cm(ip net.IP) []byte {
@@ -74,8 +105,15 @@ func srcIP2Cm(ip net.IP) []byte {
 	return nil
 }
 
-func initOobHandler(c *net.UDPConn) (getSrcAddrFromOOB, writeSrcAddrToOOB, error) {
-	if !c.LocalAddr().(*net.UDPAddr).IP.IsUnspecified() {
+// initOobHandler inits the oob handler for sockets that may receive
+// packets with different dst addresses, so responses can be sent from the
+// dst address of their queries.
+// If transparent is true, c is a transparent socket. It always needs the
+// oob handler because packets redirected by TPROXY have non-local dst
+// addresses, which are read with their ports from IP_ORIGDSTADDR. The
+// kernel allows sending from them on transparent sockets.
+func initOobHandler(c *net.UDPConn, transparent bool) (getSrcAddrFromOOB, writeSrcAddrToOOB, error) {
+	if !transparent && !c.LocalAddr().(*net.UDPAddr).IP.IsUnspecified() {
 		return nil, nil, nil
 	}
 
@@ -95,6 +133,15 @@ func initOobHandler(c *net.UDPConn) (getSrcAddrFromOOB, writeSrcAddrToOOB, error
 		}
 		switch v {
 		case unix.AF_INET:
+			if transparent {
+				if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+					controlErr = os.NewSyscallError("failed to set IP_RECVORIGDSTADDR", err)
+					return
+				}
+				getter = getOrigDstFromCM
+				setter = srcIP2Cm
+				return
+			}
 			c4 := ipv4.NewPacketConn(c)
 			if err := c4.SetControlMessage(ipv4.FlagDst, true); err != nil {
 				controlErr = fmt.Errorf("failed to set ipv4 cmsg flags, %w", err)
@@ -109,6 +156,22 @@ func initOobHandler(c *net.UDPConn) (getSrcAddrFromOOB, writeSrcAddrToOOB, error
 				controlErr = os.NewSyscallError("failed to get IPV6_V6ONLY", err)
 				return
 			}
+			if transparent {
+				if err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+					controlErr = os.NewSyscallError("failed to set IPV6_RECVORIGDSTADDR", err)
+					return
+				}
+				// Packets of ipv4 clients carry IP_ORIGDSTADDR instead.
+				if ipv6only == 0 {
+					if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+						controlErr = os.NewSyscallError("failed to set IP_RECVORIGDSTADDR", err)
+						return
+					}
+				}
+				getter = getOrigDstFromCM
+				setter = srcIP2Cm
+				return
+			}
 			if ipv6only == 1 {
 				return
 			}
@@ -131,3 +194,107 @@ func initOobHandler(c *net.UDPConn) (getSrcAddrFromOOB, writeSrcAddrToOOB, error
 	}
 	return getter, setter, nil
 }
+
+// udpBatchReader reads packets from a udp socket in batches by recvmmsg.
+type udpBatchReader struct {
+	readBatch func(ms []ipv4.Message, flags int) (int, error)
+	oobReader getSrcAddrFromOOB
+	logger    *zap.Logger
+
+	bufs []*[]byte
+	ms   []ipv4.Message
+	pkts []udpPacket
+}
+
+// newUDPBatchReader returns a reader that reads up to size packets at a
+// time. If oobReader is not nil, the dst addresses of the packets are read
+// from their control messages, see readUDP.
+func newUDPBatchReader(c *net.UDPConn, size int, oobReader getSrcAddrFromOOB, oobSize int, logger *zap.Logger) *udpBatchReader {
+	r := &udpBatchReader{
+		oobReader: oobReader,
+		logger:    logger,
+		bufs:      make([]*[]byte, size),
+		ms:        make([]ipv4.Message, size),
+		pkts:      make([]udpPacket, 0, size),
+	}
+	// ipv4.Message and ipv6.Message are the same type.
+	if c.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		r.readBatch = ipv4.NewPacketConn(c).ReadBatch
+	} else {
+		r.readBatch = ipv6.NewPacketConn(c).ReadBatch
+	}
+	for i := range r.ms {
+		r.bufs[i] = pool.GetBuf(dns.MaxMsgSize)
+		r.ms[i].Buffers = [][]byte{*r.bufs[i]}
+		if oobReader != nil {
+			r.ms[i].OOB = make([]byte, oobSize)
+		}
+	}
+	return r
+}
+
+// read blocks until at least one packet is read. The buffers of the
+// returned packets are owned by the caller. The returned slice is only
+// valid until the next read.
+func (r *udpBatchReader) read() ([]udpPacket, error) {
+	n, err := r.readBatch(r.ms, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	r.pkts = r.pkts[:0]
+	for i := range r.ms[:n] {
+		m := &r.ms[i]
+		pkt := udpPacket{b: r.bufs[i], n: m.N, remoteAddr: addrPortOf(m.Addr)}
+		if r.oobReader != nil {
+			dst, err := r.oobReader(m.OOB[:m.NN])
+			if err != nil {
+				r.logger.Error("failed to get dst address from oob", zap.Error(err))
+			} else {
+				pkt.dst = dst
+			}
+		}
+		r.pkts = append(r.pkts, pkt)
+
+		r.bufs[i] = pool.GetBuf(dns.MaxMsgSize)
+		m.Buffers[0] = *r.bufs[i]
+	}
+	return r.pkts, nil
+}
+
+// writeUDPFrom sends payload from src, which may be a non-local address,
+// to remoteAddr. It binds a transparent socket to src for it, so it is
+// only used to answer queries that were redirected by TPROXY from another
+// port. See UDPServerOpts.Transparent.
+func writeUDPFrom(src netip.AddrPort, payload []byte, remoteAddr netip.AddrPort) error {
+	network := "udp6"
+	level, opt := unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+	if src.Addr().Is4() {
+		network = "udp4"
+		level, opt = unix.SOL_IP, unix.IP_TRANSPARENT
+		remoteAddr = netip.AddrPortFrom(remoteAddr.Addr().Unmap(), remoteAddr.Port())
+	}
+	lc := net.ListenConfig{Control: func(_, _ string, rc syscall.RawConn) error {
+		var err error
+		if cErr := rc.Control(func(fd uintptr) {
+			// Other responses may be sent from src at the same time.
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+				err = os.NewSyscallError("failed to set SO_REUSEADDR", err)
+				return
+			}
+			if err = unix.SetsockoptInt(int(fd), level, opt, 1); err != nil {
+				err = os.NewSyscallError("failed to set IP_TRANSPARENT", err)
+			}
+		}); cErr != nil {
+			return cErr
+		}
+		return err
+	}}
+	c, err := lc.ListenPacket(context.Background(), network, src.String())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.(*net.UDPConn).WriteToUDPAddrPort(payload, remoteAddr)
+	return err
+}
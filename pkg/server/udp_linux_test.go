@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// dstHandler answers the dst address of queries in an A record.
+type dstHandler struct{}
+
+func (dstHandler) Handle(_ context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   meta.LocalAddr.Addr().AsSlice(),
+	})
+	b, _ := packMsgPayload(r)
+	return b
+}
+
+// TestServeUDPOOBConcurrent sends queries to different dst addresses of
+// a wildcard socket concurrently. Every query must see its own dst
+// address, so the oob buffers are not mixed up.
+func TestServeUDPOOBConcurrent(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		workerPool int
+		batchSize  int
+	}{
+		{"goroutine", 0, 0},
+		{"worker_pool", 4, 0},
+		{"batch", 0, 8},
+		{"batch_worker_pool", 4, 8},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			go ServeUDP(c, dstHandler{}, UDPServerOpts{WorkerPoolSize: tt.workerPool, OOBBufferSize: 128, BatchSize: tt.batchSize})
+
+			port := c.LocalAddr().(*net.UDPAddr).Port
+			dsts := []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")}
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					// Clients use connected sockets, so responses from a
+					// wrong src address are dropped as well.
+					client := &dns.Client{Timeout: time.Second * 5}
+					for j := 0; j < 50; j++ {
+						dst := dsts[(i+j)%len(dsts)]
+						q := new(dns.Msg)
+						q.SetQuestion(fmt.Sprintf("%d.%d.example.", i, j), dns.TypeA)
+						r, _, err := client.Exchange(q, netip.AddrPortFrom(dst, uint16(port)).String())
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if len(r.Answer) != 1 {
+							t.Errorf("unexpected response %v", r)
+							return
+						}
+						if got, _ := netip.AddrFromSlice(r.Answer[0].(*dns.A).A); got.Unmap() != dst {
+							t.Errorf("query to %s got dst address %s", dst, got)
+							return
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// listenTransparentUDP listens on a transparent udp socket at addr. It
+// skips t without CAP_NET_ADMIN.
+func listenTransparentUDP(t *testing.T, addr string) *net.UDPConn {
+	t.Helper()
+	lc := net.ListenConfig{Control: func(_, _ string, rc syscall.RawConn) error {
+		var err error
+		if cErr := rc.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}); cErr != nil {
+			return cErr
+		}
+		return err
+	}}
+	c, err := lc.ListenPacket(context.Background(), "udp4", addr)
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("CAP_NET_ADMIN is required")
+		}
+		t.Fatal(err)
+	}
+	return c.(*net.UDPConn)
+}
+
+// Packets are only redirected from other addresses by TPROXY rules, which
+// are out of the scope of unit tests. Queries that are sent to c directly
+// have their own dst address as their original dst.
+func TestServeUDPTransparent(t *testing.T) {
+	c := listenTransparentUDP(t, "0.0.0.0:0")
+	defer c.Close()
+	go ServeUDP(c, dstHandler{}, UDPServerOpts{Transparent: true})
+
+	client := &dns.Client{Timeout: time.Second * 5}
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	dst := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), uint16(c.LocalAddr().(*net.UDPAddr).Port))
+	r, _, err := client.Exchange(q, dst.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
+
+func TestWriteUDPFrom(t *testing.T) {
+	// Binding to a non-local address needs IP_TRANSPARENT as well.
+	listenTransparentUDP(t, "127.0.0.1:0").Close()
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	src := netip.MustParseAddrPort("192.0.2.1:53")
+	if err := writeUDPFrom(src, []byte("resp"), addrPortOf(client.LocalAddr())); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	b := make([]byte, 16)
+	n, from, err := client.ReadFromUDPAddrPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "resp" || from != src {
+		t.Fatalf("got %q from %s", b[:n], from)
+	}
+}
@@ -21,8 +21,29 @@
 
 package server
 
-import "net"
+import (
+	"errors"
+	"net"
+	"net/netip"
 
-func initOobHandler(c *net.UDPConn) (getSrcAddrFromOOB, writeSrcAddrToOOB, error) {
+	"go.uber.org/zap"
+)
+
+func initOobHandler(c *net.UDPConn, transparent bool) (getSrcAddrFromOOB, writeSrcAddrToOOB, error) {
 	return nil, nil, nil
 }
+
+func writeUDPFrom(src netip.AddrPort, payload []byte, remoteAddr netip.AddrPort) error {
+	return errors.New("transparent sockets are not supported on this platform")
+}
+
+// udpBatchReader is not supported on this platform.
+type udpBatchReader struct{}
+
+func newUDPBatchReader(c *net.UDPConn, size int, oobReader getSrcAddrFromOOB, oobSize int, logger *zap.Logger) *udpBatchReader {
+	return nil
+}
+
+func (r *udpBatchReader) read() ([]udpPacket, error) {
+	panic("not supported")
+}
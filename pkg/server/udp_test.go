@@ -0,0 +1,448 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeUDPMaxInFlight(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		workerPool int
+	}{
+		{"goroutine", 0},
+		{"worker_pool", 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			h := &blockingHandler{started: make(chan struct{}, 16), release: make(chan struct{})}
+			var shed atomic.Int32
+			go ServeUDP(c, h, UDPServerOpts{
+				WorkerPoolSize: tt.workerPool,
+				MaxInFlight:    2,
+				OnShed:         func() { shed.Add(1) },
+			})
+
+			addr := c.LocalAddr().String()
+			client := &dns.Client{Timeout: time.Second * 5}
+			exchange := func() (*dns.Msg, error) {
+				q := new(dns.Msg)
+				q.SetQuestion("example.com.", dns.TypeA)
+				r, _, err := client.Exchange(q, addr)
+				return r, err
+			}
+
+			// Fill the limit.
+			blocked := make(chan *dns.Msg, 2)
+			for i := 0; i < 2; i++ {
+				go func() {
+					r, err := exchange()
+					if err != nil {
+						t.Error(err)
+					}
+					blocked <- r
+				}()
+				<-h.started
+			}
+
+			for i := 0; i < 3; i++ {
+				r, err := exchange()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.Rcode != dns.RcodeServerFailure {
+					t.Fatalf("query over the limit should be shed, got %s", dns.RcodeToString[r.Rcode])
+				}
+			}
+			if n := shed.Load(); n != 3 {
+				t.Fatalf("want 3 shed queries, got %d", n)
+			}
+
+			close(h.release)
+			for i := 0; i < 2; i++ {
+				if r := <-blocked; r == nil || r.Rcode != dns.RcodeSuccess {
+					t.Fatalf("blocked query should succeed, got %v", r)
+				}
+			}
+
+			// Slots are released once the handler returns.
+			if r, err := exchange(); err != nil || r.Rcode != dns.RcodeSuccess {
+				t.Fatalf("query should succeed after the limit is freed, got %v, %v", r, err)
+			}
+		})
+	}
+}
+
+// metaHandler replies every query and sends its QueryMeta to metas.
+type metaHandler struct {
+	metas chan QueryMeta
+}
+
+func (h *metaHandler) Handle(_ context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	h.metas <- meta
+	r := new(dns.Msg)
+	r.SetReply(q)
+	b, _ := packMsgPayload(r)
+	return b
+}
+
+func TestServeUDPQueryMeta(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		workerPool int
+	}{
+		{"goroutine", 0},
+		{"worker_pool", 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			h := &metaHandler{metas: make(chan QueryMeta, 1)}
+			go ServeUDP(c, h, UDPServerOpts{WorkerPoolSize: tt.workerPool})
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			client := &dns.Client{Timeout: time.Second * 5}
+			if _, _, err := client.Exchange(q, c.LocalAddr().String()); err != nil {
+				t.Fatal(err)
+			}
+
+			meta := <-h.metas
+			if meta.Transport != TransportUDP || !meta.FromUDP {
+				t.Fatalf("want transport udp, got %s", meta.Transport)
+			}
+			if meta.ClientAddr != netip.MustParseAddr("127.0.0.1") {
+				t.Fatalf("unexpected client addr %s", meta.ClientAddr)
+			}
+			if meta.LocalAddr != c.LocalAddr().(*net.UDPAddr).AddrPort() {
+				t.Fatalf("unexpected local addr %s", meta.LocalAddr)
+			}
+			if meta.ConnID != 0 || meta.Used0RTT {
+				t.Fatalf("unexpected connection info %+v", meta)
+			}
+		})
+	}
+}
+
+// bigHandler replies every query with n A records.
+type bigHandler struct {
+	n atomic.Int32
+}
+
+func (h *bigHandler) Handle(_ context.Context, q *dns.Msg, _ QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	for i := 0; i < int(h.n.Load()); i++ {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	if q.IsEdns0() != nil {
+		r.SetEdns0(4096, false)
+	}
+	b, _ := packMsgPayload(r)
+	return b
+}
+
+func TestServeUDPAdvertisedSize(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	h := new(bigHandler)
+	go ServeUDP(c, h, UDPServerOpts{})
+
+	addr := c.LocalAddr().String()
+	client := &dns.Client{Timeout: time.Second * 5, UDPSize: dns.MaxMsgSize}
+	exchange := func(n int, udpSize uint16) *dns.Msg {
+		h.n.Store(int32(n))
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		if udpSize > 0 {
+			q.SetEdns0(udpSize, false)
+		}
+		r, _, err := client.Exchange(q, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	for _, tt := range []struct {
+		name    string
+		n       int
+		udpSize uint16
+		maxLen  int
+		wantTC  bool
+	}{
+		{"fits", 10, 4096, defaultAdvertisedUDPSize, false},
+		{"capped_by_advertised", 100, 4096, defaultAdvertisedUDPSize, true},
+		{"client_smaller", 50, 600, 600, true},
+		{"no_edns0", 50, 0, dns.MinMsgSize, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := exchange(tt.n, tt.udpSize)
+			r.Compress = true // as it was packed.
+			if l := r.Len(); l > tt.maxLen {
+				t.Fatalf("response length %d exceeds %d", l, tt.maxLen)
+			}
+			if r.Truncated != tt.wantTC {
+				t.Fatalf("want TC %v, got %v", tt.wantTC, r.Truncated)
+			}
+			if !tt.wantTC && len(r.Answer) != tt.n {
+				t.Fatalf("want %d answers, got %d", tt.n, len(r.Answer))
+			}
+			if opt := r.IsEdns0(); tt.udpSize > 0 && (opt == nil || opt.UDPSize() != defaultAdvertisedUDPSize) {
+				t.Fatalf("the response should advertise %d, got %v", defaultAdvertisedUDPSize, opt)
+			}
+		})
+	}
+}
+
+// sleepHandler replies every query after sleeping, ignoring its ctx. The
+// cause of ctx is sent to causes once it wakes up.
+type sleepHandler struct {
+	d      time.Duration
+	causes chan error
+}
+
+func (h *sleepHandler) Handle(ctx context.Context, q *dns.Msg, _ QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	time.Sleep(h.d)
+	h.causes <- context.Cause(ctx)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	b, _ := packMsgPayload(r)
+	return b
+}
+
+func TestServeUDPHandlerTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		servfail bool
+	}{
+		{"drop", false},
+		{"servfail", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			h := &sleepHandler{d: time.Millisecond * 500, causes: make(chan error, 1)}
+			go ServeUDP(c, h, UDPServerOpts{
+				HandlerTimeout:           time.Millisecond * 50,
+				ServfailOnHandlerTimeout: tt.servfail,
+			})
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			client := &dns.Client{Timeout: time.Millisecond * 300}
+			r, _, err := client.Exchange(q, c.LocalAddr().String())
+			if tt.servfail {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.Rcode != dns.RcodeServerFailure {
+					t.Fatalf("want SERVFAIL, got %s", dns.RcodeToString[r.Rcode])
+				}
+			} else if err == nil {
+				t.Fatalf("query should be dropped, got %v", r)
+			}
+
+			if cause := <-h.causes; cause != errHandlerTimeout {
+				t.Fatalf("ctx of the handler should be canceled by the timeout, got %v", cause)
+			}
+		})
+	}
+}
+
+func TestServeUDPDrain(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		workerPool int
+		batchSize  int
+	}{
+		{"goroutine", 0, 0},
+		{"worker_pool", 2, 0},
+		{"batch", 0, 8},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			h := &blockingHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+			d := NewUDPDrainer()
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- ServeUDP(c, h, UDPServerOpts{WorkerPoolSize: tt.workerPool, Drainer: d, BatchSize: tt.batchSize})
+			}()
+
+			resp := make(chan *dns.Msg, 1)
+			go func() {
+				q := new(dns.Msg)
+				q.SetQuestion("example.com.", dns.TypeA)
+				r, _, err := (&dns.Client{Timeout: time.Second * 5}).Exchange(q, c.LocalAddr().String())
+				if err != nil {
+					t.Error(err)
+				}
+				resp <- r
+			}()
+			<-h.started
+
+			drainErr := make(chan error, 1)
+			go func() { drainErr <- d.Drain(context.Background()) }()
+
+			// The in-flight query still gets its response.
+			select {
+			case err := <-drainErr:
+				t.Fatalf("drain returned before the in-flight query was done, %v", err)
+			case <-time.After(time.Millisecond * 50):
+			}
+			close(h.release)
+			if r := <-resp; r == nil || r.Rcode != dns.RcodeSuccess {
+				t.Fatalf("in-flight query should succeed, got %v", r)
+			}
+
+			if err := <-drainErr; err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-serveErr:
+				if !errors.Is(err, ErrServerDrained) {
+					t.Fatalf("expected ErrServerDrained, got %v", err)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("ServeUDP did not return after draining")
+			}
+		})
+	}
+}
+
+func TestServeUDPDrainDeadline(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	h := &blockingHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+	d := NewUDPDrainer()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- ServeUDP(c, h, UDPServerOpts{Drainer: d})
+	}()
+
+	go func() {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		(&dns.Client{Timeout: time.Second}).Exchange(q, c.LocalAddr().String())
+	}()
+	<-h.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := d.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrServerDrained) {
+			t.Fatalf("expected ErrServerDrained, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("ServeUDP did not return after draining")
+	}
+}
+
+// BenchmarkServeUDP measures the queries per second that ServeUDP answers
+// to concurrent clients, with single and batched reads.
+func BenchmarkServeUDP(b *testing.B) {
+	for _, batchSize := range []int{1, 32} {
+		b.Run(fmt.Sprintf("batch_%d", batchSize), func(b *testing.B) {
+			c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			go ServeUDP(c, new(bigHandler), UDPServerOpts{BatchSize: batchSize})
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			wire, err := q.Pack()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var lost atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				cc, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer cc.Close()
+				buf := make([]byte, dns.MaxMsgSize)
+				for pb.Next() {
+					if _, err := cc.Write(wire); err != nil {
+						b.Error(err)
+						return
+					}
+					cc.SetReadDeadline(time.Now().Add(time.Second))
+					if _, err := cc.Read(buf); err != nil {
+						lost.Add(1)
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "queries/s")
+			if n := lost.Load(); n > 0 {
+				b.Logf("%d queries were lost", n)
+			}
+		})
+	}
+}
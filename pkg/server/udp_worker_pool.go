@@ -32,11 +32,13 @@ import (
 
 type udpRequest struct {
 	q               *dns.Msg
-	clientAddr      netip.Addr
-	dstIpFromCm     net.IP
+	meta            QueryMeta
+	dst             netip.AddrPort
 	remoteAddr      netip.AddrPort
 	oobWriter       writeSrcAddrToOOB
+	packMsgPayload  func(m *dns.Msg) (*[]byte, error)
 	responsePayload *[]byte
+	done            func() // called once the request is answered.
 }
 
 type udpWorker struct {
@@ -71,7 +73,10 @@ func (w *udpWorker) run() {
 
 	for {
 		select {
-		case req := <-w.requestChan:
+		case req, ok := <-w.requestChan:
+			if !ok {
+				return
+			}
 			w.handleRequest(req)
 		case <-w.listenerCtx.Done():
 			return
@@ -80,29 +85,14 @@ func (w *udpWorker) run() {
 }
 
 func (w *udpWorker) handleRequest(req udpRequest) {
-	payload := w.handler.Handle(w.listenerCtx, req.q, QueryMeta{ClientAddr: req.clientAddr, FromUDP: true}, pool.PackBuffer)
+	defer req.done()
+	payload := w.handler.Handle(w.listenerCtx, req.q, req.meta, req.packMsgPayload)
+	pool.ReleaseDNSMsg(req.q)
 	if payload == nil {
 		return
 	}
 	defer pool.ReleaseBuf(payload)
-
-	// Check if this is an IPv4-mapped address on an IPv6-only socket
-	// If oobWriter is nil on an IPv6 socket, it means IPV6_V6ONLY=1 is set
-	localAddr := w.conn.LocalAddr().(*net.UDPAddr)
-	if localAddr.IP.To4() == nil && isIPv4Mapped(req.remoteAddr.Addr()) && req.oobWriter == nil {
-		// IPv4-mapped address on IPv6-only socket - drop silently
-		// This shouldn't happen if IPV6_V6ONLY is set correctly, but handle gracefully
-		w.logger.Debug("dropping IPv4-mapped address on IPv6-only socket", zap.Stringer("client", req.remoteAddr))
-		return
-	}
-
-	var oob []byte
-	if req.oobWriter != nil && req.dstIpFromCm != nil {
-		oob = req.oobWriter(req.dstIpFromCm)
-	}
-	if _, _, err := w.conn.WriteMsgUDPAddrPort(*payload, oob, req.remoteAddr); err != nil {
-		w.logger.Warn("failed to write response", zap.Stringer("client", req.remoteAddr), zap.Error(err))
-	}
+	writeUDPResp(w.conn, *payload, req.remoteAddr, req.dst, req.oobWriter, w.logger)
 }
 
 func (w *udpWorker) submit(req udpRequest) {
@@ -134,16 +124,18 @@ func newUDPWorkerPool(size int, cpuAffinity bool, conn *net.UDPConn, h Handler,
 	return pool
 }
 
-func (p *udpWorkerPool) submit(q *dns.Msg, clientAddr, remoteAddr netip.AddrPort, dstIpFromCm net.IP) {
+func (p *udpWorkerPool) submit(q *dns.Msg, meta QueryMeta, remoteAddr netip.AddrPort, dst netip.AddrPort, packMsgPayload func(m *dns.Msg) (*[]byte, error), done func()) {
 	worker := p.workers[p.nextWorker]
 	p.nextWorker = (p.nextWorker + 1) % len(p.workers)
 
 	req := udpRequest{
-		q:           q,
-		clientAddr:  clientAddr.Addr(),
-		dstIpFromCm: dstIpFromCm,
-		remoteAddr:  remoteAddr,
-		oobWriter:   p.oobWriter,
+		q:              q,
+		meta:           meta,
+		dst:            dst,
+		remoteAddr:     remoteAddr,
+		oobWriter:      p.oobWriter,
+		packMsgPayload: packMsgPayload,
+		done:           done,
 	}
 
 	select {
@@ -165,6 +157,15 @@ func (p *udpWorkerPool) submit(q *dns.Msg, clientAddr, remoteAddr netip.AddrPort
 	}
 }
 
+// queued returns the number of requests queued for each worker.
+func (p *udpWorkerPool) queued() []int {
+	s := make([]int, len(p.workers))
+	for i, w := range p.workers {
+		s[i] = len(w.requestChan)
+	}
+	return s
+}
+
 func (p *udpWorkerPool) stop() {
 	for _, w := range p.workers {
 		w.stop()
@@ -9,6 +9,10 @@ import (
 var (
 	errListenerCtxCanceled   = errors.New("listener ctx canceled")
 	errConnectionCtxCanceled = errors.New("connection ctx canceled")
+
+	// ErrServerDrained is returned by a server that returned because it
+	// was drained.
+	ErrServerDrained = errors.New("server drained")
 )
 
 var (
@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EDEError is an error with an Extended DNS Error (RFC 8914).
+// If the entry returns an error that wraps an *EDEError, the SERVFAIL
+// response carries its InfoCode and ExtraText.
+type EDEError struct {
+	InfoCode  uint16 // One of dns.ExtendedErrorCode*.
+	ExtraText string // Optional. It is sent to the client as is.
+	Err       error
+}
+
+// NewEDEError wraps err with an Extended DNS Error.
+func NewEDEError(infoCode uint16, extraText string, err error) *EDEError {
+	return &EDEError{InfoCode: infoCode, ExtraText: extraText, Err: err}
+}
+
+func (e *EDEError) Error() string {
+	if e.Err == nil {
+		return "ede: " + dns.ExtendedErrorCodeToString[e.InfoCode]
+	}
+	return e.Err.Error()
+}
+
+func (e *EDEError) Unwrap() error {
+	return e.Err
+}
+
+// edeFromErr returns the EDE option for the SERVFAIL response of an entry
+// error. Errors without an *EDEError get a generic code by their type.
+func edeFromErr(err error) *dns.EDNS0_EDE {
+	var edeErr *EDEError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &edeErr):
+		return &dns.EDNS0_EDE{InfoCode: edeErr.InfoCode, ExtraText: edeErr.ExtraText}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority}
+	case errors.As(err, &netErr):
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNetworkError}
+	default:
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther}
+	}
+}
@@ -81,7 +81,8 @@ func NewEntryHandler(opts EntryHandlerOpts) *EntryHandler {
 }
 
 // ServeDNS implements server.Handler.
-// If entry returns an error, a SERVFAIL response will be returned.
+// If entry returns an error, a SERVFAIL response will be returned. If the
+// client supports EDNS0, it carries an Extended DNS Error, see EDEError.
 // If entry returns without a response, a REFUSED response will be returned.
 func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
 	// basic query check.
@@ -104,6 +105,9 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 		resp = new(dns.Msg)
 		resp.SetReply(q)
 		resp.Rcode = dns.RcodeServerFailure
+		if respOpt := qCtx.RespOpt(); respOpt != nil {
+			respOpt.Option = append(respOpt.Option, edeFromErr(err))
+		}
 	} else {
 		resp = qCtx.R()
 	}
@@ -121,10 +125,8 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 		resp.Extra = append(resp.Extra, respOpt)
 	}
 
-	if serverMeta.FromUDP {
-		udpSize := getValidUDPSize(qCtx.ClientOpt())
-		resp.Truncate(udpSize)
-	}
+	// Udp responses are fitted into the negotiated size by packMsgPayload
+	// of the udp server, see server.UDPServerOpts.AdvertisedUDPSize.
 
 	payload, err := packMsgPayload(resp)
 	if err != nil {
@@ -134,18 +136,6 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 	return payload
 }
 
-// opt can be nil.
-func getValidUDPSize(opt *dns.OPT) int {
-	var s uint16
-	if opt != nil {
-		s = opt.UDPSize()
-	}
-	if s < dns.MinMsgSize {
-		s = dns.MinMsgSize
-	}
-	return int(s)
-}
-
 func newOpt() *dns.OPT {
 	opt := new(dns.OPT)
 	opt.Hdr.Name = "."
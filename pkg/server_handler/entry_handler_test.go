@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/query_context"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/server"
+	"github.com/harlanwei/mosdns-lts/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+func TestEntryHandlerEDE(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		edns0    bool
+		wantCode uint16
+		wantText string
+		wantEDE  bool
+	}{
+		{"generic", errors.New("failed"), true, dns.ExtendedErrorCodeOther, "", true},
+		{"timeout", context.DeadlineExceeded, true, dns.ExtendedErrorCodeNoReachableAuthority, "", true},
+		{
+			"ede_error",
+			NewEDEError(dns.ExtendedErrorCodeNetworkError, "all upstreams failed", errors.New("failed")),
+			true, dns.ExtendedErrorCodeNetworkError, "all upstreams failed", true,
+		},
+		{"no_edns0", errors.New("failed"), false, 0, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewEntryHandler(EntryHandlerOpts{
+				Entry: sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+					return tt.err
+				}),
+			})
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if tt.edns0 {
+				q.SetEdns0(1232, false)
+			}
+			payload := h.Handle(context.Background(), q, server.QueryMeta{FromUDP: true}, pool.PackBuffer)
+			if payload == nil {
+				t.Fatal("nil response")
+			}
+			defer pool.ReleaseBuf(payload)
+			resp := new(dns.Msg)
+			if err := resp.Unpack(*payload); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Rcode != dns.RcodeServerFailure {
+				t.Fatalf("want SERVFAIL, got %s", dns.RcodeToString[resp.Rcode])
+			}
+
+			var ede *dns.EDNS0_EDE
+			if opt := resp.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if e, ok := o.(*dns.EDNS0_EDE); ok {
+						ede = e
+					}
+				}
+			}
+			if !tt.wantEDE {
+				if ede != nil {
+					t.Fatalf("unexpected EDE %v", ede)
+				}
+				return
+			}
+			if ede == nil {
+				t.Fatal("EDE option is missing")
+			}
+			if ede.InfoCode != tt.wantCode || ede.ExtraText != tt.wantText {
+				t.Fatalf("want EDE %d %q, got %d %q", tt.wantCode, tt.wantText, ede.InfoCode, ede.ExtraText)
+			}
+		})
+	}
+}
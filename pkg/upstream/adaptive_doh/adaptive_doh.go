@@ -21,6 +21,7 @@ package adaptive_doh
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -28,60 +29,286 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/harlanwei/mosdns-lts/v5/pkg/qos"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/upstream/doh"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
 const (
-	defaultSampleSize      = 20
-	defaultPreferenceRatio = 0.8
-	defaultTrialCount      = 10
+	defaultSampleSize           = 20
+	defaultPreferenceRatio      = 0.8
+	defaultTrialCount           = 10
+	defaultDoH3FastFailAttempts = 3
+	defaultDoH3ReprobeInterval  = time.Minute * 5
+	defaultMaxSampleAge         = time.Minute * 5
+
+	// Candidates that failed at least this often are not preferred.
+	maxFailureRate = 0.5
 )
 
-type protocol string
+// Protocol is the name of a candidate upstream of an Upstream.
+type Protocol string
 
+// The names of the candidates of an Upstream created by NewUpstream.
 const (
-	protocolDoH  protocol = "doh"
-	protocolDoH3 protocol = "doh3"
+	ProtocolDoH  Protocol = "doh"
+	ProtocolDoH3 Protocol = "doh3"
 )
 
+// NamedUpstream is a candidate upstream of an Upstream, see NewNamedUpstream.
+type NamedUpstream struct {
+	Name string
+	U    *doh.Upstream
+}
+
+// SelectReason is the reason why a protocol was selected for a query.
+type SelectReason int
+
+const (
+	// ReasonTrial means the protocol was selected by the strategy during the trial.
+	ReasonTrial SelectReason = iota
+	// ReasonPreferred means the protocol is the preferred one chosen at the end of the trial.
+	ReasonPreferred
+	// ReasonFailover means the protocol became the preferred one because
+	// the previously preferred protocol kept failing.
+	ReasonFailover
+	// ReasonRetry means the selected protocol failed and the query was
+	// retried through this one. See Opt.FailoverOnError.
+	ReasonRetry
+	// ReasonPinned means the protocol was pinned by Upstream.PinProtocol.
+	ReasonPinned
+)
+
+func (r SelectReason) String() string {
+	switch r {
+	case ReasonTrial:
+		return "trial"
+	case ReasonPreferred:
+		return "preferred"
+	case ReasonFailover:
+		return "failover"
+	case ReasonRetry:
+		return "retry"
+	case ReasonPinned:
+		return "pinned"
+	default:
+		return "unknown"
+	}
+}
+
+// ExchangeInfo describes how a query was exchanged.
+type ExchangeInfo struct {
+	Protocol Protocol
+	Reason   SelectReason
+}
+
+// protocolStats holds the counters of one protocol. The counters are
+// atomic so they can be read without locking, but they are only written
+// with mu held, so snapshot can copy them consistently.
 type protocolStats struct {
+	mu sync.Mutex
+
 	totalRequests   atomic.Uint64
 	successRequests atomic.Uint64
 	failedRequests  atomic.Uint64
 	totalLatency    atomic.Int64
 	preferredCount  atomic.Uint64
 	fallbackCount   atomic.Uint64
+
+	// The counters above are reset when a trial restarts. These ones are
+	// not, so they can be exported as prometheus counters, see
+	// RegisterMetrics.
+	lifetime struct {
+		total, success, failed, preferred, fallback atomic.Uint64
+	}
+
+	// The latencies of the last Opt.SampleSize successful requests.
+	window *qos.LatencyWindow
+}
+
+// record records the result of a request.
+func (ps *protocolStats) record(latency time.Duration, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.totalRequests.Add(1)
+	ps.lifetime.total.Add(1)
+	if err != nil {
+		ps.failedRequests.Add(1)
+		ps.lifetime.failed.Add(1)
+		return
+	}
+	ps.successRequests.Add(1)
+	ps.lifetime.success.Add(1)
+	ps.totalLatency.Add(latency.Milliseconds())
+}
+
+// inc increments c and its lifetime counterpart lc, which must be the
+// counters of ps.
+func (ps *protocolStats) inc(c, lc *atomic.Uint64) {
+	ps.mu.Lock()
+	c.Add(1)
+	lc.Add(1)
+	ps.mu.Unlock()
 }
 
 type Upstream struct {
-	doh  *doh.Upstream
-	doh3 *doh.Upstream
+	// The names of the candidates, in the order they were given. The first
+	// one is the baseline, see NewNamedUpstream.
+	names     []Protocol
+	upstreams map[Protocol]*doh.Upstream
 
 	mu         sync.RWMutex
-	current    protocol
-	preferred  protocol
-	stats      map[protocol]*protocolStats
+	current    atomic.Value  // Protocol, the last one selected during the trial.
+	trialSeq   atomic.Uint64 // Number of queries selected during the trial.
+	pinned     atomic.Value  // Protocol, empty if none. See PinProtocol.
+	preferred  Protocol
+	failedOver bool // preferred was switched by recordFailure.
+	stats      map[Protocol]*protocolStats
 	sampleSize int
 	preference float64
 	trialCount int
 	trialDone  atomic.Bool
+	strategy   DecisionStrategy
+	reevaluate bool // Re-evaluate the preference after the trial, see Opt.SampleSize.
 	addr       string
 	logger     *zap.Logger
+
+	// See Opt.DoH3FastFailAttempts.
+	doh3FastFail     int
+	doh3ReprobeIvl   time.Duration
+	doh3ConnFailures atomic.Int32 // consecutive, during the trial.
+	doh3Reprobing    atomic.Bool
+	closeOnce        sync.Once
+	closeNotify      chan struct{}
+	bg               sync.WaitGroup // Background goroutines that Close waits for.
+
+	failoverOnError bool
+
+	// See Opt.SwitchMargin and Opt.SwitchCooldown.
+	switchMargin   float64
+	switchCooldown time.Duration
+	lastSwitch     time.Time // guarded by mu, zero if never switched after the trial.
+
+	// See Opt.QuiesceNonPreferred.
+	quiesce  bool
+	quiesced map[Protocol]bool // guarded by mu.
+
+	// Windows of other candidates with older samples are not compared
+	// after the trial, see Opt.SampleSize.
+	maxSampleAge time.Duration
+
+	// See RegisterMetrics.
+	metricsOnce sync.Once
+	metrics     []prometheus.Collector
 }
 
 type Opt struct {
+	// SampleSize is the number of recent latencies of each protocol that
+	// the built-in strategy compares, by their p90, at the end of and
+	// after the trial. The preferred protocol is switched once its recent
+	// latencies show it is no longer the faster one. Smaller windows react
+	// faster to latency shifts. The windows of other candidates are only
+	// compared if their newest sample is more recent than
+	// ReevaluationInterval (5 minutes if unset), since they get no queries
+	// after the trial except retries. Default is 20.
 	SampleSize int
 	Preference float64
 	TrialCount int
 	Addr       string
 	Logger     *zap.Logger
+
+	// Strategy decides the protocol during and after the trial.
+	// Nil uses the built-in strategy, which is driven by TrialCount and Preference.
+	Strategy DecisionStrategy
+
+	// WarmupBeforeTrial makes NewUpstream send a probe query through all
+	// candidates before the trial, so the trial samples reflect steady-state
+	// latency instead of the connection handshakes. This makes the DoH3-vs-DoH
+	// comparison fairer, since DoH3 always pays a QUIC handshake on its first
+	// query. NewUpstream blocks for up to WarmupTimeout (default 5s).
+	WarmupBeforeTrial bool
+	WarmupTimeout     time.Duration
+
+	// DoH3FastFailAttempts ends the trial early if the first
+	// DoH3FastFailAttempts DoH3 queries of the trial all fail with
+	// connection level errors, e.g. because UDP is blocked. DoH becomes
+	// the preferred protocol without wasting the rest of the trial.
+	// DoH3 is then probed every DoH3ReprobeInterval (default 5m) in
+	// background. Once a probe succeeds, the trial restarts.
+	// It applies to the candidate named ProtocolDoH3, if any. The first
+	// other candidate becomes the preferred one.
+	// Default is 3. Negative value disables it.
+	DoH3FastFailAttempts int
+	DoH3ReprobeInterval  time.Duration
+
+	// FailoverOnError retries a query through another candidate if the
+	// selected one failed with a connection level error, as long as the
+	// query's ctx is not done. The candidate with the best success rate is
+	// tried. Both attempts are recorded in the stats.
+	FailoverOnError bool
+
+	// QuiesceNonPreferred closes the idle connections of the non-preferred
+	// candidates once the trial is done, so an upstream does not keep idle
+	// connections of all of them. If another candidate becomes the
+	// preferred one later, it is re-warmed with a probe query in background.
+	// Queries that arrive before the probe finishes, as well as retries
+	// through a non-preferred candidate (see FailoverOnError), pay a new
+	// TCP+TLS or QUIC handshake. Use it if idle connections cost more than
+	// the occasional extra handshake latency.
+	QuiesceNonPreferred bool
+
+	// ReevaluationInterval, if set, restarts the trial periodically after
+	// it was done, so the preferred protocol follows network conditions
+	// that change over time. The counters of all candidates are cleared
+	// and the candidates are compared again for a full trial.
+	ReevaluationInterval time.Duration
+
+	// SwitchMargin and SwitchCooldown add hysteresis to the switches of the
+	// preferred protocol after the trial, so it does not flap under flaky
+	// conditions. A switch due to failures only happens if the success
+	// rate of another candidate exceeds the current one by at least
+	// SwitchMargin, e.g. 0.1. After a switch, no further switch happens
+	// within SwitchCooldown. Zero values disable them.
+	SwitchMargin   float64
+	SwitchCooldown time.Duration
 }
 
+// NewUpstream returns an Upstream that picks between a DoH and a DoH3
+// upstream, named ProtocolDoH and ProtocolDoH3. DoH is the baseline.
 func NewUpstream(dohUpstream, doh3Upstream *doh.Upstream, opt Opt) (*Upstream, error) {
 	if dohUpstream == nil || doh3Upstream == nil {
 		return nil, io.ErrClosedPipe
 	}
+	return NewNamedUpstream([]NamedUpstream{
+		{Name: string(ProtocolDoH), U: dohUpstream},
+		{Name: string(ProtocolDoH3), U: doh3Upstream},
+	}, opt)
+}
+
+// NewNamedUpstream returns an Upstream that picks among at least two
+// candidates. Names must be unique. The first candidate is the baseline:
+// it is preferred at first, and the built-in strategy only prefers another
+// candidate if it is faster by Opt.Preference.
+func NewNamedUpstream(us []NamedUpstream, opt Opt) (*Upstream, error) {
+	if len(us) < 2 {
+		return nil, errors.New("at least two candidates are required")
+	}
+	names := make([]Protocol, 0, len(us))
+	upstreams := make(map[Protocol]*doh.Upstream, len(us))
+	for i, c := range us {
+		name := Protocol(c.Name)
+		switch {
+		case len(name) == 0:
+			return nil, fmt.Errorf("candidate #%d has no name", i)
+		case c.U == nil:
+			return nil, fmt.Errorf("candidate %s has no upstream", name)
+		case upstreams[name] != nil:
+			return nil, fmt.Errorf("duplicated candidate name %s", name)
+		}
+		names = append(names, name)
+		upstreams[name] = c.U
+	}
 
 	if opt.SampleSize <= 0 {
 		opt.SampleSize = defaultSampleSize
@@ -92,148 +319,308 @@ func NewUpstream(dohUpstream, doh3Upstream *doh.Upstream, opt Opt) (*Upstream, e
 	if opt.TrialCount <= 0 {
 		opt.TrialCount = defaultTrialCount
 	}
+	if opt.DoH3FastFailAttempts == 0 {
+		opt.DoH3FastFailAttempts = defaultDoH3FastFailAttempts
+	}
+	if opt.DoH3ReprobeInterval <= 0 {
+		opt.DoH3ReprobeInterval = defaultDoH3ReprobeInterval
+	}
 	if opt.Logger == nil {
 		opt.Logger = zap.NewNop()
 	}
+	logger := opt.Logger.With(zap.String("upstream", opt.Addr))
+	reevaluate := opt.Strategy == nil
+	maxSampleAge := opt.ReevaluationInterval
+	if maxSampleAge <= 0 {
+		maxSampleAge = defaultMaxSampleAge
+	}
+	if opt.Strategy == nil {
+		opt.Strategy = &defaultStrategy{
+			candidates: names,
+			trialCount: opt.TrialCount,
+			preference: opt.Preference,
+			logger:     logger,
+		}
+	}
 
-	return &Upstream{
-		doh:       dohUpstream,
-		doh3:      doh3Upstream,
-		current:   protocolDoH,
-		preferred: protocolDoH,
-		stats: map[protocol]*protocolStats{
-			protocolDoH:  {},
-			protocolDoH3: {},
-		},
+	u := &Upstream{
+		names:      names,
+		upstreams:  upstreams,
+		preferred:  names[0],
+		stats:      make(map[Protocol]*protocolStats, len(names)),
 		sampleSize: opt.SampleSize,
 		preference: opt.Preference,
 		trialCount: opt.TrialCount,
+		strategy:   opt.Strategy,
+		reevaluate: reevaluate,
 		addr:       opt.Addr,
-		logger:     opt.Logger.With(zap.String("upstream", opt.Addr)),
-	}, nil
+		logger:     logger,
+
+		doh3FastFail:   opt.DoH3FastFailAttempts,
+		doh3ReprobeIvl: opt.DoH3ReprobeInterval,
+		closeNotify:    make(chan struct{}),
+
+		failoverOnError: opt.FailoverOnError,
+		quiesce:         opt.QuiesceNonPreferred,
+		quiesced:        make(map[Protocol]bool),
+		switchMargin:    opt.SwitchMargin,
+		switchCooldown:  opt.SwitchCooldown,
+		maxSampleAge:    maxSampleAge,
+	}
+	for _, name := range names {
+		u.stats[name] = &protocolStats{window: qos.NewLatencyWindow(opt.SampleSize)}
+	}
+	u.current.Store(names[0])
+	u.pinned.Store(Protocol(""))
+
+	if opt.WarmupBeforeTrial {
+		if opt.WarmupTimeout <= 0 {
+			opt.WarmupTimeout = defaultWarmupTimeout
+		}
+		u.warmup(opt.WarmupTimeout)
+	}
+	if opt.ReevaluationInterval > 0 {
+		u.bg.Add(1)
+		go u.reevaluatePeriodically(opt.ReevaluationInterval)
+	}
+	return u, nil
 }
 
 func (u *Upstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
-	selectedProtocol := u.selectProtocol()
+	r, _, err := u.ExchangeContextWithInfo(ctx, q)
+	return r, err
+}
 
-	u.logger.Debug("using protocol for query",
-		zap.String("protocol", string(selectedProtocol)),
-		zap.String("preferred", string(u.preferred)),
-	)
+// ExchangeContextWithInfo is like ExchangeContext but also returns the
+// protocol that was used and why it was selected. info is valid even if
+// err is not nil.
+func (u *Upstream) ExchangeContextWithInfo(ctx context.Context, q []byte) (_ *[]byte, info ExchangeInfo, _ error) {
+	selectedProtocol, reason := u.selectProtocol()
+	info = ExchangeInfo{Protocol: selectedProtocol, Reason: reason}
+
+	u.logSelected(selectedProtocol, reason)
+
+	r, err := u.exchange(ctx, selectedProtocol, q, false)
+	if err != nil && reason != ReasonPinned && u.failoverOnError && isConnErr(err) && ctx.Err() == nil {
+		other, _ := u.bestOther(selectedProtocol)
+		info = ExchangeInfo{Protocol: other, Reason: ReasonRetry}
+		if ce := u.logger.Check(zap.DebugLevel, "retrying query with another protocol"); ce != nil {
+			ce.Write(zap.String("protocol", string(other)))
+		}
+		r, err = u.exchange(ctx, other, q, true)
+	}
+	return r, info, err
+}
 
+// exchange sends q through protocol p and records the result in stats.
+// retry indicates q was already tried through another protocol, in which
+// case the result does not count as a preferred or fallback query.
+func (u *Upstream) exchange(ctx context.Context, p Protocol, q []byte, retry bool) (*[]byte, error) {
 	var r *[]byte
 	var err error
 	var latency time.Duration
 
 	start := time.Now()
-	if selectedProtocol == protocolDoH {
-		r, err = u.doh.ExchangeContext(ctx, q)
-	} else {
-		r, err = u.doh3.ExchangeContext(ctx, q)
-	}
+	r, err = u.upstreams[p].ExchangeContext(ctx, q)
 	latency = time.Since(start)
 
-	u.stats[selectedProtocol].totalRequests.Add(1)
+	// Pinned queries are only recorded, see PinProtocol.
+	_, pinned := u.IsPinned()
+	u.stats[p].record(latency, err)
 
 	if err != nil {
-		u.stats[selectedProtocol].failedRequests.Add(1)
 		u.logger.Warn("query failed",
-			zap.String("protocol", string(selectedProtocol)),
+			zap.String("protocol", string(p)),
 			zap.Duration("latency", latency),
 			zap.Error(err),
 		)
-		u.recordFailure(selectedProtocol)
+		if pinned {
+			return nil, err
+		}
+		u.recordFailure(p)
+		if p == ProtocolDoH3 && isConnErr(err) {
+			u.recordDoH3ConnFailure()
+		}
 		return nil, err
 	}
 
-	u.stats[selectedProtocol].successRequests.Add(1)
-	u.stats[selectedProtocol].totalLatency.Add(int64(latency.Milliseconds()))
+	if p == ProtocolDoH3 {
+		u.doh3ConnFailures.Store(0)
+	}
+	u.stats[p].window.Record(latency)
 
-	u.logger.Debug("query succeeded",
-		zap.String("protocol", string(selectedProtocol)),
-		zap.Duration("latency", latency),
-	)
+	u.logSucceeded(p, latency)
 
-	if !u.trialDone.Load() {
+	switch {
+	case pinned:
+		// Neither the trial nor the preference is evaluated.
+	case !u.trialDone.Load():
 		u.evaluatePreference()
-	} else if selectedProtocol == u.preferred {
-		u.stats[selectedProtocol].preferredCount.Add(1)
-	} else {
-		u.stats[selectedProtocol].fallbackCount.Add(1)
-		u.logger.Debug("using fallback protocol",
-			zap.String("fallback", string(selectedProtocol)),
-			zap.String("preferred", string(u.preferred)),
-		)
+	case retry:
+		// p was not selected, this is neither a preferred nor a fallback query.
+	case p == u.GetPreferredProtocol():
+		u.stats[p].inc(&u.stats[p].preferredCount, &u.stats[p].lifetime.preferred)
+		if u.reevaluate {
+			u.reevaluatePreferred(p)
+		}
+	default:
+		u.stats[p].inc(&u.stats[p].fallbackCount, &u.stats[p].lifetime.fallback)
+		if ce := u.logger.Check(zap.DebugLevel, "using fallback protocol"); ce != nil {
+			ce.Write(
+				zap.String("fallback", string(p)),
+				zap.String("preferred", string(u.GetPreferredProtocol())),
+			)
+		}
 	}
 
 	return r, nil
 }
 
-func (u *Upstream) selectProtocol() protocol {
+// logSelected and logSucceeded log per-query debug messages. They run on
+// every query, so fields are only built if debug logging is enabled.
+func (u *Upstream) logSelected(p Protocol, reason SelectReason) {
+	if ce := u.logger.Check(zap.DebugLevel, "using protocol for query"); ce != nil {
+		ce.Write(zap.String("protocol", string(p)), zap.Stringer("reason", reason))
+	}
+}
+
+func (u *Upstream) logSucceeded(p Protocol, latency time.Duration) {
+	if ce := u.logger.Check(zap.DebugLevel, "query succeeded"); ce != nil {
+		ce.Write(zap.String("protocol", string(p)), zap.Duration("latency", latency))
+	}
+}
+
+func (u *Upstream) selectProtocol() (Protocol, SelectReason) {
+	if p, ok := u.IsPinned(); ok {
+		return p, ReasonPinned
+	}
+
 	u.mu.RLock()
 	defer u.mu.RUnlock()
 
 	if !u.trialDone.Load() {
-		if u.current == protocolDoH {
-			u.current = protocolDoH3
-		} else {
-			u.current = protocolDoH
-		}
-		return u.current
+		// Selections only hold the read lock and run concurrently. The
+		// sequence number, not the last selected protocol, tells each
+		// query its turn.
+		s := u.decisionStats()
+		s.TrialSeq = u.trialSeq.Add(1) - 1
+		p := u.strategy.SelectDuringTrial(s)
+		u.current.Store(p)
+		return p, ReasonTrial
 	}
 
-	stats := u.stats[u.preferred]
-	totalRequests := stats.totalRequests.Load()
-	if totalRequests == 0 {
-		return u.preferred
+	// The preferred protocol follows the windowed latencies, see
+	// reevaluatePreferred, and failures, see recordFailure.
+	reason := ReasonPreferred
+	if u.failedOver {
+		reason = ReasonFailover
 	}
+	return u.preferred, reason
+}
 
-	doHStats := u.stats[protocolDoH]
-	doH3Stats := u.stats[protocolDoH3]
-
-	doH3Available := doH3Stats.totalRequests.Load() > 0 &&
-		float64(doH3Stats.failedRequests.Load())/float64(doH3Stats.totalRequests.Load()) < 0.5
+func (u *Upstream) recordFailure(p Protocol) {
+	if p != u.GetPreferredProtocol() {
+		return
+	}
+	other, otherStats := u.bestOther(p)
+	if otherStats.TotalRequests == 0 {
+		return
+	}
+	currentStats := u.stats[p].snapshot()
+	otherSuccessRate := successRate(otherStats)
+	currentSuccessRate := successRate(currentStats)
+	if ce := u.logger.Check(zap.DebugLevel, "comparing protocol success rates"); ce != nil {
+		ce.Write(
+			zap.String("protocol", string(p)),
+			zap.Float64("current_success_rate", currentSuccessRate),
+			zap.String("other_protocol", string(other)),
+			zap.Float64("other_success_rate", otherSuccessRate),
+		)
+	}
+	if otherSuccessRate <= currentSuccessRate {
+		return
+	}
+	if otherSuccessRate < currentSuccessRate+u.switchMargin {
+		u.logSwitchSuppressed(p, other, "margin")
+		return
+	}
+	u.mu.Lock()
+	if u.preferred != p {
+		u.mu.Unlock()
+		return
+	}
+	if !u.switchAllowed() {
+		u.mu.Unlock()
+		u.logSwitchSuppressed(p, other, "cooldown")
+		return
+	}
+	u.preferred = other
+	u.failedOver = true
+	u.lastSwitch = time.Now()
+	u.quiesceOthers(other)
+	u.mu.Unlock()
+	u.logger.Warn("switching preferred protocol due to failures",
+		zap.String("from", string(p)),
+		zap.String("to", string(other)),
+		zap.Float64("old_success_rate", currentSuccessRate),
+		zap.Float64("new_success_rate", otherSuccessRate),
+		zap.Uint64("old_failed", currentStats.FailedRequests),
+		zap.Uint64("old_total", currentStats.TotalRequests),
+		zap.Uint64("new_failed", otherStats.FailedRequests),
+		zap.Uint64("new_total", otherStats.TotalRequests),
+	)
+}
 
-	if u.preferred == protocolDoH3 && doH3Available {
-		doH3FasterCount := doH3Stats.preferredCount.Load()
-		doHFallbackCount := doHStats.fallbackCount.Load()
-		total := doH3FasterCount + doHFallbackCount
-		if total > 0 && float64(doH3FasterCount)/float64(total) >= u.preference {
-			return protocolDoH3
+// bestOther returns the candidate other than p with the highest success
+// rate, and its stats. Ties are broken by the p90 of the latency windows.
+// Candidates without requests rank last, in their configured order.
+func (u *Upstream) bestOther(p Protocol) (Protocol, ProtocolStats) {
+	var best Protocol
+	var bestStats ProtocolStats
+	for _, c := range u.names {
+		if c == p {
+			continue
+		}
+		s := u.stats[c].snapshot()
+		if len(best) == 0 || ranksBefore(s, bestStats) {
+			best, bestStats = c, s
 		}
 	}
+	return best, bestStats
+}
 
-	return u.preferred
+// ranksBefore reports whether a candidate with stats a ranks before one
+// with stats b, see bestOther.
+func ranksBefore(a, b ProtocolStats) bool {
+	if (a.TotalRequests > 0) != (b.TotalRequests > 0) {
+		return a.TotalRequests > 0
+	}
+	if ra, rb := successRate(a), successRate(b); ra != rb {
+		return ra > rb
+	}
+	return a.P90Latency < b.P90Latency
 }
 
-func (u *Upstream) recordFailure(p protocol) {
-	if p == u.preferred {
-		stats := u.stats[getOtherProtocol(p)]
-		if stats.totalRequests.Load() > 0 {
-			otherSuccessRate := float64(stats.successRequests.Load()) / float64(stats.totalRequests.Load())
-			currentSuccessRate := float64(u.stats[p].successRequests.Load()) / float64(u.stats[p].totalRequests.Load())
-			u.logger.Debug("comparing protocol success rates",
-				zap.String("protocol", string(p)),
-				zap.Float64("current_success_rate", currentSuccessRate),
-				zap.String("other_protocol", string(getOtherProtocol(p))),
-				zap.Float64("other_success_rate", otherSuccessRate),
-			)
-			if otherSuccessRate > currentSuccessRate {
-				u.mu.Lock()
-				u.preferred = getOtherProtocol(p)
-				u.mu.Unlock()
-				u.logger.Warn("switching preferred protocol due to failures",
-					zap.String("from", string(p)),
-					zap.String("to", string(u.preferred)),
-					zap.Float64("old_success_rate", currentSuccessRate),
-					zap.Float64("new_success_rate", otherSuccessRate),
-					zap.Uint64("old_failed", u.stats[p].failedRequests.Load()),
-					zap.Uint64("old_total", u.stats[p].totalRequests.Load()),
-					zap.Uint64("new_failed", stats.failedRequests.Load()),
-					zap.Uint64("new_total", stats.totalRequests.Load()),
-				)
-			}
-		}
+func successRate(s ProtocolStats) float64 {
+	if s.TotalRequests == 0 {
+		return 0
+	}
+	return float64(s.SuccessRequests) / float64(s.TotalRequests)
+}
+
+// switchAllowed reports whether the preferred protocol is out of its
+// Opt.SwitchCooldown. It must be called with u.mu held.
+func (u *Upstream) switchAllowed() bool {
+	return u.switchCooldown <= 0 || u.lastSwitch.IsZero() || time.Since(u.lastSwitch) >= u.switchCooldown
+}
+
+func (u *Upstream) logSwitchSuppressed(p, other Protocol, reason string) {
+	if ce := u.logger.Check(zap.DebugLevel, "switch of preferred protocol suppressed"); ce != nil {
+		ce.Write(
+			zap.String("protocol", string(p)),
+			zap.String("other_protocol", string(other)),
+			zap.String("reason", reason),
+		)
 	}
 }
 
@@ -241,91 +628,122 @@ func (u *Upstream) evaluatePreference() {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
-	doHStats := u.stats[protocolDoH]
-	doH3Stats := u.stats[protocolDoH3]
-
-	totalSamples := doHStats.totalRequests.Load() + doH3Stats.totalRequests.Load()
-	if totalSamples < uint64(u.trialCount) {
+	stats := u.decisionStats()
+	if !u.strategy.ShouldFinishTrial(stats) {
 		return
 	}
 
 	u.trialDone.Store(true)
+	u.preferred = u.strategy.ChoosePreferred(stats)
+	u.failedOver = false
+	u.quiesceOthers(u.preferred)
+}
 
-	if doH3Stats.totalRequests.Load() == 0 {
-		u.preferred = protocolDoH
-		u.logger.Info("DoH3 not available, using DoH")
+// reevaluatePreferred compares the p90 latency of the window of the
+// preferred protocol p with the fastest other candidate after the trial,
+// and switches to it if p is no longer faster. The baseline is preferred
+// again as soon as it is as fast as p. Other candidates are only preferred
+// if they are faster by the preference ratio, like in the trial.
+func (u *Upstream) reevaluatePreferred(p Protocol) {
+	other, otherLatency := u.fastestOther(p)
+	if len(other) == 0 {
 		return
 	}
+	pLatency := u.stats[p].window.Percentile(latencyPercentile)
 
-	doH3FailureRate := float64(doH3Stats.failedRequests.Load()) / float64(doH3Stats.totalRequests.Load())
-	if doH3FailureRate >= 0.5 {
-		u.preferred = protocolDoH
-		u.logger.Info("DoH3 failure rate too high, using DoH",
-			zap.Float64("failure_rate", doH3FailureRate),
-			zap.Uint64("doh3_failed", doH3Stats.failedRequests.Load()),
-			zap.Uint64("doh3_total", doH3Stats.totalRequests.Load()),
-		)
+	var switchPreferred bool
+	if other == u.names[0] {
+		switchPreferred = otherLatency <= pLatency
+	} else {
+		switchPreferred = float64(otherLatency) < float64(pLatency)*u.preference
+	}
+	if !switchPreferred {
 		return
 	}
 
-	if doHStats.totalRequests.Load() == 0 {
-		u.preferred = protocolDoH3
-		u.logger.Info("only DoH3 available")
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.preferred != p || !u.trialDone.Load() {
 		return
 	}
-
-	doHAvgLatency := float64(doHStats.totalLatency.Load()) / float64(doHStats.successRequests.Load())
-	doH3AvgLatency := float64(doH3Stats.totalLatency.Load()) / float64(doH3Stats.successRequests.Load())
-
-	u.logger.Info("protocol evaluation",
-		zap.Float64("doh_latency", doHAvgLatency),
-		zap.Uint64("doh_success", doHStats.successRequests.Load()),
-		zap.Uint64("doh_failed", doHStats.failedRequests.Load()),
-		zap.Float64("doh3_latency", doH3AvgLatency),
-		zap.Uint64("doh3_success", doH3Stats.successRequests.Load()),
-		zap.Uint64("doh3_failed", doH3Stats.failedRequests.Load()),
-		zap.Float64("preference_threshold", u.preference),
-	)
-
-	if doH3AvgLatency < doHAvgLatency*u.preference {
-		u.preferred = protocolDoH3
-		u.logger.Info("switched preferred protocol to DoH3 (faster)",
-			zap.Float64("doh_latency", doHAvgLatency),
-			zap.Float64("doh3_latency", doH3AvgLatency),
-			zap.Float64("improvement", (doHAvgLatency-doH3AvgLatency)/doHAvgLatency*100),
-		)
-	} else {
-		u.preferred = protocolDoH
-		u.logger.Info("kept preferred protocol as DoH",
-			zap.Float64("doh_latency", doHAvgLatency),
-			zap.Float64("doh3_latency", doH3AvgLatency),
-			zap.String("reason", "DoH3 not sufficiently faster"),
-		)
+	if !u.switchAllowed() {
+		u.logSwitchSuppressed(p, other, "cooldown")
+		return
 	}
+	u.preferred = other
+	u.failedOver = false
+	u.lastSwitch = time.Now()
+	u.quiesceOthers(other)
+	u.logger.Info("switching preferred protocol due to latency",
+		zap.String("from", string(p)),
+		zap.String("to", string(other)),
+		zap.Duration("old_latency", pLatency),
+		zap.Duration("new_latency", otherLatency),
+	)
 }
 
-func getOtherProtocol(p protocol) protocol {
-	if p == protocolDoH {
-		return protocolDoH3
+// fastestOther returns the candidate other than p with the lowest p90
+// latency of its window, and the latency. Candidates without recent
+// samples, see Opt.SampleSize, or that failed too often are skipped. It
+// returns an empty Protocol if there is no such candidate.
+func (u *Upstream) fastestOther(p Protocol) (Protocol, time.Duration) {
+	var fastest Protocol
+	var fastestLatency time.Duration
+	for _, c := range u.names {
+		if c == p || u.stats[c].window.Len() == 0 {
+			continue
+		}
+		if time.Since(u.stats[c].window.LastRecord()) > u.maxSampleAge {
+			continue // Stale, e.g. it was quiesced since the trial.
+		}
+		if s := u.stats[c].snapshot(); s.TotalRequests > 0 && 1-successRate(s) >= maxFailureRate {
+			continue
+		}
+		if l := u.stats[c].window.Percentile(latencyPercentile); len(fastest) == 0 || l < fastestLatency {
+			fastest, fastestLatency = c, l
+		}
 	}
-	return protocolDoH
+	return fastest, fastestLatency
 }
 
 func (u *Upstream) Close() error {
+	u.closeOnce.Do(func() {
+		// Under u.mu, so no background goroutine is added to u.bg
+		// after it was closed, see closed.
+		u.mu.Lock()
+		close(u.closeNotify)
+		u.mu.Unlock()
+	})
+	u.bg.Wait()
 	return nil
 }
 
-func (u *Upstream) GetStats() map[protocol]*protocolStats {
+// closed reports whether u was closed. Background goroutines must only be
+// added to u.bg if it reports false with u.mu held.
+func (u *Upstream) closed() bool {
+	select {
+	case <-u.closeNotify:
+		return true
+	default:
+		return false
+	}
+}
+
+// GetStats returns the live counters of u. They keep changing while
+// queries are in flight, so reading several of them does not give a
+// consistent view. Use Snapshot for a point-in-time copy.
+func (u *Upstream) GetStats() map[Protocol]*protocolStats {
 	return u.stats
 }
 
-func (u *Upstream) GetCurrentProtocol() protocol {
+func (u *Upstream) GetCurrentProtocol() Protocol {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
-	return u.current
+	return u.current.Load().(Protocol)
 }
 
-func (u *Upstream) GetPreferredProtocol() protocol {
+// GetPreferredProtocol returns the name of the preferred candidate.
+func (u *Upstream) GetPreferredProtocol() Protocol {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
 	return u.preferred
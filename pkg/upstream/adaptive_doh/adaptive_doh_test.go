@@ -21,15 +21,22 @@ package adaptive_doh
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/harlanwei/mosdns-lts/v5/pkg/upstream/doh"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func TestAdaptiveDoH(t *testing.T) {
@@ -84,13 +91,13 @@ func TestAdaptiveDoH(t *testing.T) {
 
 	stats := adaptive.GetStats()
 	t.Logf("DoH stats: total=%d, success=%d, failed=%d",
-		stats[protocolDoH].totalRequests.Load(),
-		stats[protocolDoH].successRequests.Load(),
-		stats[protocolDoH].failedRequests.Load())
+		stats[ProtocolDoH].totalRequests.Load(),
+		stats[ProtocolDoH].successRequests.Load(),
+		stats[ProtocolDoH].failedRequests.Load())
 	t.Logf("DoH3 stats: total=%d, success=%d, failed=%d",
-		stats[protocolDoH3].totalRequests.Load(),
-		stats[protocolDoH3].successRequests.Load(),
-		stats[protocolDoH3].failedRequests.Load())
+		stats[ProtocolDoH3].totalRequests.Load(),
+		stats[ProtocolDoH3].successRequests.Load(),
+		stats[ProtocolDoH3].failedRequests.Load())
 	t.Logf("Preferred protocol: %s", adaptive.GetPreferredProtocol())
 	t.Logf("Current protocol: %s", adaptive.GetCurrentProtocol())
 }
@@ -142,16 +149,225 @@ func TestAdaptiveDoHProtocolSwitch(t *testing.T) {
 
 	stats := adaptive.GetStats()
 	t.Logf("Slow protocol stats: total=%d, success=%d, latency=%d",
-		stats[protocolDoH].totalRequests.Load(),
-		stats[protocolDoH].successRequests.Load(),
-		stats[protocolDoH].totalLatency.Load())
+		stats[ProtocolDoH].totalRequests.Load(),
+		stats[ProtocolDoH].successRequests.Load(),
+		stats[ProtocolDoH].totalLatency.Load())
 	t.Logf("Fast protocol stats: total=%d, success=%d, latency=%d",
-		stats[protocolDoH3].totalRequests.Load(),
-		stats[protocolDoH3].successRequests.Load(),
-		stats[protocolDoH3].totalLatency.Load())
+		stats[ProtocolDoH3].totalRequests.Load(),
+		stats[ProtocolDoH3].successRequests.Load(),
+		stats[ProtocolDoH3].totalLatency.Load())
 	t.Logf("Preferred protocol: %s", adaptive.GetPreferredProtocol())
 }
 
+type fixedStrategy struct {
+	trial      Protocol
+	trialCount uint64
+	preferred  Protocol
+}
+
+func (f *fixedStrategy) SelectDuringTrial(_ DecisionStats) Protocol {
+	return f.trial
+}
+
+func (f *fixedStrategy) ShouldFinishTrial(s DecisionStats) bool {
+	return s.Protocols[f.trial].TotalRequests >= f.trialCount
+}
+
+func (f *fixedStrategy) ChoosePreferred(_ DecisionStats) Protocol {
+	return f.preferred
+}
+
+func TestAdaptiveDoHCustomStrategy(t *testing.T) {
+	doHServer := createTestServer(t, false)
+	doH3Server := createTestServer(t, true)
+	defer doHServer.Close()
+	defer doH3Server.Close()
+
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, doHServer.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doH3Server.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{
+		Logger:   zap.NewNop(),
+		Strategy: &fixedStrategy{trial: ProtocolDoH3, trialCount: 3, preferred: ProtocolDoH3},
+	})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	defer adaptive.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := adaptive.ExchangeContext(context.Background(), q); err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+	}
+
+	stats := adaptive.GetStats()
+	if n := stats[ProtocolDoH].totalRequests.Load(); n != 0 {
+		t.Errorf("expected no DoH queries, got %d", n)
+	}
+	if n := stats[ProtocolDoH3].totalRequests.Load(); n != 5 {
+		t.Errorf("expected 5 DoH3 queries, got %d", n)
+	}
+	if p := adaptive.GetPreferredProtocol(); p != ProtocolDoH3 {
+		t.Errorf("expected preferred protocol %s, got %s", ProtocolDoH3, p)
+	}
+}
+
+func TestAdaptiveDoHExchangeInfo(t *testing.T) {
+	var dohFail atomic.Bool
+	ok := createTestServer(t, false)
+	defer ok.Close()
+	doHServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dohFail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		ok.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer doHServer.Close()
+	doH3Server := createTestServer(t, true)
+	defer doH3Server.Close()
+
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, doHServer.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doH3Server.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{
+		Logger:   zap.NewNop(),
+		Strategy: &fixedStrategy{trial: ProtocolDoH3, trialCount: 2, preferred: ProtocolDoH},
+	})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	defer adaptive.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+
+	for i, want := range []ExchangeInfo{
+		{ProtocolDoH3, ReasonTrial},
+		{ProtocolDoH3, ReasonTrial},
+		{ProtocolDoH, ReasonPreferred},
+	} {
+		_, info, err := adaptive.ExchangeContextWithInfo(context.Background(), q)
+		if err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+		if info != want {
+			t.Fatalf("query %d: want %+v, got %+v", i, want, info)
+		}
+	}
+
+	// The preferred DoH starts failing, DoH3 takes over.
+	dohFail.Store(true)
+	_, info, err := adaptive.ExchangeContextWithInfo(context.Background(), q)
+	if err == nil {
+		t.Fatal("expected DoH query to fail")
+	}
+	if want := (ExchangeInfo{ProtocolDoH, ReasonPreferred}); info != want {
+		t.Fatalf("want %+v, got %+v", want, info)
+	}
+	_, info, err = adaptive.ExchangeContextWithInfo(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ExchangeInfo{ProtocolDoH3, ReasonFailover}); info != want {
+		t.Fatalf("want %+v, got %+v", want, info)
+	}
+}
+
+func TestAdaptiveDoHWarmup(t *testing.T) {
+	var hits [2]atomic.Int32
+	servers := make([]*httptest.Server, 2)
+	ups := make([]*doh.Upstream, 2)
+	for i := range servers {
+		base := createTestServer(t, i == 1)
+		defer base.Close()
+		h := base.Config.Handler
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+			h.ServeHTTP(w, r)
+		}))
+		defer servers[i].Close()
+		u, err := doh.NewUpstream(servers[i].URL, servers[i].Client().Transport, zap.NewNop())
+		if err != nil {
+			t.Fatalf("failed to create upstream: %v", err)
+		}
+		ups[i] = u
+	}
+
+	adaptive, err := NewUpstream(ups[0], ups[1], Opt{
+		Logger:            zap.NewNop(),
+		WarmupBeforeTrial: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	defer adaptive.Close()
+
+	for i := range hits {
+		if n := hits[i].Load(); n != 1 {
+			t.Errorf("expected 1 warmup query on server %d, got %d", i, n)
+		}
+	}
+	for p, s := range adaptive.GetStats() {
+		if n := s.totalRequests.Load(); n != 0 {
+			t.Errorf("warmup should not be recorded, %s has %d requests", p, n)
+		}
+	}
+}
+
+func TestAdaptiveDoHWarmupTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hang.Close()
+	defer close(release)
+
+	dohUpstream, err := doh.NewUpstream(hang.URL, hang.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(hang.URL, hang.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+
+	start := time.Now()
+	_, err = NewUpstream(dohUpstream, doh3Upstream, Opt{
+		Logger:            zap.NewNop(),
+		WarmupBeforeTrial: true,
+		WarmupTimeout:     time.Millisecond * 100,
+	})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("warmup did not respect its timeout, took %s", elapsed)
+	}
+}
+
 func createTestServer(t *testing.T, doh3 bool) *httptest.Server {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -237,3 +453,934 @@ func createDelayedServer(t *testing.T, delay time.Duration, doh3 bool) *httptest
 
 	return httptest.NewServer(handler)
 }
+
+// blockableTransport fails all requests with a dial error while blocked.
+type blockableTransport struct {
+	blocked atomic.Bool
+	next    http.RoundTripper
+}
+
+func (b *blockableTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if b.blocked.Load() {
+		return nil, &net.OpError{Op: "dial", Net: "udp", Err: errors.New("network is unreachable")}
+	}
+	return b.next.RoundTrip(r)
+}
+
+func TestAdaptiveDoHFastFail(t *testing.T) {
+	doHServer := createTestServer(t, false)
+	doH3Server := createTestServer(t, true)
+	defer doHServer.Close()
+	defer doH3Server.Close()
+
+	doh3Transport := &blockableTransport{next: doH3Server.Client().Transport}
+	doh3Transport.blocked.Store(true)
+
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, doHServer.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doh3Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{
+		Logger:               zap.NewNop(),
+		TrialCount:           100,
+		DoH3FastFailAttempts: 2,
+		DoH3ReprobeInterval:  time.Millisecond * 20,
+	})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	defer adaptive.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+
+	// The trial alternates: DoH3 (fails), DoH, DoH3 (fails), then gives up on DoH3.
+	for i := 0; i < 3; i++ {
+		adaptive.ExchangeContext(context.Background(), q)
+	}
+	if !adaptive.trialDone.Load() {
+		t.Fatal("trial should be finished early")
+	}
+	for i := 0; i < 5; i++ {
+		_, info, err := adaptive.ExchangeContextWithInfo(context.Background(), q)
+		if err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+		if info.Protocol != ProtocolDoH {
+			t.Fatalf("query %d: expected DoH, got %+v", i, info)
+		}
+	}
+	if n := adaptive.GetStats()[ProtocolDoH3].totalRequests.Load(); n != 2 {
+		t.Fatalf("expected 2 DoH3 queries, got %d", n)
+	}
+
+	// DoH3 is back, the trial restarts after a reprobe.
+	doh3Transport.blocked.Store(false)
+	deadline := time.Now().Add(time.Second * 5)
+	for adaptive.trialDone.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("trial was not restarted")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_, info, err := adaptive.ExchangeContextWithInfo(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Reason != ReasonTrial {
+		t.Fatalf("expected a trial query, got %+v", info)
+	}
+}
+
+func TestAdaptiveDoHCloseWaitsForReprobe(t *testing.T) {
+	doHServer := createTestServer(t, false)
+	doH3Server := createTestServer(t, true)
+	defer doHServer.Close()
+	defer doH3Server.Close()
+
+	doh3Transport := &blockableTransport{next: doH3Server.Client().Transport}
+	doh3Transport.blocked.Store(true)
+
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, doHServer.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doh3Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{
+		Logger:               zap.NewNop(),
+		TrialCount:           100,
+		DoH3FastFailAttempts: 2,
+		DoH3ReprobeInterval:  time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		adaptive.ExchangeContext(context.Background(), q)
+	}
+	if !adaptive.doh3Reprobing.Load() {
+		t.Fatal("DoH3 should be reprobed")
+	}
+
+	adaptive.Close()
+	if adaptive.doh3Reprobing.Load() {
+		t.Fatal("Close returned before the reprobe goroutine exited")
+	}
+}
+
+func TestAdaptiveDoHFailoverOnError(t *testing.T) {
+	doHServer := createTestServer(t, false)
+	doH3Server := createTestServer(t, true)
+	defer doHServer.Close()
+	defer doH3Server.Close()
+
+	doh3Transport := &blockableTransport{next: doH3Server.Client().Transport}
+	doh3Transport.blocked.Store(true)
+
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, doHServer.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doh3Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{
+		Logger:               zap.NewNop(),
+		Strategy:             &fixedStrategy{trial: ProtocolDoH3, trialCount: 100},
+		DoH3FastFailAttempts: -1,
+		FailoverOnError:      true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	defer adaptive.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		resp, info, err := adaptive.ExchangeContextWithInfo(context.Background(), q)
+		if err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+		if resp == nil {
+			t.Fatalf("query %d returned nil response", i)
+		}
+		if info.Protocol != ProtocolDoH || info.Reason != ReasonRetry {
+			t.Fatalf("query %d: expected a DoH retry, got %+v", i, info)
+		}
+	}
+
+	stats := adaptive.GetStats()
+	doh3Stats, dohStats := stats[ProtocolDoH3], stats[ProtocolDoH]
+	if doh3Stats.totalRequests.Load() != n || doh3Stats.failedRequests.Load() != n {
+		t.Fatalf("expected %d failed DoH3 attempts, got total=%d failed=%d",
+			n, doh3Stats.totalRequests.Load(), doh3Stats.failedRequests.Load())
+	}
+	if dohStats.totalRequests.Load() != n || dohStats.successRequests.Load() != n {
+		t.Fatalf("expected %d successful DoH attempts, got total=%d success=%d",
+			n, dohStats.totalRequests.Load(), dohStats.successRequests.Load())
+	}
+}
+
+func TestAdaptiveDoHSampleSize(t *testing.T) {
+	server := createTestServer(t, false)
+	defer server.Close()
+
+	// samplesToSwitch returns how many slow DoH3 samples it takes to give
+	// up DoH3 after it was preferred with a window of sampleSize.
+	samplesToSwitch := func(sampleSize int) int {
+		up, err := doh.NewUpstream(server.URL, server.Client().Transport, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		adaptive, err := NewUpstream(up, up, Opt{Logger: zap.NewNop(), SampleSize: sampleSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer adaptive.Close()
+
+		for i := 0; i < sampleSize; i++ {
+			adaptive.stats[ProtocolDoH].window.Record(time.Millisecond * 50)
+			adaptive.stats[ProtocolDoH3].window.Record(time.Millisecond * 10)
+		}
+		adaptive.trialDone.Store(true)
+		adaptive.preferred = ProtocolDoH3
+
+		// DoH3 becomes slow.
+		for n := 1; n <= 100; n++ {
+			adaptive.stats[ProtocolDoH3].window.Record(time.Millisecond * 200)
+			adaptive.reevaluatePreferred(ProtocolDoH3)
+			if adaptive.GetPreferredProtocol() == ProtocolDoH {
+				return n
+			}
+		}
+		t.Fatalf("sample size %d: DoH3 is still preferred", sampleSize)
+		return 0
+	}
+
+	small, large := samplesToSwitch(4), samplesToSwitch(20)
+	if small != 1 || large != 3 {
+		t.Fatalf("expected to switch after 1 and 3 samples, got %d and %d", small, large)
+	}
+}
+
+func TestAdaptiveDoHStaleWindow(t *testing.T) {
+	server := createTestServer(t, false)
+	defer server.Close()
+
+	up, err := doh.NewUpstream(server.URL, server.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	adaptive, err := NewUpstream(up, up, Opt{Logger: zap.NewNop(), SampleSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adaptive.Close()
+	adaptive.maxSampleAge = time.Millisecond * 50
+
+	for i := 0; i < 4; i++ {
+		adaptive.stats[ProtocolDoH].window.Record(time.Millisecond * 50)
+		adaptive.stats[ProtocolDoH3].window.Record(time.Millisecond * 10)
+	}
+	adaptive.trialDone.Store(true)
+	adaptive.preferred = ProtocolDoH3
+
+	// DoH got no queries since, its window does not tell whether it is
+	// faster now.
+	time.Sleep(adaptive.maxSampleAge * 2)
+	adaptive.stats[ProtocolDoH3].window.Record(time.Millisecond * 200)
+	adaptive.reevaluatePreferred(ProtocolDoH3)
+	if p := adaptive.GetPreferredProtocol(); p != ProtocolDoH3 {
+		t.Fatalf("switched to %s by a stale window", p)
+	}
+
+	// A recent DoH sample makes its window count again.
+	adaptive.stats[ProtocolDoH].window.Record(time.Millisecond * 50)
+	adaptive.reevaluatePreferred(ProtocolDoH3)
+	if p := adaptive.GetPreferredProtocol(); p != ProtocolDoH {
+		t.Fatalf("expected preferred protocol %s, got %s", ProtocolDoH, p)
+	}
+}
+
+func BenchmarkQueryDebugLogDisabled(b *testing.B) {
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(io.Discard), zap.InfoLevel)
+	u := &Upstream{logger: zap.New(core).With(zap.String("upstream", "https://example.com/dns-query"))}
+	logQuery := func() {
+		u.logSelected(ProtocolDoH3, ReasonPreferred)
+		u.logSucceeded(ProtocolDoH3, time.Millisecond)
+	}
+	if n := testing.AllocsPerRun(100, logQuery); n != 0 {
+		b.Fatalf("per-query debug logs allocate %v times with debug disabled", n)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		logQuery()
+	}
+}
+
+// quiesceTransport counts the calls of RoundTrip and CloseIdleConnections.
+type quiesceTransport struct {
+	next     http.RoundTripper
+	trips    atomic.Int32
+	quiesced atomic.Int32
+}
+
+func (q *quiesceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	q.trips.Add(1)
+	return q.next.RoundTrip(r)
+}
+
+func (q *quiesceTransport) CloseIdleConnections() {
+	q.quiesced.Add(1)
+}
+
+func TestAdaptiveDoHQuiesceNonPreferred(t *testing.T) {
+	var dohFail atomic.Bool
+	ok := createTestServer(t, false)
+	defer ok.Close()
+	doHServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dohFail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		ok.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer doHServer.Close()
+	doH3Server := createTestServer(t, true)
+	defer doH3Server.Close()
+
+	dohTransport := &quiesceTransport{next: doHServer.Client().Transport}
+	doh3Transport := &quiesceTransport{next: doH3Server.Client().Transport}
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, dohTransport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doh3Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{
+		Logger:              zap.NewNop(),
+		Strategy:            &fixedStrategy{trial: ProtocolDoH3, trialCount: 2, preferred: ProtocolDoH},
+		QuiesceNonPreferred: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	defer adaptive.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := adaptive.ExchangeContext(context.Background(), q); err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+	}
+	if n := doh3Transport.quiesced.Load(); n != 1 {
+		t.Fatalf("expected DoH3 to be quiesced once after the trial, got %d", n)
+	}
+	if n := dohTransport.quiesced.Load(); n != 0 {
+		t.Fatalf("expected the preferred DoH not to be quiesced, got %d", n)
+	}
+
+	// DoH fails and DoH3 takes over. DoH is quiesced and DoH3 is re-warmed.
+	dohFail.Store(true)
+	adaptive.ExchangeContext(context.Background(), q)
+	if p := adaptive.GetPreferredProtocol(); p != ProtocolDoH3 {
+		t.Fatalf("expected preferred protocol %s, got %s", ProtocolDoH3, p)
+	}
+	if n := dohTransport.quiesced.Load(); n != 1 {
+		t.Fatalf("expected DoH to be quiesced once, got %d", n)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for doh3Transport.trips.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("DoH3 was not re-warmed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Once closed, quiesced candidates are not re-warmed anymore.
+	adaptive.Close()
+	trips := dohTransport.trips.Load()
+	adaptive.mu.Lock()
+	adaptive.unquiesce(ProtocolDoH)
+	adaptive.mu.Unlock()
+	time.Sleep(time.Millisecond * 50)
+	if n := dohTransport.trips.Load(); n != trips {
+		t.Fatalf("DoH was re-warmed after Close, %d trips", n-trips)
+	}
+}
+
+func TestAdaptiveDoHRegisterMetrics(t *testing.T) {
+	doHServer := createTestServer(t, false)
+	doH3Server := createTestServer(t, true)
+	defer doHServer.Close()
+	defer doH3Server.Close()
+
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, doHServer.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doH3Server.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{
+		Addr:     "https://example.com/dns-query",
+		Logger:   zap.NewNop(),
+		Strategy: &fixedStrategy{trial: ProtocolDoH3, trialCount: 3, preferred: ProtocolDoH3},
+	})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	defer adaptive.Close()
+
+	if err := adaptive.RegisterMetrics(nil); err == nil {
+		t.Fatal("expected an error for a nil registerer")
+	}
+	reg := prometheus.NewRegistry()
+	for i := 0; i < 2; i++ {
+		if err := adaptive.RegisterMetrics(reg); err != nil {
+			t.Fatalf("registration #%d failed: %v", i, err)
+		}
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := adaptive.ExchangeContext(context.Background(), q); err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64) // by name and protocol
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["addr"] != "https://example.com/dns-query" {
+				t.Fatalf("%s: unexpected labels %v", mf.GetName(), labels)
+			}
+			v := m.GetCounter().GetValue()
+			if g := m.GetGauge(); g != nil {
+				v = g.GetValue()
+			}
+			got[mf.GetName()+"/"+labels["protocol"]] = v
+		}
+	}
+	for name, want := range map[string]float64{
+		"adaptive_doh_query_total/doh3":     5,
+		"adaptive_doh_success_total/doh3":   5,
+		"adaptive_doh_preferred_total/doh3": 2,
+		"adaptive_doh_query_total/doh":      0,
+		"adaptive_doh_preferred/doh3":       1,
+		"adaptive_doh_preferred/doh":        0,
+	} {
+		if v, ok := got[name]; !ok || v != want {
+			t.Errorf("%s: want %v, got %v", name, want, v)
+		}
+	}
+	if _, ok := got["adaptive_doh_avg_latency_millisecond/doh3"]; !ok {
+		t.Error("missing the average latency")
+	}
+}
+
+func TestAdaptiveDoHReevaluationInterval(t *testing.T) {
+	doHServer := createTestServer(t, false)
+	doH3Server := createTestServer(t, true)
+	defer doHServer.Close()
+	defer doH3Server.Close()
+
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, doHServer.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doH3Server.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{
+		Logger:               zap.NewNop(),
+		Strategy:             &fixedStrategy{trial: ProtocolDoH3, trialCount: 3, preferred: ProtocolDoH3},
+		ReevaluationInterval: time.Millisecond * 50,
+	})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	finishTrial := func() {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			if _, err := adaptive.ExchangeContext(context.Background(), q); err != nil {
+				t.Fatalf("query %d failed: %v", i, err)
+			}
+		}
+		if !adaptive.trialDone.Load() {
+			t.Fatal("trial should be done")
+		}
+	}
+
+	finishTrial()
+	deadline := time.Now().Add(time.Second * 5)
+	for adaptive.trialDone.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("trial was not restarted")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	adaptive.mu.RLock()
+	n := adaptive.stats[ProtocolDoH3].totalRequests.Load()
+	lifetime := adaptive.stats[ProtocolDoH3].lifetime.total.Load()
+	adaptive.mu.RUnlock()
+	if n != 0 {
+		t.Fatalf("stats should be cleared when the trial restarts, got %d requests", n)
+	}
+	if lifetime != 3 {
+		t.Fatalf("lifetime counters should be kept when the trial restarts, got %d requests", lifetime)
+	}
+
+	// No more restarts once u is closed.
+	if err := adaptive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	finishTrial()
+	time.Sleep(time.Millisecond * 150)
+	if !adaptive.trialDone.Load() {
+		t.Fatal("trial should not be restarted after Close")
+	}
+}
+
+func TestDefaultStrategyWindowedLatency(t *testing.T) {
+	d := &defaultStrategy{candidates: []Protocol{ProtocolDoH, ProtocolDoH3}, trialCount: 10, preference: 0.8, logger: zap.NewNop()}
+
+	// DoH3 was slow at startup, which still dominates its cumulative
+	// average, but its recent samples are fast.
+	s := DecisionStats{Protocols: map[Protocol]ProtocolStats{
+		ProtocolDoH: {
+			TotalRequests: 5, SuccessRequests: 5, TotalLatency: 5 * 50,
+			P90Latency: time.Millisecond * 50,
+		},
+		ProtocolDoH3: {
+			TotalRequests: 5, SuccessRequests: 5, TotalLatency: 2000 + 4*10,
+			P90Latency: time.Millisecond * 10,
+		},
+	}}
+	if p := d.ChoosePreferred(s); p != ProtocolDoH3 {
+		t.Fatalf("expected %s by the windowed latencies, got %s", ProtocolDoH3, p)
+	}
+
+	s.Protocols[ProtocolDoH3] = ProtocolStats{TotalRequests: 5, SuccessRequests: 5, P90Latency: time.Millisecond * 45}
+	if p := d.ChoosePreferred(s); p != ProtocolDoH {
+		t.Fatalf("expected %s if DoH3 is not sufficiently faster, got %s", ProtocolDoH, p)
+	}
+}
+
+func TestAdaptiveDoHConcurrentTrial(t *testing.T) {
+	doHServer := createTestServer(t, false)
+	doH3Server := createTestServer(t, true)
+	defer doHServer.Close()
+	defer doH3Server.Close()
+
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, doHServer.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doH3Server.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{Logger: zap.NewNop(), TrialCount: 1000, SampleSize: 10})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	defer adaptive.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := adaptive.ExchangeContext(context.Background(), q); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := adaptive.GetStats()
+	if n, n3 := stats[ProtocolDoH].totalRequests.Load(), stats[ProtocolDoH3].totalRequests.Load(); n != 50 || n3 != 50 {
+		t.Fatalf("the trial should alternate between protocols, got %d DoH and %d DoH3 queries", n, n3)
+	}
+
+	// Run past the end of the trial, so the preferred protocol is chosen,
+	// re-evaluated and read concurrently.
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := adaptive.ExchangeContext(context.Background(), q); err != nil {
+					t.Error(err)
+					return
+				}
+				adaptive.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+	if !adaptive.trialDone.Load() {
+		t.Fatal("the trial should be done")
+	}
+}
+
+func TestAdaptiveDoHPinProtocol(t *testing.T) {
+	doHServer := createTestServer(t, false)
+	doH3Server := createTestServer(t, true)
+	defer doHServer.Close()
+	defer doH3Server.Close()
+
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, doHServer.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doH3Server.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{Logger: zap.NewNop(), TrialCount: 4})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	defer adaptive.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+
+	if _, ok := adaptive.IsPinned(); ok {
+		t.Fatal("new upstream should not be pinned")
+	}
+	if err := adaptive.PinProtocol(Protocol("doq")); err == nil {
+		t.Fatal("pinning an unknown protocol should fail")
+	}
+	if _, ok := adaptive.IsPinned(); ok {
+		t.Fatal("a failed pin should not pin the upstream")
+	}
+	if err := adaptive.PinProtocol(ProtocolDoH); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := adaptive.IsPinned(); !ok || p != ProtocolDoH {
+		t.Fatalf("expected pinned %s, got %s %v", ProtocolDoH, p, ok)
+	}
+	for i := 0; i < 10; i++ {
+		_, info, err := adaptive.ExchangeContextWithInfo(context.Background(), q)
+		if err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+		if info.Protocol != ProtocolDoH || info.Reason != ReasonPinned {
+			t.Fatalf("query %d: expected %s pinned, got %+v", i, ProtocolDoH, info)
+		}
+	}
+	stats := adaptive.GetStats()
+	if n := stats[ProtocolDoH].totalRequests.Load(); n != 10 {
+		t.Fatalf("pinned queries should be recorded, got %d", n)
+	}
+	if adaptive.trialDone.Load() {
+		t.Fatal("the trial should not be evaluated while pinned")
+	}
+
+	adaptive.Unpin()
+	if _, ok := adaptive.IsPinned(); ok {
+		t.Fatal("upstream should be unpinned")
+	}
+	_, info, err := adaptive.ExchangeContextWithInfo(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The trial resumes, and is finished by this query since the pinned
+	// queries were recorded.
+	if info.Reason != ReasonTrial || !adaptive.trialDone.Load() {
+		t.Fatalf("the trial should be evaluated once unpinned, got %+v", info)
+	}
+}
+
+func TestAdaptiveDoHSwitchHysteresis(t *testing.T) {
+	server := createTestServer(t, false)
+	defer server.Close()
+	up, err := doh.NewUpstream(server.URL, server.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	adaptive, err := NewUpstream(up, up, Opt{Logger: zap.NewNop(), SwitchMargin: 0.2, SwitchCooldown: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adaptive.Close()
+
+	setRates := func(p Protocol, success uint64) {
+		adaptive.stats[p].totalRequests.Store(10)
+		adaptive.stats[p].successRequests.Store(success)
+		adaptive.stats[p].failedRequests.Store(10 - success)
+	}
+	adaptive.trialDone.Store(true)
+	adaptive.preferred = ProtocolDoH3
+
+	// DoH is better, but not by the margin.
+	setRates(ProtocolDoH3, 5)
+	setRates(ProtocolDoH, 6)
+	adaptive.recordFailure(ProtocolDoH3)
+	if p := adaptive.GetPreferredProtocol(); p != ProtocolDoH3 {
+		t.Fatalf("switch within the margin should be suppressed, got %s", p)
+	}
+
+	setRates(ProtocolDoH, 8)
+	adaptive.recordFailure(ProtocolDoH3)
+	if p := adaptive.GetPreferredProtocol(); p != ProtocolDoH {
+		t.Fatalf("expected a switch to %s, got %s", ProtocolDoH, p)
+	}
+
+	// DoH3 is much better now, but the cooldown has not elapsed.
+	setRates(ProtocolDoH3, 10)
+	setRates(ProtocolDoH, 5)
+	adaptive.recordFailure(ProtocolDoH)
+	if p := adaptive.GetPreferredProtocol(); p != ProtocolDoH {
+		t.Fatalf("switch within the cooldown should be suppressed, got %s", p)
+	}
+
+	adaptive.mu.Lock()
+	adaptive.lastSwitch = adaptive.lastSwitch.Add(-time.Hour)
+	adaptive.mu.Unlock()
+	adaptive.recordFailure(ProtocolDoH)
+	if p := adaptive.GetPreferredProtocol(); p != ProtocolDoH3 {
+		t.Fatalf("expected a switch back to %s after the cooldown, got %s", ProtocolDoH3, p)
+	}
+}
+
+func TestAdaptiveDoHSnapshot(t *testing.T) {
+	doHServer := createTestServer(t, false)
+	doH3Server := createTestServer(t, true)
+	defer doHServer.Close()
+	defer doH3Server.Close()
+
+	dohUpstream, err := doh.NewUpstream(doHServer.URL, doHServer.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH upstream: %v", err)
+	}
+	doh3Upstream, err := doh.NewUpstream(doH3Server.URL, doH3Server.Client().Transport, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create DoH3 upstream: %v", err)
+	}
+	adaptive, err := NewUpstream(dohUpstream, doh3Upstream, Opt{Logger: zap.NewNop(), TrialCount: 10})
+	if err != nil {
+		t.Fatalf("failed to create adaptive upstream: %v", err)
+	}
+	defer adaptive.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if _, err := adaptive.ExchangeContext(context.Background(), q); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	checkSnapshot := func(s Snapshot) {
+		for p, ps := range s.Protocols {
+			if ps.TotalRequests != ps.SuccessRequests+ps.FailedRequests {
+				t.Fatalf("inconsistent %s snapshot: %+v", p, ps)
+			}
+		}
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		checkSnapshot(adaptive.Snapshot())
+	}
+
+	s := adaptive.Snapshot()
+	checkSnapshot(s)
+	var total uint64
+	for _, ps := range s.Protocols {
+		total += ps.TotalRequests
+		if ps.SuccessRequests > 0 && ps.AvgLatencyMs != float64(ps.TotalLatency)/float64(ps.SuccessRequests) {
+			t.Fatalf("unexpected avg latency %v", ps.AvgLatencyMs)
+		}
+	}
+	if total != 100 {
+		t.Fatalf("expected 100 requests in the snapshot, got %d", total)
+	}
+	if !s.TrialDone || s.Preferred != adaptive.GetPreferredProtocol() {
+		t.Fatalf("unexpected snapshot state: %+v", s)
+	}
+
+	// The snapshot is a copy, later queries don't change it.
+	if _, err := adaptive.ExchangeContext(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	if s.Protocols[ProtocolDoH].TotalRequests+s.Protocols[ProtocolDoH3].TotalRequests != 100 {
+		t.Fatal("the snapshot changed after a query")
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Snapshot
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Protocols[ProtocolDoH].TotalRequests != s.Protocols[ProtocolDoH].TotalRequests {
+		t.Fatalf("unexpected json round trip: %s", b)
+	}
+}
+
+func TestAdaptiveDoHNamedUpstreams(t *testing.T) {
+	slowServer := createDelayedServer(t, 50*time.Millisecond, false)
+	fastServer := createTestServer(t, false)
+	defer slowServer.Close()
+	defer fastServer.Close()
+
+	newUpstream := func(s *httptest.Server) *doh.Upstream {
+		up, err := doh.NewUpstream(s.URL, s.Client().Transport, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return up
+	}
+	slow, fast := newUpstream(slowServer), newUpstream(fastServer)
+
+	for _, us := range [][]NamedUpstream{
+		{{Name: "v4", U: slow}},
+		{{Name: "v4", U: slow}, {Name: "v4", U: fast}},
+		{{Name: "v4", U: slow}, {Name: "", U: fast}},
+		{{Name: "v4", U: slow}, {Name: "v6", U: nil}},
+	} {
+		if _, err := NewNamedUpstream(us, Opt{}); err == nil {
+			t.Fatalf("expected an error for candidates %+v", us)
+		}
+	}
+
+	adaptive, err := NewNamedUpstream([]NamedUpstream{
+		{Name: "v4", U: slow},
+		{Name: "v6", U: fast},
+		{Name: "h3", U: slow},
+	}, Opt{Logger: zap.NewNop(), TrialCount: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adaptive.Close()
+	if p := adaptive.GetPreferredProtocol(); p != "v4" {
+		t.Fatalf("expected the baseline to be preferred before the trial, got %s", p)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		_, info, err := adaptive.ExchangeContextWithInfo(context.Background(), q)
+		if err != nil {
+			t.Fatalf("query %d failed: %v", i, err)
+		}
+		if info.Reason != ReasonTrial {
+			t.Fatalf("query %d: expected a trial query, got %+v", i, info)
+		}
+	}
+
+	s := adaptive.Snapshot()
+	for _, p := range []Protocol{"v4", "v6", "h3"} {
+		if n := s.Protocols[p].TotalRequests; n != 2 {
+			t.Fatalf("the trial should rotate through all candidates, got %d queries for %s", n, p)
+		}
+	}
+	if p := adaptive.GetPreferredProtocol(); p != "v6" {
+		t.Fatalf("expected the fastest candidate v6 to be preferred, got %s", p)
+	}
+	_, info, err := adaptive.ExchangeContextWithInfo(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Protocol != "v6" || info.Reason != ReasonPreferred {
+		t.Fatalf("unexpected exchange info %+v", info)
+	}
+}
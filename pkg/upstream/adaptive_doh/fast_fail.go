@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package adaptive_doh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+// isConnErr reports whether err is a connection level error, which means
+// the server was not reachable, rather than an error of the server.
+func isConnErr(err error) bool {
+	var netErr net.Error
+	var idleErr *quic.IdleTimeoutError
+	var handshakeErr *quic.HandshakeTimeoutError
+	var transportErr *quic.TransportError
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr) ||
+		errors.As(err, &idleErr) ||
+		errors.As(err, &handshakeErr) ||
+		errors.As(err, &transportErr)
+}
+
+// recordDoH3ConnFailure ends the trial with the first other candidate
+// preferred if the first DoH3 queries of the trial all failed with
+// connection level errors.
+func (u *Upstream) recordDoH3ConnFailure() {
+	if u.doh3FastFail < 0 || u.trialDone.Load() {
+		return
+	}
+	if int(u.doh3ConnFailures.Add(1)) < u.doh3FastFail ||
+		u.stats[ProtocolDoH3].successRequests.Load() > 0 {
+		return
+	}
+
+	u.mu.Lock()
+	if u.trialDone.Load() {
+		u.mu.Unlock()
+		return
+	}
+	preferred := u.names[0]
+	if preferred == ProtocolDoH3 {
+		preferred = u.names[1]
+	}
+	u.trialDone.Store(true)
+	u.preferred = preferred
+	u.failedOver = false
+	u.quiesceOthers(preferred)
+	if !u.closed() && u.doh3Reprobing.CompareAndSwap(false, true) {
+		u.bg.Add(1)
+		go u.reprobeDoH3()
+	}
+	u.mu.Unlock()
+
+	u.logger.Warn("DoH3 seems unreachable",
+		zap.String("preferred", string(preferred)),
+		zap.Int("failed_attempts", u.doh3FastFail),
+		zap.Duration("reprobe_interval", u.doh3ReprobeIvl),
+	)
+}
+
+// reprobeDoH3 probes DoH3 periodically until it succeeds or u is closed.
+// Then it restarts the trial.
+func (u *Upstream) reprobeDoH3() {
+	defer u.bg.Done()
+	defer u.doh3Reprobing.Store(false)
+
+	ticker := time.NewTicker(u.doh3ReprobeIvl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.closeNotify:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), defaultWarmupTimeout)
+		err := u.probe(ctx, u.upstreams[ProtocolDoH3])
+		cancel()
+		if err != nil {
+			u.logger.Debug("DoH3 reprobe failed", zap.Error(err))
+			continue
+		}
+
+		u.mu.Lock()
+		u.restartTrial()
+		delete(u.quiesced, ProtocolDoH3) // The probe has just warmed DoH3 up.
+		u.unquiesceAll()
+		u.mu.Unlock()
+		u.logger.Info("DoH3 is reachable again, restarting trial")
+		return
+	}
+}
+
+// restartTrial clears the stats and starts a new trial. It must be called
+// with u.mu held.
+func (u *Upstream) restartTrial() {
+	u.resetStats()
+	u.doh3ConnFailures.Store(0)
+	u.trialSeq.Store(0)
+	u.trialDone.Store(false)
+}
+
+// resetStats resets the counters of all protocols. It must be called with
+// u.mu held.
+func (u *Upstream) resetStats() {
+	for _, ps := range u.stats {
+		ps.mu.Lock()
+		ps.totalRequests.Store(0)
+		ps.successRequests.Store(0)
+		ps.failedRequests.Store(0)
+		ps.totalLatency.Store(0)
+		ps.preferredCount.Store(0)
+		ps.fallbackCount.Store(0)
+		ps.mu.Unlock()
+		ps.window.Reset()
+	}
+}
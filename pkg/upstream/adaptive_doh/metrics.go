@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package adaptive_doh
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterMetrics registers the metrics of the protocols of u to r. They
+// are labelled by "addr" and "protocol". Registering u to the same r again
+// is a no-op.
+func (u *Upstream) RegisterMetrics(r prometheus.Registerer) error {
+	if r == nil {
+		return errors.New("nil prometheus registerer")
+	}
+	u.metricsOnce.Do(u.initMetrics)
+	for _, c := range u.metrics {
+		if err := r.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if errors.As(err, &are) && are.ExistingCollector == c {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *Upstream) initMetrics() {
+	for _, p := range u.names {
+		s := u.stats[p]
+		lb := prometheus.Labels{"addr": u.addr, "protocol": string(p)}
+		counter := func(name, help string, f func() uint64) prometheus.Collector {
+			return prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        name,
+				Help:        help,
+				ConstLabels: lb,
+			}, func() float64 { return float64(f()) })
+		}
+		u.metrics = append(u.metrics,
+			counter("adaptive_doh_query_total", "The total number of queries sent through this protocol", s.lifetime.total.Load),
+			counter("adaptive_doh_success_total", "The total number of queries that succeeded", s.lifetime.success.Load),
+			counter("adaptive_doh_err_total", "The total number of queries that failed", s.lifetime.failed.Load),
+			counter("adaptive_doh_preferred_total", "The total number of successful queries while this protocol was the preferred one", s.lifetime.preferred.Load),
+			counter("adaptive_doh_fallback_total", "The total number of successful queries while this protocol was not the preferred one", s.lifetime.fallback.Load),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "adaptive_doh_avg_latency_millisecond",
+				Help:        "The average latency of successful queries in millisecond, 0 if there is none",
+				ConstLabels: lb,
+			}, func() float64 {
+				n := s.successRequests.Load()
+				if n == 0 {
+					return 0
+				}
+				return float64(s.totalLatency.Load()) / float64(n)
+			}),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "adaptive_doh_preferred",
+				Help:        "1 if this protocol is the preferred one, 0 otherwise",
+				ConstLabels: lb,
+			}, func() float64 {
+				if u.GetPreferredProtocol() == p {
+					return 1
+				}
+				return 0
+			}),
+		)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package adaptive_doh
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// PinProtocol makes u always use protocol p, e.g. DoH on networks that
+// silently drop HTTP/3. The trial and the preference are not evaluated
+// while u is pinned, and failed queries are not retried through another
+// protocol, but the stats are still recorded. It returns an error if p is
+// not the name of a candidate of u.
+func (u *Upstream) PinProtocol(p Protocol) error {
+	if u.upstreams[p] == nil {
+		return fmt.Errorf("cannot pin unknown protocol %s", p)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pinned.Store(p)
+	u.unquiesce(p)
+	u.logger.Info("protocol pinned", zap.String("protocol", string(p)))
+	return nil
+}
+
+// Unpin undoes PinProtocol. The trial or the preference is evaluated from
+// where it was.
+func (u *Upstream) Unpin() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if p := u.pinned.Swap(Protocol("")).(Protocol); len(p) > 0 {
+		u.logger.Info("protocol unpinned", zap.String("protocol", string(p)))
+	}
+}
+
+// IsPinned returns the pinned protocol, see PinProtocol.
+func (u *Upstream) IsPinned() (Protocol, bool) {
+	p := u.pinned.Load().(Protocol)
+	return p, len(p) > 0
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package adaptive_doh
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// quiesceOthers quiesces the connections of all candidates but p, see
+// Opt.QuiesceNonPreferred, and re-warms p in background if it was
+// quiesced. It must be called with u.mu held.
+func (u *Upstream) quiesceOthers(p Protocol) {
+	if !u.quiesce {
+		return
+	}
+	for _, c := range u.names {
+		if c == p || u.quiesced[c] {
+			continue
+		}
+		u.quiesced[c] = true
+		u.upstreams[c].Quiesce()
+		u.logger.Debug("protocol quiesced", zap.String("protocol", string(c)))
+	}
+	u.unquiesce(p)
+}
+
+// unquiesce re-warms p in background if it was quiesced and u is not
+// closed. It must be called with u.mu held.
+func (u *Upstream) unquiesce(p Protocol) {
+	if !u.quiesced[p] {
+		return
+	}
+	delete(u.quiesced, p)
+	if u.closed() {
+		return
+	}
+	u.bg.Add(1)
+	go u.rewarm(p)
+}
+
+// unquiesceAll re-warms all quiesced candidates in background. It must be
+// called with u.mu held.
+func (u *Upstream) unquiesceAll() {
+	for p := range u.quiesced {
+		u.unquiesce(p)
+	}
+}
+
+// rewarm sends a probe through protocol p, so its connection is likely
+// established before the next queries arrive.
+func (u *Upstream) rewarm(p Protocol) {
+	defer u.bg.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultWarmupTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := u.probe(ctx, u.upstreams[p]); err != nil {
+		u.logger.Warn("re-warm failed", zap.String("protocol", string(p)), zap.Error(err))
+		return
+	}
+	u.logger.Debug("re-warm done", zap.String("protocol", string(p)), zap.Duration("latency", time.Since(start)))
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package adaptive_doh
+
+import (
+	"time"
+)
+
+// reevaluatePeriodically restarts the trial every interval until u is
+// closed. See Opt.ReevaluationInterval.
+func (u *Upstream) reevaluatePeriodically(interval time.Duration) {
+	defer u.bg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.closeNotify:
+			return
+		case <-ticker.C:
+		}
+
+		// DoH3 reprobes restart the trial once DoH3 is reachable again.
+		if !u.trialDone.Load() || u.doh3Reprobing.Load() {
+			continue
+		}
+		u.mu.Lock()
+		u.restartTrial()
+		u.unquiesceAll() // All candidates are compared again.
+		u.mu.Unlock()
+		u.logger.Info("restarting trial to re-evaluate the preferred protocol")
+	}
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package adaptive_doh
+
+// Snapshot is a point-in-time copy of the state and the stats of an
+// Upstream. It can be stored or serialized safely.
+type Snapshot struct {
+	Current   Protocol `json:"current"`
+	Preferred Protocol `json:"preferred"`
+	Pinned    Protocol `json:"pinned,omitempty"` // empty if not pinned.
+	TrialDone bool     `json:"trial_done"`
+
+	Protocols map[Protocol]ProtocolStats `json:"protocols"`
+}
+
+// Snapshot returns a copy of the state and the stats of u. The counters of
+// each protocol are copied atomically, so they are consistent with each
+// other, e.g. TotalRequests == SuccessRequests + FailedRequests.
+func (u *Upstream) Snapshot() Snapshot {
+	u.mu.RLock()
+	s := Snapshot{
+		Current:   u.current.Load().(Protocol),
+		Preferred: u.preferred,
+		TrialDone: u.trialDone.Load(),
+		Protocols: make(map[Protocol]ProtocolStats, len(u.stats)),
+	}
+	u.mu.RUnlock()
+	s.Pinned, _ = u.IsPinned()
+	for p, ps := range u.stats {
+		s.Protocols[p] = ps.snapshot()
+	}
+	return s
+}
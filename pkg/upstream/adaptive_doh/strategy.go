@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package adaptive_doh
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// latencyPercentile is the percentile of the latency windows that the
+// protocols are compared by.
+const latencyPercentile = 0.9
+
+// ProtocolStats is a point-in-time copy of the counters of one protocol.
+type ProtocolStats struct {
+	TotalRequests   uint64 `json:"total_requests"`
+	SuccessRequests uint64 `json:"success_requests"`
+	FailedRequests  uint64 `json:"failed_requests"`
+	TotalLatency    int64  `json:"total_latency_ms"` // in milliseconds, successful requests only.
+	PreferredCount  uint64 `json:"preferred_count"`
+	FallbackCount   uint64 `json:"fallback_count"`
+
+	// AvgLatencyMs is TotalLatency / SuccessRequests, 0 if there is no
+	// successful request.
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+
+	// The average and p90 latency of the last Opt.SampleSize successful
+	// requests. Unlike TotalLatency, old samples age out.
+	AvgLatency time.Duration `json:"window_avg_latency"`
+	P90Latency time.Duration `json:"window_p90_latency"`
+}
+
+// DecisionStats is the view of the Upstream that is handed to a DecisionStrategy.
+type DecisionStats struct {
+	Current   Protocol
+	Preferred Protocol
+	Protocols map[Protocol]ProtocolStats
+
+	// TrialSeq is the number of queries that were selected during the
+	// trial before this one. Only set for SelectDuringTrial.
+	TrialSeq uint64
+}
+
+// DecisionStrategy decides which protocol the Upstream uses.
+// Its methods are always called with the Upstream's lock held, so
+// implementations see consistent stats. SelectDuringTrial only holds the
+// read lock and may be called concurrently, the other methods need no
+// locking of their own as long as they are not shared between Upstreams.
+type DecisionStrategy interface {
+	// SelectDuringTrial returns the protocol for the next query during the trial.
+	SelectDuringTrial(s DecisionStats) Protocol
+
+	// ShouldFinishTrial reports whether enough samples were collected.
+	ShouldFinishTrial(s DecisionStats) bool
+
+	// ChoosePreferred returns the preferred protocol once the trial is finished.
+	ChoosePreferred(s DecisionStats) Protocol
+}
+
+func (p *protocolStats) snapshot() ProtocolStats {
+	p.mu.Lock()
+	s := ProtocolStats{
+		TotalRequests:   p.totalRequests.Load(),
+		SuccessRequests: p.successRequests.Load(),
+		FailedRequests:  p.failedRequests.Load(),
+		TotalLatency:    p.totalLatency.Load(),
+		PreferredCount:  p.preferredCount.Load(),
+		FallbackCount:   p.fallbackCount.Load(),
+	}
+	p.mu.Unlock()
+	if s.SuccessRequests > 0 {
+		s.AvgLatencyMs = float64(s.TotalLatency) / float64(s.SuccessRequests)
+	}
+	s.AvgLatency = p.window.Mean()
+	s.P90Latency = p.window.Percentile(latencyPercentile)
+	return s
+}
+
+// decisionStats must be called with u.mu held.
+func (u *Upstream) decisionStats() DecisionStats {
+	s := DecisionStats{
+		Current:   u.current.Load().(Protocol),
+		Preferred: u.preferred,
+		Protocols: make(map[Protocol]ProtocolStats, len(u.stats)),
+	}
+	for p, ps := range u.stats {
+		s.Protocols[p] = ps.snapshot()
+	}
+	return s
+}
+
+// defaultStrategy rotates through the candidates during the trial. The
+// first candidate is the baseline. Another candidate is only preferred if
+// it is available and sufficiently faster than the baseline.
+type defaultStrategy struct {
+	candidates []Protocol
+	trialCount int
+	preference float64
+	logger     *zap.Logger
+}
+
+func (d *defaultStrategy) SelectDuringTrial(s DecisionStats) Protocol {
+	// The baseline takes the last turn of each round.
+	return d.candidates[(s.TrialSeq+1)%uint64(len(d.candidates))]
+}
+
+func (d *defaultStrategy) ShouldFinishTrial(s DecisionStats) bool {
+	var total uint64
+	for _, ps := range s.Protocols {
+		total += ps.TotalRequests
+	}
+	return total >= uint64(d.trialCount)
+}
+
+func (d *defaultStrategy) ChoosePreferred(s DecisionStats) Protocol {
+	baseline := d.candidates[0]
+	baselineStats := s.Protocols[baseline]
+
+	// The fastest candidate that is available and does not fail too often.
+	var best Protocol
+	var bestStats ProtocolStats
+	for _, p := range d.candidates[1:] {
+		ps := s.Protocols[p]
+		if ps.TotalRequests == 0 {
+			d.logger.Info("protocol not available", zap.String("protocol", string(p)))
+			continue
+		}
+		failureRate := float64(ps.FailedRequests) / float64(ps.TotalRequests)
+		if failureRate >= maxFailureRate {
+			d.logger.Info("protocol failure rate too high",
+				zap.String("protocol", string(p)),
+				zap.Float64("failure_rate", failureRate),
+				zap.Uint64("failed", ps.FailedRequests),
+				zap.Uint64("total", ps.TotalRequests),
+			)
+			continue
+		}
+		if len(best) == 0 || ps.P90Latency < bestStats.P90Latency {
+			best, bestStats = p, ps
+		}
+	}
+
+	if len(best) == 0 {
+		d.logger.Info("no other protocol available", zap.String("using", string(baseline)))
+		return baseline
+	}
+	if baselineStats.SuccessRequests == 0 {
+		d.logger.Info("baseline protocol not available",
+			zap.String("baseline", string(baseline)),
+			zap.String("using", string(best)),
+		)
+		return best
+	}
+
+	baselineLatency := baselineStats.P90Latency
+	bestLatency := bestStats.P90Latency
+
+	d.logger.Info("protocol evaluation",
+		zap.String("baseline", string(baseline)),
+		zap.Duration("baseline_p90_latency", baselineLatency),
+		zap.Uint64("baseline_success", baselineStats.SuccessRequests),
+		zap.Uint64("baseline_failed", baselineStats.FailedRequests),
+		zap.String("candidate", string(best)),
+		zap.Duration("candidate_p90_latency", bestLatency),
+		zap.Uint64("candidate_success", bestStats.SuccessRequests),
+		zap.Uint64("candidate_failed", bestStats.FailedRequests),
+		zap.Float64("preference_threshold", d.preference),
+	)
+
+	if float64(bestLatency) < float64(baselineLatency)*d.preference {
+		d.logger.Info("switched preferred protocol (faster)",
+			zap.String("protocol", string(best)),
+			zap.Duration("baseline_p90_latency", baselineLatency),
+			zap.Duration("p90_latency", bestLatency),
+			zap.Float64("improvement", float64(baselineLatency-bestLatency)/float64(baselineLatency)*100),
+		)
+		return best
+	}
+
+	d.logger.Info("kept preferred protocol as the baseline",
+		zap.String("protocol", string(baseline)),
+		zap.Duration("baseline_p90_latency", baselineLatency),
+		zap.Duration("candidate_p90_latency", bestLatency),
+		zap.String("reason", string(best)+" not sufficiently faster"),
+	)
+	return baseline
+}
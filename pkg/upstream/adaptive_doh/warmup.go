@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package adaptive_doh
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/upstream/doh"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const defaultWarmupTimeout = time.Second * 5
+
+// warmup sends a probe query through all candidates concurrently, so their
+// connections are established before the trial. Otherwise, the first DoH3
+// samples include the QUIC handshake while DoH may already reuse a warm
+// connection, which biases the comparison against DoH3.
+// Results are not recorded in stats. Errors are only logged.
+// It returns within timeout.
+func (u *Upstream) warmup(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for p, up := range u.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			if err := u.probe(ctx, up); err != nil {
+				u.logger.Warn("warmup failed", zap.String("protocol", string(p)), zap.Error(err))
+				return
+			}
+			u.logger.Debug("warmup done", zap.String("protocol", string(p)), zap.Duration("latency", time.Since(start)))
+		}()
+	}
+	wg.Wait()
+}
+
+// probe sends a ". NS" query through up. The result is not recorded in stats.
+func (u *Upstream) probe(ctx context.Context, up *doh.Upstream) error {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	q, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	r, err := up.ExchangeContext(ctx, q)
+	if err != nil {
+		return err
+	}
+	pool.ReleaseBuf(r)
+	return nil
+}
@@ -44,20 +44,31 @@ var (
 	errNoAddrInResp = errors.New("resp does not have ip address")
 )
 
+// New returns a Bootstrap that resolves host via bootstrapServers. They are
+// tried in order until one of them answers. The first resolution starts
+// immediately in background, New does not wait for it and does not report
+// its errors. GetAddrPortStr blocks until an address was resolved. The
+// resolved address is pinned until its ttl (at least 5m) expires, then it
+// is refreshed on the next call of GetAddrPortStr.
 func New(
 	host string,
 	port uint16,
-	bootstrapServer netip.AddrPort,
+	bootstrapServers []netip.AddrPort,
 	bootstrapVer int, // 0,4,6
 	logger *zap.Logger, // not nil
 ) (*Bootstrap, error) {
 	dp := new(Bootstrap)
 	dp.fqdn = dns.Fqdn(host)
 	dp.port = port
-	if !bootstrapServer.IsValid() {
-		return nil, errors.New("invalid bootstrap server address")
+	if len(bootstrapServers) == 0 {
+		return nil, errors.New("no bootstrap server")
+	}
+	for _, ap := range bootstrapServers {
+		if !ap.IsValid() {
+			return nil, errors.New("invalid bootstrap server address")
+		}
+		dp.bootstrap = append(dp.bootstrap, net.UDPAddrFromAddrPort(ap))
 	}
-	dp.bootstrap = net.UDPAddrFromAddrPort(bootstrapServer)
 	qt, ok := bootstrapVer2Qt(bootstrapVer)
 	if !ok {
 		return nil, fmt.Errorf("invalid bootstrap version %d", bootstrapVer)
@@ -66,13 +77,14 @@ func New(
 	dp.logger = logger
 
 	dp.readyNotify = make(chan struct{})
+	dp.tryUpdate()
 	return dp, nil
 }
 
 type Bootstrap struct {
 	fqdn      string
 	port      uint16
-	bootstrap *net.UDPAddr
+	bootstrap []*net.UDPAddr
 	qt        uint16      // dns.TypeA or dns.TypeAAAA
 	logger    *zap.Logger // not nil
 
@@ -105,10 +117,8 @@ func (sp *Bootstrap) tryUpdate() {
 		if time.Now().After(sp.nextUpdate) {
 			go func() {
 				defer sp.updating.Store(false)
-				ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
-				defer cancel()
 				start := time.Now()
-				addr, ttl, err := sp.updateAddr(ctx)
+				addr, ttl, err := sp.updateAddr(context.Background())
 				if err != nil {
 					sp.logger.Check(zap.WarnLevel, "failed to update bootstrap addr").Write(
 						zap.String("fqdn", sp.fqdn),
@@ -136,9 +146,21 @@ func (sp *Bootstrap) tryUpdate() {
 }
 
 func (sp *Bootstrap) updateAddr(ctx context.Context) (netip.Addr, uint32, error) {
-	addr, ttl, err := sp.resolve(ctx, sp.qt)
-	if err != nil {
-		return netip.Addr{}, 0, err
+	var addr netip.Addr
+	var ttl uint32
+	var errs []error
+	for _, server := range sp.bootstrap {
+		queryCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+		var err error
+		addr, ttl, err = sp.resolve(queryCtx, server, sp.qt)
+		cancel()
+		if err == nil {
+			break
+		}
+		errs = append(errs, fmt.Errorf("bootstrap %s, %w", server, err))
+	}
+	if len(errs) == len(sp.bootstrap) {
+		return netip.Addr{}, 0, errors.Join(errs...)
 	}
 
 	addrPort := netip.AddrPortFrom(addr, sp.port).String()
@@ -152,14 +174,14 @@ func (sp *Bootstrap) updateAddr(ctx context.Context) (netip.Addr, uint32, error)
 	return addr, ttl, nil
 }
 
-func (sp *Bootstrap) resolve(ctx context.Context, qt uint16) (netip.Addr, uint32, error) {
+func (sp *Bootstrap) resolve(ctx context.Context, server *net.UDPAddr, qt uint16) (netip.Addr, uint32, error) {
 	const edns0UdpSize = 1200
 
 	q := new(dns.Msg)
 	q.SetQuestion(sp.fqdn, qt)
 	q.SetEdns0(edns0UdpSize, false)
 
-	c, err := net.DialUDP("udp", nil, sp.bootstrap)
+	c, err := net.DialUDP("udp", nil, server)
 	if err != nil {
 		return netip.Addr{}, 0, err
 	}
@@ -70,6 +70,15 @@ func NewUpstream(endPoint string, rt http.RoundTripper, logger *zap.Logger) (*Up
 	}, nil
 }
 
+// Quiesce closes the idle connections of the underlying http.RoundTripper
+// if it supports it, e.g. *http.Transport and *http3.Transport.
+// Connections are re-established by the next query.
+func (u *Upstream) Quiesce() {
+	if c, ok := u.rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
 var (
 	bufPool4k = pool.NewBytesBufPool(4096)
 )
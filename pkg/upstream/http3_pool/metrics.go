@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http3_pool
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector returns a prometheus.Collector of the metrics of p: the
+// numbers of active and total connections, the total numbers of dials
+// and failed dials, and the total number of connections removed by the
+// health check or for being idle, by the "reason" label.
+// Metrics have a const "name" label of PoolConfig.Name.
+func (p *ConnPool) Collector() prometheus.Collector {
+	labels := prometheus.Labels{"name": p.name}
+	return &poolCollector{
+		p:            p,
+		active:       prometheus.NewDesc("http3_pool_active_connections", "The number of healthy and recently used connections", nil, labels),
+		total:        prometheus.NewDesc("http3_pool_connections", "The number of pooled connections", nil, labels),
+		dials:        prometheus.NewDesc("http3_pool_dials_total", "The total number of dials", nil, labels),
+		dialFailures: prometheus.NewDesc("http3_pool_dial_failures_total", "The total number of failed or rejected dials", nil, labels),
+		removed:      prometheus.NewDesc("http3_pool_removed_connections_total", "The total number of connections removed by the health check or for being idle", []string{"reason"}, labels),
+	}
+}
+
+type poolCollector struct {
+	p *ConnPool
+
+	active       *prometheus.Desc
+	total        *prometheus.Desc
+	dials        *prometheus.Desc
+	dialFailures *prometheus.Desc
+	removed      *prometheus.Desc
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+	ch <- c.total
+	ch <- c.dials
+	ch <- c.dialFailures
+	ch <- c.removed
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	active, total := c.p.Stats()
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(active))
+	ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, float64(total))
+	ch <- prometheus.MustNewConstMetric(c.dials, prometheus.CounterValue, float64(c.p.dials.Load()))
+	ch <- prometheus.MustNewConstMetric(c.dialFailures, prometheus.CounterValue, float64(c.p.dialFailures.Load()))
+	ch <- prometheus.MustNewConstMetric(c.removed, prometheus.CounterValue, float64(c.p.removedUnhealthy.Load()), "health_check")
+	ch <- prometheus.MustNewConstMetric(c.removed, prometheus.CounterValue, float64(c.p.removedIdle.Load()), "idle")
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http3_pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestConnPoolCollector(t *testing.T) {
+	dial := newTestQUICServer(t)
+	var failDial atomic.Bool
+	p, err := NewConnPool(PoolConfig{
+		Name:           "test",
+		MaxConnections: 2,
+		Dialer: func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+			if failDial.Load() {
+				return nil, nil, errors.New("dial failed")
+			}
+			return dial(ctx)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(p.Collector()); err != nil {
+		t.Fatal(err)
+	}
+
+	idle, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failDial.Store(true)
+	if _, _, err := p.get(context.Background(), true); err == nil {
+		t.Fatal("expected a dial error")
+	}
+	failDial.Store(false)
+	closed, _, err := p.get(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One connection goes idle, the other one is closed.
+	p.mu.Lock()
+	idle.lastUsed = time.Now().Add(-time.Hour)
+	p.mu.Unlock()
+	closed.conn.CloseWithError(0, "")
+	p.checkHealth()
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, l := range m.GetLabel() {
+				switch l.GetName() {
+				case "name":
+					if l.GetValue() != "test" {
+						t.Fatalf("%s: unexpected name label %s", name, l.GetValue())
+					}
+				case "reason":
+					name += "/" + l.GetValue()
+				}
+			}
+			if g := m.GetGauge(); g != nil {
+				got[name] = g.GetValue()
+			} else {
+				got[name] = m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	for name, want := range map[string]float64{
+		"http3_pool_active_connections":                     0,
+		"http3_pool_connections":                            0,
+		"http3_pool_dials_total":                            3,
+		"http3_pool_dial_failures_total":                    1,
+		"http3_pool_removed_connections_total/health_check": 1,
+		"http3_pool_removed_connections_total/idle":         1,
+	} {
+		if got[name] != want {
+			t.Fatalf("%s: want %v, got %v", name, want, got[name])
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http3_pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// connBudget limits the total number of connections of the pools that
+// share it. A nil *connBudget is unlimited.
+type connBudget struct {
+	mu    sync.Mutex
+	max   int
+	used  int
+	avail chan struct{} // closed and renewed when a slot is released.
+}
+
+func newConnBudget(max int) *connBudget {
+	return &connBudget{max: max, avail: make(chan struct{})}
+}
+
+// tryAcquire takes a slot. If there is none, it returns false and a
+// channel that is closed when one may become available.
+func (b *connBudget) tryAcquire() (bool, <-chan struct{}) {
+	if b == nil {
+		return true, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used >= b.max {
+		return false, b.avail
+	}
+	b.used++
+	return true, nil
+}
+
+func (b *connBudget) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used--
+	close(b.avail)
+	b.avail = make(chan struct{})
+}
+
+type MultiHostPoolConfig struct {
+	// Template is the config of the pool of each host. Its Dialer is
+	// ignored, DialerFactory is used instead.
+	Template PoolConfig
+
+	// DialerFactory returns the dialer of the pool of host, which is the
+	// authority (host[:port]) of the request url. Required.
+	DialerFactory func(host string) func(ctx context.Context) (*quic.Conn, *http3.Transport, error)
+
+	// MaxTotalConnections limits the number of connections of all hosts.
+	// Default (0) means unlimited. Each host is still limited by
+	// Template.MaxConnections.
+	MaxTotalConnections int
+}
+
+// MultiHostPool is a http.RoundTripper that keeps a ConnPool for each
+// request host, so one transport can serve multiple DoH3 endpoints.
+// Connections are never shared between hosts. Pools are created lazily.
+type MultiHostPool struct {
+	template      PoolConfig
+	dialerFactory func(host string) func(ctx context.Context) (*quic.Conn, *http3.Transport, error)
+	budget        *connBudget
+
+	mu     sync.Mutex
+	pools  map[string]*ConnPool
+	closed bool
+}
+
+func NewMultiHostPool(cfg MultiHostPoolConfig) (*MultiHostPool, error) {
+	if cfg.DialerFactory == nil {
+		return nil, errors.New("DialerFactory is required")
+	}
+	m := &MultiHostPool{
+		template:      cfg.Template,
+		dialerFactory: cfg.DialerFactory,
+		pools:         make(map[string]*ConnPool),
+	}
+	if cfg.MaxTotalConnections > 0 {
+		m.budget = newConnBudget(cfg.MaxTotalConnections)
+	}
+	return m, nil
+}
+
+// pool returns the pool of host, it creates one if there is none.
+func (m *MultiHostPool) pool(host string) (*ConnPool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, errPoolClosed
+	}
+	if p := m.pools[host]; p != nil {
+		return p, nil
+	}
+
+	cfg := m.template
+	cfg.Dialer = m.dialerFactory(host)
+	if cfg.Dialer == nil {
+		return nil, fmt.Errorf("no dialer for host %s", host)
+	}
+	p, err := newConnPool(cfg, m.budget)
+	if err != nil {
+		return nil, err
+	}
+	m.pools[host] = p
+	return p, nil
+}
+
+func (m *MultiHostPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	p, err := m.pool(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	return roundTrip(p, req)
+}
+
+func (m *MultiHostPool) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for _, p := range m.pools {
+		_ = p.Close()
+	}
+	return nil
+}
+
+// Stats returns the sum of the stats of all hosts.
+func (m *MultiHostPool) Stats() (active int, total int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.pools {
+		a, t := p.Stats()
+		active += a
+		total += t
+	}
+	return active, total
+}
+
+// ReuseStats returns the sum of the reuse stats of all hosts.
+func (m *MultiHostPool) ReuseStats() (reused uint64, dialed uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.pools {
+		r, d := p.ReuseStats()
+		reused += r
+		dialed += d
+	}
+	return reused, dialed
+}
+
+// ConnStats returns the connection stats of each host.
+func (m *MultiHostPool) ConnStats() map[string][]ConnStat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[string][]ConnStat, len(m.pools))
+	for host, p := range m.pools {
+		stats[host] = p.ConnStats()
+	}
+	return stats
+}
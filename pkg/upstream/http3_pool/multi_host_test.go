@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http3_pool
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestMultiHostPool(t *testing.T) {
+	type dialer = func(ctx context.Context) (*quic.Conn, *http3.Transport, error)
+	servers := map[string]dialer{
+		"a.example:443": newTestQUICServer(t),
+		"b.example:443": newTestQUICServer(t),
+	}
+	dials := map[string]*atomic.Int32{"a.example:443": {}, "b.example:443": {}}
+	factory := func(host string) dialer {
+		dial := servers[host]
+		if dial == nil {
+			return nil
+		}
+		return func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+			dials[host].Add(1)
+			return dial(ctx)
+		}
+	}
+
+	m, err := NewMultiHostPool(MultiHostPoolConfig{
+		Template:      PoolConfig{MaxConnections: 2},
+		DialerFactory: factory,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	get := func(host string) *pooledConn {
+		t.Helper()
+		p, err := m.pool(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc
+	}
+
+	a1, a2 := get("a.example:443"), get("a.example:443")
+	b := get("b.example:443")
+	if a1 != a2 {
+		t.Fatal("connections of the same host should be reused")
+	}
+	if b == a1 || b.conn.RemoteAddr().String() == a1.conn.RemoteAddr().String() {
+		t.Fatal("connections should not be shared across hosts")
+	}
+	if dials["a.example:443"].Load() != 1 || dials["b.example:443"].Load() != 1 {
+		t.Fatalf("expected 1 dial per host, got %d %d", dials["a.example:443"].Load(), dials["b.example:443"].Load())
+	}
+	if _, total := m.Stats(); total != 2 {
+		t.Fatalf("expected 2 connections in total, got %d", total)
+	}
+	if stats := m.ConnStats(); len(stats) != 2 || len(stats["a.example:443"]) != 1 {
+		t.Fatalf("unexpected conn stats %+v", stats)
+	}
+
+	// RoundTrip dispatches by the request host.
+	req, _ := http.NewRequest(http.MethodGet, "https://c.example/dns-query", nil)
+	if _, err := m.RoundTrip(req); err == nil {
+		t.Fatal("expected an error for a host without a dialer")
+	}
+}
+
+func TestMultiHostPoolMaxTotalConnections(t *testing.T) {
+	dial := newTestQUICServer(t)
+	m, err := NewMultiHostPool(MultiHostPoolConfig{
+		Template: PoolConfig{MaxConnections: 2},
+		DialerFactory: func(string) func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+			return dial
+		},
+		MaxTotalConnections: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	pa, _ := m.pool("a.example")
+	pb, _ := m.pool("b.example")
+	a, err := pa.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := pb.Get(ctx); err == nil {
+		t.Fatal("the shared budget should be exhausted")
+	}
+
+	// Releasing a connection of a unblocks a waiter of b.
+	res := make(chan error, 1)
+	go func() {
+		_, err := pb.Get(context.Background())
+		res <- err
+	}()
+	time.Sleep(time.Millisecond * 20)
+	pa.Release(a, false)
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("waiter of b was not unblocked")
+	}
+	if _, total := m.Stats(); total != 1 {
+		t.Fatalf("expected 1 connection in total, got %d", total)
+	}
+}
@@ -21,7 +21,9 @@ package http3_pool
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,35 +33,167 @@ import (
 	"go.uber.org/zap"
 )
 
+var (
+	errConnIdle      = errors.New("idle timeout in pool")
+	errConnUnhealthy = errors.New("released as unhealthy")
+	errPoolClosed    = errors.New("pool closed")
+	errConnExpired   = errors.New("max lifetime reached")
+)
+
+const (
+	// maxRetiredStats is the number of retired connections kept for ConnStats.
+	maxRetiredStats = 16
+
+	// expiredConnGracePeriod is how long a connection that reached
+	// PoolConfig.MaxConnLifetime stays open for requests in flight.
+	expiredConnGracePeriod = 10 * time.Second
+
+	healthCheckInterval        = 30 * time.Second
+	defaultHealthProbeInterval = 30 * time.Second
+	maxHealthProbeTimeout      = 5 * time.Second
+)
+
 type pooledConn struct {
 	conn      *quic.Conn
 	transport *http3.Transport
+	createdAt time.Time
 	lastUsed  time.Time
 	healthy   atomic.Bool
+	lastErr   atomic.Pointer[error] // why the conn became unhealthy, nil if it is healthy.
+
+	// retiring is set when pc expired and will be closed after
+	// expiredConnGracePeriod. Guarded by ConnPool.mu.
+	retiring bool
 }
 
-type ConnPool struct {
-	minConnections int
-	maxConnections int
-	idleTimeout    time.Duration
+// setLastErr records err as the reason why pc became unhealthy. The close
+// reason of the quic connection takes precedence, if it was closed.
+// Only the first reason is kept.
+func (pc *pooledConn) setLastErr(err error) {
+	if cause := context.Cause(pc.conn.Context()); cause != nil {
+		err = cause
+	}
+	pc.lastErr.CompareAndSwap(nil, &err)
+}
 
-	mu     sync.Mutex
-	conns  []*pooledConn
-	dialer func(ctx context.Context) (*quic.Conn, *http3.Transport, error)
+func (pc *pooledConn) getLastErr() error {
+	if err := pc.lastErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// ConnStat describes a connection of the pool.
+type ConnStat struct {
+	RemoteAddr string
+	LastUsed   time.Time
+	Healthy    bool
+
+	// Retired is true if the connection was removed from the pool.
+	Retired bool
+
+	// LastErr is why the connection became unhealthy or was retired, e.g.
+	// the quic close reason (idle timeout, TLS alert, application error...)
+	// or the error passed to ReleaseWithError.
+	LastErr error
+}
+
+type ConnPool struct {
+	minConnections   int
+	maxConnections   int
+	idleTimeout      time.Duration
+	failOnExhaustion bool
+	maxWait          time.Duration
+	maxDials         int
+	maxLifetime      time.Duration
+	healthProbe      func(ctx context.Context, conn *quic.Conn) error
+	probeInterval    time.Duration
+
+	mu      sync.Mutex
+	conns   []*pooledConn
+	retired []ConnStat    // Most recently retired connections, the newest last.
+	dialing int           // number of dials in progress, they count towards maxConnections.
+	avail   chan struct{} // closed and renewed when a connection or a slot may become available.
+	dialer  func(ctx context.Context) (*quic.Conn, *http3.Transport, error)
+
+	// Number of connections handed out by Get and not released yet,
+	// see Drain. Guarded by mu.
+	inFlight int
+
+	onNewConn func(*quic.Conn, *http3.Transport) error
+
+	// budget, if not nil, is shared with other pools and limits their
+	// total number of connections, see MultiHostPool.
+	budget *connBudget
 
 	logger *zap.Logger
 	closed atomic.Bool
+
+	// Number of connections handed out by Get, see ReuseStats.
+	reused atomic.Uint64
+	dialed atomic.Uint64
+
+	// For Collector.
+	name             string
+	dials            atomic.Uint64
+	dialFailures     atomic.Uint64
+	removedIdle      atomic.Uint64
+	removedUnhealthy atomic.Uint64 // by the health check or the health probe.
 }
 
 type PoolConfig struct {
+	// Name is the "name" label of the metrics of the pool, see Collector.
+	Name string
+
 	MinConnections int
 	MaxConnections int
 	IdleTimeout    time.Duration
 	Dialer         func(ctx context.Context) (*quic.Conn, *http3.Transport, error)
 	Logger         *zap.Logger
+
+	// When the pool is exhausted, Get waits for a connection to become
+	// available. The wait is bounded by the ctx of Get and MaxWait
+	// (if > 0). FailOnExhaustion makes Get return an error immediately
+	// instead.
+	FailOnExhaustion bool
+	MaxWait          time.Duration
+
+	// OnNewConn, if set, is called with every newly dialed connection
+	// before it enters the pool. If it returns an error, the connection
+	// is closed and the dial fails.
+	OnNewConn func(*quic.Conn, *http3.Transport) error
+
+	// MaxConcurrentDials limits the number of dials in progress. When the
+	// limit is reached, Get waits for an in-progress dial instead of
+	// dialing, even if FailOnExhaustion is set. The wait is bounded by
+	// the ctx of Get. This avoids a burst of handshakes on a cold pool.
+	// Default (0) is MaxConnections.
+	MaxConcurrentDials int
+
+	// MaxConnLifetime retires connections older than it, even if they
+	// are busy and healthy, so new server addresses and certificates are
+	// eventually picked up. Retired connections are replaced on demand or
+	// to maintain MinConnections. Default (0) means unlimited.
+	MaxConnLifetime time.Duration
+
+	// HealthProbe, if set, is called with every pooled connection each
+	// HealthProbeInterval, e.g. to send a lightweight request. If it
+	// returns an error, the connection is removed. This catches half-dead
+	// paths, where the connection is still open but its streams time out.
+	// The ctx of HealthProbe is canceled after HealthProbeInterval or 5s,
+	// whichever is shorter. Without it, the pool only checks whether
+	// connections were closed.
+	HealthProbe         func(ctx context.Context, conn *quic.Conn) error
+	HealthProbeInterval time.Duration // Default is 30s.
 }
 
 func NewConnPool(cfg PoolConfig) (*ConnPool, error) {
+	return newConnPool(cfg, nil)
+}
+
+// newConnPool is NewConnPool. The pool shares budget with other pools,
+// see ConnPool.budget.
+func newConnPool(cfg PoolConfig, budget *connBudget) (*ConnPool, error) {
 	if cfg.MinConnections < 0 {
 		return nil, fmt.Errorf("MinConnections cannot be negative")
 	}
@@ -72,14 +206,30 @@ func NewConnPool(cfg PoolConfig) (*ConnPool, error) {
 	if cfg.IdleTimeout <= 0 {
 		cfg.IdleTimeout = 60 * time.Second
 	}
+	if cfg.MaxConcurrentDials <= 0 || cfg.MaxConcurrentDials > cfg.MaxConnections {
+		cfg.MaxConcurrentDials = cfg.MaxConnections
+	}
+	if cfg.HealthProbeInterval <= 0 {
+		cfg.HealthProbeInterval = defaultHealthProbeInterval
+	}
 
 	pool := &ConnPool{
-		minConnections: cfg.MinConnections,
-		maxConnections: cfg.MaxConnections,
-		idleTimeout:    cfg.IdleTimeout,
-		dialer:         cfg.Dialer,
-		logger:         cfg.Logger,
-		conns:          make([]*pooledConn, 0, cfg.MaxConnections),
+		minConnections:   cfg.MinConnections,
+		maxConnections:   cfg.MaxConnections,
+		idleTimeout:      cfg.IdleTimeout,
+		failOnExhaustion: cfg.FailOnExhaustion,
+		maxWait:          cfg.MaxWait,
+		maxDials:         cfg.MaxConcurrentDials,
+		maxLifetime:      cfg.MaxConnLifetime,
+		name:             cfg.Name,
+		healthProbe:      cfg.HealthProbe,
+		probeInterval:    cfg.HealthProbeInterval,
+		dialer:           cfg.Dialer,
+		onNewConn:        cfg.OnNewConn,
+		budget:           budget,
+		logger:           cfg.Logger,
+		conns:            make([]*pooledConn, 0, cfg.MaxConnections),
+		avail:            make(chan struct{}),
 	}
 
 	if pool.logger == nil {
@@ -92,68 +242,293 @@ func NewConnPool(cfg PoolConfig) (*ConnPool, error) {
 	return pool, nil
 }
 
+// Get returns a connection of the pool. Connections are multiplexed, the
+// same one may be handed out to concurrent callers. Each connection
+// handed out must be given back by one Release, see Drain.
 func (p *ConnPool) Get(ctx context.Context) (*pooledConn, error) {
-	if p.closed.Load() {
-		return nil, fmt.Errorf("connection pool is closed")
+	pc, _, err := p.get(ctx, false)
+	return pc, err
+}
+
+// get is Get, but it always dials a new connection if fresh is set.
+// reused reports whether pc was already in the pool.
+func (p *ConnPool) get(ctx context.Context, fresh bool) (pc *pooledConn, reused bool, err error) {
+	var maxWaitC <-chan time.Time
+	if !p.failOnExhaustion && p.maxWait > 0 {
+		t := time.NewTimer(p.maxWait)
+		defer t.Stop()
+		maxWaitC = t.C
+	}
+
+	for {
+		p.mu.Lock()
+		// Under p.mu, so Drain does not miss a connection handed out here.
+		if p.closed.Load() {
+			p.mu.Unlock()
+			return nil, false, fmt.Errorf("connection pool is closed")
+		}
+		now := time.Now()
+		for i := len(p.conns) - 1; i >= 0; i-- {
+			pc := p.conns[i]
+			if p.expired(pc, now) {
+				p.retireExpiredConn(i)
+				continue
+			}
+			if pc.healthy.Load() && now.Sub(pc.lastUsed) < p.idleTimeout {
+				if fresh {
+					continue
+				}
+				pc.lastUsed = now
+				p.inFlight++
+				p.mu.Unlock()
+				p.reused.Add(1)
+				return pc, true, nil
+			}
+			reason := errConnIdle
+			if !pc.healthy.Load() {
+				reason = errConnUnhealthy
+			}
+			p.removeConn(i, reason)
+		}
+
+		exhausted := len(p.conns)+p.dialing >= p.maxConnections
+		var budgetAvail <-chan struct{}
+		if !exhausted && p.dialing < p.maxDials {
+			var ok bool
+			if ok, budgetAvail = p.budget.tryAcquire(); ok {
+				p.dialing++
+				p.mu.Unlock()
+				pc, err := p.dialNew(ctx, true)
+				return pc, false, err
+			}
+			exhausted = true // The shared budget is exhausted.
+		}
+
+		avail := p.avail
+		p.mu.Unlock()
+		if !exhausted {
+			// Dials are throttled, wait for one of them.
+			select {
+			case <-avail:
+				continue
+			case <-ctx.Done():
+				return nil, false, fmt.Errorf("waiting for connection dial, %w", context.Cause(ctx))
+			}
+		}
+		if p.failOnExhaustion {
+			return nil, false, fmt.Errorf("connection pool exhausted (max: %d)", p.maxConnections)
+		}
+
+		select {
+		case <-avail:
+		case <-budgetAvail:
+		case <-maxWaitC:
+			return nil, false, fmt.Errorf("connection pool exhausted (max: %d), max wait time reached", p.maxConnections)
+		case <-ctx.Done():
+			return nil, false, fmt.Errorf("connection pool exhausted (max: %d), %w", p.maxConnections, context.Cause(ctx))
+		}
 	}
+}
+
+// dialNew dials a new connection for a slot that was reserved
+// by increasing p.dialing. If handOut is set, the connection is counted
+// as handed out by Get.
+func (p *ConnPool) dialNew(ctx context.Context, handOut bool) (*pooledConn, error) {
+	conn, transport, err := p.dial(ctx)
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.dialing--
+	defer p.notifyAvail()
 
+	if err != nil {
+		p.budget.release()
+		return nil, err
+	}
+	if p.closed.Load() {
+		p.budget.release()
+		conn.CloseWithError(0, "pool closed")
+		return nil, fmt.Errorf("connection pool is closed")
+	}
 	now := time.Now()
+	pc := &pooledConn{
+		conn:      conn,
+		transport: transport,
+		createdAt: now,
+		lastUsed:  now,
+	}
+	pc.healthy.Store(true)
+	p.conns = append(p.conns, pc)
+	if handOut {
+		p.inFlight++
+		p.dialed.Add(1)
+	}
+	return pc, nil
+}
 
-	for i := len(p.conns) - 1; i >= 0; i-- {
-		pc := p.conns[i]
-		if pc.healthy.Load() && now.Sub(pc.lastUsed) < p.idleTimeout {
-			pc.lastUsed = now
-			return pc, nil
+// Warmup dials connections concurrently until the pool has
+// PoolConfig.MinConnections, instead of waiting for the health check to
+// do it. Call it at startup, so the first requests don't pay for the
+// handshakes. It returns the errors of the failed dials, if any.
+func (p *ConnPool) Warmup(ctx context.Context) error {
+	p.mu.Lock()
+	n := p.minConnections - len(p.conns) - p.dialing
+	p.mu.Unlock()
+
+	errs := make([]error, max(n, 0))
+	var wg sync.WaitGroup
+	for i := range errs {
+		p.mu.Lock()
+		if p.closed.Load() || len(p.conns)+p.dialing >= p.minConnections {
+			p.mu.Unlock()
+			break
 		}
-		p.removeConn(i)
+		if ok, _ := p.budget.tryAcquire(); !ok {
+			p.mu.Unlock()
+			errs[i] = errors.New("connection budget exhausted")
+			break
+		}
+		p.dialing++
+		p.mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = p.dialNew(ctx, false)
+		}()
 	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
 
-	if len(p.conns) < p.maxConnections {
-		conn, transport, err := p.dialer(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("failed to dial new connection: %w", err)
-		}
-		pc := &pooledConn{
-			conn:      conn,
-			transport: transport,
-			lastUsed:  now,
+// dial dials a new connection and validates it with p.onNewConn.
+func (p *ConnPool) dial(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+	p.dials.Add(1)
+	conn, transport, err := p.dialer(ctx)
+	if err != nil {
+		p.dialFailures.Add(1)
+		return nil, nil, fmt.Errorf("failed to dial new connection: %w", err)
+	}
+	if p.onNewConn != nil {
+		if err := p.onNewConn(conn, transport); err != nil {
+			p.dialFailures.Add(1)
+			conn.CloseWithError(0, "rejected")
+			return nil, nil, fmt.Errorf("new connection rejected: %w", err)
 		}
-		pc.healthy.Store(true)
-		p.conns = append(p.conns, pc)
-		return pc, nil
 	}
+	return conn, transport, nil
+}
 
-	return nil, fmt.Errorf("connection pool exhausted (max: %d)", p.maxConnections)
+// notifyAvail wakes up all Get calls that are waiting for a connection.
+// It must be called with p.mu held.
+func (p *ConnPool) notifyAvail() {
+	close(p.avail)
+	p.avail = make(chan struct{})
 }
 
 func (p *ConnPool) Release(pc *pooledConn, healthy bool) {
+	if healthy {
+		p.ReleaseWithError(pc, nil)
+	} else {
+		p.ReleaseWithError(pc, errConnUnhealthy)
+	}
+}
+
+// ReleaseWithError is like Release. A non-nil err marks pc unhealthy and
+// is recorded as the reason, see ConnStat.LastErr.
+func (p *ConnPool) ReleaseWithError(pc *pooledConn, err error) {
 	if pc == nil {
 		return
 	}
 
-	pc.healthy.Store(healthy)
-	pc.lastUsed = time.Now()
-
+	healthy := err == nil
 	if !healthy {
+		// Before closing it, which would override the close reason.
+		pc.setLastErr(err)
 		pc.conn.CloseWithError(0, "unhealthy")
-		p.mu.Lock()
-		for i := range p.conns {
-			if p.conns[i] == pc {
-				p.removeConn(i)
-				break
-			}
+	}
+	pc.healthy.Store(healthy)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight--
+	if p.inFlight == 0 && p.closed.Load() {
+		p.notifyAvail() // for Drain
+	}
+	if i := slices.Index(p.conns, pc); i >= 0 {
+		pc.lastUsed = time.Now()
+		if !healthy {
+			p.removeConn(i, err)
 		}
-		p.mu.Unlock()
+		return
+	}
+
+	// pc was removed from the pool between Get and Release, e.g. by a
+	// health check. Nobody will reuse it, make sure it is closed. Expired
+	// conns are closed after their grace period instead.
+	if !pc.retiring {
+		pc.conn.CloseWithError(0, "")
 	}
 }
 
-func (p *ConnPool) removeConn(index int) {
+// removeConn closes and removes the conn at index, and keeps its stat.
+// reason is recorded if pc has no last error yet.
+// It must be called with p.mu held.
+func (p *ConnPool) removeConn(index int, reason error) {
+	if reason == errConnIdle {
+		p.removedIdle.Add(1)
+	}
 	pc := p.conns[index]
+	pc.setLastErr(reason)
 	pc.conn.CloseWithError(0, "")
+	p.detachConn(index)
+}
+
+// retireExpiredConn is like removeConn, but it closes the conn after
+// expiredConnGracePeriod, because the conn may still have requests in flight.
+// It must be called with p.mu held.
+func (p *ConnPool) retireExpiredConn(index int) {
+	pc := p.conns[index]
+	pc.setLastErr(errConnExpired)
+	pc.retiring = true
+	p.detachConn(index)
+	time.AfterFunc(expiredConnGracePeriod, func() {
+		pc.conn.CloseWithError(0, "")
+	})
+}
+
+// detachConn removes the conn at index from the pool without closing it.
+// It must be called with p.mu held.
+func (p *ConnPool) detachConn(index int) {
+	pc := p.conns[index]
 	p.conns = append(p.conns[:index], p.conns[index+1:]...)
+	p.addRetired(pc)
+	p.budget.release()
+	p.notifyAvail()
+}
+
+// expired reports whether pc reached p.maxLifetime.
+func (p *ConnPool) expired(pc *pooledConn, now time.Time) bool {
+	return p.maxLifetime > 0 && now.Sub(pc.createdAt) >= p.maxLifetime
+}
+
+func (p *ConnPool) addRetired(pc *pooledConn) {
+	stat := pc.stat()
+	stat.Retired = true
+	if len(p.retired) >= maxRetiredStats {
+		p.retired = append(p.retired[:0], p.retired[1:]...)
+	}
+	p.retired = append(p.retired, stat)
+}
+
+// stat must be called with p.mu held.
+func (pc *pooledConn) stat() ConnStat {
+	return ConnStat{
+		RemoteAddr: pc.conn.RemoteAddr().String(),
+		LastUsed:   pc.lastUsed,
+		Healthy:    pc.healthy.Load(),
+		LastErr:    pc.getLastErr(),
+	}
 }
 
 func (p *ConnPool) Close() error {
@@ -163,17 +538,55 @@ func (p *ConnPool) Close() error {
 	defer p.mu.Unlock()
 
 	for _, pc := range p.conns {
+		pc.setLastErr(errPoolClosed)
 		pc.conn.CloseWithError(0, "pool closed")
+		p.budget.release()
 	}
 	p.conns = p.conns[:0]
+	p.notifyAvail()
 
 	return nil
 }
 
+// Drain closes p gracefully. It stops handing out connections at once,
+// waits for the connections handed out by Get to be released, and then
+// closes all of them like Close. If ctx is done first, the connections
+// are closed anyway and the cause of ctx is returned.
+func (p *ConnPool) Drain(ctx context.Context) error {
+	defer p.Close()
+
+	p.mu.Lock()
+	p.closed.Store(true)
+	p.notifyAvail() // Waiting Gets will see that p is closed.
+	p.mu.Unlock()
+
+	for {
+		p.mu.Lock()
+		n := p.inFlight
+		avail := p.avail
+		p.mu.Unlock()
+		if n <= 0 {
+			return nil
+		}
+		select {
+		case <-avail:
+		case <-ctx.Done():
+			return fmt.Errorf("%d requests still in flight, %w", n, context.Cause(ctx))
+		}
+	}
+}
+
 func (p *ConnPool) healthCheckLoop() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(healthCheckInterval)
 	defer ticker.Stop()
 
+	var probeC <-chan time.Time // nil, never fires if there is no probe.
+	if p.healthProbe != nil {
+		probeTicker := time.NewTicker(p.probeInterval)
+		defer probeTicker.Stop()
+		probeC = probeTicker.C
+	}
+
 	for {
 		select {
 		case <-ticker.C:
@@ -181,6 +594,47 @@ func (p *ConnPool) healthCheckLoop() {
 				return
 			}
 			p.checkHealth()
+		case <-probeC:
+			if p.closed.Load() {
+				return
+			}
+			p.probeHealth()
+		}
+	}
+}
+
+// probeHealth calls p.healthProbe with all pooled connections concurrently,
+// and removes the ones that failed it. p.mu is not held during the probes.
+func (p *ConnPool) probeHealth() {
+	p.mu.Lock()
+	conns := slices.Clone(p.conns)
+	p.mu.Unlock()
+
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i, pc := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), min(p.probeInterval, maxHealthProbeTimeout))
+			defer cancel()
+			errs[i] = p.healthProbe(ctx, pc.conn)
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, pc := range conns {
+		if errs[i] == nil {
+			continue
+		}
+		p.logger.Debug("connection failed health probe", zap.Stringer("addr", pc.conn.RemoteAddr()), zap.Error(errs[i]))
+		pc.healthy.Store(false)
+		// pc may have been removed during the probe.
+		if idx := slices.Index(p.conns, pc); idx >= 0 {
+			p.removedUnhealthy.Add(1)
+			p.removeConn(idx, fmt.Errorf("health probe failed, %w", errs[i]))
 		}
 	}
 }
@@ -192,17 +646,26 @@ func (p *ConnPool) checkHealth() {
 	now := time.Now()
 	for i := len(p.conns) - 1; i >= 0; i-- {
 		pc := p.conns[i]
-		if now.Sub(pc.lastUsed) > p.idleTimeout || !p.checkConnHealth(pc) {
-			p.removeConn(i)
+		if p.expired(pc, now) {
+			p.retireExpiredConn(i)
+		} else if now.Sub(pc.lastUsed) > p.idleTimeout {
+			p.removeConn(i, errConnIdle)
+		} else if !p.checkConnHealth(pc) {
+			p.removedUnhealthy.Add(1)
+			p.removeConn(i, errConnUnhealthy)
 		}
 	}
 
-	for len(p.conns) < p.minConnections {
+	for len(p.conns)+p.dialing < p.minConnections {
+		if ok, _ := p.budget.tryAcquire(); !ok {
+			break
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		conn, transport, err := p.dialer(ctx)
+		conn, transport, err := p.dial(ctx)
 		cancel()
 
 		if err != nil {
+			p.budget.release()
 			p.logger.Warn("failed to maintain minimum connections", zap.Error(err))
 			break
 		}
@@ -210,15 +673,18 @@ func (p *ConnPool) checkHealth() {
 		pc := &pooledConn{
 			conn:      conn,
 			transport: transport,
+			createdAt: now,
 			lastUsed:  now,
 		}
 		pc.healthy.Store(true)
 		p.conns = append(p.conns, pc)
+		p.notifyAvail()
 	}
 }
 
 func (p *ConnPool) checkConnHealth(pc *pooledConn) bool {
 	if pc.conn.Context().Err() != nil {
+		pc.setLastErr(errConnUnhealthy) // records the close reason
 		pc.healthy.Store(false)
 		return false
 	}
@@ -253,7 +719,7 @@ func (p *ConnPool) cleanupIdle() {
 		}
 		pc := p.conns[i]
 		if now.Sub(pc.lastUsed) > p.idleTimeout {
-			p.removeConn(i)
+			p.removeConn(i, errConnIdle)
 		}
 	}
 }
@@ -270,3 +736,24 @@ func (p *ConnPool) Stats() (active int, total int) {
 	}
 	return active, len(p.conns)
 }
+
+// ConnStats returns the stats of the connections in the pool, followed by
+// the stats of the most recently retired connections.
+func (p *ConnPool) ConnStats() []ConnStat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]ConnStat, 0, len(p.conns)+len(p.retired))
+	for _, pc := range p.conns {
+		stats = append(stats, pc.stat())
+	}
+	return append(stats, p.retired...)
+}
+
+// ReuseStats returns the number of connections handed out by Get that were
+// reused from the pool and that were freshly dialed. A low reuse ratio,
+// reused / (reused + dialed), means connections are retired too often,
+// e.g. the idle timeout is too aggressive.
+func (p *ConnPool) ReuseStats() (reused uint64, dialed uint64) {
+	return p.reused.Load(), p.dialed.Load()
+}
@@ -0,0 +1,645 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http3_pool
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/utils"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newTestQUICServer starts a quic listener that accepts and holds connections.
+// It returns a dialer for the pool that connects to it.
+func newTestQUICServer(t testing.TB) func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+	t.Helper()
+	cert, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{http3.NextProtoH3},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.CloseWithError(0, "") })
+		}
+	}()
+
+	addr := l.Addr().String()
+	return func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+		c, err := quic.DialAddr(ctx, addr, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{http3.NextProtoH3},
+		}, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c, &http3.Transport{}, nil
+	}
+}
+
+func TestConnPoolWaitOnExhaustion(t *testing.T) {
+	// Get waits by default.
+	dial := newTestQUICServer(t)
+	dialStarted := make(chan struct{})
+	dialRelease := make(chan struct{})
+	blockingDial := func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+		close(dialStarted)
+		<-dialRelease
+		return dial(ctx)
+	}
+
+	p, err := NewConnPool(PoolConfig{
+		MaxConnections: 1,
+		Dialer:         blockingDial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The first Get takes the only slot and blocks in the dialer.
+	firstRes := make(chan *pooledConn, 1)
+	go func() {
+		pc, err := p.Get(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		firstRes <- pc
+	}()
+	<-dialStarted
+
+	waiterRes := make(chan *pooledConn, 1)
+	go func() {
+		pc, err := p.Get(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		waiterRes <- pc
+	}()
+
+	select {
+	case <-waiterRes:
+		t.Fatal("waiter should be blocked while the pool is exhausted")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// Releasing the slot unblocks the waiter.
+	close(dialRelease)
+	first := <-firstRes
+	select {
+	case pc := <-waiterRes:
+		if pc == nil || pc != first {
+			t.Fatal("waiter should reuse the newly dialed connection")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("waiter was not unblocked")
+	}
+}
+
+func TestConnPoolExhaustedFailFast(t *testing.T) {
+	dialStarted := make(chan struct{})
+	dialRelease := make(chan struct{})
+	defer close(dialRelease)
+	blockingDial := func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+		close(dialStarted)
+		<-dialRelease
+		return nil, nil, errors.New("dial canceled")
+	}
+
+	p, err := NewConnPool(PoolConfig{MaxConnections: 1, Dialer: blockingDial, FailOnExhaustion: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	go p.Get(context.Background())
+	<-dialStarted
+
+	if _, err := p.Get(context.Background()); err == nil {
+		t.Fatal("expected an exhausted error")
+	}
+
+	// Without FailOnExhaustion, the wait honors ctx.
+	p.failOnExhaustion = false
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := p.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a ctx deadline error, got %v", err)
+	}
+
+	// And MaxWait, independent of ctx.
+	p.maxWait = time.Millisecond * 50
+	start := time.Now()
+	if _, err := p.Get(context.Background()); err == nil || !strings.Contains(err.Error(), "max wait time reached") {
+		t.Fatalf("expected a max wait error, got %v", err)
+	}
+	if d := time.Since(start); d < p.maxWait {
+		t.Fatalf("returned after %s, before MaxWait", d)
+	}
+}
+
+func TestConnPoolOnNewConn(t *testing.T) {
+	errRejected := errors.New("rejected")
+	var dialed []*quic.Conn
+	dial := newTestQUICServer(t)
+	p, err := NewConnPool(PoolConfig{
+		MinConnections: 1,
+		MaxConnections: 2,
+		Dialer: func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+			c, tr, err := dial(ctx)
+			if err == nil {
+				dialed = append(dialed, c)
+			}
+			return c, tr, err
+		},
+		OnNewConn: func(c *quic.Conn, _ *http3.Transport) error {
+			return errRejected
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Get(context.Background()); !errors.Is(err, errRejected) {
+			t.Fatalf("expected a rejected error, got %v", err)
+		}
+	}
+	p.checkHealth() // min-connection maintenance
+
+	if _, total := p.Stats(); total != 0 {
+		t.Fatalf("rejected connections should not be pooled, got %d", total)
+	}
+	if len(dialed) != 4 {
+		t.Fatalf("expected 4 dials, got %d", len(dialed))
+	}
+	for _, c := range dialed {
+		if c.Context().Err() == nil {
+			t.Fatal("rejected connection was not closed")
+		}
+	}
+}
+
+func TestConnPoolMaxConcurrentDials(t *testing.T) {
+	const maxConns = 4
+	dial := newTestQUICServer(t)
+	var dialing, peakDialing, dials atomic.Int32
+	p, err := NewConnPool(PoolConfig{
+		MaxConnections:     maxConns,
+		MaxConcurrentDials: 1,
+		Dialer: func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+			dials.Add(1)
+			n := dialing.Add(1)
+			defer dialing.Add(-1)
+			for {
+				peak := peakDialing.Load()
+				if n <= peak || peakDialing.CompareAndSwap(peak, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond * 20) // make the handshake slow enough to overlap.
+			return dial(ctx)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			if _, err := p.Get(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := peakDialing.Load(); n != 1 {
+		t.Fatalf("expected at most 1 concurrent dial, got %d", n)
+	}
+	if n := dials.Load(); n > maxConns {
+		t.Fatalf("expected at most %d dials, got %d", maxConns, n)
+	}
+	if _, total := p.Stats(); total > maxConns {
+		t.Fatalf("expected at most %d connections, got %d", maxConns, total)
+	}
+}
+
+func TestConnPoolConnStats(t *testing.T) {
+	cert, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{http3.NextProtoH3},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The server closes every other connection with an application error.
+	var accepted int
+	go func() {
+		for {
+			c, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			accepted++
+			if accepted%2 == 0 {
+				c.CloseWithError(0x2, "go away")
+			} else {
+				t.Cleanup(func() { c.CloseWithError(0, "") })
+			}
+		}
+	}()
+
+	p, err := NewConnPool(PoolConfig{
+		MaxConnections: 1,
+		Dialer: func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+			c, err := quic.DialAddr(ctx, l.Addr().String(), &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{http3.NextProtoH3},
+			}, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			return c, &http3.Transport{}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Released with an error by the user.
+	errRoundTrip := errors.New("round trip failed")
+	pc, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ReleaseWithError(pc, errRoundTrip)
+
+	// Closed by the peer.
+	pc, err = p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pc.conn.Context().Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("connection was not closed by the server")
+	}
+	p.checkHealth()
+
+	stats := p.ConnStats()
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 retired connections, got %+v", stats)
+	}
+	for _, s := range stats {
+		if !s.Retired || s.Healthy || s.RemoteAddr == "" {
+			t.Fatalf("unexpected stat %+v", s)
+		}
+	}
+	if !errors.Is(stats[0].LastErr, errRoundTrip) {
+		t.Fatalf("expected the round trip error, got %v", stats[0].LastErr)
+	}
+	var appErr *quic.ApplicationError
+	if !errors.As(stats[1].LastErr, &appErr) || appErr.ErrorCode != 0x2 || !appErr.Remote {
+		t.Fatalf("expected the remote application error 0x2, got %v", stats[1].LastErr)
+	}
+}
+
+func TestConnPoolMaxConnLifetime(t *testing.T) {
+	const lifetime = time.Millisecond * 50
+	p, err := NewConnPool(PoolConfig{
+		MinConnections:  1,
+		MaxConnections:  1,
+		MaxConnLifetime: lifetime,
+		Dialer:          newTestQUICServer(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	first, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release(first, true)
+	if pc, err := p.Get(context.Background()); err != nil || pc != first {
+		t.Fatalf("a young connection should be reused, got %v, %v", pc, err)
+	}
+
+	// The busy and healthy connection is cycled once it is too old.
+	time.Sleep(lifetime)
+	second, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("an expired connection should not be reused")
+	}
+	if first.conn.Context().Err() != nil {
+		t.Fatal("an expired connection should stay open for requests in flight")
+	}
+
+	// The health check also retires it and maintains MinConnections.
+	time.Sleep(lifetime)
+	p.checkHealth()
+	stats := p.ConnStats()
+	if len(stats) != 3 {
+		t.Fatalf("expected 1 connection and 2 retired ones, got %+v", stats)
+	}
+	if stats[0].Retired || !stats[0].Healthy {
+		t.Fatalf("unexpected stat of the new connection %+v", stats[0])
+	}
+	for _, s := range stats[1:] {
+		if !s.Retired || !errors.Is(s.LastErr, errConnExpired) {
+			t.Fatalf("unexpected stat of the expired connection %+v", s)
+		}
+	}
+}
+
+func TestConnPoolReuseStats(t *testing.T) {
+	p, err := NewConnPool(PoolConfig{
+		MaxConnections: 1,
+		Dialer:         newTestQUICServer(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	pc, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused, dialed := p.ReuseStats(); reused != 0 || dialed != 1 {
+		t.Fatalf("expected 0 reused and 1 dialed, got %d, %d", reused, dialed)
+	}
+	p.Release(pc, true)
+
+	for i := 1; i <= 2; i++ {
+		pc, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Release(pc, true)
+		if reused, dialed := p.ReuseStats(); reused != uint64(i) || dialed != 1 {
+			t.Fatalf("expected %d reused and 1 dialed, got %d, %d", i, reused, dialed)
+		}
+	}
+}
+
+func TestConnPoolReleaseEvicted(t *testing.T) {
+	p, err := NewConnPool(PoolConfig{
+		MaxConnections: 4,
+		IdleTimeout:    time.Millisecond,
+		Dialer:         newTestQUICServer(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The conn is evicted without being closed between Get and Release.
+	pc, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.detachConn(slices.Index(p.conns, pc))
+	p.mu.Unlock()
+	p.Release(pc, true)
+	if pc.conn.Context().Err() == nil {
+		t.Fatal("a released conn that is no longer in the pool should be closed")
+	}
+	p.Release(pc, false)
+	if _, total := p.Stats(); total != 0 {
+		t.Fatalf("expected no conn in the pool, got %d", total)
+	}
+	if n := len(p.ConnStats()); n != 1 {
+		t.Fatalf("the conn should be retired once, got %d stats", n)
+	}
+
+	// Race health check evictions against releases.
+	for i := 0; i < 20; i++ {
+		pc, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 2)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.checkHealth()
+		}()
+		p.Release(pc, i%2 == 0)
+		<-done
+
+		p.mu.Lock()
+		tracked := slices.Contains(p.conns, pc)
+		p.mu.Unlock()
+		if !tracked && pc.conn.Context().Err() == nil {
+			t.Fatal("a conn that is no longer in the pool should be closed")
+		}
+	}
+}
+
+func TestConnPoolHealthProbe(t *testing.T) {
+	var failing atomic.Pointer[quic.Conn]
+	errProbe := errors.New("probe timed out")
+	p, err := NewConnPool(PoolConfig{
+		MinConnections: 2,
+		MaxConnections: 2,
+		Dialer:         newTestQUICServer(t),
+		HealthProbe: func(ctx context.Context, conn *quic.Conn) error {
+			if conn == failing.Load() {
+				return errProbe
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.checkHealth() // dials MinConnections
+	p.mu.Lock()
+	pcs := slices.Clone(p.conns)
+	p.mu.Unlock()
+
+	p.probeHealth()
+	if active, total := p.Stats(); total != 2 {
+		t.Fatalf("healthy connections should be kept, got %d active and %d total", active, total)
+	}
+
+	// The connection is open, but it fails the probe.
+	failing.Store(pcs[0].conn)
+	p.probeHealth()
+	stats := p.ConnStats()
+	if len(stats) != 2 || stats[0].Retired || !stats[1].Retired || !errors.Is(stats[1].LastErr, errProbe) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if pcs[0].conn.Context().Err() == nil {
+		t.Fatal("the connection that failed the probe should be closed")
+	}
+}
+
+func TestConnPoolWarmup(t *testing.T) {
+	p, err := NewConnPool(PoolConfig{
+		MinConnections: 2,
+		MaxConnections: 4,
+		Dialer:         newTestQUICServer(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err := p.Warmup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if active, total := p.Stats(); active != 2 || total != 2 {
+		t.Fatalf("want 2 connections after warmup, got %d active and %d total", active, total)
+	}
+	// Warmup does not hand out connections.
+	if reused, dialed := p.ReuseStats(); reused != 0 || dialed != 0 {
+		t.Fatalf("unexpected reuse stats %d, %d", reused, dialed)
+	}
+	// The pool is warm already.
+	if err := p.Warmup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, total := p.Stats(); total != 2 {
+		t.Fatalf("want 2 connections after the second warmup, got %d", total)
+	}
+}
+
+func TestConnPoolDrain(t *testing.T) {
+	p, err := NewConnPool(PoolConfig{MaxConnections: 1, Dialer: newTestQUICServer(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- p.Drain(context.Background()) }()
+	time.Sleep(time.Millisecond * 50)
+	if _, err := p.Get(context.Background()); err == nil {
+		t.Fatal("a draining pool should not hand out connections")
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("drain should wait for the request in flight, got %v", err)
+	default:
+	}
+	if pc.conn.Context().Err() != nil {
+		t.Fatal("the connection in use should stay open while draining")
+	}
+
+	p.Release(pc, true)
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if pc.conn.Context().Err() == nil {
+		t.Fatal("the connection should be closed after draining")
+	}
+
+	// The connections are closed anyway if the ctx is done.
+	p, err = NewConnPool(PoolConfig{MaxConnections: 1, Dialer: newTestQUICServer(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err = p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := p.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want a deadline exceeded error, got %v", err)
+	}
+	if pc.conn.Context().Err() == nil {
+		t.Fatal("the connection should be closed when the drain times out")
+	}
+}
+
+// TestConnPoolGetClosedUnderLock closes p while Get waits for p.mu, like
+// Drain does. Get must not hand out a connection then.
+func TestConnPoolGetClosedUnderLock(t *testing.T) {
+	p, err := NewConnPool(PoolConfig{MinConnections: 1, MaxConnections: 1, Dialer: newTestQUICServer(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Warmup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	p.mu.Lock()
+	res := make(chan error, 1)
+	go func() {
+		_, err := p.Get(context.Background())
+		res <- err
+	}()
+	time.Sleep(time.Millisecond * 50) // Get is waiting for p.mu.
+	p.closed.Store(true)
+	p.mu.Unlock()
+	if err := <-res; err == nil {
+		t.Fatal("a closed pool should not hand out connections")
+	}
+}
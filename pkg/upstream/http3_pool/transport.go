@@ -22,10 +22,14 @@ package http3_pool
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap"
@@ -36,6 +40,8 @@ type PooledTransport struct {
 	quicConfig *quic.Config
 	tlsConfig  *tls.Config
 	dialer     func(ctx context.Context) (*quic.Conn, *http3.Transport, error)
+	enable0RTT bool
+	logger     *zap.Logger
 }
 
 type TransportConfig struct {
@@ -46,45 +52,232 @@ type TransportConfig struct {
 	MaxConns    int
 	IdleTimeout time.Duration
 	Logger      *zap.Logger
+
+	// Addr is the server address (host:port) for the default dialer,
+	// which dials with QUICConfig and TLSConfig. It is required if
+	// Dialer is nil, and ignored otherwise.
+	Addr string
+
+	// Enable0RTT makes the default dialer resume TLS sessions and dial
+	// early, so GET requests on resumed connections are sent in 0-RTT
+	// without waiting for the handshake. TLSConfig.ClientSessionCache is
+	// set if it is nil. POST requests are never sent in 0-RTT, because
+	// 0-RTT data can be replayed.
+	Enable0RTT bool
+
+	// Options of the pool, see PoolConfig.
+	Name                string
+	FailOnExhaustion    bool
+	MaxWait             time.Duration
+	MaxConcurrentDials  int
+	MaxConnLifetime     time.Duration
+	HealthProbe         func(ctx context.Context, conn *quic.Conn) error
+	HealthProbeInterval time.Duration
+	OnNewConn           func(*quic.Conn, *http3.Transport) error
 }
 
 func NewPooledTransport(cfg TransportConfig) (*PooledTransport, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	p := &PooledTransport{
+		quicConfig: cfg.QUICConfig,
+		tlsConfig:  cfg.TLSConfig,
+		dialer:     cfg.Dialer,
+		enable0RTT: cfg.Enable0RTT && cfg.Dialer == nil,
+		logger:     logger,
+	}
+	if p.dialer == nil {
+		if len(cfg.Addr) == 0 {
+			return nil, errors.New("either Dialer or Addr is required")
+		}
+		p.tlsConfig = p.tlsConfig.Clone()
+		if p.tlsConfig == nil {
+			p.tlsConfig = new(tls.Config)
+		}
+		if len(p.tlsConfig.NextProtos) == 0 {
+			p.tlsConfig.NextProtos = []string{http3.NextProtoH3}
+		}
+		if p.enable0RTT && p.tlsConfig.ClientSessionCache == nil {
+			p.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+		addr := cfg.Addr
+		p.dialer = func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+			return p.dial(ctx, addr)
+		}
+	}
+
 	pool, err := NewConnPool(PoolConfig{
-		MinConnections: cfg.MinConns,
-		MaxConnections: cfg.MaxConns,
-		IdleTimeout:    cfg.IdleTimeout,
-		Dialer:         cfg.Dialer,
-		Logger:         cfg.Logger,
+		Name:                cfg.Name,
+		MinConnections:      cfg.MinConns,
+		MaxConnections:      cfg.MaxConns,
+		IdleTimeout:         cfg.IdleTimeout,
+		Dialer:              p.dialer,
+		Logger:              cfg.Logger,
+		FailOnExhaustion:    cfg.FailOnExhaustion,
+		MaxWait:             cfg.MaxWait,
+		OnNewConn:           cfg.OnNewConn,
+		MaxConcurrentDials:  cfg.MaxConcurrentDials,
+		MaxConnLifetime:     cfg.MaxConnLifetime,
+		HealthProbe:         cfg.HealthProbe,
+		HealthProbeInterval: cfg.HealthProbeInterval,
 	})
 	if err != nil {
 		return nil, err
 	}
+	p.pool = pool
+	return p, nil
+}
 
-	return &PooledTransport{
-		pool:       pool,
-		quicConfig: cfg.QUICConfig,
-		tlsConfig:  cfg.TLSConfig,
-		dialer:     cfg.Dialer,
-	}, nil
+// dial is the default dialer, see TransportConfig.Addr.
+func (p *PooledTransport) dial(ctx context.Context, addr string) (*quic.Conn, *http3.Transport, error) {
+	if !p.enable0RTT {
+		c, err := quic.DialAddr(ctx, addr, p.tlsConfig, p.quicConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c, p.newHTTP3Transport(c), nil
+	}
+
+	start := time.Now()
+	c, err := quic.DialAddrEarly(ctx, addr, p.tlsConfig, p.quicConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	ready := time.Since(start)
+	go func() {
+		select {
+		case <-c.HandshakeComplete():
+		case <-c.Context().Done():
+			return
+		}
+		if c.ConnectionState().Used0RTT {
+			handshake := time.Since(start)
+			p.logger.Debug("0-rtt connection resumed",
+				zap.Stringer("addr", c.RemoteAddr()),
+				zap.Duration("handshake", handshake),
+				zap.Duration("saved", handshake-ready),
+			)
+		}
+	}()
+	return c, p.newHTTP3Transport(c), nil
+}
+
+// newHTTP3Transport returns a http3.Transport that sends requests on c.
+func (p *PooledTransport) newHTTP3Transport(c *quic.Conn) *http3.Transport {
+	return &http3.Transport{
+		TLSClientConfig: p.tlsConfig,
+		QUICConfig:      p.quicConfig,
+		Dial: func(context.Context, string, *tls.Config, *quic.Config) (*quic.Conn, error) {
+			return c, nil
+		},
+	}
+}
+
+// Drain closes the pool gracefully, see ConnPool.Drain.
+func (p *PooledTransport) Drain(ctx context.Context) error {
+	return p.pool.Drain(ctx)
+}
+
+// Warmup dials up to TransportConfig.MinConns connections now, see
+// ConnPool.Warmup.
+func (p *PooledTransport) Warmup(ctx context.Context) error {
+	return p.pool.Warmup(ctx)
 }
 
 func (p *PooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	ctx := req.Context()
+	if p.enable0RTT && req.Method == http.MethodGet {
+		// GET is idempotent, safe to be replayed.
+		r := *req
+		r.Method = http3.MethodGet0RTT
+		req = &r
+	}
+	return roundTrip(p.pool, req)
+}
 
-	pc, err := p.pool.Get(ctx)
+// roundTrip sends req on a pooled connection. If a reused connection
+// fails with a connection level error, it was probably closed by the
+// server while it was idle in the pool, so req is retried once on a
+// newly dialed connection.
+func roundTrip(pool *ConnPool, req *http.Request) (*http.Response, error) {
+	pc, reused, err := pool.get(req.Context(), false)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get connection from pool: %w", err)
 	}
 
 	resp, err := pc.transport.RoundTrip(req)
-	if err != nil {
-		p.pool.Release(pc, false)
+	if err == nil {
+		releaseOnClose(pool, pc, resp)
+		return resp, nil
+	}
+	pool.ReleaseWithError(pc, err)
+	if !reused || !isConnErr(err) || req.Context().Err() != nil {
+		return nil, err
+	}
+	retryReq, ok := rewindBody(req)
+	if !ok {
 		return nil, err
 	}
 
+	pc, _, err = pool.get(req.Context(), true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection from pool: %w", err)
+	}
+	resp, err = pc.transport.RoundTrip(retryReq)
+	if err != nil {
+		pool.ReleaseWithError(pc, err)
+		return nil, err
+	}
+	releaseOnClose(pool, pc, resp)
 	return resp, nil
 }
 
+// releaseOnClose releases pc once the body of resp is closed, because
+// the request is in flight until then, see ConnPool.Drain.
+func releaseOnClose(pool *ConnPool, pc *pooledConn, resp *http.Response) {
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { pool.Release(pc, true) }}
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// isConnErr reports whether err means the quic connection is gone, as
+// opposed to an error of the request itself.
+func isConnErr(err error) bool {
+	var appErr *quic.ApplicationError
+	var idleErr *quic.IdleTimeoutError
+	var resetErr *quic.StatelessResetError
+	return errors.As(err, &appErr) || errors.As(err, &idleErr) || errors.As(err, &resetErr)
+}
+
+// rewindBody returns req with its body reset, so it can be sent again.
+// It returns false if the body cannot be reset.
+func rewindBody(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	r := req.Clone(req.Context())
+	r.Body = body
+	return r, true
+}
+
 func (p *PooledTransport) Close() error {
 	return p.pool.Close()
 }
@@ -92,3 +285,19 @@ func (p *PooledTransport) Close() error {
 func (p *PooledTransport) Stats() (active int, total int) {
 	return p.pool.Stats()
 }
+
+// ReuseStats returns the number of requests that were sent on reused
+// connections and on freshly dialed connections, see ConnPool.ReuseStats.
+func (p *PooledTransport) ReuseStats() (reused uint64, dialed uint64) {
+	return p.pool.ReuseStats()
+}
+
+func (p *PooledTransport) ConnStats() []ConnStat {
+	return p.pool.ConnStats()
+}
+
+// Collector returns a prometheus.Collector of the pool, see
+// ConnPool.Collector.
+func (p *PooledTransport) Collector() prometheus.Collector {
+	return p.pool.Collector()
+}
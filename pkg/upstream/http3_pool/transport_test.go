@@ -0,0 +1,256 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http3_pool
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestRoundTripRetryStaleConn(t *testing.T) {
+	cert, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{http3.NextProtoH3},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The server echoes request bodies, and closes its connections on
+	// demand, like a server that drops idle clients.
+	srv := &http3.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})}
+	var mu sync.Mutex
+	var serverConns []*quic.Conn
+	go func() {
+		for {
+			c, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			serverConns = append(serverConns, c)
+			mu.Unlock()
+			go srv.ServeQUICConn(c)
+		}
+	}()
+
+	addr := l.Addr().String()
+	p, err := NewConnPool(PoolConfig{
+		MaxConnections: 1,
+		Dialer: func(ctx context.Context) (*quic.Conn, *http3.Transport, error) {
+			c, err := quic.DialAddr(ctx, addr, &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{http3.NextProtoH3},
+			}, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			return c, &http3.Transport{
+				Dial: func(context.Context, string, *tls.Config, *quic.Config) (*quic.Conn, error) {
+					return c, nil
+				},
+			}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	post := func(body string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := roundTrip(p, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if b, _ := io.ReadAll(resp.Body); string(b) != body {
+			t.Fatalf("want body %q, got %q", body, b)
+		}
+	}
+
+	post("first")
+	stale := p.conns[0].conn
+	mu.Lock()
+	for _, c := range serverConns {
+		c.CloseWithError(0, "")
+	}
+	mu.Unlock()
+	<-stale.Context().Done()
+
+	// The pool still thinks the closed connection is healthy. The request
+	// fails on it and is sent again on a new one.
+	post("second")
+	if reused, dialed := p.ReuseStats(); reused != 1 || dialed != 2 {
+		t.Fatalf("want 1 reused and 2 dialed connections, got %d and %d", reused, dialed)
+	}
+}
+
+func TestPooledTransport0RTT(t *testing.T) {
+	cert, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", http3.ConfigureTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}), &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http3.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Method)
+	})}
+	go srv.ServeListener(l)
+	defer srv.Close()
+
+	p, err := NewPooledTransport(TransportConfig{
+		Addr:       l.Addr().String(),
+		TLSConfig:  &tls.Config{ServerName: "example.com", InsecureSkipVerify: true},
+		MaxConns:   1,
+		Enable0RTT: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	get := func() *pooledConn {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := p.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if b, _ := io.ReadAll(resp.Body); string(b) != http.MethodGet {
+			t.Fatalf("want a GET request, got %q", b)
+		}
+		p.pool.mu.Lock()
+		defer p.pool.mu.Unlock()
+		return p.pool.conns[0]
+	}
+
+	first := get()
+	if first.conn.ConnectionState().Used0RTT {
+		t.Fatal("the first connection has no session to resume")
+	}
+	// Wait for the session ticket, which is sent after the handshake.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := p.tlsConfig.ClientSessionCache.Get("example.com"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no session ticket received")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	p.pool.mu.Lock()
+	p.pool.removeConn(0, errors.New("test"))
+	p.pool.mu.Unlock()
+
+	second := get()
+	if second == first || !second.conn.ConnectionState().Used0RTT {
+		t.Fatal("the second connection should be resumed in 0-rtt")
+	}
+}
+
+func TestNewPooledTransportPoolConfig(t *testing.T) {
+	dial := newTestQUICServer(t)
+	var newConns atomic.Int32
+	p, err := NewPooledTransport(TransportConfig{
+		Dialer:             dial,
+		MaxConns:           4,
+		Name:               "test",
+		FailOnExhaustion:   true,
+		MaxWait:            time.Second,
+		MaxConcurrentDials: 2,
+		MaxConnLifetime:    time.Minute,
+		HealthProbe: func(ctx context.Context, conn *quic.Conn) error {
+			return nil
+		},
+		HealthProbeInterval: time.Second * 10,
+		OnNewConn: func(*quic.Conn, *http3.Transport) error {
+			newConns.Add(1)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	pool := p.pool
+	if pool.name != "test" || !pool.failOnExhaustion || pool.maxWait != time.Second ||
+		pool.maxDials != 2 || pool.maxLifetime != time.Minute ||
+		pool.healthProbe == nil || pool.probeInterval != time.Second*10 {
+		t.Fatal("options are not passed to the pool")
+	}
+	pc, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(pc, true)
+	if newConns.Load() != 1 {
+		t.Fatal("OnNewConn is not passed to the pool")
+	}
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(p.Collector()); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "http3_pool_dials_total" && mf.GetMetric()[0].GetCounter().GetValue() == 1 {
+			return
+		}
+	}
+	t.Fatal("the collector does not report the dial")
+}
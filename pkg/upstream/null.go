@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+var errNullUpstream = errors.New("null upstream error")
+
+// nullUpstream answers queries locally without any network io.
+// It is meant for testing failover and policies.
+//
+// Address format: null://<mode>[?delay=<duration>][&ttl=<seconds>][&a=<ip>][&aaaa=<ip>]
+//   - refused, servfail, nxdomain, noerror: Replies with the rcode.
+//   - answer: Replies with the a/aaaa records given in the query string.
+//     a and aaaa can be repeated.
+//   - error: Returns an error instead of a response.
+//
+// delay simulates the latency of each exchange.
+type nullUpstream struct {
+	rcode int
+	err   error
+	delay time.Duration
+	ttl   uint32
+	a     []netip.Addr
+	aaaa  []netip.Addr
+}
+
+func newNullUpstream(u *url.URL) (*nullUpstream, error) {
+	nu := &nullUpstream{ttl: 300}
+	switch mode := u.Host; mode {
+	case "refused":
+		nu.rcode = dns.RcodeRefused
+	case "servfail":
+		nu.rcode = dns.RcodeServerFailure
+	case "nxdomain":
+		nu.rcode = dns.RcodeNameError
+	case "noerror", "answer":
+		nu.rcode = dns.RcodeSuccess
+	case "error":
+		nu.err = errNullUpstream
+	default:
+		return nil, fmt.Errorf("invalid null upstream mode [%s]", mode)
+	}
+
+	query := u.Query()
+	if s := query.Get("delay"); len(s) > 0 {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay, %w", err)
+		}
+		nu.delay = d
+	}
+	if s := query.Get("ttl"); len(s) > 0 {
+		ttl, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl, %w", err)
+		}
+		nu.ttl = uint32(ttl)
+	}
+	for _, s := range query["a"] {
+		addr, err := netip.ParseAddr(s)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("invalid a record [%s]", s)
+		}
+		nu.a = append(nu.a, addr)
+	}
+	for _, s := range query["aaaa"] {
+		addr, err := netip.ParseAddr(s)
+		if err != nil || !addr.Is6() {
+			return nil, fmt.Errorf("invalid aaaa record [%s]", s)
+		}
+		nu.aaaa = append(nu.aaaa, addr)
+	}
+	if u.Host != "answer" && (len(nu.a) > 0 || len(nu.aaaa) > 0) {
+		return nil, errors.New("records are only allowed in answer mode")
+	}
+	return nu, nil
+}
+
+func (u *nullUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, fmt.Errorf("invalid query, %w", err)
+	}
+
+	if u.delay > 0 {
+		timer := time.NewTimer(u.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+
+	if u.err != nil {
+		return nil, u.err
+	}
+
+	r := new(dns.Msg)
+	r.SetRcode(q, u.rcode)
+	r.RecursionAvailable = true
+	if u.rcode == dns.RcodeSuccess && len(q.Question) == 1 {
+		question := q.Question[0]
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: u.ttl}
+		switch question.Qtype {
+		case dns.TypeA:
+			for _, addr := range u.a {
+				r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+			}
+		case dns.TypeAAAA:
+			for _, addr := range u.aaaa {
+				r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+			}
+		}
+	}
+	return pool.PackBuffer(r)
+}
+
+func (u *nullUpstream) Close() error {
+	return nil
+}
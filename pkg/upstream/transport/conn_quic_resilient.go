@@ -22,6 +22,8 @@ package transport
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"net"
 	"time"
 
 	"github.com/harlanwei/mosdns-lts/v5/pkg/dnsutils"
@@ -108,7 +110,7 @@ func (re *resilientExchanger) ExchangeReserved(ctx context.Context, q []byte) (r
 	defer func() {
 		duration := time.Since(startTime)
 		if err != nil {
-			re.conn.timeout.RecordTimeout()
+			re.conn.timeout.RecordFailure(isTimeoutErr(err), duration)
 		} else {
 			re.conn.timeout.RecordSuccess(duration)
 		}
@@ -158,13 +160,20 @@ func exchangeOnStream(stream *quic.Stream, q []byte) (resp *[]byte, err error) {
 	stream.Close()
 
 	r, err := dnsutils.ReadRawMsgFromTCP(stream)
-	if resp != nil {
-		binary.BigEndian.PutUint16((*resp), orgQid)
+	if r != nil {
+		binary.BigEndian.PutUint16((*r), orgQid)
 	}
 	stream.CancelRead(_DOQ_NO_ERROR)
 	return r, err
 }
 
+// isTimeoutErr reports whether err is caused by a deadline, either the
+// stream deadline or the ctx one.
+func isTimeoutErr(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
 func (re *resilientExchanger) WithdrawReserved() {
 	re.stream.CancelRead(_DOQ_REQUEST_CANCELLED)
 	re.stream.CancelWrite(_DOQ_REQUEST_CANCELLED)
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/server"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqEchoHandler answers every query with a TXT record that holds the
+// qname, after a random delay so responses are sent out of order.
+// Queries with a non-zero ID are refused (RFC 9250 4.2.1).
+type doqEchoHandler struct{}
+
+func (doqEchoHandler) Handle(ctx context.Context, q *dns.Msg, meta server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	time.Sleep(time.Duration(rand.IntN(5000)) * time.Microsecond)
+	resp := new(dns.Msg)
+	if q.Id != 0 || len(q.Question) != 1 {
+		resp.SetRcode(q, dns.RcodeRefused)
+	} else {
+		resp.SetReply(q)
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{q.Question[0].Name},
+		})
+	}
+	payload, err := packMsgPayload(resp)
+	if err != nil {
+		return nil
+	}
+	return payload
+}
+
+// dialTestDoQServer starts a DoQ server with doqEchoHandler and returns a
+// client connection to it.
+func dialTestDoQServer(t *testing.T) *quic.Conn {
+	t.Helper()
+	cert, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+	}, &quic.Config{MaxIncomingStreams: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.ServeDoQ(l, doqEchoHandler{}, server.DoQServerOpts{})
+
+	c, err := quic.DialAddr(context.Background(), l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"doq"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.CloseWithError(0, "") })
+	return c
+}
+
+func Test_quicConn_concurrent_id_correlation(t *testing.T) {
+	tests := []struct {
+		name    string
+		newConn func(c *quic.Conn) DnsConn
+	}{
+		{"quic", func(c *quic.Conn) DnsConn { return NewQuicDnsConn(c) }},
+		{"resilient_quic", func(c *quic.Conn) DnsConn { return NewResilientQuicConn(c, ResilientConnConfig{}) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := tt.newConn(dialTestDoQServer(t))
+
+			const n = 100
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					qid := uint16(i + 1)
+					qname := fmt.Sprintf("q%d.example.", i)
+					q := new(dns.Msg)
+					q.SetQuestion(qname, dns.TypeTXT)
+					q.Id = qid
+					b, err := q.Pack()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					re, closed := dc.ReserveNewQuery()
+					if re == nil {
+						t.Errorf("failed to reserve query, conn closed: %v", closed)
+						return
+					}
+					ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+					defer cancel()
+					payload, err := re.ExchangeReserved(ctx, b)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer pool.ReleaseBuf(payload)
+
+					resp := new(dns.Msg)
+					if err := resp.Unpack(*payload); err != nil {
+						t.Error(err)
+						return
+					}
+					if resp.Id != qid {
+						t.Errorf("query %d: want id %d, got %d", i, qid, resp.Id)
+					}
+					if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].Header().Name != qname {
+						t.Errorf("query %d: response does not match query %s: %v", i, qname, resp)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -107,11 +107,23 @@ type Opt struct {
 	// and reliability metrics. This overrides EnableHTTP3.
 	AdaptiveDoH bool
 
+	// AdaptiveDoHQuiesce closes the idle connections of the non-preferred
+	// protocol of AdaptiveDoH. See adaptive_doh.Opt.QuiesceNonPreferred.
+	AdaptiveDoHQuiesce bool
+
+	// AdaptiveDoHReevaluationInterval periodically restarts the trial of
+	// AdaptiveDoH. See adaptive_doh.Opt.ReevaluationInterval.
+	AdaptiveDoHReevaluationInterval time.Duration
+
 	// Bootstrap specifies a plain dns server to solve the
 	// upstream server domain address.
 	// It must be an IP address. Port is optional.
 	Bootstrap string
 
+	// BootstrapServers are more bootstrap servers, which are tried in order
+	// after Bootstrap if it does not answer.
+	BootstrapServers []string
+
 	// Bootstrap version. One of 0 (default equals 4), 4, 6.
 	// TODO: Support dual-stack.
 	BootstrapVer int
@@ -135,6 +147,9 @@ type Opt struct {
 // Helper protocol:
 //   - tcp+pipeline/tls+pipeline: Automatically set opt.EnablePipeline to true.
 //   - h3: Automatically set opt.EnableHTTP3 to true.
+//
+// Pseudo protocol:
+//   - null: Replies locally without network io. See nullUpstream.
 func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 	if opt.Logger == nil {
 		opt.Logger = mlog.Nop()
@@ -152,6 +167,14 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		return nil, fmt.Errorf("invalid server address, %w", err)
 	}
 
+	if addrURL.Scheme == "null" {
+		nu, err := newNullUpstream(addrURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid null upstream, %w", err)
+		}
+		return nu, nil
+	}
+
 	// Apply helper protocol
 	switch addrURL.Scheme {
 	case "tcp+pipeline", "tls+pipeline":
@@ -173,12 +196,16 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		}),
 	}
 
-	var bootstrapAp netip.AddrPort
-	if s := opt.Bootstrap; len(s) > 0 {
-		bootstrapAp, err = parseBootstrapAp(s)
+	var bootstrapAps []netip.AddrPort
+	for _, s := range append([]string{opt.Bootstrap}, opt.BootstrapServers...) {
+		if len(s) == 0 {
+			continue
+		}
+		ap, err := parseBootstrapAp(s)
 		if err != nil {
-			return nil, fmt.Errorf("invalid bootstrap, %w", err)
+			return nil, fmt.Errorf("invalid bootstrap %s, %w", s, err)
 		}
+		bootstrapAps = append(bootstrapAps, ap)
 	}
 
 	newUdpAddrResolveFunc := func(defaultPort uint16) (func(ctx context.Context) (*net.UDPAddr, error), error) {
@@ -193,9 +220,9 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 				return ua, nil
 			}, nil
 		} else { // Not an ip, assuming it's a domain name.
-			if bootstrapAp.IsValid() {
+			if len(bootstrapAps) > 0 {
 				// Bootstrap enabled.
-				bs, err := bootstrap.New(host, port, bootstrapAp, opt.BootstrapVer, opt.Logger)
+				bs, err := bootstrap.New(host, port, bootstrapAps, opt.BootstrapVer, opt.Logger)
 				if err != nil {
 					return nil, err
 				}
@@ -248,9 +275,9 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 				return nil, errors.New("addr must be an ip address")
 			}
 			// Host is not an ip addr, assuming it is a domain.
-			if bootstrapAp.IsValid() {
+			if len(bootstrapAps) > 0 {
 				// Bootstrap enabled.
-				bs, err := bootstrap.New(host, port, bootstrapAp, opt.BootstrapVer, opt.Logger)
+				bs, err := bootstrap.New(host, port, bootstrapAps, opt.BootstrapVer, opt.Logger)
 				if err != nil {
 					return nil, err
 				}
@@ -469,7 +496,9 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			}
 
 			adaptiveUpstream, err := adaptive_doh.CreateAdaptiveUpstream(addrURL.String(), t1, t3, adaptive_doh.Opt{
-				Logger: opt.Logger,
+				Logger:               opt.Logger,
+				QuiesceNonPreferred:  opt.AdaptiveDoHQuiesce,
+				ReevaluationInterval: opt.AdaptiveDoHReevaluationInterval,
 			})
 			if err != nil {
 				quicTransport.Close()
@@ -675,6 +704,7 @@ func (u *adaptiveDoHWithClose) ExchangeContext(ctx context.Context, m []byte) (*
 }
 
 func (u *adaptiveDoHWithClose) Close() error {
+	u.u.Close()
 	if u.closer != nil {
 		return u.closer.Close()
 	}
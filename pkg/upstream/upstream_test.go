@@ -231,3 +231,71 @@ func (s *vServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	time.Sleep(s.latency)
 	w.WriteMsg(r)
 }
+
+func TestNullUpstream(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qb, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchange := func(addr string) (*dns.Msg, error) {
+		t.Helper()
+		u, err := NewUpstream(addr, Opt{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer u.Close()
+		b, err := u.ExchangeContext(context.Background(), qb)
+		if err != nil {
+			return nil, err
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(*b); err != nil {
+			t.Fatal(err)
+		}
+		return r, nil
+	}
+
+	for addr, rcode := range map[string]int{
+		"null://refused":  dns.RcodeRefused,
+		"null://servfail": dns.RcodeServerFailure,
+		"null://nxdomain": dns.RcodeNameError,
+		"null://noerror":  dns.RcodeSuccess,
+	} {
+		r, err := exchange(addr)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if r.Id != q.Id || r.Rcode != rcode || len(r.Answer) != 0 {
+			t.Fatalf("%s: unexpected response %v", addr, r)
+		}
+	}
+
+	r, err := exchange("null://answer?a=192.0.2.1&a=192.0.2.2&aaaa=2001:db8::1&ttl=60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 2 || r.Answer[0].Header().Ttl != 60 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("unexpected answer %v", r)
+	}
+
+	if _, err := exchange("null://error"); !errors.Is(err, errNullUpstream) {
+		t.Fatalf("expected errNullUpstream, got %v", err)
+	}
+
+	start := time.Now()
+	if _, err := exchange("null://refused?delay=50ms"); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < time.Millisecond*50 {
+		t.Fatal("delay was not applied")
+	}
+
+	for _, addr := range []string{"null://unknown", "null://refused?a=192.0.2.1", "null://answer?a=2001:db8::1", "null://refused?delay=x"} {
+		if _, err := NewUpstream(addr, Opt{}); err == nil {
+			t.Fatalf("%s: expected an error", addr)
+		}
+	}
+}
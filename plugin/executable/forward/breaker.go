@@ -0,0 +1,49 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"errors"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/qos"
+)
+
+func (a *CircuitBreakerArgs) check() error {
+	if a.MaxFailures < 0 || a.ResetTimeout < 0 || a.HalfOpenAttempts < 0 || a.MinRequests < 0 {
+		return errors.New("thresholds cannot be negative")
+	}
+	if a.FailureRateThreshold < 0 || a.FailureRateThreshold > 1 {
+		return errors.New("failure_rate_threshold must be in [0, 1]")
+	}
+	return nil
+}
+
+// newBreaker returns a new breaker with the thresholds of a. Args must have
+// been checked.
+func (a *CircuitBreakerArgs) newBreaker() *qos.CircuitBreaker {
+	return qos.NewCircuitBreaker(qos.CircuitBreakerConfig{
+		MaxFailures:          a.MaxFailures,
+		ResetTimeout:         time.Duration(a.ResetTimeout) * time.Second,
+		HalfOpenAttempts:     a.HalfOpenAttempts,
+		FailureRateThreshold: a.FailureRateThreshold,
+		MinRequests:          a.MinRequests,
+	})
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"github.com/harlanwei/mosdns-lts/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+var dns64Key = query_context.RegKey()
+
+// SetDNS64 marks qCtx as a query from a client behind NAT64. Forward
+// plugins that handle qCtx later will only send it to upstreams that have
+// UpstreamConfig.DNS64 set, if it is an AAAA query.
+func SetDNS64(qCtx *query_context.Context, enable bool) {
+	if !enable {
+		qCtx.DeleteValue(dns64Key)
+		return
+	}
+	qCtx.StoreValue(dns64Key, true)
+}
+
+// isDNS64Query reports whether qCtx is an AAAA query that must be sent to
+// DNS64 upstreams, see Args.DNS64Clients and SetDNS64.
+func (f *Forward) isDNS64Query(qCtx *query_context.Context) bool {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeAAAA {
+		return false
+	}
+	if f.args.DNS64Clients {
+		return true
+	}
+	_, ok := qCtx.GetValue(dns64Key)
+	return ok
+}
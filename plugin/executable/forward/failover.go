@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import "time"
+
+// Values of Args.SelectionStrategy.
+const (
+	SelectionWeighted = "weighted"
+	SelectionFailover = "failover"
+)
+
+// failoverProbeInterval is how often an unhealthy upstream that has a
+// higher priority than the one in use gets a probe query, so its error
+// rate can recover. See upstreamSelector.failoverOrder.
+const failoverProbeInterval = time.Second * 5
+
+// failoverHealthy reports whether uw is healthy for the "failover"
+// selection strategy. Upstreams with an open breaker are routed around
+// by selectUpstreams anyway.
+func (s *upstreamSelector) failoverHealthy(uw *upstreamWrapper) bool {
+	healthy := uw.getErrorRate() < s.failoverErrorRate
+	if !healthy {
+		uw.failedOver.Store(true)
+	} else if uw.failedOver.CompareAndSwap(true, false) {
+		// Recovered, traffic returns to it with a slow start.
+		uw.markEligible()
+	}
+	return healthy
+}
+
+// failoverOrder returns all upstreams in the configured order, healthy
+// ones first. If the first healthy upstream is in its slow start, it only
+// stays first with the probability of its slow start factor.
+// probe is the first unhealthy upstream that precedes the first healthy
+// one, or -1 if there is none.
+func (s *upstreamSelector) failoverOrder() (order []int, probe int) {
+	probe = -1
+	order = make([]int, 0, len(s.us))
+	var unhealthy []int
+	for i, uw := range s.us {
+		if s.failoverHealthy(uw) {
+			order = append(order, i)
+			continue
+		}
+		if len(order) == 0 && probe < 0 {
+			probe = i
+		}
+		unhealthy = append(unhealthy, i)
+	}
+
+	if len(order) > 1 {
+		if f := s.slowStartFactor(s.us[order[0]], time.Now()); f < 1 && s.rand() >= f {
+			order[0], order[1] = order[1], order[0]
+		}
+	}
+	if len(order) == 0 {
+		probe = -1 // All upstreams are tried in order anyway.
+	}
+	return append(order, unhealthy...), probe
+}
+
+// tryProbe reports whether uw is due for a failover probe, or a probe of
+// Args.MaxErrorRate. It returns true at most once per failoverProbeInterval.
+func (uw *upstreamWrapper) tryProbe(now time.Time) bool {
+	last := uw.lastProbe.Load()
+	if now.Sub(time.Unix(0, last)) < failoverProbeInterval {
+		return false
+	}
+	return uw.lastProbe.CompareAndSwap(last, now.UnixNano())
+}
@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/harlanwei/mosdns-lts/v5/coremain"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/cache"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/query_context"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/upstream"
@@ -36,6 +37,7 @@ import (
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 const PluginType = "forward"
@@ -47,6 +49,7 @@ func init() {
 
 const (
 	maxConcurrentQueries = 3
+	defaultRaceCount     = 2
 	queryTimeout         = time.Second * 5
 )
 
@@ -54,12 +57,131 @@ type Args struct {
 	Upstreams  []UpstreamConfig `yaml:"upstreams"`
 	Concurrent int              `yaml:"concurrent"`
 
+	// Groups organizes upstreams into tiers, e.g. local, regional and
+	// global resolvers. Queries are sent to the first group, and escalate
+	// to the next group if all selected upstreams of a group failed.
+	// Groups whose upstreams are all routed around, e.g. by open circuit
+	// breakers, are only tried after all other groups. Upstreams are
+	// selected within a group by its own selection strategy. Groups cannot
+	// be used with Upstreams, which is the same as a single group.
+	Groups []UpstreamGroup `yaml:"groups"`
+
+	// RaceMode sends each query to the top RaceCount selected upstreams
+	// concurrently and replies the first valid response. The exchanges of
+	// the other upstreams are canceled then, so an upstream that randomly
+	// stalls does not hold the query. Canceled exchanges are not counted
+	// as errors. RaceMode overrides Concurrent. Default RaceCount is 2.
+	RaceMode  bool `yaml:"race_mode"`
+	RaceCount int  `yaml:"race_count"`
+
+	// Dedup makes concurrent identical queries share one upstream exchange.
+	Dedup bool `yaml:"dedup"`
+
+	// ErrorRateDecay is the weight of the latest query in the decayed error
+	// rate of upstreams, which penalizes upstreams when selecting them.
+	// Larger values forget old errors faster. Valid range is (0, 1].
+	// Default (0) is 0.05.
+	ErrorRateDecay float64 `yaml:"error_rate_decay"`
+
+	// Scorer is the name of the scorer that scores upstreams for selection.
+	// Built-in scorers are "latency", "latency_error", "round_robin" and
+	// "random". More can be registered by RegScorer. "round_robin" takes
+	// turns per query, so it ignores SelectorCacheTTL.
+	// Default is "latency_error".
+	Scorer string `yaml:"scorer"`
+
+	// SelectorTuning tunes how the built-in scorers score upstreams.
+	SelectorTuning SelectorTuning `yaml:"selector_tuning"`
+
+	// EmaDecayAfter, in seconds, makes the latency EMA of an upstream
+	// that has not had a successful query for that long drift back
+	// towards SelectorTuning.DefaultLatency, halving the gap every
+	// EmaDecayAfter seconds. So an upstream that was slow once is probed
+	// again later, rather than starved forever. 0 disables the decay.
+	EmaDecayAfter int `yaml:"ema_decay_after"`
+
+	// PreferFullerResponses slightly favors upstreams whose responses
+	// have more records on average, e.g. ones that don't strip the
+	// additional section. It is applied on top of the Scorer.
+	PreferFullerResponses bool `yaml:"prefer_fuller_responses"`
+
+	// CircuitBreaker, if set, gives each upstream a circuit breaker. An
+	// upstream whose breaker is open is not queried and is excluded from
+	// selection until the breaker half-opens.
+	CircuitBreaker *CircuitBreakerArgs `yaml:"circuit_breaker"`
+
+	// SlowStartDuration, in seconds, ramps the selection weight of an
+	// upstream from a small fraction up to full after it was added or its
+	// circuit breaker closed, so a cold upstream is not overwhelmed.
+	// Default (0) disables it.
+	SlowStartDuration int `yaml:"slow_start_duration"`
+
+	// StickyByQName makes the "weighted" strategy send the same qname to
+	// the same upstreams, for upstreams with per-domain caches. Upstreams
+	// are ordered by a rendezvous hash of the qname, weighted by Weight,
+	// instead of a random weighted draw. If the selected upstreams failed,
+	// the query falls through to the next ones in that order.
+	StickyByQName bool `yaml:"sticky_by_qname"`
+
+	// SelectionStrategy is how upstreams are selected. "weighted" selects
+	// them in a random order weighted by their scores, see Scorer.
+	// "failover" always uses the first healthy upstream in the configured
+	// order (active/standby). An upstream is healthy if its breaker is not
+	// open and its decayed error rate is below FailoverErrorRate. Higher
+	// priority upstreams that are unhealthy get a probe query every 5s,
+	// so traffic returns to them once they recover, with a slow start if
+	// SlowStartDuration is set.
+	// Default is "weighted".
+	SelectionStrategy string `yaml:"selection_strategy"`
+
+	// FailoverErrorRate is the max error rate of a healthy upstream for
+	// the "failover" strategy, see ErrorRateDecay. Default is 0.5.
+	FailoverErrorRate float64 `yaml:"failover_error_rate"`
+
+	// MaxErrorRate, if set, makes the selector route around upstreams
+	// whose error rate (see ErrorRateDecay) is at least MaxErrorRate,
+	// unless no other upstream is available. They get a probe query every
+	// 5s so their error rate can recover. Zero disables it.
+	MaxErrorRate float64 `yaml:"max_error_rate"`
+
+	// SelectorCacheTTL is how long, in milliseconds, the weighted order of
+	// upstreams is cached before the scores are recomputed. Shorter TTLs
+	// react faster to latency and error changes, at the cost of scoring
+	// upstreams more often. 0 disables the cache, so the scores are
+	// recomputed for every query. Default (unset) is 5000.
+	SelectorCacheTTL *int `yaml:"selector_cache_ttl"`
+
+	// SelectionSeed, if not zero, seeds the random numbers of upstream
+	// selection, so the selections are reproducible, e.g. for canaries.
+	// Default (0) uses the global random source.
+	SelectionSeed uint64 `yaml:"selection_seed"`
+
+	// DNS64Clients sends all AAAA queries only to upstreams that have
+	// UpstreamConfig.DNS64 set, for networks where clients are behind
+	// NAT64. Without it, queries can be marked by SetDNS64.
+	DNS64Clients bool `yaml:"dns64_clients"`
+
+	// OnAllFail is what to do when all selected upstreams failed.
+	// "return_error" returns the error to the caller. "servfail" replies
+	// SERVFAIL. "stale" replies the last good response of the same query
+	// with a short ttl, or returns the error if there is none.
+	// Default is "return_error".
+	OnAllFail string `yaml:"on_all_fail"`
+
+	// StaleMaxAge is how long, in seconds, a response can be served as
+	// stale. Default is 86400. StaleCacheSize is the max number of stale
+	// responses that are kept. Default is 4096. Only for "stale" mode.
+	StaleMaxAge    int `yaml:"stale_max_age"`
+	StaleCacheSize int `yaml:"stale_cache_size"`
+
 	// Global options.
 	Socks5       string `yaml:"socks5"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
 	Bootstrap    string `yaml:"bootstrap"`
 	BootstrapVer int    `yaml:"bootstrap_version"`
+
+	BootstrapServers []string `yaml:"bootstrap_servers"`
 }
 
 type UpstreamConfig struct {
@@ -75,11 +197,104 @@ type UpstreamConfig struct {
 	EnableHTTP3        bool `yaml:"enable_http3"`
 	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
 
+	// DNS64 indicates this upstream synthesizes AAAA records (RFC 6147).
+	DNS64 bool `yaml:"dns64"`
+
+	// Weight multiplies the score of this upstream, so traffic is biased
+	// towards upstreams with higher weights while latency and errors still
+	// count. It must not be negative. Default (0) is 1.
+	Weight float64 `yaml:"weight"`
+
+	// TTLClamp, if set, clamps the ttls of the records in responses from
+	// this upstream, for upstreams that return absurd ttls.
+	TTLClamp *TTLClamp `yaml:"ttl_clamp"`
+
+	// MaxInFlight, if set, makes the selector route around this upstream
+	// while it has MaxInFlight queries in flight, unless no other upstream
+	// is available. Zero means no limit.
+	MaxInFlight int `yaml:"max_in_flight"`
+
+	// AddressFamilyFilter removes the address records of a family from the
+	// answer section of responses from this upstream, for upstreams whose
+	// A or AAAA answers are unreliable. "keep_a" drops AAAA records,
+	// "keep_aaaa" drops A records. Default is "keep_both".
+	AddressFamilyFilter string `yaml:"address_family_filter"`
+
 	Socks5       string `yaml:"socks5"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
 	Bootstrap    string `yaml:"bootstrap"`
 	BootstrapVer int    `yaml:"bootstrap_version"`
+
+	// BootstrapServers are more bootstrap servers, tried in order after
+	// Bootstrap. The upstream's host is resolved in background as soon as
+	// the upstream is created, queries wait for the first resolution. The
+	// address is pinned until its ttl expires, so upstreams by hostname
+	// never depend on mosdns itself.
+	BootstrapServers []string `yaml:"bootstrap_servers"`
+}
+
+// UpstreamGroup is a group of upstreams, see Args.Groups.
+type UpstreamGroup struct {
+	Name      string           `yaml:"name"`
+	Upstreams []UpstreamConfig `yaml:"upstreams"` // Required.
+
+	// SelectionStrategy is how upstreams are selected within the group.
+	// Default is Args.SelectionStrategy.
+	SelectionStrategy string `yaml:"selection_strategy"`
+}
+
+// Values of UpstreamConfig.AddressFamilyFilter.
+const (
+	AddressFamilyKeepBoth = "keep_both"
+	AddressFamilyKeepA    = "keep_a"
+	AddressFamilyKeepAAAA = "keep_aaaa"
+)
+
+// TTLClamp is a range of ttls in seconds. Zero Max means no upper bound.
+type TTLClamp struct {
+	Min uint32 `yaml:"min"`
+	Max uint32 `yaml:"max"`
+}
+
+// SelectorTuning tunes the built-in scorers, see Args.SelectorTuning.
+// Unset fields keep their defaults.
+type SelectorTuning struct {
+	// NoiseFactor is the max relative random noise of scores, so that
+	// slower upstreams are still explored sometimes. Stable networks need
+	// less of it. It is in [0, 1). Default is 0.125.
+	NoiseFactor *float64 `yaml:"noise_factor"`
+
+	// ErrorPenaltyMult is how hard the "latency_error" scorer penalizes
+	// the error rate of upstreams. It must not be negative. Default is 8.
+	ErrorPenaltyMult *float64 `yaml:"error_penalty_mult"`
+
+	// DefaultLatency is the latency, in milliseconds, assumed for
+	// upstreams without a successful query yet. It must be positive.
+	// Default is 10.
+	DefaultLatency *float64 `yaml:"default_latency"`
+}
+
+// CircuitBreakerArgs are the thresholds of the circuit breakers of
+// upstreams, see Args.CircuitBreaker.
+type CircuitBreakerArgs struct {
+	// MaxFailures is the number of consecutive failures that open the
+	// breaker. Default is 10.
+	MaxFailures int `yaml:"max_failures"`
+
+	// ResetTimeout is how long, in seconds, the breaker stays open before
+	// it half-opens and lets queries through again. HalfOpenAttempts is
+	// the number of successful queries that close it then. Defaults are
+	// 60 and 3.
+	ResetTimeout     int `yaml:"reset_timeout"`
+	HalfOpenAttempts int `yaml:"half_open_attempts"`
+
+	// FailureRateThreshold, if set, opens the breaker once this rate of
+	// the queries in the last 10s failed, instead of MaxFailures. The rate
+	// is only judged once there are MinRequests queries. It is in (0, 1].
+	// Default MinRequests is 20.
+	FailureRateThreshold float64 `yaml:"failure_rate_threshold"`
+	MinRequests          int     `yaml:"min_requests"`
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -91,6 +306,7 @@ func Init(bp *coremain.BP, args any) (any, error) {
 		_ = f.Close()
 		return nil, err
 	}
+	bp.RegAPI(f.Api())
 	return f, nil
 }
 
@@ -101,30 +317,111 @@ type Forward struct {
 	args *Args
 
 	logger       *zap.Logger
+	tracer       Tracer
 	us           []*upstreamWrapper
 	tag2Upstream map[string]*upstreamWrapper // for fast tag lookup only.
 
-	selector *upstreamSelector
+	groups []*upstreamGroup   // Upstreams of each group are contiguous in us.
+	sf     singleflight.Group // for Args.Dedup
+
+	staleCache *cache.Cache[staleKey, *dns.Msg] // for Args.OnAllFail "stale"
+
+	// OnUpstreamSkipped, if not nil, is called when the selector routes
+	// around a degraded upstream that it would otherwise have selected.
+	// tag is the upstream tag or address. reason is one of SkipReason*.
+	// It must not block. Set it before f is used.
+	OnUpstreamSkipped func(tag string, reason string)
 }
 
+// Reasons for Forward.OnUpstreamSkipped.
+const (
+	SkipReasonCircuitOpen = "circuit_open" // Its circuit breaker is open.
+	SkipReasonErrorRate   = "error_rate"   // See Args.MaxErrorRate.
+	SkipReasonSaturated   = "saturated"    // See UpstreamConfig.MaxInFlight.
+	SkipReasonUnhealthy   = "unhealthy"    // Failed over, see Args.SelectionStrategy.
+)
+
 type Opts struct {
 	Logger     *zap.Logger
 	MetricsTag string
+
+	// Tracer, if set, traces every upstream exchange.
+	Tracer Tracer
+}
+
+func (f *Forward) upstreamSkipped(idx int, reason string) {
+	if f.OnUpstreamSkipped != nil {
+		f.OnUpstreamSkipped(f.us[idx].name(), reason)
+	}
 }
 
 // NewForward inits a Forward from given args.
 // args must contain at least one upstream.
 func NewForward(args *Args, opt Opts) (*Forward, error) {
-	if len(args.Upstreams) == 0 {
-		return nil, errors.New("no upstream is configured")
+	groups := args.Groups
+	if len(groups) == 0 {
+		if len(args.Upstreams) == 0 {
+			return nil, errors.New("no upstream is configured")
+		}
+		groups = []UpstreamGroup{{Upstreams: args.Upstreams}}
+	} else if len(args.Upstreams) > 0 {
+		return nil, errors.New("upstreams and groups cannot be both configured")
 	}
 	if opt.Logger == nil {
 		opt.Logger = zap.NewNop()
 	}
+	if opt.Tracer == nil {
+		opt.Tracer = nopTracer{}
+	}
+	if _, err := newScorer(args.Scorer); err != nil {
+		return nil, err
+	}
+	if err := checkSelectionStrategy(args.SelectionStrategy); err != nil {
+		return nil, err
+	}
+	for i, g := range groups {
+		if len(g.Upstreams) == 0 {
+			return nil, fmt.Errorf("#%d group has no upstream", i)
+		}
+		if err := checkSelectionStrategy(g.SelectionStrategy); err != nil {
+			return nil, fmt.Errorf("#%d group invalid args, %w", i, err)
+		}
+	}
+	if args.FailoverErrorRate < 0 || args.FailoverErrorRate > 1 {
+		return nil, errors.New("failover_error_rate must be in [0, 1]")
+	}
+	if args.MaxErrorRate < 0 || args.MaxErrorRate > 1 {
+		return nil, errors.New("max_error_rate must be in [0, 1]")
+	}
+	if args.ErrorRateDecay < 0 || args.ErrorRateDecay > 1 {
+		return nil, errors.New("error_rate_decay must be in (0, 1]")
+	}
+	if args.SelectorCacheTTL != nil && *args.SelectorCacheTTL < 0 {
+		return nil, errors.New("selector_cache_ttl cannot be negative")
+	}
+	if args.RaceCount < 0 {
+		return nil, errors.New("race_count cannot be negative")
+	}
+	if cb := args.CircuitBreaker; cb != nil {
+		if err := cb.check(); err != nil {
+			return nil, fmt.Errorf("invalid circuit_breaker, %w", err)
+		}
+	}
+	if err := checkOnAllFail(args.OnAllFail); err != nil {
+		return nil, err
+	}
+	tuning, err := args.SelectorTuning.tuning()
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector_tuning, %w", err)
+	}
+	if args.EmaDecayAfter < 0 {
+		return nil, errors.New("ema_decay_after cannot be negative")
+	}
 
 	f := &Forward{
 		args:         args,
 		logger:       opt.Logger,
+		tracer:       opt.Tracer,
 		tag2Upstream: make(map[string]*upstreamWrapper),
 	}
 
@@ -134,51 +431,85 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		utils.SetDefaultString(&c.BindToDevice, args.BindToDevice)
 		utils.SetDefaultString(&c.Bootstrap, args.Bootstrap)
 		utils.SetDefaultUnsignNum(&c.BootstrapVer, args.BootstrapVer)
-	}
-
-	for i, c := range args.Upstreams {
-		if len(c.Addr) == 0 {
-			return nil, fmt.Errorf("#%d upstream invalid args, addr is required", i)
-		}
-		applyGlobal(&c)
-
-		uw := newWrapper(i, c, opt.MetricsTag)
-		uOpt := upstream.Opt{
-			DialAddr:       c.DialAddr,
-			Socks5:         c.Socks5,
-			SoMark:         c.SoMark,
-			BindToDevice:   c.BindToDevice,
-			IdleTimeout:    time.Duration(c.IdleTimeout) * time.Second,
-			EnablePipeline: c.EnablePipeline,
-			EnableHTTP3:    c.EnableHTTP3,
-			Bootstrap:      c.Bootstrap,
-			BootstrapVer:   c.BootstrapVer,
-			TLSConfig: &tls.Config{
-				InsecureSkipVerify: c.InsecureSkipVerify,
-				ClientSessionCache: tls.NewLRUClientSessionCache(4),
-			},
-			Logger:        opt.Logger,
-			EventObserver: uw,
+		if len(c.BootstrapServers) == 0 {
+			c.BootstrapServers = args.BootstrapServers
 		}
+	}
 
-		u, err := upstream.NewUpstream(c.Addr, uOpt)
-		if err != nil {
-			_ = f.Close()
-			return nil, fmt.Errorf("failed to init upstream #%d: %w", i, err)
-		}
-		uw.u = u
-		f.us = append(f.us, uw)
+	for gi, g := range groups {
+		offset := len(f.us)
+		for _, c := range g.Upstreams {
+			i := len(f.us)
+			if len(c.Addr) == 0 {
+				return nil, fmt.Errorf("#%d upstream invalid args, addr is required", i)
+			}
+			if c.Weight < 0 {
+				return nil, fmt.Errorf("#%d upstream invalid args, weight cannot be negative", i)
+			}
+			if c.MaxInFlight < 0 {
+				return nil, fmt.Errorf("#%d upstream invalid args, max_in_flight cannot be negative", i)
+			}
+			if tc := c.TTLClamp; tc != nil && tc.Max > 0 && tc.Min > tc.Max {
+				return nil, fmt.Errorf("#%d upstream invalid args, ttl_clamp min is larger than max", i)
+			}
+			switch c.AddressFamilyFilter {
+			case "", AddressFamilyKeepBoth, AddressFamilyKeepA, AddressFamilyKeepAAAA:
+			default:
+				return nil, fmt.Errorf("#%d upstream invalid args, unknown address_family_filter %s", i, c.AddressFamilyFilter)
+			}
+			applyGlobal(&c)
+
+			uw := newWrapper(i, c, opt.MetricsTag)
+			uw.errorRateDecay = args.ErrorRateDecay
+			uw.maxErrorRate = args.MaxErrorRate
+			uw.emaDecayAfter = time.Duration(args.EmaDecayAfter) * time.Second
+			uw.emaDecayTarget = tuning.defaultLatency
+			if args.CircuitBreaker != nil {
+				uw.setBreaker(args.CircuitBreaker.newBreaker())
+			}
+			uOpt := upstream.Opt{
+				DialAddr:         c.DialAddr,
+				Socks5:           c.Socks5,
+				SoMark:           c.SoMark,
+				BindToDevice:     c.BindToDevice,
+				IdleTimeout:      time.Duration(c.IdleTimeout) * time.Second,
+				EnablePipeline:   c.EnablePipeline,
+				EnableHTTP3:      c.EnableHTTP3,
+				Bootstrap:        c.Bootstrap,
+				BootstrapVer:     c.BootstrapVer,
+				BootstrapServers: c.BootstrapServers,
+				TLSConfig: &tls.Config{
+					InsecureSkipVerify: c.InsecureSkipVerify,
+					ClientSessionCache: tls.NewLRUClientSessionCache(4),
+				},
+				Logger:        opt.Logger,
+				EventObserver: uw,
+			}
 
-		if len(c.Tag) > 0 {
-			if _, dup := f.tag2Upstream[c.Tag]; dup {
+			u, err := upstream.NewUpstream(c.Addr, uOpt)
+			if err != nil {
 				_ = f.Close()
-				return nil, fmt.Errorf("duplicated upstream tag %s", c.Tag)
+				return nil, fmt.Errorf("failed to init upstream #%d: %w", i, err)
+			}
+			uw.u = u
+			f.us = append(f.us, uw)
+
+			if len(c.Tag) > 0 {
+				if _, dup := f.tag2Upstream[c.Tag]; dup {
+					_ = f.Close()
+					return nil, fmt.Errorf("duplicated upstream tag %s", c.Tag)
+				}
+				f.tag2Upstream[c.Tag] = uw
 			}
-			f.tag2Upstream[c.Tag] = uw
 		}
+		name := g.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("#%d", gi)
+		}
+		utils.SetDefaultString(&g.SelectionStrategy, args.SelectionStrategy)
+		f.groups = append(f.groups, f.newGroup(name, g.SelectionStrategy, offset, len(g.Upstreams)))
 	}
-
-	f.selector = newUpstreamSelector(f.us)
+	f.initStaleCache()
 
 	return f, nil
 }
@@ -196,10 +527,40 @@ func (f *Forward) RegisterMetricsTo(r prometheus.Registerer) error {
 	return nil
 }
 
+// ThreadMax returns the peak number of concurrent queries of each upstream
+// since it was created or since the last ResetThreadMax call.
+// Upstreams are keyed by their tags, or addresses if tags are empty.
+func (f *Forward) ThreadMax() map[string]int64 {
+	m := make(map[string]int64, len(f.us))
+	for _, uw := range f.us {
+		m[uw.name()] = uw.inFlightMax.Load()
+	}
+	return m
+}
+
+// ResetThreadMax resets the peak numbers reported by ThreadMax to the
+// current numbers of in-flight queries.
+func (f *Forward) ResetThreadMax() {
+	for _, uw := range f.us {
+		uw.resetInFlightMax()
+	}
+}
+
 func (f *Forward) Exec(ctx context.Context, qCtx *query_context.Context) (err error) {
-	r, err := f.exchange(ctx, qCtx, f.us)
+	return f.exec(ctx, qCtx, f.us, &f.sf)
+}
+
+func (f *Forward) exec(ctx context.Context, qCtx *query_context.Context, us []*upstreamWrapper, sf *singleflight.Group) error {
+	r, err := f.doExchange(ctx, qCtx, us, sf)
 	if err != nil {
-		return err
+		if !errors.Is(err, errAllUpstreamsFailed) {
+			return err
+		}
+		if r, err = f.onAllFail(qCtx, err); err != nil {
+			return err
+		}
+	} else {
+		f.saveStale(qCtx, r)
 	}
 	qCtx.SetResponse(r)
 	return nil
@@ -219,13 +580,9 @@ func (f *Forward) QuickConfigureExec(args string) (any, error) {
 			us = append(us, u)
 		}
 	}
+	sf := new(singleflight.Group) // us is different from f.us, don't share the group.
 	var execFunc sequence.ExecutableFunc = func(ctx context.Context, qCtx *query_context.Context) error {
-		r, err := f.exchange(ctx, qCtx, us)
-		if err != nil {
-			return err
-		}
-		qCtx.SetResponse(r)
-		return nil
+		return f.exec(ctx, qCtx, us, sf)
 	}
 	return execFunc, nil
 }
@@ -234,9 +591,65 @@ func (f *Forward) Close() error {
 	for _, u := range f.us {
 		_ = u.Close()
 	}
+	if f.staleCache != nil {
+		_ = f.staleCache.Close()
+	}
 	return nil
 }
 
+// doExchange calls exchange. If Args.Dedup is set, concurrent queries that
+// only differ in msg id share one exchange via sf.
+func (f *Forward) doExchange(ctx context.Context, qCtx *query_context.Context, us []*upstreamWrapper, sf *singleflight.Group) (*dns.Msg, error) {
+	if !f.args.Dedup {
+		return f.exchange(ctx, qCtx, us)
+	}
+
+	key, err := dedupKey(qCtx.Q())
+	if err != nil {
+		return nil, err
+	}
+	if p := getUpstreamPolicy(qCtx); p != nil {
+		key += p.key()
+	}
+	if f.isDNS64Query(qCtx) {
+		key += "|dns64"
+	}
+	qCtxCopy := qCtx.Copy() // qCtx may be modified by other plugins once this call returns.
+	resChan := sf.DoChan(key, func() (any, error) {
+		// Not bound to ctx. Other callers may still be waiting when it is done.
+		// Values, e.g. the trace of the first caller, are kept.
+		exchangeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+		defer cancel()
+		return f.exchange(exchangeCtx, qCtxCopy, us)
+	})
+
+	select {
+	case res := <-resChan:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		r := res.Val.(*dns.Msg)
+		if res.Shared {
+			r = r.Copy()
+		}
+		r.Id = qCtx.Q().Id
+		return r, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// dedupKey returns the wire format of q without its msg id.
+// It covers the question, header flags and all EDNS0 options.
+func dedupKey(q *dns.Msg) (string, error) {
+	b, err := pool.PackBuffer(q)
+	if err != nil {
+		return "", err
+	}
+	defer pool.ReleaseBuf(b)
+	return string((*b)[2:]), nil
+}
+
 func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us []*upstreamWrapper) (*dns.Msg, error) {
 	if len(us) == 0 {
 		return nil, errors.New("no upstream to exchange")
@@ -255,7 +668,50 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	if concurrent > maxConcurrentQueries {
 		concurrent = maxConcurrentQueries
 	}
+	if f.args.RaceMode {
+		concurrent = f.args.RaceCount
+		if concurrent == 0 {
+			concurrent = defaultRaceCount
+		}
+	}
 
+	// Indices are of f.us. us may be a subset of it.
+	filter := f.upstreamFilter(qCtx, us)
+	qname := qCtx.QQuestion().Name
+	err = errNoAllowedUpstream
+	for _, g := range f.groupOrder(filter) {
+		escalated := errors.Is(err, errAllUpstreamsFailed)
+		groupFilter := filter
+		for {
+			selectedIndices := g.selectUpstreams(qname, concurrent, groupFilter)
+			if len(selectedIndices) == 0 {
+				break
+			}
+			if escalated {
+				if ce := f.logger.Check(zap.DebugLevel, "escalating to the next upstream group"); ce != nil {
+					ce.Write(zap.Uint32("uqid", qCtx.Id()), zap.String("group", g.name))
+				}
+				escalated = false
+			}
+			var r *dns.Msg
+			r, err = f.exchangeSelected(ctx, qCtx, queryPayload, selectedIndices, f.args.RaceMode)
+			if !errors.Is(err, errAllUpstreamsFailed) {
+				return r, err
+			}
+			if !g.selector.sticky || g.selector.failover {
+				break
+			}
+			// Fall through to the next upstreams in the order of qname.
+			groupFilter = without(groupFilter, selectedIndices)
+		}
+	}
+	return nil, err
+}
+
+// exchangeSelected sends queryPayload to the upstreams of selectedIndices.
+// If race is set, the exchanges that are still running are canceled once
+// it returns, see Args.RaceMode.
+func (f *Forward) exchangeSelected(ctx context.Context, qCtx *query_context.Context, queryPayload *[]byte, selectedIndices []int, race bool) (*dns.Msg, error) {
 	type res struct {
 		r   *dns.Msg
 		err error
@@ -266,19 +722,35 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	done := make(chan struct{})
 	defer close(done)
 
-	selectedIndices := f.selector.selectUpstreams(concurrent)
+	var raceCtx context.Context // Canceled when the race is over.
+	if race {
+		var cancelRace context.CancelFunc
+		raceCtx, cancelRace = context.WithCancel(context.Background())
+		defer cancelRace()
+	}
+
 	for _, idx := range selectedIndices {
-		u := us[idx]
+		u := f.us[idx]
 		qc := copyPayload(queryPayload)
 		go func(uw *upstreamWrapper, uqid uint32, question dns.Question) {
 			defer pool.ReleaseBuf(qc)
+			traceCtx, finish := f.tracer.StartExchange(ctx, uw.name())
 			// Give each upstream a fixed timeout to finish the query.
-			upstreamCtx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+			// It is not canceled with the query, only the trace is kept.
+			upstreamCtx, cancel := context.WithTimeout(context.WithoutCancel(traceCtx), queryTimeout)
 			defer cancel()
+			if raceCtx != nil {
+				stop := context.AfterFunc(raceCtx, cancel)
+				defer stop()
+			}
 
 			var r *dns.Msg
 			respPayload, err := uw.ExchangeContext(upstreamCtx, *qc)
-			if err != nil {
+			if err != nil && raceCtx != nil && raceCtx.Err() != nil {
+				if ce := f.logger.Check(zap.DebugLevel, "upstream lost the race"); ce != nil {
+					ce.Write(zap.Uint32("uqid", uqid), zap.String("upstream", uw.name()))
+				}
+			} else if err != nil {
 				f.logger.Warn(
 					"upstream error",
 					zap.Uint32("uqid", uqid),
@@ -294,8 +766,11 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 				pool.ReleaseBuf(respPayload)
 				if err != nil {
 					r = nil
+				} else {
+					uw.clampTTL(r)
 				}
 			}
+			finish(err)
 			select {
 			case resChan <- res{r: r, err: err, uw: uw}:
 			case <-done:
@@ -303,7 +778,7 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 		}(u, qCtx.Id(), qCtx.QQuestion())
 	}
 
-	for i := 0; i < concurrent; i++ {
+	for i := 0; i < len(selectedIndices); i++ {
 		select {
 		case res := <-resChan:
 			r, err := res.r, res.err
@@ -312,7 +787,7 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 			}
 
 			// Retry until the last
-			if i < concurrent-1 && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			if i < len(selectedIndices)-1 && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
 				continue
 			}
 			res.uw.IncrementUsedTotal()
@@ -321,7 +796,7 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 			return nil, context.Cause(ctx)
 		}
 	}
-	return nil, errors.New("all upstream servers failed")
+	return nil, errAllUpstreamsFailed
 }
 
 func quickSetup(bq sequence.BQ, s string) (any, error) {
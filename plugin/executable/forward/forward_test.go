@@ -1,10 +1,94 @@
 package fastforward
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/cache"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/qos"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/query_context"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/upstream"
+	"github.com/harlanwei/mosdns-lts/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 )
 
+type fakeUpstream struct {
+	exchanges atomic.Int64
+	release   chan struct{} // if not nil, exchanges block until it is closed.
+	rcode     int
+	err       error
+}
+
+func (u *fakeUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	u.exchanges.Add(1)
+	if u.release != nil {
+		select {
+		case <-u.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if u.err != nil {
+		return nil, u.err
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	r.SetRcode(q, u.rcode)
+	return pool.PackBuffer(r)
+}
+
+func (u *fakeUpstream) Close() error {
+	return nil
+}
+
+// newTestForward builds a Forward on top of us. Upstreams are tagged
+// "u0", "u1", ... in order.
+func newTestForward(args *Args, us ...upstream.Upstream) *Forward {
+	f := &Forward{
+		args:         args,
+		logger:       zap.NewNop(),
+		tracer:       nopTracer{},
+		tag2Upstream: make(map[string]*upstreamWrapper),
+	}
+	for i, u := range us {
+		cfg := UpstreamConfig{Tag: fmt.Sprintf("u%d", i)}
+		uw := newWrapper(i, cfg, "test")
+		uw.errorRateDecay = args.ErrorRateDecay
+		uw.maxErrorRate = args.MaxErrorRate
+		if args.CircuitBreaker != nil {
+			uw.setBreaker(args.CircuitBreaker.newBreaker())
+		}
+		uw.u = u
+		f.us = append(f.us, uw)
+		f.tag2Upstream[cfg.Tag] = uw
+	}
+	f.groups = []*upstreamGroup{f.newGroup("#0", args.SelectionStrategy, 0, len(f.us))}
+	f.initStaleCache()
+	return f
+}
+
+func newTestQCtx(name string, qtype uint16) *query_context.Context {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	return query_context.NewContext(q)
+}
+
 func TestSelectUpstreams(t *testing.T) {
 	us := []*upstreamWrapper{
 		{emaLatency: atomic.Int64{}},
@@ -18,13 +102,16 @@ func TestSelectUpstreams(t *testing.T) {
 	us[2].emaLatency.Store(200)
 	us[3].emaLatency.Store(400)
 
-	selector := newUpstreamSelector(us)
+	selector := newUpstreamSelector(us, weightCacheTTL)
 
 	selectionCount := make(map[int]int)
 	iterations := 10000
 
 	for i := 0; i < iterations; i++ {
-		selected := selector.selectUpstreams(1)
+		selector.mu.Lock()
+		selector.cachedOrder = nil
+		selector.mu.Unlock()
+		selected := selector.selectUpstreams("", 1, nil)
 		if len(selected) != 1 {
 			t.Fatalf("expected 1 selection, got %d", len(selected))
 		}
@@ -54,14 +141,14 @@ func TestSelectUpstreamsWithNoise(t *testing.T) {
 	us[1].emaLatency.Store(100)
 	us[2].emaLatency.Store(200)
 
-	selector := newUpstreamSelector(us)
+	selector := newUpstreamSelector(us, weightCacheTTL)
 
 	selectionCount := make(map[int]int)
 	for i := 0; i < 1000; i++ {
 		selector.mu.Lock()
 		selector.cachedOrder = nil
 		selector.mu.Unlock()
-		indices := selector.selectUpstreams(1)
+		indices := selector.selectUpstreams("", 1, nil)
 		selectionCount[indices[0]]++
 	}
 
@@ -81,6 +168,48 @@ func TestSelectUpstreamsWithNoise(t *testing.T) {
 	}
 }
 
+func TestSelectUpstreamsSeeded(t *testing.T) {
+	us := []*upstreamWrapper{{}, {}, {}, {}}
+	for i, uw := range us {
+		uw.emaLatency.Store(int64(50 * (i + 1)))
+	}
+
+	orders := func(seed uint64) [][]int {
+		selector := newUpstreamSelector(us, weightCacheTTL)
+		selector.setRand(newSeededRand(seed))
+		var res [][]int
+		for i := 0; i < 100; i++ {
+			res = append(res, selector.sampleOrder())
+		}
+		return res
+	}
+
+	// The same seed gives exactly the same selections.
+	a, b := orders(1), orders(1)
+	for i := range a {
+		if !slices.Equal(a[i], b[i]) {
+			t.Fatalf("round %d: expected the same order with the same seed, got %v and %v", i, a[i], b[i])
+		}
+	}
+	c := orders(2)
+	differ := false
+	for i := range a {
+		differ = differ || !slices.Equal(a[i], c[i])
+	}
+	if !differ {
+		t.Fatal("expected different orders with different seeds")
+	}
+
+	// A constant 0.5 means no noise and draws at the middle of the
+	// remaining weights. Scores are 1/50, 1/100, 1/150 and 1/200, so the
+	// first draw is 1/48, which is past the first upstream (1/50).
+	selector := newUpstreamSelector(us, weightCacheTTL)
+	selector.setRand(func() float64 { return 0.5 })
+	if got := selector.sampleOrder(); !slices.Equal(got, []int{1, 0, 2, 3}) {
+		t.Fatalf("expected order [1 0 2 3], got %v", got)
+	}
+}
+
 func TestSelectUpstreamsMultiple(t *testing.T) {
 	us := []*upstreamWrapper{
 		{emaLatency: atomic.Int64{}},
@@ -93,9 +222,9 @@ func TestSelectUpstreamsMultiple(t *testing.T) {
 		us[i].emaLatency.Store(int64(50 * (i + 1)))
 	}
 
-	selector := newUpstreamSelector(us)
+	selector := newUpstreamSelector(us, weightCacheTTL)
 
-	indices := selector.selectUpstreams(2)
+	indices := selector.selectUpstreams("", 2, nil)
 	if len(indices) != 2 {
 		t.Fatalf("expected 2 selections, got %d", len(indices))
 	}
@@ -122,9 +251,9 @@ func TestSelectUpstreamsAllWhenCountExceeds(t *testing.T) {
 		{emaLatency: atomic.Int64{}},
 	}
 
-	selector := newUpstreamSelector(us)
+	selector := newUpstreamSelector(us, weightCacheTTL)
 
-	indices := selector.selectUpstreams(10)
+	indices := selector.selectUpstreams("", 10, nil)
 	if len(indices) != 3 {
 		t.Fatalf("expected 3 selections when count exceeds available, got %d", len(indices))
 	}
@@ -145,9 +274,9 @@ func TestSelectUpstreamsZeroLatency(t *testing.T) {
 
 	us[1].emaLatency.Store(100)
 
-	selector := newUpstreamSelector(us)
+	selector := newUpstreamSelector(us, weightCacheTTL)
 
-	selected := selector.selectUpstreams(1)
+	selected := selector.selectUpstreams("", 1, nil)
 	if len(selected) != 1 {
 		t.Fatalf("expected 1 selection, got %d", len(selected))
 	}
@@ -159,25 +288,26 @@ func TestSelectUpstreamsZeroLatency(t *testing.T) {
 
 func TestSelectUpstreamsWithErrorPenalty(t *testing.T) {
 	us := []*upstreamWrapper{
-		{emaLatency: atomic.Int64{}, queryCount: atomic.Int64{}, errorCount: atomic.Int64{}},
-		{emaLatency: atomic.Int64{}, queryCount: atomic.Int64{}, errorCount: atomic.Int64{}},
+		{emaLatency: atomic.Int64{}},
+		{emaLatency: atomic.Int64{}},
 	}
 
 	us[0].emaLatency.Store(50)
-	us[0].queryCount.Store(100)
-	us[0].errorCount.Store(0)
+	us[0].errorRate.Store(math.Float64bits(0))
 
 	us[1].emaLatency.Store(50)
-	us[1].queryCount.Store(100)
-	us[1].errorCount.Store(50)
+	us[1].errorRate.Store(math.Float64bits(0.5))
 
-	selector := newUpstreamSelector(us)
+	selector := newUpstreamSelector(us, weightCacheTTL)
 
 	selectionCount := make(map[int]int)
 	iterations := 10000
 
 	for i := 0; i < iterations; i++ {
-		selected := selector.selectUpstreams(1)
+		selector.mu.Lock()
+		selector.cachedOrder = nil
+		selector.mu.Unlock()
+		selected := selector.selectUpstreams("", 1, nil)
 		if len(selected) != 1 {
 			t.Fatalf("expected 1 selection, got %d", len(selected))
 		}
@@ -186,7 +316,7 @@ func TestSelectUpstreamsWithErrorPenalty(t *testing.T) {
 
 	t.Logf("Selection distribution (upstream with errors should be selected less often):")
 	for i := 0; i < len(us); i++ {
-		errorRate := float64(us[i].errorCount.Load()) / float64(us[i].queryCount.Load())
+		errorRate := us[i].getErrorRate()
 		t.Logf("  Upstream %d (latency %dms, error rate %.2f%%): %d times (%.2f%%)",
 			i, us[i].emaLatency.Load(), errorRate*100, selectionCount[i],
 			float64(selectionCount[i])/float64(iterations)*100)
@@ -197,6 +327,66 @@ func TestSelectUpstreamsWithErrorPenalty(t *testing.T) {
 	}
 }
 
+func TestSelectorTuning(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	for _, st := range []SelectorTuning{
+		{NoiseFactor: f(-0.1)},
+		{NoiseFactor: f(1)},
+		{ErrorPenaltyMult: f(-1)},
+		{DefaultLatency: f(0)},
+	} {
+		u := UpstreamConfig{Addr: "127.0.0.1"}
+		if _, err := NewForward(&Args{Upstreams: []UpstreamConfig{u}, SelectorTuning: st}, Opts{}); err == nil {
+			t.Fatalf("expected an error for %+v", st)
+		}
+	}
+
+	tuning, err := (&SelectorTuning{NoiseFactor: f(0), ErrorPenaltyMult: f(2), DefaultLatency: f(40)}).tuning()
+	if err != nil {
+		t.Fatal(err)
+	}
+	us := []*upstreamWrapper{{}, {}}
+	us[1].emaLatency.Store(20)
+	us[1].errorRate.Store(math.Float64bits(0.5))
+	s := newUpstreamSelector(us, weightCacheTTL)
+	s.setTuning(tuning)
+
+	// Without noise, scores are exact. The one without queries has the
+	// default latency, the other is penalized by its error rate.
+	scores := s.calculateScores()
+	if scores[0].score != 1.0/40 || scores[1].score != 1.0/(20*2) {
+		t.Fatalf("unexpected scores %+v", scores)
+	}
+}
+
+func TestEmaLatencyDecay(t *testing.T) {
+	uw := &upstreamWrapper{emaDecayTarget: 10}
+	uw.emaLatency.Store(1000)
+	uw.lastSuccess.Store(time.Now().Add(-3 * time.Second).UnixNano())
+	if l := uw.getEmaLatency(); l != 1000 {
+		t.Fatalf("expected no decay if it is disabled, got %d", l)
+	}
+
+	uw.emaDecayAfter = time.Second
+	now := time.Unix(0, uw.lastSuccess.Load())
+	if l := uw.decayedEmaLatency(now.Add(time.Second)); l != 1000 {
+		t.Fatalf("expected no decay before ema_decay_after, got %d", l)
+	}
+	// Idle for 2s more than ema_decay_after, the gap is quartered.
+	if l := uw.decayedEmaLatency(now.Add(3 * time.Second)); l != 258 {
+		t.Fatalf("expected a decayed latency 258, got %d", l)
+	}
+
+	// The next sample is averaged with the decayed value.
+	uw.updateEmaLatency(10)
+	if l := uw.emaLatency.Load(); l >= 1000*0.7 {
+		t.Fatalf("expected the stale latency to be forgotten, got %d", l)
+	}
+	if _, err := NewForward(&Args{Upstreams: []UpstreamConfig{{Addr: "127.0.0.1"}}, EmaDecayAfter: -1}, Opts{}); err == nil {
+		t.Fatal("expected an error for a negative ema_decay_after")
+	}
+}
+
 func TestSelectUpstreamsCaching(t *testing.T) {
 	us := []*upstreamWrapper{
 		{emaLatency: atomic.Int64{}},
@@ -208,10 +398,10 @@ func TestSelectUpstreamsCaching(t *testing.T) {
 	us[1].emaLatency.Store(100)
 	us[2].emaLatency.Store(200)
 
-	selector := newUpstreamSelector(us)
+	selector := newUpstreamSelector(us, weightCacheTTL)
 
-	indices1 := selector.selectUpstreams(2)
-	indices2 := selector.selectUpstreams(2)
+	indices1 := selector.selectUpstreams("", 2, nil)
+	indices2 := selector.selectUpstreams("", 2, nil)
 
 	if len(indices1) != 2 || len(indices2) != 2 {
 		t.Fatalf("expected 2 selections, got %d and %d", len(indices1), len(indices2))
@@ -221,3 +411,1360 @@ func TestSelectUpstreamsCaching(t *testing.T) {
 		t.Logf("Note: Cached selection may differ due to cache TTL expiration or initial call")
 	}
 }
+
+type tracedExchange struct {
+	tag    string
+	err    error
+	parent any // the value of the ctx key, to check that the trace ctx is passed.
+}
+
+type traceCtxKey struct{}
+
+// recordingTracer records finished exchanges.
+type recordingTracer struct {
+	finished chan tracedExchange
+}
+
+func (r *recordingTracer) StartExchange(ctx context.Context, tag string) (context.Context, func(err error)) {
+	return context.WithValue(ctx, traceCtxKey{}, tag), func(err error) {
+		r.finished <- tracedExchange{tag: tag, err: err, parent: ctx.Value(traceCtxKey{})}
+	}
+}
+
+// ctxUpstream fails if its ctx does not carry the trace.
+type ctxUpstream struct {
+	fakeUpstream
+}
+
+func (u *ctxUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	if ctx.Value(traceCtxKey{}) == nil {
+		return nil, errors.New("no trace in ctx")
+	}
+	return u.fakeUpstream.ExchangeContext(ctx, m)
+}
+
+func TestForwardTracer(t *testing.T) {
+	errBroken := errors.New("broken")
+	f := newTestForward(&Args{Concurrent: 2}, &ctxUpstream{}, &fakeUpstream{err: errBroken})
+	tracer := &recordingTracer{finished: make(chan tracedExchange, 2)}
+	f.tracer = tracer
+
+	ctx := context.WithValue(context.Background(), traceCtxKey{}, "query")
+	if err := f.Exec(ctx, newTestQCtx("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	// One span per exchange, including the one that did not win.
+	got := make(map[string]tracedExchange)
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-tracer.finished:
+			got[e.tag] = e
+		case <-time.After(time.Second * 5):
+			t.Fatalf("expected 2 traced exchanges, got %v", got)
+		}
+	}
+	if e, ok := got["u0"]; !ok || e.err != nil || e.parent != "query" {
+		t.Fatalf("unexpected trace of u0 %+v", e)
+	}
+	if e, ok := got["u1"]; !ok || !errors.Is(e.err, errBroken) || e.parent != "query" {
+		t.Fatalf("unexpected trace of u1 %+v", e)
+	}
+}
+
+func TestForwardDedup(t *testing.T) {
+	u := &fakeUpstream{release: make(chan struct{})}
+	f := newTestForward(&Args{Dedup: true}, u)
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			qCtx := newTestQCtx("example.com", dns.TypeA)
+			qCtx.Q().Id = id
+			if err := f.Exec(context.Background(), qCtx); err != nil {
+				errs <- err
+				return
+			}
+			if r := qCtx.R(); r == nil || r.Id != id {
+				errs <- fmt.Errorf("query %d got an invalid response %v", id, r)
+			}
+		}(uint16(i))
+	}
+
+	time.Sleep(time.Millisecond * 100) // Let all queries join the in-flight exchange.
+	close(u.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if got := u.exchanges.Load(); got != 1 {
+		t.Fatalf("expected exactly 1 upstream exchange, got %d", got)
+	}
+
+	// The in-flight entry must be cleared once the exchange is done.
+	if err := f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if got := u.exchanges.Load(); got != 2 {
+		t.Fatalf("expected a new upstream exchange, got %d exchanges", got)
+	}
+}
+
+func TestSelectUpstreamsAsyncRefresh(t *testing.T) {
+	us := []*upstreamWrapper{
+		{emaLatency: atomic.Int64{}},
+		{emaLatency: atomic.Int64{}},
+		{emaLatency: atomic.Int64{}},
+	}
+	selector := newUpstreamSelector(us, weightCacheTTL)
+	warm := selector.selectUpstreams("", 2, nil) // Cold cache, computed synchronously.
+
+	// Pretend a background refresh is running and the cache has expired.
+	// The query path must serve the cached order without recomputing.
+	selector.refreshing.Store(true)
+	stale := time.Now().Add(-weightCacheTTL * 2)
+	selector.mu.Lock()
+	selector.lastUpdate = stale
+	selector.mu.Unlock()
+
+	for i := 0; i < 100; i++ {
+		got := selector.selectUpstreams("", 2, nil)
+		if got[0] != warm[0] || got[1] != warm[1] {
+			t.Fatalf("expected cached order %v, got %v", warm, got)
+		}
+	}
+	selector.mu.RLock()
+	lastUpdate := selector.lastUpdate
+	selector.mu.RUnlock()
+	if !lastUpdate.Equal(stale) {
+		t.Fatal("query path should not recompute the order synchronously")
+	}
+
+	// Once no refresh is running, a stale cache triggers one in background.
+	selector.refreshing.Store(false)
+	selector.selectUpstreams("", 2, nil)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		selector.mu.RLock()
+		lastUpdate = selector.lastUpdate
+		selector.mu.RUnlock()
+		if !lastUpdate.Equal(stale) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background refresh did not run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSelectUpstreamsNoCache(t *testing.T) {
+	newSelector := func(cacheTTL time.Duration) (*upstreamSelector, []*upstreamWrapper) {
+		us := []*upstreamWrapper{{}, {}}
+		us[0].emaLatency.Store(1)
+		us[1].emaLatency.Store(1000)
+		s := newUpstreamSelector(us, cacheTTL)
+		s.setRand(func() float64 { return 0.5 }) // No noise.
+		return s, us
+	}
+
+	selector, us := newSelector(0)
+	if got := selector.selectUpstreams("", 1, nil); got[0] != 0 {
+		t.Fatalf("expected the faster upstream 0, got %v", got)
+	}
+	us[0].emaLatency.Store(1000)
+	us[1].emaLatency.Store(1)
+	if got := selector.selectUpstreams("", 1, nil); got[0] != 1 {
+		t.Fatalf("expected the latency change to be reflected immediately, got %v", got)
+	}
+
+	// With the cache, the order is kept until it expires.
+	selector, us = newSelector(weightCacheTTL)
+	selector.selectUpstreams("", 1, nil)
+	us[0].emaLatency.Store(1000)
+	us[1].emaLatency.Store(1)
+	if got := selector.selectUpstreams("", 1, nil); got[0] != 0 {
+		t.Fatalf("expected the cached order, got %v", got)
+	}
+}
+
+func TestUpstreamErrorRateDecay(t *testing.T) {
+	u := &fakeUpstream{}
+	f := newTestForward(&Args{ErrorRateDecay: 0.1}, u)
+	uw := f.us[0]
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qb, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(n int) {
+		for i := 0; i < n; i++ {
+			if r, err := uw.ExchangeContext(context.Background(), qb); err == nil {
+				pool.ReleaseBuf(r)
+			}
+		}
+	}
+
+	// A burst of errors.
+	u.err = errors.New("upstream down")
+	exchange(20)
+	burstRate := uw.getErrorRate()
+	if burstRate < 0.8 {
+		t.Fatalf("expected a high error rate after a burst of errors, got %f", burstRate)
+	}
+
+	// Then the upstream recovers.
+	u.err = nil
+	exchange(50)
+	recoveredRate := uw.getErrorRate()
+	if recoveredRate > 0.01 {
+		t.Fatalf("expected the error rate to decay, got %f", recoveredRate)
+	}
+
+	// Lifetime counters are kept for metrics.
+	if uw.errorCount.Load() != 20 || uw.queryCount.Load() != 70 {
+		t.Fatalf("unexpected lifetime counters, errors: %d, queries: %d", uw.errorCount.Load(), uw.queryCount.Load())
+	}
+
+	for _, d := range []float64{-0.1, 1.5} {
+		if _, err := NewForward(&Args{Upstreams: []UpstreamConfig{{Addr: "127.0.0.1"}}, ErrorRateDecay: d}, Opts{}); err == nil {
+			t.Fatalf("error_rate_decay %v should be rejected", d)
+		}
+	}
+}
+
+func TestForwardRaceMode(t *testing.T) {
+	stall := make(chan struct{}) // Never closed.
+	us := []*fakeUpstream{{release: stall}, {}, {release: stall}}
+	f := newTestForward(&Args{RaceMode: true, RaceCount: 3}, us[0], us[1], us[2])
+
+	start := time.Now()
+	qCtx := newTestQCtx("example.com", dns.TypeA)
+	if err := f.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if qCtx.R() == nil {
+		t.Fatal("expected a response from the fastest upstream")
+	}
+
+	// The stalled upstreams are canceled once the race is won, and that
+	// is not counted as an error.
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		running := false
+		for i, u := range us {
+			if u.exchanges.Load() != 1 || f.us[i].inFlight.Load() != 0 {
+				running = true
+			}
+		}
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the losers of the race were not canceled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed >= queryTimeout {
+		t.Fatalf("the losers should be canceled before they time out, took %s", elapsed)
+	}
+	for i, uw := range f.us {
+		if n := uw.errorCount.Load(); n != 0 {
+			t.Fatalf("u%d: canceled exchanges should not count as errors, got %d", i, n)
+		}
+		if r := uw.getErrorRate(); r != 0 {
+			t.Fatalf("u%d: unexpected error rate %v", i, r)
+		}
+	}
+
+	// Only the top RaceCount upstreams race.
+	us = []*fakeUpstream{{}, {}, {}}
+	f = newTestForward(&Args{RaceMode: true}, us[0], us[1], us[2])
+	if err := f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(time.Second * 2)
+	for us[0].exchanges.Load()+us[1].exchanges.Load()+us[2].exchanges.Load() < defaultRaceCount {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the default number of upstreams to race")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if n := us[0].exchanges.Load() + us[1].exchanges.Load() + us[2].exchanges.Load(); n != defaultRaceCount {
+		t.Fatalf("expected %d racing upstreams, got %d", defaultRaceCount, n)
+	}
+}
+
+func TestForwardStickyByQName(t *testing.T) {
+	us := []*fakeUpstream{{}, {}, {}, {}}
+	f := newTestForward(&Args{StickyByQName: true}, us[0], us[1], us[2], us[3])
+	exchanges := func() []int64 {
+		n := make([]int64, len(us))
+		for i, u := range us {
+			n[i] = u.exchanges.Load()
+		}
+		return n
+	}
+
+	used := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("name%d.example", i)
+		before := exchanges()
+		for j := 0; j < 5; j++ {
+			if err := f.Exec(context.Background(), newTestQCtx(name, dns.TypeA)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		after := exchanges()
+		for k := range us {
+			switch after[k] - before[k] {
+			case 0:
+			case 5:
+				used[k] = true
+			default:
+				t.Fatalf("%s should always go to the same upstream, exchanges before %v, after %v", name, before, after)
+			}
+		}
+	}
+	if len(used) < 2 {
+		t.Fatalf("names should be spread across upstreams, only used %v", used)
+	}
+
+	// Latencies change on every exchange, they must not remap names.
+	sel := f.groups[0].selector
+	orders := make(map[string][]int)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("name%d.example.", i)
+		orders[name] = sel.stickyOrder(name)
+	}
+	for i, uw := range f.us {
+		uw.updateEmaLatency(int64(time.Millisecond) * int64(1+i*50))
+	}
+	for name, order := range orders {
+		if got := sel.stickyOrder(name); !slices.Equal(got, order) {
+			t.Fatalf("%s was remapped by latency jitter, from %v to %v", name, order, got)
+		}
+	}
+
+	// The query falls through to the next upstream of the name.
+	order := f.groups[0].selector.stickyOrder("name0.example.")
+	us[order[0]].err = errors.New("failed")
+	before := exchanges()
+	if err := f.Exec(context.Background(), newTestQCtx("name0.example", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	after := exchanges()
+	if after[order[0]]-before[order[0]] != 1 || after[order[1]]-before[order[1]] != 1 {
+		t.Fatalf("expected %d then %d to be tried, exchanges before %v, after %v", order[0], order[1], before, after)
+	}
+}
+
+func TestForwardUpstreamPolicy(t *testing.T) {
+	us := []*fakeUpstream{{}, {}, {}}
+	f := newTestForward(&Args{Concurrent: 3}, us[0], us[1], us[2])
+
+	for i := 0; i < 10; i++ {
+		qCtx := newTestQCtx("internal.example", dns.TypeA)
+		SetUpstreamPolicy(qCtx, &UpstreamPolicy{Allow: []string{"u1"}})
+		if err := f.Exec(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if us[0].exchanges.Load() != 0 || us[2].exchanges.Load() != 0 || us[1].exchanges.Load() != 10 {
+		t.Fatalf("only u1 should be used, exchanges: %d %d %d",
+			us[0].exchanges.Load(), us[1].exchanges.Load(), us[2].exchanges.Load())
+	}
+
+	qCtx := newTestQCtx("internal.example", dns.TypeA)
+	SetUpstreamPolicy(qCtx, &UpstreamPolicy{Allow: []string{"u1"}, Deny: []string{"u1"}})
+	if err := f.Exec(context.Background(), qCtx); !errors.Is(err, errNoAllowedUpstream) {
+		t.Fatalf("expected errNoAllowedUpstream, got %v", err)
+	}
+
+	// The policy also applies to quick configured upstream subsets.
+	exec, err := f.QuickConfigureExec("u0 u2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qCtx = newTestQCtx("internal.example", dns.TypeA)
+	SetUpstreamPolicy(qCtx, &UpstreamPolicy{Deny: []string{"u0"}})
+	if err := exec.(sequence.ExecutableFunc)(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if us[0].exchanges.Load() != 0 || us[2].exchanges.Load() != 1 {
+		t.Fatalf("only u2 should be used, exchanges: %d %d %d",
+			us[0].exchanges.Load(), us[1].exchanges.Load(), us[2].exchanges.Load())
+	}
+}
+
+func TestForwardDNS64(t *testing.T) {
+	us := []*fakeUpstream{{}, {}, {}}
+	f := newTestForward(&Args{Concurrent: 3}, us[0], us[1], us[2])
+	f.us[1].cfg.DNS64 = true
+
+	exec := func(qtype uint16, dns64 bool) error {
+		qCtx := newTestQCtx("ipv4only.example", qtype)
+		SetDNS64(qCtx, dns64)
+		return f.Exec(context.Background(), qCtx)
+	}
+	for i := 0; i < 10; i++ {
+		if err := exec(dns.TypeAAAA, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if us[0].exchanges.Load() != 0 || us[2].exchanges.Load() != 0 || us[1].exchanges.Load() != 10 {
+		t.Fatalf("only u1 should be used, exchanges: %d %d %d",
+			us[0].exchanges.Load(), us[1].exchanges.Load(), us[2].exchanges.Load())
+	}
+
+	// With the only DNS64 upstream broken, queries that are not restricted
+	// still succeed.
+	us[1].err = errors.New("broken")
+	if err := exec(dns.TypeA, true); err != nil {
+		t.Fatalf("A queries should not be restricted: %v", err)
+	}
+	if err := exec(dns.TypeAAAA, false); err != nil {
+		t.Fatalf("AAAA queries without the DNS64 flag should not be restricted: %v", err)
+	}
+	if err := exec(dns.TypeAAAA, true); err == nil {
+		t.Fatal("DNS64 AAAA queries should only use u1")
+	}
+
+	// DNS64Clients flags all AAAA queries.
+	f.args.DNS64Clients = true
+	if err := exec(dns.TypeAAAA, false); err == nil {
+		t.Fatal("DNS64 AAAA queries should only use u1")
+	}
+}
+
+func TestForwardOnAllFail(t *testing.T) {
+	errBroken := errors.New("broken")
+	exec := func(f *Forward) (*query_context.Context, error) {
+		qCtx := newTestQCtx("example.com", dns.TypeA)
+		return qCtx, f.Exec(context.Background(), qCtx)
+	}
+
+	// return_error, also the default.
+	for _, mode := range []string{"", OnAllFailReturnError} {
+		f := newTestForward(&Args{Concurrent: 2, OnAllFail: mode}, &fakeUpstream{err: errBroken}, &fakeUpstream{err: errBroken})
+		if _, err := exec(f); !errors.Is(err, errAllUpstreamsFailed) {
+			t.Fatalf("mode %q: expected the all failed error, got %v", mode, err)
+		}
+	}
+
+	// servfail
+	f := newTestForward(&Args{Concurrent: 2, OnAllFail: OnAllFailServfail}, &fakeUpstream{err: errBroken}, &fakeUpstream{err: errBroken})
+	qCtx, err := exec(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeServerFailure || r.Id != qCtx.Q().Id {
+		t.Fatalf("expected a SERVFAIL response, got %v", r)
+	}
+
+	// stale
+	u := &fakeUpstream{}
+	f = newTestForward(&Args{OnAllFail: OnAllFailStale}, u)
+	defer f.Close()
+	f.staleCache.Close()
+	f.staleCache = cache.New[staleKey, *dns.Msg](cache.Opts{SyncWrites: true})
+	if _, err := exec(f); err != nil {
+		t.Fatal(err)
+	}
+	u.err = errBroken
+	qCtx, err = exec(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeSuccess || r.Id != qCtx.Q().Id {
+		t.Fatalf("expected the stale response, got %v", r)
+	}
+
+	// Without a stale response, the error is returned.
+	qCtx = newTestQCtx("other.example.com", dns.TypeA)
+	if err := f.Exec(context.Background(), qCtx); !errors.Is(err, errAllUpstreamsFailed) {
+		t.Fatalf("expected the all failed error, got %v", err)
+	}
+
+	if _, err := NewForward(&Args{Upstreams: []UpstreamConfig{{Addr: "127.0.0.1"}}, OnAllFail: "invalid"}, Opts{}); err == nil {
+		t.Fatal("expected an invalid mode error")
+	}
+}
+
+func TestForwardTTLClamp(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Response = true
+	resp.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0}},
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1 << 31}},
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}},
+	}
+	resp.SetEdns0(1232, true)
+	b, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newTestForward(&Args{}, &echoUpstream{b: b})
+	f.us[0].cfg.TTLClamp = &TTLClamp{Min: 10, Max: 86400}
+	qCtx := newTestQCtx("example.com", dns.TypeA)
+	if err := f.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	r := qCtx.R()
+	for i, want := range []uint32{10, 86400, 300} {
+		if got := r.Answer[i].Header().Ttl; got != want {
+			t.Fatalf("answer %d: want ttl %d, got %d", i, want, got)
+		}
+	}
+	if opt := qCtx.UpstreamOpt(); opt == nil || !opt.Do() {
+		t.Fatal("opt record should not be changed")
+	}
+
+	if _, err := NewForward(&Args{Upstreams: []UpstreamConfig{{Addr: "127.0.0.1", TTLClamp: &TTLClamp{Min: 10, Max: 5}}}}, Opts{}); err == nil {
+		t.Fatal("expected an invalid ttl_clamp error")
+	}
+}
+
+func TestForwardAddressFamilyFilter(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Response = true
+	hdr := func(t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: "example.com.", Rrtype: t, Class: dns.ClassINET, Ttl: 300}
+	}
+	resp.Answer = []dns.RR{
+		&dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: "example.com."},
+		&dns.A{Hdr: hdr(dns.TypeA), A: net.IPv4(192, 0, 2, 1)},
+		&dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: net.ParseIP("2001:db8::1")},
+		&dns.A{Hdr: hdr(dns.TypeA), A: net.IPv4(192, 0, 2, 2)},
+	}
+	b, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newTestForward(&Args{}, &echoUpstream{b: b})
+	f.us[0].cfg.AddressFamilyFilter = AddressFamilyKeepA
+	qCtx := newTestQCtx("example.com", dns.TypeA)
+	if err := f.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	r := qCtx.R()
+	if len(r.Answer) != 3 {
+		t.Fatalf("expected 3 answers, got %v", r.Answer)
+	}
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			t.Fatalf("AAAA records should be removed, got %v", r.Answer)
+		}
+	}
+
+	if _, err := NewForward(&Args{Upstreams: []UpstreamConfig{{Addr: "127.0.0.1", AddressFamilyFilter: "keep_mx"}}}, Opts{}); err == nil {
+		t.Fatal("expected an invalid address_family_filter error")
+	}
+}
+
+func TestForwardOnUpstreamSkipped(t *testing.T) {
+	us := []*fakeUpstream{{}, {}}
+	f := newTestForward(&Args{Concurrent: 2}, us[0], us[1])
+	var skipped []string
+	f.OnUpstreamSkipped = func(tag string, reason string) {
+		skipped = append(skipped, tag+" "+reason)
+	}
+
+	// Trip the breaker of u0.
+	cb := qos.NewCircuitBreaker(qos.CircuitBreakerConfig{MaxFailures: 1})
+	cb.Execute(func() error { return errors.New("failed") })
+	if cb.State() != qos.StateOpen {
+		t.Fatalf("breaker should be open, got %s", cb.State())
+	}
+	f.us[0].breaker = cb
+
+	if err := f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0] != "u0 "+SkipReasonCircuitOpen {
+		t.Fatalf("unexpected skip events %v", skipped)
+	}
+	if us[0].exchanges.Load() != 0 {
+		t.Fatal("u0 should be routed around")
+	}
+
+	// If every upstream is degraded, they are still selected and nothing
+	// is reported, but their open breakers refuse the query.
+	f.us[1].breaker = cb
+	if err := f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA)); !errors.Is(err, errAllUpstreamsFailed) {
+		t.Fatalf("expected errAllUpstreamsFailed, got %v", err)
+	}
+	if len(skipped) != 1 {
+		t.Fatalf("unexpected skip events %v", skipped)
+	}
+	if us[0].exchanges.Load() != 0 || us[1].exchanges.Load() != 1 {
+		t.Fatal("open breakers should not let queries through")
+	}
+}
+
+func TestForwardSkipReasons(t *testing.T) {
+	// exec runs a query through f and returns the skip events.
+	exec := func(t *testing.T, f *Forward) []string {
+		t.Helper()
+		var mu sync.Mutex
+		var skipped []string
+		f.OnUpstreamSkipped = func(tag string, reason string) {
+			mu.Lock()
+			defer mu.Unlock()
+			skipped = append(skipped, tag+" "+reason)
+		}
+		if err := f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return skipped
+	}
+
+	t.Run("error_rate", func(t *testing.T) {
+		us := []*fakeUpstream{{}, {}}
+		f := newTestForward(&Args{Concurrent: 2, MaxErrorRate: 0.5}, us[0], us[1])
+		f.us[0].errorRate.Store(math.Float64bits(1))
+		f.us[0].lastProbe.Store(time.Now().UnixNano())
+
+		if skipped := exec(t, f); len(skipped) != 1 || skipped[0] != "u0 "+SkipReasonErrorRate {
+			t.Fatalf("unexpected skip events %v", skipped)
+		}
+		if us[0].exchanges.Load() != 0 {
+			t.Fatal("u0 should be routed around")
+		}
+
+		// Once the probe interval has passed, u0 gets a probe and is not
+		// reported.
+		f.us[0].lastProbe.Store(0)
+		if skipped := exec(t, f); len(skipped) != 0 {
+			t.Fatalf("unexpected skip events %v", skipped)
+		}
+		deadline := time.Now().Add(time.Second * 5)
+		for us[0].exchanges.Load() != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("u0 should get a probe")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("saturated", func(t *testing.T) {
+		us := []*fakeUpstream{{}, {}}
+		f := newTestForward(&Args{Concurrent: 2}, us[0], us[1])
+		f.us[0].cfg.MaxInFlight = 1
+		f.us[0].inFlight.Store(1)
+
+		if skipped := exec(t, f); len(skipped) != 1 || skipped[0] != "u0 "+SkipReasonSaturated {
+			t.Fatalf("unexpected skip events %v", skipped)
+		}
+		if us[0].exchanges.Load() != 0 {
+			t.Fatal("u0 should be routed around")
+		}
+		if !f.us[0].healthy() {
+			t.Fatal("a saturated upstream should still be healthy")
+		}
+
+		f.us[0].inFlight.Store(0)
+		if skipped := exec(t, f); len(skipped) != 0 {
+			t.Fatalf("unexpected skip events %v", skipped)
+		}
+	})
+
+	t.Run("unhealthy", func(t *testing.T) {
+		us := []*fakeUpstream{{}, {}}
+		f := newTestForward(&Args{ErrorRateDecay: 0.5, SelectionStrategy: SelectionFailover}, us[0], us[1])
+		f.us[0].errorRate.Store(math.Float64bits(1))
+		f.us[0].lastProbe.Store(time.Now().UnixNano())
+
+		if skipped := exec(t, f); len(skipped) != 1 || skipped[0] != "u0 "+SkipReasonUnhealthy {
+			t.Fatalf("unexpected skip events %v", skipped)
+		}
+		if us[0].exchanges.Load() != 0 || us[1].exchanges.Load() != 1 {
+			t.Fatal("u0 should be failed over")
+		}
+
+		// The probe is not reported.
+		f.us[0].lastProbe.Store(0)
+		if skipped := exec(t, f); len(skipped) != 0 {
+			t.Fatalf("unexpected skip events %v", skipped)
+		}
+	})
+}
+
+// gatherUpstreamGauges returns the values of the gauge name of the
+// upstreams of f by their tags.
+func gatherUpstreamGauges(t *testing.T, f *Forward, name string) map[string]float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	if err := f.RegisterMetricsTo(reg); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "upstream" {
+					values[l.GetValue()] = m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return values
+}
+
+func TestForwardSelectorScoreMetric(t *testing.T) {
+	f := newTestForward(&Args{}, &fakeUpstream{}, &fakeUpstream{})
+	f.groups[0].selector.setRand(func() float64 { return 0.5 }) // No noise.
+	f.us[0].emaLatency.Store(10)
+	f.us[1].emaLatency.Store(100)
+
+	if err := f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	scores := gatherUpstreamGauges(t, f, "selector_score")
+	if math.Abs(scores["u0"]-0.1) > 1e-9 || math.Abs(scores["u1"]-0.01) > 1e-9 {
+		t.Fatalf("unexpected selector scores %v", scores)
+	}
+}
+
+func TestForwardCircuitBreaker(t *testing.T) {
+	us := []*fakeUpstream{{err: errors.New("failed")}, {}}
+	f := newTestForward(&Args{CircuitBreaker: &CircuitBreakerArgs{MaxFailures: 2}}, us[0], us[1])
+	// Pin the order, u0 first.
+	f.groups[0].selector.scorer = &roundRobinScorer{n: 2, round: 1}
+	f.groups[0].selector.cacheTTL = 0
+	f.groups[0].selector.setRand(func() float64 { return 0.5 })
+
+	for i := 0; i < 2; i++ {
+		f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA))
+		f.groups[0].selector.scorer.(*roundRobinScorer).round = 1
+	}
+	if s := f.us[0].breaker.State(); s != qos.StateOpen {
+		t.Fatalf("the breaker of u0 should be open, state: %s", s)
+	}
+	if s := f.us[1].breaker.State(); s != qos.StateClosed {
+		t.Fatalf("the breaker of u1 should be closed, state: %s", s)
+	}
+
+	// u0 is excluded from selection while its breaker is open.
+	for _, sc := range f.groups[0].selector.calculateScores() {
+		if sc.idx == 0 && sc.score != 0 {
+			t.Fatalf("u0 should have a zero score, got %v", sc.score)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := us[0].exchanges.Load(); n != 2 {
+		t.Fatalf("u0 should not be queried while its breaker is open, got %d exchanges", n)
+	}
+
+	// The state is exported as a metric.
+	if states := gatherUpstreamGauges(t, f, "circuit_breaker_state"); states["u0"] != float64(qos.StateOpen) || states["u1"] != float64(qos.StateClosed) {
+		t.Fatalf("unexpected breaker state metrics %v", states)
+	}
+
+	if _, err := NewForward(&Args{
+		Upstreams:      []UpstreamConfig{{Addr: "null://refused"}},
+		CircuitBreaker: &CircuitBreakerArgs{FailureRateThreshold: 2},
+	}, Opts{}); err == nil {
+		t.Fatal("invalid circuit breaker args should be rejected")
+	}
+}
+
+func TestForwardReady(t *testing.T) {
+	errFailed := errors.New("failed")
+	us := []*fakeUpstream{{err: errFailed}, {}}
+	f := newTestForward(&Args{Concurrent: 2, ErrorRateDecay: 0.5}, us[0], us[1])
+	if !f.Ready() {
+		t.Fatal("new forward should be ready")
+	}
+
+	// All upstreams are failing.
+	us[1].err = errFailed
+	for i := 0; i < 4; i++ {
+		f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA))
+	}
+	if f.Ready() {
+		t.Fatalf("forward should not be ready, health: %+v", f.HealthReport())
+	}
+	for _, h := range f.HealthReport() {
+		if h.Healthy || h.ErrorRate < maxHealthyErrorRate {
+			t.Fatalf("unexpected health %+v", h)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	f.Api().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("want 503, got %d", rec.Code)
+	}
+}
+
+func TestForwardThreadMax(t *testing.T) {
+	const k = 8
+	u := &fakeUpstream{release: make(chan struct{})}
+	f := newTestForward(&Args{}, u)
+	uw := f.us[0]
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < k; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := uw.ExchangeContext(context.Background(), b); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for u.exchanges.Load() < k {
+		time.Sleep(time.Millisecond)
+	}
+	if got := f.ThreadMax()["u0"]; got != k {
+		t.Fatalf("want thread max %d, got %d", k, got)
+	}
+
+	close(u.release)
+	wg.Wait()
+	if got := f.ThreadMax()["u0"]; got != k {
+		t.Fatalf("thread max should be kept after queries returned, got %d", got)
+	}
+	if got := uw.inFlight.Load(); got != 0 {
+		t.Fatalf("want 0 in-flight, got %d", got)
+	}
+
+	f.ResetThreadMax()
+	if got := f.ThreadMax()["u0"]; got != 0 {
+		t.Fatalf("want thread max 0 after reset, got %d", got)
+	}
+	if _, err := uw.ExchangeContext(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ThreadMax()["u0"]; got != 1 {
+		t.Fatalf("want thread max 1, got %d", got)
+	}
+}
+
+func TestSelectUpstreamsRoundRobinScorer(t *testing.T) {
+	// The upstreams take turns per query, although the order of other
+	// scorers is cached.
+	f := newTestForward(&Args{Scorer: "round_robin"}, &fakeUpstream{}, &fakeUpstream{}, &fakeUpstream{}, &fakeUpstream{})
+	us := f.us
+	us[0].emaLatency.Store(10)
+	us[3].emaLatency.Store(1000)
+	selector := f.groups[0].selector
+
+	selectionCount := make(map[int]int)
+	iterations := 1000
+	for i := 0; i < iterations; i++ {
+		selectionCount[selector.selectUpstreams("", 1, nil)[0]]++
+	}
+
+	// Allow a few misses, others have a tiny but non-zero weight.
+	for i := range us {
+		if n := selectionCount[i]; n < iterations/len(us)-10 || n > iterations/len(us)+10 {
+			t.Errorf("round_robin should select upstreams evenly, got %v", selectionCount)
+			break
+		}
+	}
+}
+
+func TestSelectUpstreamsRandomScorer(t *testing.T) {
+	us := []*upstreamWrapper{{}, {}}
+	us[0].emaLatency.Store(10)
+	us[1].emaLatency.Store(1000)
+	us[1].errorRate.Store(math.Float64bits(1))
+
+	s, err := newScorer("random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := newUpstreamSelector(us, weightCacheTTL)
+	selector.scorer = s
+	selector.setRand(newSeededRand(1)) // deterministic
+
+	selectionCount := make(map[int]int)
+	iterations := 10000
+	for i := 0; i < iterations; i++ {
+		selector.mu.Lock()
+		selector.cachedOrder = nil
+		selector.mu.Unlock()
+		selectionCount[selector.selectUpstreams("", 1, nil)[0]]++
+	}
+
+	// The slow upstream should still get about half of the queries.
+	if n := selectionCount[1]; n < iterations*4/10 || n > iterations*6/10 {
+		t.Errorf("random should ignore latency and errors, got %v", selectionCount)
+	}
+}
+
+func TestSelectUpstreamsWeight(t *testing.T) {
+	us := []*upstreamWrapper{{}, {}}
+	us[0].cfg.Weight = 3
+	for _, uw := range us {
+		uw.emaLatency.Store(10)
+	}
+	selector := newUpstreamSelector(us, weightCacheTTL)
+	selector.setRand(newSeededRand(1)) // deterministic
+
+	selectionCount := make(map[int]int)
+	iterations := 10000
+	for i := 0; i < iterations; i++ {
+		selector.mu.Lock()
+		selector.cachedOrder = nil
+		selector.mu.Unlock()
+		selectionCount[selector.selectUpstreams("", 1, nil)[0]]++
+	}
+
+	// Expect about 3:1.
+	if n := selectionCount[0]; n < iterations*70/100 || n > iterations*80/100 {
+		t.Errorf("expected about 75%% of queries on the weighted upstream, got %v", selectionCount)
+	}
+
+	if _, err := NewForward(&Args{Upstreams: []UpstreamConfig{{Addr: "null://refused", Weight: -1}}}, Opts{}); err == nil {
+		t.Fatal("negative weight should be rejected")
+	}
+}
+
+func TestSelectUpstreamsSlowStart(t *testing.T) {
+	us := []*upstreamWrapper{{}, {}}
+	for _, uw := range us {
+		uw.emaLatency.Store(10)
+	}
+	selector := newUpstreamSelector(us, weightCacheTTL)
+	selector.slowStart = time.Minute
+	us[0].eligibleSince.Store(time.Now().Add(-time.Hour).UnixNano())
+	us[1].markEligible()
+
+	share := func() float64 {
+		selectionCount := make(map[int]int)
+		iterations := 10000
+		for i := 0; i < iterations; i++ {
+			selector.mu.Lock()
+			selector.cachedOrder = nil
+			selector.mu.Unlock()
+			selectionCount[selector.selectUpstreams("", 1, nil)[0]]++
+		}
+		return float64(selectionCount[1]) / float64(iterations)
+	}
+
+	// Expect about 1:10 right after u1 became eligible.
+	if s := share(); s > 0.15 {
+		t.Errorf("a just eligible upstream should get reduced traffic, got %.2f", s)
+	}
+
+	// Full traffic after the slow start.
+	us[1].eligibleSince.Store(time.Now().Add(-time.Minute).UnixNano())
+	if s := share(); s < 0.4 || s > 0.6 {
+		t.Errorf("expected about half of the traffic after the slow start, got %.2f", s)
+	}
+
+	// A recovered breaker restarts it.
+	cb := qos.NewCircuitBreaker(qos.CircuitBreakerConfig{MaxFailures: 1})
+	us[1].setBreaker(cb)
+	cb.Execute(func() error { return errors.New("failed") })
+	cb.Reset()
+	if s := share(); s > 0.15 {
+		t.Errorf("a recovered upstream should get reduced traffic, got %.2f", s)
+	}
+}
+
+func TestRegScorer(t *testing.T) {
+	if err := RegScorer("latency", func() Scorer { return randomScorer{} }); err == nil {
+		t.Fatal("duplicated registration should fail")
+	}
+	if _, err := NewForward(&Args{Upstreams: []UpstreamConfig{{Addr: "null://refused"}}, Scorer: "no_such_scorer"}, Opts{}); err == nil {
+		t.Fatal("unknown scorer should be rejected")
+	}
+}
+
+func TestSelectUpstreamsPreferFuller(t *testing.T) {
+	full := new(dns.Msg)
+	full.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 4; i++ {
+		full.Extra = append(full.Extra, &dns.A{Hdr: dns.RR_Header{Name: "ns.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}})
+	}
+	minimal := new(dns.Msg) // NODATA
+	minimal.SetQuestion("example.com.", dns.TypeA)
+
+	us := []*upstreamWrapper{newWrapper(0, UpstreamConfig{}, "test"), newWrapper(1, UpstreamConfig{}, "test")}
+	for i, m := range []*dns.Msg{minimal, full} {
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		us[i].u = &echoUpstream{b: b}
+		for j := 0; j < 20; j++ {
+			if _, err := us[i].ExchangeContext(context.Background(), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		us[i].emaLatency.Store(20) // same latency
+	}
+	if n0, n1 := us[0].stat().EmaRecordCount, us[1].stat().EmaRecordCount; n0 != 0 || n1 <= 0 {
+		t.Fatalf("unexpected record counts %v, %v", n0, n1)
+	}
+
+	selector := newUpstreamSelector(us, weightCacheTTL)
+	selector.preferFuller = true
+	selectionCount := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		selector.mu.Lock()
+		selector.cachedOrder = nil
+		selector.mu.Unlock()
+		selectionCount[selector.selectUpstreams("", 1, nil)[0]]++
+	}
+	t.Logf("selection distribution: %v", selectionCount)
+	if selectionCount[1] <= selectionCount[0]*6/5 {
+		t.Errorf("the fuller upstream should be preferred, got %v", selectionCount)
+	}
+}
+
+// echoUpstream always responds b.
+type echoUpstream struct {
+	b []byte
+}
+
+func (u *echoUpstream) ExchangeContext(_ context.Context, _ []byte) (*[]byte, error) {
+	return copyPayload(&u.b), nil
+}
+
+func (u *echoUpstream) Close() error {
+	return nil
+}
+
+func TestForwardFailoverStrategy(t *testing.T) {
+	errFailed := errors.New("failed")
+	us := []*fakeUpstream{{}, {}, {}}
+	f := newTestForward(&Args{ErrorRateDecay: 0.5, SelectionStrategy: SelectionFailover}, us[0], us[1], us[2])
+	exec := func() error {
+		return f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA))
+	}
+
+	// Steady state, all queries go to the primary.
+	for i := 0; i < 20; i++ {
+		if err := exec(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n0, n1, n2 := us[0].exchanges.Load(), us[1].exchanges.Load(), us[2].exchanges.Load(); n0 != 20 || n1 != 0 || n2 != 0 {
+		t.Fatalf("all queries should go to the primary, got %d, %d, %d", n0, n1, n2)
+	}
+
+	// The primary fails, the secondary takes over. The primary gets a
+	// probe along with the first query, but no more within the interval.
+	us[0].err = errFailed
+	exec()
+	for i := 0; i < 10; i++ {
+		if err := exec(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := us[1].exchanges.Load(); n != 10 {
+		t.Fatalf("the secondary should take over, got %d queries", n)
+	}
+	if n := us[0].exchanges.Load(); n != 22 {
+		t.Fatalf("the primary should get one probe, got %d queries", n-21)
+	}
+	if n := us[2].exchanges.Load(); n != 0 {
+		t.Fatalf("the third upstream should not be used, got %d queries", n)
+	}
+
+	// The primary recovers. Traffic returns to it after a successful probe.
+	us[0].err = nil
+	f.us[0].lastProbe.Store(0)
+	secondaryQueries := us[1].exchanges.Load()
+	if err := exec(); err != nil {
+		t.Fatal(err)
+	}
+	// exec returns on the first response, which may be the one of the
+	// probe. Wait for the query to the secondary as well, so it is not
+	// counted below.
+	deadline := time.Now().Add(time.Second * 5)
+	for f.us[0].getErrorRate() >= maxHealthyErrorRate ||
+		us[1].exchanges.Load() == secondaryQueries || f.us[1].inFlight.Load() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the probe did not succeed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	n0, n1 := us[0].exchanges.Load(), us[1].exchanges.Load()
+	for i := 0; i < 10; i++ {
+		if err := exec(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := us[0].exchanges.Load() - n0; n != 10 {
+		t.Fatalf("traffic should return to the primary, got %d queries", n)
+	}
+	if n := us[1].exchanges.Load() - n1; n != 0 {
+		t.Fatalf("the secondary should not be used after failback, got %d queries", n)
+	}
+}
+
+func TestFailoverSlowStart(t *testing.T) {
+	us := []*upstreamWrapper{newWrapper(0, UpstreamConfig{}, "test"), newWrapper(1, UpstreamConfig{}, "test")}
+	selector := newUpstreamSelector(us, weightCacheTTL)
+	selector.failover = true
+	selector.failoverErrorRate = maxHealthyErrorRate
+	selector.slowStart = time.Minute
+	us[0].eligibleSince.Store(time.Now().Add(-time.Hour).UnixNano())
+	us[1].eligibleSince.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	// u0 failed over and just recovered.
+	us[0].errorRate.Store(math.Float64bits(1))
+	selector.selectUpstreams("", 1, nil)
+	us[0].errorRate.Store(0)
+
+	selectionCount := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		selectionCount[selector.selectUpstreams("", 1, nil)[0]]++
+	}
+	if s := float64(selectionCount[0]) / 10000; s > 0.15 {
+		t.Errorf("a recovered primary should get reduced traffic, got %.2f", s)
+	}
+}
+
+func TestForwardUpstreamStats(t *testing.T) {
+	us := []*fakeUpstream{{}, {err: errors.New("failed")}}
+	f := newTestForward(&Args{ErrorRateDecay: 0.5}, us[0], us[1])
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for _, uw := range f.us {
+			if r, err := uw.ExchangeContext(context.Background(), b); err == nil {
+				pool.ReleaseBuf(r)
+			}
+		}
+	}
+	f.us[0].emaLatency.Store(20)
+
+	stats := f.UpstreamStats()
+	if len(stats) != 2 {
+		t.Fatalf("want 2 stats, got %d", len(stats))
+	}
+	if s := stats[0]; s.Tag != "u0" || s.QueryCount != 3 || s.ErrorCount != 0 || s.ErrorRate != 0 || s.EmaLatencyMs != 20 {
+		t.Fatalf("unexpected stat of u0 %+v", s)
+	}
+	if s := stats[1]; s.Tag != "u1" || s.QueryCount != 3 || s.ErrorCount != 3 || s.ErrorRate != 0.875 || s.InFlight != 0 {
+		t.Fatalf("unexpected stat of u1 %+v", s)
+	}
+}
+
+// newTestGroups splits the upstreams of f into groups of the given sizes.
+func newTestGroups(f *Forward, strategy string, sizes ...int) {
+	f.groups = nil
+	offset := 0
+	for i, n := range sizes {
+		f.groups = append(f.groups, f.newGroup(fmt.Sprintf("#%d", i), strategy, offset, n))
+		offset += n
+	}
+}
+
+func TestForwardGroupWeighting(t *testing.T) {
+	us := []*fakeUpstream{{}, {}, {}}
+	f := newTestForward(&Args{}, us[0], us[1], us[2])
+	f.us[1].cfg.Weight = 9
+	newTestGroups(f, SelectionWeighted, 2, 1)
+	for _, g := range f.groups {
+		g.selector.setRand(newSeededRand(1)) // deterministic
+	}
+
+	for i := 0; i < 200; i++ {
+		f.groups[0].selector.mu.Lock()
+		f.groups[0].selector.cachedOrder = nil
+		f.groups[0].selector.mu.Unlock()
+		if err := f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n0, n1, n2 := us[0].exchanges.Load(), us[1].exchanges.Load(), us[2].exchanges.Load()
+	if n2 != 0 {
+		t.Fatalf("the second group should not be used, got %d queries", n2)
+	}
+	if n1 < n0*3 {
+		t.Fatalf("the upstream with a higher weight should be preferred within its group, got %d vs %d", n1, n0)
+	}
+}
+
+func TestForwardGroupEscalation(t *testing.T) {
+	errFailed := errors.New("failed")
+	us := []*fakeUpstream{{err: errFailed}, {err: errFailed}, {}, {}}
+	f := newTestForward(&Args{}, us[0], us[1], us[2], us[3])
+	newTestGroups(f, SelectionFailover, 2, 2)
+	exec := func() error {
+		return f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA))
+	}
+
+	// The selected upstream of the first group failed, the query escalates.
+	if err := exec(); err != nil {
+		t.Fatal(err)
+	}
+	if n0, n1, n2 := us[0].exchanges.Load(), us[1].exchanges.Load(), us[2].exchanges.Load(); n0 != 1 || n1 != 0 || n2 != 1 {
+		t.Fatalf("unexpected exchanges %d, %d, %d", n0, n1, n2)
+	}
+
+	// The first group is routed around while its breakers are open.
+	cb := qos.NewCircuitBreaker(qos.CircuitBreakerConfig{MaxFailures: 1})
+	cb.Execute(func() error { return errFailed })
+	f.us[0].breaker = cb
+	f.us[1].breaker = cb
+	if err := exec(); err != nil {
+		t.Fatal(err)
+	}
+	if n0, n1, n2 := us[0].exchanges.Load(), us[1].exchanges.Load(), us[2].exchanges.Load(); n0 != 1 || n1 != 0 || n2 != 2 {
+		t.Fatalf("the first group should be routed around, got %d, %d, %d", n0, n1, n2)
+	}
+
+	// All groups failed.
+	for _, u := range us {
+		u.err = errFailed
+	}
+	if err := exec(); !errors.Is(err, errAllUpstreamsFailed) {
+		t.Fatalf("expected errAllUpstreamsFailed, got %v", err)
+	}
+}
+
+func TestNewForwardGroups(t *testing.T) {
+	u := UpstreamConfig{Addr: "127.0.0.1"}
+	if _, err := NewForward(&Args{Upstreams: []UpstreamConfig{u}, Groups: []UpstreamGroup{{Upstreams: []UpstreamConfig{u}}}}, Opts{}); err == nil {
+		t.Fatal("expected an error if both upstreams and groups are configured")
+	}
+	if _, err := NewForward(&Args{Groups: []UpstreamGroup{{Upstreams: []UpstreamConfig{u}}, {}}}, Opts{}); err == nil {
+		t.Fatal("expected an error for an empty group")
+	}
+
+	f, err := NewForward(&Args{Groups: []UpstreamGroup{
+		{Name: "local", Upstreams: []UpstreamConfig{u, u}},
+		{Upstreams: []UpstreamConfig{u}, SelectionStrategy: SelectionFailover},
+	}}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if len(f.us) != 3 || len(f.groups) != 2 {
+		t.Fatalf("unexpected upstreams %d and groups %d", len(f.us), len(f.groups))
+	}
+	if g := f.groups[1]; g.name != "#1" || g.offset != 2 || !g.selector.failover || len(g.selector.us) != 1 {
+		t.Fatalf("unexpected second group %+v", g)
+	}
+}
+
+// tripBreaker gives uw a breaker that is tripped and half-opens after
+// resetTimeout. A successful query closes it then.
+func tripBreaker(uw *upstreamWrapper, resetTimeout time.Duration) *qos.CircuitBreaker {
+	cb := qos.NewCircuitBreaker(qos.CircuitBreakerConfig{MaxFailures: 1, ResetTimeout: resetTimeout, HalfOpenAttempts: 1})
+	cb.Execute(func() error { return errors.New("failed") })
+	uw.setBreaker(cb)
+	return cb
+}
+
+// waitBreakerClosed waits for the exchanges that may still be in flight
+// after Exec returned to close cb.
+func waitBreakerClosed(t *testing.T, cb *qos.CircuitBreaker) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for cb.State() != qos.StateClosed {
+		if time.Now().After(deadline) {
+			t.Fatalf("the breaker should be closed, state: %s", cb.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestForwardBreakerRecovers(t *testing.T) {
+	us := []*fakeUpstream{{}, {}}
+	f := newTestForward(&Args{Concurrent: 2}, us[0], us[1])
+	cb := tripBreaker(f.us[0], time.Millisecond*50)
+	exec := func() {
+		t.Helper()
+		if err := f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exec()
+	if n := us[0].exchanges.Load(); n != 0 {
+		t.Fatalf("u0 should be routed around, got %d queries", n)
+	}
+
+	// After the reset timeout, u0 gets a half-open trial and rejoins.
+	time.Sleep(time.Millisecond * 60)
+	exec()
+	waitBreakerClosed(t, cb)
+	if n := us[0].exchanges.Load(); n != 1 {
+		t.Fatalf("u0 should get a trial query, got %d queries", n)
+	}
+	// Exec returns on the first response, which may be the one of u1.
+	exec()
+	deadline := time.Now().Add(time.Second * 5)
+	for us[0].exchanges.Load() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("u0 should rejoin, got %d queries", us[0].exchanges.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestForwardGroupFailBack(t *testing.T) {
+	us := []*fakeUpstream{{}, {}}
+	f := newTestForward(&Args{}, us[0], us[1])
+	newTestGroups(f, SelectionFailover, 1, 1)
+	cb := tripBreaker(f.us[0], time.Millisecond*50)
+	exec := func() {
+		t.Helper()
+		if err := f.Exec(context.Background(), newTestQCtx("example.com", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first group fails over to the second one.
+	exec()
+	if n0, n1 := us[0].exchanges.Load(), us[1].exchanges.Load(); n0 != 0 || n1 != 1 {
+		t.Fatalf("the first group should be routed around, got %d, %d", n0, n1)
+	}
+
+	// And fails back after the reset timeout.
+	time.Sleep(time.Millisecond * 60)
+	exec()
+	waitBreakerClosed(t, cb)
+	exec()
+	if n0, n1 := us[0].exchanges.Load(), us[1].exchanges.Load(); n0 != 2 || n1 != 1 {
+		t.Fatalf("the first group should be used again, got %d, %d", n0, n1)
+	}
+}
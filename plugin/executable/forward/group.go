@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"fmt"
+	"time"
+)
+
+// upstreamGroup is a group of upstreams that has its own selector, see
+// Args.Groups.
+type upstreamGroup struct {
+	name     string
+	offset   int // Index of the first upstream of the group in Forward.us.
+	selector *upstreamSelector
+}
+
+func checkSelectionStrategy(s string) error {
+	switch s {
+	case "", SelectionWeighted, SelectionFailover:
+		return nil
+	default:
+		return fmt.Errorf("unknown selection_strategy %s", s)
+	}
+}
+
+// newGroup returns a group of the n upstreams f.us[offset:offset+n], which
+// are selected by strategy. Args of f must have been validated.
+func (f *Forward) newGroup(name, strategy string, offset, n int) *upstreamGroup {
+	args := f.args
+	cacheTTL := weightCacheTTL
+	if args.SelectorCacheTTL != nil {
+		cacheTTL = time.Duration(*args.SelectorCacheTTL) * time.Millisecond
+	}
+	s := newUpstreamSelector(f.us[offset:offset+n], cacheTTL)
+	s.scorer, _ = newScorer(args.Scorer) // Scorers are stateful, each group has its own.
+	if _, ok := s.scorer.(perQueryScorer); ok {
+		s.cacheTTL = 0
+	}
+	s.preferFuller = args.PreferFullerResponses
+	tuning, _ := args.SelectorTuning.tuning()
+	s.setTuning(tuning)
+	s.slowStart = time.Duration(args.SlowStartDuration) * time.Second
+	s.sticky = args.StickyByQName
+	s.failover = strategy == SelectionFailover
+	s.failoverErrorRate = args.FailoverErrorRate
+	if s.failoverErrorRate == 0 {
+		s.failoverErrorRate = maxHealthyErrorRate
+	}
+	if args.SelectionSeed != 0 {
+		s.setRand(newSeededRand(args.SelectionSeed))
+	}
+	s.onSkipped = func(idx int, reason string) {
+		f.upstreamSkipped(offset+idx, reason)
+	}
+	return &upstreamGroup{name: name, offset: offset, selector: s}
+}
+
+// selectUpstreams is upstreamSelector.selectUpstreams of g, except that
+// filter takes and the returned indices are indices of Forward.us.
+func (g *upstreamGroup) selectUpstreams(qname string, count int, filter func(idx int) bool) []int {
+	var groupFilter func(idx int) bool
+	if filter != nil {
+		groupFilter = func(idx int) bool { return filter(g.offset + idx) }
+	}
+	selected := g.selector.selectUpstreams(qname, count, groupFilter)
+	for i := range selected {
+		selected[i] += g.offset
+	}
+	return selected
+}
+
+// available reports whether g has an upstream that filter accepts and that
+// is not routed around by the selector. Open breakers let a trial query
+// through once their reset timeout elapsed, so g fails back then. Error
+// rates only recover with traffic, so upstreams that are routed around for
+// their error rates still count.
+func (g *upstreamGroup) available(filter func(idx int) bool) bool {
+	for i, uw := range g.selector.us {
+		if r := uw.skipReason(); (filter == nil || filter(g.offset+i)) && (len(r) == 0 || r == SkipReasonErrorRate) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupOrder returns the groups of f in the configured order, available
+// groups first.
+func (f *Forward) groupOrder(filter func(idx int) bool) []*upstreamGroup {
+	if len(f.groups) == 1 {
+		return f.groups
+	}
+	order := make([]*upstreamGroup, 0, len(f.groups))
+	var unavailable []*upstreamGroup
+	for _, g := range f.groups {
+		if g.available(filter) {
+			order = append(order, g)
+		} else {
+			unavailable = append(unavailable, g)
+		}
+	}
+	return append(order, unavailable...)
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxHealthyErrorRate is the max decayed error rate of a healthy upstream.
+const maxHealthyErrorRate = 0.5
+
+// UpstreamHealth is the health of an upstream, see Forward.HealthReport.
+type UpstreamHealth struct {
+	Tag          string  `json:"tag"` // upstream tag or address
+	Healthy      bool    `json:"healthy"`
+	ErrorRate    float64 `json:"error_rate"`
+	BreakerState string  `json:"breaker_state,omitempty"` // empty if the upstream has no breaker
+	EmaLatencyMs int64   `json:"ema_latency_ms"`
+}
+
+// healthy reports whether uw has an acceptable error rate and is not
+// routed around by the selector, except for being saturated for now.
+func (uw *upstreamWrapper) healthy() bool {
+	r := uw.skipReason()
+	return uw.getErrorRate() < maxHealthyErrorRate && (len(r) == 0 || r == SkipReasonSaturated)
+}
+
+// Ready reports whether at least one upstream is healthy.
+func (f *Forward) Ready() bool {
+	for _, uw := range f.us {
+		if uw.healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthReport returns the health of all upstreams.
+func (f *Forward) HealthReport() []UpstreamHealth {
+	report := make([]UpstreamHealth, 0, len(f.us))
+	for _, uw := range f.us {
+		h := UpstreamHealth{
+			Tag:          uw.name(),
+			Healthy:      uw.healthy(),
+			ErrorRate:    uw.getErrorRate(),
+			EmaLatencyMs: uw.getEmaLatency(),
+		}
+		if uw.breaker != nil {
+			h.BreakerState = uw.breaker.State().String()
+		}
+		report = append(report, h)
+	}
+	return report
+}
+
+// UpstreamStats returns a snapshot of the stats of all upstreams, in the
+// configured order.
+func (f *Forward) UpstreamStats() []UpstreamStat {
+	stats := make([]UpstreamStat, 0, len(f.us))
+	for _, uw := range f.us {
+		stats = append(stats, uw.stat())
+	}
+	return stats
+}
+
+// Api returns the http api of f.
+// "/ready" responds 200 if f is Ready, or 503 otherwise.
+// "/health" responds the HealthReport in json.
+func (f *Forward) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/ready", func(w http.ResponseWriter, req *http.Request) {
+		if !f.Ready() {
+			http.Error(w, "no healthy upstream", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Get("/health", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(f.HealthReport()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	return r
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"time"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/cache"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/dnsutils"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+// Modes of Args.OnAllFail.
+const (
+	OnAllFailReturnError = "return_error"
+	OnAllFailServfail    = "servfail"
+	OnAllFailStale       = "stale"
+)
+
+const (
+	defaultStaleMaxAge    = time.Hour * 24
+	defaultStaleCacheSize = 4096
+
+	// staleAnswerTTL is the ttl of stale responses, as recommended by RFC 8767.
+	staleAnswerTTL = 30
+)
+
+var errAllUpstreamsFailed = errors.New("all upstream servers failed")
+
+type staleKey string
+
+var staleSeed = maphash.MakeSeed()
+
+func (k staleKey) Sum() uint64 {
+	return maphash.String(staleSeed, string(k))
+}
+
+func checkOnAllFail(mode string) error {
+	switch mode {
+	case "", OnAllFailReturnError, OnAllFailServfail, OnAllFailStale:
+		return nil
+	default:
+		return fmt.Errorf("invalid on_all_fail mode %s", mode)
+	}
+}
+
+// initStaleCache inits the store of stale responses if Args.OnAllFail is
+// "stale".
+func (f *Forward) initStaleCache() {
+	if f.args.OnAllFail != OnAllFailStale {
+		return
+	}
+	size := f.args.StaleCacheSize
+	if size <= 0 {
+		size = defaultStaleCacheSize
+	}
+	f.staleCache = cache.New[staleKey, *dns.Msg](cache.Opts{Size: size})
+}
+
+// saveStale keeps a copy of r to serve it when all upstreams fail.
+func (f *Forward) saveStale(qCtx *query_context.Context, r *dns.Msg) {
+	if f.staleCache == nil || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
+		return
+	}
+	key, err := dedupKey(qCtx.Q())
+	if err != nil {
+		return
+	}
+	maxAge := defaultStaleMaxAge
+	if f.args.StaleMaxAge > 0 {
+		maxAge = time.Duration(f.args.StaleMaxAge) * time.Second
+	}
+	f.staleCache.Store(staleKey(key), r.Copy(), time.Now().Add(maxAge))
+}
+
+// onAllFail builds the response for qCtx when all upstreams failed with err,
+// according to Args.OnAllFail. If there is none, err is returned.
+func (f *Forward) onAllFail(qCtx *query_context.Context, err error) (*dns.Msg, error) {
+	switch f.args.OnAllFail {
+	case OnAllFailServfail:
+		r := new(dns.Msg)
+		r.SetRcode(qCtx.Q(), dns.RcodeServerFailure)
+		return r, nil
+	case OnAllFailStale:
+		key, kErr := dedupKey(qCtx.Q())
+		if kErr != nil {
+			return nil, err
+		}
+		stale, _, ok := f.staleCache.Get(staleKey(key))
+		if !ok {
+			return nil, err
+		}
+		r := stale.Copy()
+		r.Id = qCtx.Q().Id
+		dnsutils.SetTTL(r, staleAnswerTTL)
+		return r, nil
+	default:
+		return nil, err
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/harlanwei/mosdns-lts/v5/pkg/query_context"
+)
+
+var errNoAllowedUpstream = errors.New("no upstream is allowed for this query")
+
+var upstreamPolicyKey = query_context.RegKey()
+
+// UpstreamPolicy restricts the upstreams, by tag, that forward plugins may
+// use for a query. Upstreams without a tag can't be allowed explicitly.
+type UpstreamPolicy struct {
+	Allow []string // If empty, all upstreams are allowed.
+	Deny  []string
+}
+
+// SetUpstreamPolicy stores p in qCtx. Forward plugins that handle qCtx later
+// will only use the upstreams allowed by p. A nil p removes the restriction.
+// p must not be modified after this call.
+func SetUpstreamPolicy(qCtx *query_context.Context, p *UpstreamPolicy) {
+	if p == nil {
+		qCtx.DeleteValue(upstreamPolicyKey)
+		return
+	}
+	qCtx.StoreValue(upstreamPolicyKey, p)
+}
+
+func getUpstreamPolicy(qCtx *query_context.Context) *UpstreamPolicy {
+	v, ok := qCtx.GetValue(upstreamPolicyKey)
+	if !ok {
+		return nil
+	}
+	return v.(*UpstreamPolicy)
+}
+
+func (p *UpstreamPolicy) allowed(tag string) bool {
+	if len(p.Allow) > 0 && !slices.Contains(p.Allow, tag) {
+		return false
+	}
+	return !slices.Contains(p.Deny, tag)
+}
+
+// key returns a string that identifies p, for Args.Dedup.
+func (p *UpstreamPolicy) key() string {
+	return strings.Join(p.Allow, ",") + "|" + strings.Join(p.Deny, ",")
+}
+
+// upstreamFilter returns a filter for upstreamSelector that only accepts
+// upstreams in us and allowed by the policy of qCtx. DNS64 queries only
+// accept DNS64 upstreams. It returns nil if all upstreams of f are acceptable.
+func (f *Forward) upstreamFilter(qCtx *query_context.Context, us []*upstreamWrapper) func(idx int) bool {
+	p := getUpstreamPolicy(qCtx)
+	dns64 := f.isDNS64Query(qCtx)
+	allUs := len(us) == len(f.us) && (len(us) == 0 || &us[0] == &f.us[0])
+	if p == nil && !dns64 && allUs {
+		return nil
+	}
+	return func(idx int) bool {
+		uw := f.us[idx]
+		if !allUs && !slices.Contains(us, uw) {
+			return false
+		}
+		if dns64 && !uw.cfg.DNS64 {
+			return false
+		}
+		return p == nil || p.allowed(uw.cfg.Tag)
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+)
+
+const defaultScorer = "latency_error"
+
+// UpstreamStat is a snapshot of the stats of an upstream.
+type UpstreamStat struct {
+	Tag          string
+	Addr         string
+	EmaLatencyMs int64 // 0 if there is no successful query yet.
+	QueryCount   int64
+	ErrorCount   int64
+	ErrorRate    float64 // Decayed, see Args.ErrorRateDecay.
+	InFlight     int64
+
+	// EmaRecordCount is an EWMA of the number of records in responses.
+	EmaRecordCount float64
+}
+
+// Scorer scores upstreams for selection. Upstreams are selected in a
+// weighted random order, weighted by their scores, so scores must be > 0.
+// Each time the scores are recomputed, Score is called for all upstreams
+// in the order they were configured, idx starting at 0.
+// Score is never called concurrently on a Scorer.
+type Scorer interface {
+	Score(idx int, s UpstreamStat) float64
+}
+
+var scorerReg struct {
+	sync.RWMutex
+	m map[string]func() Scorer
+}
+
+// RegScorer registers a scorer that can be selected by Args.Scorer.
+// newScorer is called once per Forward.
+func RegScorer(name string, newScorer func() Scorer) error {
+	scorerReg.Lock()
+	defer scorerReg.Unlock()
+
+	if _, ok := scorerReg.m[name]; ok {
+		return fmt.Errorf("scorer %s has already been registered", name)
+	}
+	if scorerReg.m == nil {
+		scorerReg.m = make(map[string]func() Scorer)
+	}
+	scorerReg.m[name] = newScorer
+	return nil
+}
+
+func MustRegScorer(name string, newScorer func() Scorer) {
+	if err := RegScorer(name, newScorer); err != nil {
+		panic(err.Error())
+	}
+}
+
+// newScorer returns a new scorer of the given name, or the default
+// scorer if name is empty.
+func newScorer(name string) (Scorer, error) {
+	if len(name) == 0 {
+		name = defaultScorer
+	}
+	scorerReg.RLock()
+	f := scorerReg.m[name]
+	scorerReg.RUnlock()
+	if f == nil {
+		return nil, fmt.Errorf("unknown scorer %s", name)
+	}
+	return f(), nil
+}
+
+func init() {
+	MustRegScorer("latency", func() Scorer {
+		return &latencyScorer{rand: rand.Float64, tuning: defaultSelectorTuning}
+	})
+	MustRegScorer("latency_error", func() Scorer {
+		return &latencyErrorScorer{rand: rand.Float64, tuning: defaultSelectorTuning}
+	})
+	MustRegScorer("round_robin", func() Scorer { return new(roundRobinScorer) })
+	MustRegScorer("random", func() Scorer { return randomScorer{} })
+}
+
+// selectorTuning is the resolved Args.SelectorTuning.
+type selectorTuning struct {
+	noiseFactor      float64
+	errorPenaltyMult float64
+	defaultLatency   float64
+}
+
+var defaultSelectorTuning = selectorTuning{
+	noiseFactor:      0.125,
+	errorPenaltyMult: 8,
+	defaultLatency:   10,
+}
+
+// tuning returns the tuning of t, with defaults for the unset fields.
+func (t *SelectorTuning) tuning() (selectorTuning, error) {
+	st := defaultSelectorTuning
+	if v := t.NoiseFactor; v != nil {
+		if *v < 0 || *v >= 1 {
+			return st, errors.New("noise_factor must be in [0, 1)")
+		}
+		st.noiseFactor = *v
+	}
+	if v := t.ErrorPenaltyMult; v != nil {
+		if *v < 0 {
+			return st, errors.New("error_penalty_mult cannot be negative")
+		}
+		st.errorPenaltyMult = *v
+	}
+	if v := t.DefaultLatency; v != nil {
+		if *v <= 0 {
+			return st, errors.New("default_latency must be positive")
+		}
+		st.defaultLatency = *v
+	}
+	return st, nil
+}
+
+func (t selectorTuning) latency(s UpstreamStat) float64 {
+	if s.EmaLatencyMs == 0 {
+		return t.defaultLatency
+	}
+	return float64(s.EmaLatencyMs)
+}
+
+func (t selectorTuning) withNoise(score float64, rand func() float64) float64 {
+	noise := (rand()*2 - 1) * t.noiseFactor
+	return score * (1 + noise)
+}
+
+// tunableScorer is implemented by the built-in scorers that use the
+// Args.SelectorTuning, so upstreamSelector.setTuning can apply it.
+type tunableScorer interface {
+	setTuning(t selectorTuning)
+}
+
+// perQueryScorer is implemented by scorers that change their scores on
+// every call rather than with the stats, so the order that they produce
+// must not be cached. See Args.SelectorCacheTTL.
+type perQueryScorer interface {
+	perQuery()
+}
+
+// randScorer is implemented by scorers that draw random numbers, so
+// upstreamSelector.setRand can make them draw from its source.
+type randScorer interface {
+	setRand(rand func() float64)
+}
+
+// latencyScorer prefers upstreams with lower latency.
+type latencyScorer struct {
+	rand   func() float64
+	tuning selectorTuning
+}
+
+func (l *latencyScorer) Score(_ int, s UpstreamStat) float64 {
+	return l.tuning.withNoise(1.0/l.tuning.latency(s), l.rand)
+}
+
+func (l *latencyScorer) setRand(rand func() float64) {
+	l.rand = rand
+}
+
+func (l *latencyScorer) setTuning(t selectorTuning) {
+	l.tuning = t
+}
+
+// latencyErrorScorer prefers upstreams with lower latency and penalizes
+// upstreams with errors.
+type latencyErrorScorer struct {
+	rand   func() float64
+	tuning selectorTuning
+}
+
+func (l *latencyErrorScorer) Score(_ int, s UpstreamStat) float64 {
+	penaltyFactor := 1.0 + s.ErrorRate*l.tuning.errorPenaltyMult
+	return l.tuning.withNoise(1.0/(l.tuning.latency(s)*penaltyFactor), l.rand)
+}
+
+func (l *latencyErrorScorer) setRand(rand func() float64) {
+	l.rand = rand
+}
+
+func (l *latencyErrorScorer) setTuning(t selectorTuning) {
+	l.tuning = t
+}
+
+// roundRobinScorer makes the upstreams take turns to be the first one in
+// the order. The rest are in random order. A turn lasts one query, the
+// order is never cached.
+type roundRobinScorer struct {
+	round int
+	n     int // number of upstreams, learnt from the previous round.
+}
+
+func (r *roundRobinScorer) perQuery() {}
+
+func (r *roundRobinScorer) Score(idx int, _ UpstreamStat) float64 {
+	if idx == 0 && r.n > 0 {
+		r.round = (r.round + 1) % r.n
+	}
+	if idx+1 > r.n {
+		r.n = idx + 1
+	}
+	if idx == r.round {
+		return 1
+	}
+	return 1e-6
+}
+
+// randomScorer ignores all stats.
+type randomScorer struct{}
+
+func (randomScorer) Score(_ int, _ UpstreamStat) float64 {
+	return 1
+}
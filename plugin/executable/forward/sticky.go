@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"cmp"
+	"hash/fnv"
+	"math"
+	"slices"
+	"strings"
+)
+
+// stickyOrder returns the indices of all upstreams ordered by weighted
+// rendezvous hashing of qname, see Args.StickyByQName. Each upstream draws
+// a hash of qname and its name, scaled by its Weight. The weights are
+// static, so a qname stays on its upstreams as long as they are
+// configured. Latencies are not used, they change on every exchange and
+// would remap qnames all the time.
+func (s *upstreamSelector) stickyOrder(qname string) []int {
+	qname = strings.ToLower(qname)
+	scores := make([]upstreamScore, len(s.us))
+	for i, uw := range s.us {
+		h := fnv.New64a()
+		h.Write([]byte(qname))
+		h.Write([]byte{0})
+		h.Write([]byte(uw.name()))
+		// A uniform number in (0, 1) from the top 53 bits of the hash.
+		x := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		scores[i] = upstreamScore{idx: i, score: -uw.weight() / math.Log(x)}
+	}
+	slices.SortStableFunc(scores, func(a, b upstreamScore) int {
+		return cmp.Compare(b.score, a.score)
+	})
+
+	order := make([]int, len(scores))
+	for i, sc := range scores {
+		order[i] = sc.idx
+	}
+	return order
+}
+
+// without returns a filter that accepts what filter accepts, except the
+// indices. filter can be nil.
+func without(filter func(idx int) bool, indices []int) func(idx int) bool {
+	return func(idx int) bool {
+		return !slices.Contains(indices, idx) && (filter == nil || filter(idx))
+	}
+}
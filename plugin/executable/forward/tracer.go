@@ -0,0 +1,39 @@
+/*
+ * Copyright (C) 2025, Wei Chen
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import "context"
+
+// Tracer traces upstream exchanges, e.g. with OpenTelemetry spans, without
+// making the forward plugin depend on a tracing library.
+type Tracer interface {
+	// StartExchange is called when an exchange with the upstream tag (or
+	// its address if it has no tag) starts. ctx is the ctx of the query.
+	// The returned ctx is passed to the upstream. finish is called once
+	// with the error of the exchange, nil if it succeeded, even if the
+	// query no longer waits for it. It must be concurrent safe.
+	StartExchange(ctx context.Context, tag string) (_ context.Context, finish func(err error))
+}
+
+type nopTracer struct{}
+
+func (nopTracer) StartExchange(ctx context.Context, _ string) (context.Context, func(err error)) {
+	return ctx, func(error) {}
+}
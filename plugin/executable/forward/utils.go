@@ -21,12 +21,18 @@ package fastforward
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"math"
 	"math/rand/v2"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/harlanwei/mosdns-lts/v5/pkg/dnsutils"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/pool"
+	"github.com/harlanwei/mosdns-lts/v5/pkg/qos"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/upstream"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
@@ -34,10 +40,18 @@ import (
 )
 
 const (
-	weightCacheTTL   = time.Second * 5
-	noiseFactor      = 0.125
-	errorPenaltyMult = 8.0
-	defaultLatency   = 10.0
+	// weightCacheTTL is the default of Args.SelectorCacheTTL.
+	weightCacheTTL = time.Second * 5
+
+	defaultErrorRateDecay = 0.05
+
+	// See Args.PreferFullerResponses.
+	recordCountAlpha = 0.1
+	fullnessWeight   = 0.5
+
+	// slowStartMinFactor is the fraction of its score that an upstream
+	// starts with when it becomes eligible, see Args.SlowStartDuration.
+	slowStartMinFactor = 0.1
 )
 
 type upstreamScore struct {
@@ -49,43 +63,208 @@ type upstreamSelector struct {
 	us []*upstreamWrapper
 
 	mu          sync.RWMutex
-	cachedOrder []int
+	cachedOrder []int // A weighted random order of all upstreams.
 	lastUpdate  time.Time
+	cacheTTL    time.Duration // Zero disables the cache.
+
+	refreshing atomic.Bool
+
+	scoreMu sync.Mutex // Scorer is not concurrent safe.
+	scorer  Scorer
+
+	// rand draws the weighted random order, see setRand.
+	rand func() float64
+
+	preferFuller bool          // Args.PreferFullerResponses
+	slowStart    time.Duration // Args.SlowStartDuration
+	sticky       bool          // Args.StickyByQName, see stickyOrder.
+
+	// Args.SelectionStrategy "failover", see failoverOrder.
+	failover          bool
+	failoverErrorRate float64
+
+	// Optional. Called when an upstream is routed around by selectUpstreams.
+	onSkipped func(idx int, reason string)
 }
 
-func newUpstreamSelector(us []*upstreamWrapper) *upstreamSelector {
+// newUpstreamSelector returns a selector that uses the default scorer and
+// caches the weighted order for cacheTTL. Zero cacheTTL recomputes the
+// order on every selection.
+func newUpstreamSelector(us []*upstreamWrapper, cacheTTL time.Duration) *upstreamSelector {
 	return &upstreamSelector{
-		us: us,
+		us:       us,
+		cacheTTL: cacheTTL,
+		scorer:   &latencyErrorScorer{rand: rand.Float64, tuning: defaultSelectorTuning},
+		rand:     rand.Float64,
+	}
+}
+
+// setTuning makes the scorer of s use t. It must be called after the
+// scorer was set and before s is used.
+func (s *upstreamSelector) setTuning(t selectorTuning) {
+	if ts, ok := s.scorer.(tunableScorer); ok {
+		ts.setTuning(t)
+	}
+}
+
+// setRand makes s and its scorer draw random numbers from r instead of
+// the global source, so the selections are reproducible. r must be
+// concurrent safe. It must be called after the scorer was set and
+// before s is used.
+func (s *upstreamSelector) setRand(r func() float64) {
+	s.rand = r
+	if rs, ok := s.scorer.(randScorer); ok {
+		rs.setRand(r)
+	}
+}
+
+// newSeededRand returns a concurrent safe func that returns pseudo-random
+// numbers in [0.0, 1.0) from a source seeded by seed.
+func newSeededRand(seed uint64) func() float64 {
+	var mu sync.Mutex
+	r := rand.New(rand.NewPCG(seed, seed))
+	return func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return r.Float64()
 	}
 }
 
-func (s *upstreamSelector) selectUpstreams(count int) []int {
-	if len(s.us) <= count {
-		indices := make([]int, len(s.us))
-		for i := range indices {
-			indices[i] = i
+// selectUpstreams returns up to count upstream indices in a weighted
+// random order, or in the order of qname if s is sticky. If filter is not
+// nil, only upstreams that it returns true for are selected. Degraded
+// upstreams (see upstreamWrapper.skipReason) are routed around, unless no
+// other upstream is available.
+func (s *upstreamSelector) selectUpstreams(qname string, count int, filter func(idx int) bool) []int {
+	selected := make([]int, 0, min(count, len(s.us)))
+	var skipped []int
+	var reasons []string
+	pick := func(idx int) (full bool) {
+		if filter != nil && !filter(idx) {
+			return false
+		}
+		if r := s.us[idx].skipReason(); len(r) > 0 {
+			skipped = append(skipped, idx)
+			reasons = append(reasons, r)
+			return false
+		}
+		selected = append(selected, idx)
+		return len(selected) == count
+	}
+
+	if s.failover {
+		order, probe := s.failoverOrder()
+		for _, idx := range order {
+			if pick(idx) {
+				break
+			}
+		}
+		// Race a probe query to the unhealthy upstream with higher
+		// priority, so it can recover.
+		if probe >= 0 && len(selected) > 0 && !slices.Contains(selected, probe) &&
+			(filter == nil || filter(probe)) && len(s.us[probe].skipReason()) == 0 &&
+			s.us[probe].tryProbe(time.Now()) {
+			selected = append(selected, probe)
+		}
+		// Unhealthy upstreams with higher priority than the one in use
+		// were routed around.
+		if len(selected) > 0 {
+			for idx := range selected[0] {
+				if s.us[idx].failedOver.Load() && !slices.Contains(selected, idx) &&
+					(filter == nil || filter(idx)) && len(s.us[idx].skipReason()) == 0 {
+					skipped = append(skipped, idx)
+					reasons = append(reasons, SkipReasonUnhealthy)
+				}
+			}
+		}
+	} else if s.sticky {
+		for _, idx := range s.stickyOrder(qname) {
+			if pick(idx) {
+				break
+			}
+		}
+	} else if len(s.us) <= count {
+		for i := range s.us {
+			pick(i)
+		}
+	} else {
+		for _, idx := range s.getOrder() {
+			if pick(idx) {
+				break
+			}
+		}
+	}
+
+	if len(selected) == 0 {
+		// Nothing else to route to. Try the degraded upstreams anyway.
+		return skipped[:min(count, len(skipped))]
+	}
+	// Race a probe query to an upstream that is routed around for its
+	// error rate, so the error rate can recover.
+	for i, idx := range skipped {
+		if reasons[i] == SkipReasonErrorRate && s.us[idx].tryProbe(time.Now()) {
+			selected = append(selected, idx)
+			skipped = slices.Delete(skipped, i, i+1)
+			reasons = slices.Delete(reasons, i, i+1)
+			break
+		}
+	}
+	if s.onSkipped != nil {
+		for i, idx := range skipped {
+			s.onSkipped(idx, reasons[i])
 		}
-		return indices
+	}
+	return selected
+}
+
+// getOrder returns the cached order. The returned slice must not be modified.
+func (s *upstreamSelector) getOrder() []int {
+	if s.cacheTTL <= 0 {
+		return s.sampleOrder()
 	}
 
 	s.mu.RLock()
-	if s.cachedOrder != nil && time.Since(s.lastUpdate) < weightCacheTTL {
-		order := make([]int, count)
-		copy(order, s.cachedOrder[:count])
+	if s.cachedOrder != nil {
+		order := s.cachedOrder
+		age := time.Since(s.lastUpdate)
 		s.mu.RUnlock()
+		// The cached order is recomputed in background before it expires,
+		// so the query path always reads a warm cache.
+		if age >= s.cacheTTL*4/5 {
+			s.refreshAsync()
+		}
 		return order
 	}
 	s.mu.RUnlock()
 
+	// Cold cache. Only the very first callers compute the order synchronously.
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.cachedOrder == nil {
+		s.cachedOrder = s.sampleOrder()
+		s.lastUpdate = time.Now()
+	}
+	return s.cachedOrder
+}
 
-	if s.cachedOrder != nil && time.Since(s.lastUpdate) < weightCacheTTL {
-		order := make([]int, count)
-		copy(order, s.cachedOrder[:count])
-		return order
+// refreshAsync recomputes the cached order in a new goroutine.
+// At most one refresh runs at a time.
+func (s *upstreamSelector) refreshAsync() {
+	if !s.refreshing.CompareAndSwap(false, true) {
+		return
 	}
+	go func() {
+		defer s.refreshing.Store(false)
+		order := s.sampleOrder()
+		s.mu.Lock()
+		s.cachedOrder = order
+		s.lastUpdate = time.Now()
+		s.mu.Unlock()
+	}()
+}
 
+// sampleOrder returns a weighted random order of all upstreams.
+func (s *upstreamSelector) sampleOrder() []int {
 	scores := s.calculateScores()
 
 	totalWeight := 0.0
@@ -93,11 +272,11 @@ func (s *upstreamSelector) selectUpstreams(count int) []int {
 		totalWeight += sc.score
 	}
 
-	selected := make([]int, 0, count)
+	selected := make([]int, 0, len(scores))
 	used := make(map[int]bool)
 
-	for len(selected) < count {
-		r := rand.Float64() * totalWeight
+	for len(selected) < len(scores) {
+		r := s.rand() * totalWeight
 		cumulative := 0.0
 
 		for _, sc := range scores {
@@ -113,42 +292,52 @@ func (s *upstreamSelector) selectUpstreams(count int) []int {
 			}
 		}
 	}
+	return selected
+}
 
-	s.cachedOrder = selected
-	s.lastUpdate = time.Now()
-
-	result := make([]int, count)
-	copy(result, selected)
-	return result
+// slowStartFactor scales the score of uw from slowStartMinFactor up to 1
+// linearly within s.slowStart after uw became eligible.
+func (s *upstreamSelector) slowStartFactor(uw *upstreamWrapper, now time.Time) float64 {
+	if s.slowStart <= 0 {
+		return 1
+	}
+	elapsed := now.Sub(time.Unix(0, uw.eligibleSince.Load()))
+	if elapsed >= s.slowStart {
+		return 1
+	}
+	return slowStartMinFactor + (1-slowStartMinFactor)*float64(max(elapsed, 0))/float64(s.slowStart)
 }
 
 func (s *upstreamSelector) calculateScores() []upstreamScore {
-	scores := make([]upstreamScore, len(s.us))
+	s.scoreMu.Lock()
+	defer s.scoreMu.Unlock()
 
+	stats := make([]UpstreamStat, len(s.us))
+	maxRecords := 0.0
 	for i, uw := range s.us {
-		latency := float64(uw.getEmaLatency())
-		if latency == 0 {
-			latency = defaultLatency
-		}
-
-		queryTotal := uw.queryCount.Load()
-		errorTotal := uw.errorCount.Load()
+		stats[i] = uw.stat()
+		maxRecords = max(maxRecords, stats[i].EmaRecordCount)
+	}
 
-		var errorRate float64
-		if queryTotal > 0 {
-			errorRate = float64(errorTotal) / float64(queryTotal)
+	now := time.Now()
+	scores := make([]upstreamScore, len(s.us))
+	for i := range s.us {
+		score := s.scorer.Score(i, stats[i]) * s.us[i].weight()
+		if s.preferFuller && maxRecords > 0 {
+			score *= 1 + fullnessWeight*stats[i].EmaRecordCount/maxRecords
 		}
-
-		noise := (rand.Float64()*2 - 1) * noiseFactor
-		penaltyFactor := 1.0 + errorRate*errorPenaltyMult
-		score := (1.0 / (latency * penaltyFactor)) * (1 + noise)
-
+		score *= s.slowStartFactor(s.us[i], now)
+		// Excluded until its breaker half-opens or its error rate recovers.
+		// Saturation is short-lived, it is only checked by selectUpstreams.
+		if r := s.us[i].skipReason(); r == SkipReasonCircuitOpen || r == SkipReasonErrorRate {
+			score = 0
+		}
+		s.us[i].score.Store(math.Float64bits(score))
 		scores[i] = upstreamScore{
 			idx:   i,
 			score: score,
 		}
 	}
-
 	return scores
 }
 
@@ -159,15 +348,50 @@ type upstreamWrapper struct {
 	queryTotal      prometheus.Counter
 	errTotal        prometheus.Counter
 	thread          prometheus.Gauge
+	threadMax       prometheus.GaugeFunc
 	responseLatency prometheus.Histogram
+	breakerState    prometheus.GaugeFunc // Only registered if uw has a breaker.
+	selectorScore   prometheus.GaugeFunc
 
 	connOpened prometheus.Counter
 	connClosed prometheus.Counter
 	usedTotal  prometheus.Counter
 
 	emaLatency atomic.Int64
-	queryCount atomic.Int64
-	errorCount atomic.Int64
+	queryCount atomic.Int64 // lifetime total, for metrics
+	errorCount atomic.Int64 // lifetime total, for metrics
+
+	inFlight    atomic.Int64
+	inFlightMax atomic.Int64 // high-water mark of inFlight
+
+	// An EWMA of the error indicator (1 on failure, 0 on success).
+	// Stored as math.Float64bits.
+	errorRate      atomic.Uint64
+	errorRateDecay float64 // Args.ErrorRateDecay
+	maxErrorRate   float64 // Args.MaxErrorRate
+
+	// For Args.EmaDecayAfter, see getEmaLatency. lastSuccess is the unix
+	// nanoseconds of the last successful query.
+	emaDecayAfter  time.Duration
+	emaDecayTarget float64
+	lastSuccess    atomic.Int64
+
+	// An EWMA of the number of records in responses. Stored as math.Float64bits.
+	recordCount atomic.Uint64
+
+	// The latest score computed by the selector. Stored as math.Float64bits.
+	score atomic.Uint64
+
+	breaker *qos.CircuitBreaker // Optional, nil if the upstream has no breaker.
+
+	// When the upstream was added or recovered, in unix nanoseconds.
+	// See Args.SlowStartDuration.
+	eligibleSince atomic.Int64
+
+	// For Args.SelectionStrategy "failover". failedOver is set while uw is
+	// unhealthy. lastProbe is the unix nanoseconds of the last probe.
+	failedOver atomic.Bool
+	lastProbe  atomic.Int64
 }
 
 func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
@@ -183,7 +407,7 @@ func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
 // Note: upstreamWrapper.u still needs to be set.
 func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper {
 	lb := map[string]string{"upstream": cfg.Tag, "tag": pluginTag}
-	return &upstreamWrapper{
+	uw := &upstreamWrapper{
 		cfg: cfg,
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
@@ -223,18 +447,62 @@ func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper
 			ConstLabels: lb,
 		}),
 	}
+	uw.threadMax = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "thread_max",
+		Help:        "The peak number of threads (queries) that were processed concurrently",
+		ConstLabels: lb,
+	}, func() float64 { return float64(uw.inFlightMax.Load()) })
+	uw.breakerState = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "circuit_breaker_state",
+		Help:        "The state of the circuit breaker, 0 closed, 1 half-open, 2 open",
+		ConstLabels: lb,
+	}, func() float64 {
+		if uw.breaker == nil {
+			return float64(qos.StateClosed)
+		}
+		return float64(uw.breaker.State())
+	})
+	uw.selectorScore = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "selector_score",
+		Help:        "The latest score of this upstream computed by the selector",
+		ConstLabels: lb,
+	}, func() float64 { return math.Float64frombits(uw.score.Load()) })
+	uw.markEligible()
+	return uw
+}
+
+// markEligible starts the slow start of uw.
+func (uw *upstreamWrapper) markEligible() {
+	uw.eligibleSince.Store(time.Now().UnixNano())
+}
+
+// setBreaker sets the circuit breaker of uw. uw starts a slow start when
+// the breaker closes.
+func (uw *upstreamWrapper) setBreaker(cb *qos.CircuitBreaker) {
+	uw.breaker = cb
+	cb.SetStateChangeListener(func(c qos.StateChange) {
+		if c.To == qos.StateClosed {
+			uw.markEligible()
+		}
+	})
 }
 
 func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
-	for _, collector := range [...]prometheus.Collector{
+	collectors := []prometheus.Collector{
 		uw.queryTotal,
 		uw.errTotal,
 		uw.thread,
+		uw.threadMax,
 		uw.responseLatency,
 		uw.connOpened,
 		uw.connClosed,
 		uw.usedTotal,
-	} {
+		uw.selectorScore,
+	}
+	if uw.breaker != nil {
+		collectors = append(collectors, uw.breakerState)
+	}
+	for _, collector := range collectors {
 		if err := r.Register(collector); err != nil {
 			return err
 		}
@@ -251,23 +519,133 @@ func (uw *upstreamWrapper) name() string {
 	return uw.cfg.Addr
 }
 
+// weight returns UpstreamConfig.Weight, or 1 if it is not set.
+func (uw *upstreamWrapper) weight() float64 {
+	if uw.cfg.Weight > 0 {
+		return uw.cfg.Weight
+	}
+	return 1
+}
+
+// clampTTL clamps the ttls of r into UpstreamConfig.TTLClamp, if it is set.
+func (uw *upstreamWrapper) clampTTL(r *dns.Msg) {
+	tc := uw.cfg.TTLClamp
+	if tc == nil {
+		return
+	}
+	if tc.Min > 0 {
+		dnsutils.ApplyMinimalTTL(r, tc.Min)
+	}
+	if tc.Max > 0 {
+		dnsutils.ApplyMaximumTTL(r, tc.Max)
+	}
+}
+
+// filterAddressFamily removes the A or AAAA records from the answer
+// section of the response r, as UpstreamConfig.AddressFamilyFilter says.
+// If records were removed, r is released and a repacked one is returned.
+// Responses that cannot be unpacked are returned as is.
+func (uw *upstreamWrapper) filterAddressFamily(r *[]byte) (*[]byte, error) {
+	var drop uint16
+	switch uw.cfg.AddressFamilyFilter {
+	case AddressFamilyKeepA:
+		drop = dns.TypeAAAA
+	case AddressFamilyKeepAAAA:
+		drop = dns.TypeA
+	default:
+		return r, nil
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(*r); err != nil {
+		return r, nil
+	}
+	n := len(m.Answer)
+	m.Answer = slices.DeleteFunc(m.Answer, func(rr dns.RR) bool { return rr.Header().Rrtype == drop })
+	if len(m.Answer) == n {
+		return r, nil
+	}
+	pool.ReleaseBuf(r)
+	return pool.PackBuffer(m)
+}
+
+// skipReason returns why uw should be routed around by the selector.
+// It returns an empty string if uw is usable.
+func (uw *upstreamWrapper) skipReason() string {
+	// Once the reset timeout elapsed, the next query is a half-open trial.
+	if uw.breaker != nil && !uw.breaker.Allow() {
+		return SkipReasonCircuitOpen
+	}
+	if uw.maxErrorRate > 0 && uw.getErrorRate() >= uw.maxErrorRate {
+		return SkipReasonErrorRate
+	}
+	if n := uw.cfg.MaxInFlight; n > 0 && uw.inFlight.Load() >= int64(n) {
+		return SkipReasonSaturated
+	}
+	return ""
+}
+
+func (uw *upstreamWrapper) stat() UpstreamStat {
+	return UpstreamStat{
+		Tag:            uw.cfg.Tag,
+		Addr:           uw.cfg.Addr,
+		EmaLatencyMs:   uw.getEmaLatency(),
+		QueryCount:     uw.queryCount.Load(),
+		ErrorCount:     uw.errorCount.Load(),
+		ErrorRate:      uw.getErrorRate(),
+		InFlight:       uw.inFlight.Load(),
+		EmaRecordCount: math.Float64frombits(uw.recordCount.Load()),
+	}
+}
+
+// ExchangeContext exchanges m through the breaker of uw, if any. If the
+// breaker is open, m is not sent and qos.ErrCircuitBreakerOpen is returned.
 func (uw *upstreamWrapper) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	if uw.breaker == nil {
+		return uw.exchange(ctx, m)
+	}
+	var r *[]byte
+	err := uw.breaker.ExecuteContext(ctx, func() error {
+		var err error
+		r, err = uw.exchange(ctx, m)
+		return err
+	})
+	return r, err
+}
+
+func (uw *upstreamWrapper) exchange(ctx context.Context, m []byte) (*[]byte, error) {
 	uw.queryTotal.Inc()
 	uw.queryCount.Add(1)
 
 	start := time.Now()
 	uw.thread.Inc()
+	uw.updateInFlightMax(uw.inFlight.Add(1))
 	r, err := uw.u.ExchangeContext(ctx, m)
+	uw.inFlight.Add(-1)
 	uw.thread.Dec()
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		// The exchange was abandoned, e.g. it lost a race (see
+		// Args.RaceMode). This says nothing about the upstream.
+		return nil, err
+	}
+	if err == nil {
+		r, err = uw.filterAddressFamily(r)
+	}
 
 	latency := time.Since(start).Milliseconds()
 
+	uw.updateErrorRate(err != nil)
 	if err != nil {
 		uw.errTotal.Inc()
 		uw.errorCount.Add(1)
 	} else {
 		uw.responseLatency.Observe(float64(latency))
 		uw.updateEmaLatency(latency)
+		if len(*r) >= 12 {
+			// ANCOUNT, NSCOUNT and ARCOUNT in the header.
+			n := int(binary.BigEndian.Uint16((*r)[6:])) + int(binary.BigEndian.Uint16((*r)[8:])) + int(binary.BigEndian.Uint16((*r)[10:]))
+			updateEwma(&uw.recordCount, float64(n), recordCountAlpha)
+		}
 	}
 	return r, err
 }
@@ -283,7 +661,9 @@ func (uw *upstreamWrapper) Close() error {
 func (uw *upstreamWrapper) updateEmaLatency(latency int64) {
 	const alpha = 0.3
 
-	current := uw.emaLatency.Load()
+	now := time.Now()
+	current := uw.decayedEmaLatency(now)
+	uw.lastSuccess.Store(now.UnixNano())
 	if current == 0 {
 		uw.emaLatency.Store(latency)
 	} else {
@@ -293,7 +673,66 @@ func (uw *upstreamWrapper) updateEmaLatency(latency int64) {
 }
 
 func (uw *upstreamWrapper) getEmaLatency() int64 {
-	return uw.emaLatency.Load()
+	return uw.decayedEmaLatency(time.Now())
+}
+
+// decayedEmaLatency returns the latency EMA of uw at now. If uw has been
+// idle for longer than Args.EmaDecayAfter, the gap between the EMA and
+// the default latency halves every EmaDecayAfter after that.
+func (uw *upstreamWrapper) decayedEmaLatency(now time.Time) int64 {
+	ema := uw.emaLatency.Load()
+	last := uw.lastSuccess.Load()
+	if uw.emaDecayAfter <= 0 || ema == 0 || last == 0 {
+		return ema
+	}
+	over := now.Sub(time.Unix(0, last)) - uw.emaDecayAfter
+	if over <= 0 {
+		return ema
+	}
+	f := math.Exp2(-float64(over) / float64(uw.emaDecayAfter))
+	v := uw.emaDecayTarget + (float64(ema)-uw.emaDecayTarget)*f
+	return max(int64(math.Round(v)), 1) // 0 means no successful query yet.
+}
+
+func (uw *upstreamWrapper) updateInFlightMax(n int64) {
+	for {
+		m := uw.inFlightMax.Load()
+		if n <= m || uw.inFlightMax.CompareAndSwap(m, n) {
+			return
+		}
+	}
+}
+
+// resetInFlightMax resets the high-water mark to the current in-flight number.
+func (uw *upstreamWrapper) resetInFlightMax() {
+	uw.inFlightMax.Store(uw.inFlight.Load())
+}
+
+func (uw *upstreamWrapper) updateErrorRate(failed bool) {
+	alpha := uw.errorRateDecay
+	if alpha == 0 {
+		alpha = defaultErrorRateDecay
+	}
+	var v float64
+	if failed {
+		v = 1
+	}
+	updateEwma(&uw.errorRate, v, alpha)
+}
+
+// updateEwma adds x to the EWMA stored in p as math.Float64bits.
+func updateEwma(p *atomic.Uint64, x, alpha float64) {
+	for {
+		old := p.Load()
+		v := math.Float64frombits(old)*(1-alpha) + x*alpha
+		if p.CompareAndSwap(old, math.Float64bits(v)) {
+			return
+		}
+	}
+}
+
+func (uw *upstreamWrapper) getErrorRate() float64 {
+	return math.Float64frombits(uw.errorRate.Load())
 }
 
 type queryInfo dns.Msg
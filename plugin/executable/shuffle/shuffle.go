@@ -21,7 +21,9 @@ package shuffle
 
 import (
 	"context"
+	"fmt"
 	"math/rand/v2"
+	"strings"
 
 	"github.com/harlanwei/mosdns-lts/v5/pkg/query_context"
 	"github.com/harlanwei/mosdns-lts/v5/plugin/executable/sequence"
@@ -36,59 +38,153 @@ func init() {
 
 var _ sequence.Executable = (*Shuffle)(nil)
 
+// Shuffle shuffles records within each RRset of the response. The order of
+// RRsets is kept, so are CNAME chains. RRSIG records are always placed right
+// after the RRset that they cover.
 type Shuffle struct {
-	answer bool
-	ns     bool
-	extra  bool
+	answer     bool
+	ns         bool
+	extra      bool
+	skipSigned bool
+}
+
+type Opts struct {
+	Answer bool
+	Ns     bool
+	Extra  bool
+
+	// SkipSigned skips shuffling if the response has the AD bit or
+	// contains RRSIG records.
+	SkipSigned bool
 }
 
 func NewShuffle(answer, ns, extra bool) *Shuffle {
+	return NewShuffleWithOpts(Opts{Answer: answer, Ns: ns, Extra: extra})
+}
+
+func NewShuffleWithOpts(opts Opts) *Shuffle {
 	return &Shuffle{
-		answer: answer,
-		ns:     ns,
-		extra:  extra,
+		answer:     opts.Answer,
+		ns:         opts.Ns,
+		extra:      opts.Extra,
+		skipSigned: opts.SkipSigned,
 	}
 }
 
+// QuickSetup format: [skip_signed]
 func QuickSetup(_ sequence.BQ, s string) (any, error) {
-	return NewShuffle(true, false, false), nil
+	opts := Opts{Answer: true}
+	for _, arg := range strings.Fields(s) {
+		switch arg {
+		case "skip_signed":
+			opts.SkipSigned = true
+		default:
+			return nil, fmt.Errorf("invalid argument %s", arg)
+		}
+	}
+	return NewShuffleWithOpts(opts), nil
 }
 
 func (s *Shuffle) Exec(_ context.Context, qCtx *query_context.Context) error {
-	if r := qCtx.R(); r != nil {
-		if s.answer && len(r.Answer) > 0 {
-			rand.Shuffle(len(r.Answer), func(i, j int) {
-				r.Answer[i], r.Answer[j] = r.Answer[j], r.Answer[i]
-			})
-		}
-		if s.ns && len(r.Ns) > 0 {
-			rand.Shuffle(len(r.Ns), func(i, j int) {
-				r.Ns[i], r.Ns[j] = r.Ns[j], r.Ns[i]
-			})
+	r := qCtx.R()
+	if r == nil {
+		return nil
+	}
+	if s.skipSigned && isSigned(r) {
+		return nil
+	}
+
+	if s.answer {
+		shuffleRRsets(r.Answer)
+	}
+	if s.ns {
+		shuffleRRsets(r.Ns)
+	}
+	if s.extra && len(r.Extra) > 0 {
+		filtered := []dns.RR{}
+		for _, rr := range r.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				filtered = append(filtered, rr)
+			}
 		}
-		if s.extra && len(r.Extra) > 0 {
-			filtered := []dns.RR{}
+		if len(filtered) > 0 {
+			shuffleRRsets(filtered)
+			newExtra := []dns.RR{}
 			for _, rr := range r.Extra {
-				if rr.Header().Rrtype != dns.TypeOPT {
-					filtered = append(filtered, rr)
+				if rr.Header().Rrtype == dns.TypeOPT {
+					newExtra = append(newExtra, rr)
+				} else if len(filtered) > 0 {
+					newExtra = append(newExtra, filtered[0])
+					filtered = filtered[1:]
 				}
 			}
-			if len(filtered) > 0 {
-				rand.Shuffle(len(filtered), func(i, j int) {
-					filtered[i], filtered[j] = filtered[j], filtered[i]
-				})
-				newExtra := []dns.RR{}
-				for _, rr := range r.Extra {
-					if rr.Header().Rrtype == dns.TypeOPT {
-						newExtra = append(newExtra, rr)
-					} else if len(filtered) > 0 {
-						newExtra = append(newExtra, filtered[0])
-						filtered = filtered[1:]
-					}
-				}
-				r.Extra = newExtra
-			}
+			r.Extra = newExtra
 		}
 	}
 	return nil
 }
+
+func isSigned(m *dns.Msg) bool {
+	if m.AuthenticatedData {
+		return true
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type rrsetKey struct {
+	name  string
+	typ   uint16
+	class uint16
+}
+
+type rrset struct {
+	rrs  []dns.RR
+	sigs []dns.RR
+}
+
+// shuffleRRsets shuffles records within each RRset of rrs in place.
+// RRsets are ordered by their first appearance in rrs. Each RRset is
+// followed by the RRSIGs that cover it.
+func shuffleRRsets(rrs []dns.RR) {
+	if len(rrs) < 2 {
+		return
+	}
+
+	var sets []*rrset
+	setOf := make(map[rrsetKey]*rrset)
+	for _, rr := range rrs {
+		h := rr.Header()
+		k := rrsetKey{name: strings.ToLower(h.Name), typ: h.Rrtype, class: h.Class}
+		sig, isSig := rr.(*dns.RRSIG)
+		if isSig {
+			k.typ = sig.TypeCovered
+		}
+		set := setOf[k]
+		if set == nil {
+			set = new(rrset)
+			setOf[k] = set
+			sets = append(sets, set)
+		}
+		if isSig {
+			set.sigs = append(set.sigs, rr)
+		} else {
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+
+	i := 0
+	for _, set := range sets {
+		rand.Shuffle(len(set.rrs), func(i, j int) {
+			set.rrs[i], set.rrs[j] = set.rrs[j], set.rrs[i]
+		})
+		i += copy(rrs[i:], set.rrs)
+		i += copy(rrs[i:], set.sigs)
+	}
+}
@@ -84,3 +84,105 @@ func TestEmptyResponse(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func newSignedResponse() *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+
+	hdr := func(name string, typ uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: typ, Class: dns.ClassINET, Ttl: 300}
+	}
+	sig := func(name string, covered uint16) *dns.RRSIG {
+		return &dns.RRSIG{Hdr: hdr(name, dns.TypeRRSIG), TypeCovered: covered, SignerName: "example.com."}
+	}
+	r.Answer = append(r.Answer,
+		&dns.CNAME{Hdr: hdr("www.example.com.", dns.TypeCNAME), Target: "a.example.com."},
+		sig("www.example.com.", dns.TypeCNAME),
+	)
+	for i := 1; i <= 8; i++ {
+		r.Answer = append(r.Answer, &dns.A{Hdr: hdr("a.example.com.", dns.TypeA), A: net.IPv4(192, 0, 2, byte(i))})
+	}
+	r.Answer = append(r.Answer, sig("a.example.com.", dns.TypeA))
+	return r
+}
+
+func TestShuffleSigned(t *testing.T) {
+	s := NewShuffle(true, false, false)
+	shuffled := false
+	for i := 0; i < 20; i++ {
+		r := newSignedResponse()
+		orig := r.Copy()
+		qCtx := query_context.NewContext(new(dns.Msg))
+		qCtx.SetResponse(r)
+		if err := s.Exec(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.Answer) != len(orig.Answer) {
+			t.Fatalf("answer count changed: %d -> %d", len(orig.Answer), len(r.Answer))
+		}
+		// The CNAME and its RRSIG stay first, each RRSIG follows its RRset.
+		if r.Answer[0].Header().Rrtype != dns.TypeCNAME {
+			t.Fatalf("CNAME should stay first, got %v", r.Answer[0])
+		}
+		if sig, ok := r.Answer[1].(*dns.RRSIG); !ok || sig.TypeCovered != dns.TypeCNAME {
+			t.Fatalf("RRSIG of the CNAME should follow it, got %v", r.Answer[1])
+		}
+		for _, rr := range r.Answer[2:10] {
+			if rr.Header().Rrtype != dns.TypeA {
+				t.Fatalf("A RRset is split, got %v", rr)
+			}
+		}
+		if sig, ok := r.Answer[10].(*dns.RRSIG); !ok || sig.TypeCovered != dns.TypeA {
+			t.Fatalf("RRSIG of the A RRset should follow it, got %v", r.Answer[10])
+		}
+		for j := 2; j < 10; j++ {
+			if r.Answer[j].String() != orig.Answer[j].String() {
+				shuffled = true
+			}
+		}
+	}
+	if !shuffled {
+		t.Fatal("A records were never shuffled")
+	}
+}
+
+func TestShuffleSkipSigned(t *testing.T) {
+	s, err := QuickSetup(nil, "skip_signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := newSignedResponse()
+	unsignedAD := newSignedResponse()
+	unsignedAD.AuthenticatedData = true
+	var answer []dns.RR
+	for _, rr := range unsignedAD.Answer {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			answer = append(answer, rr)
+		}
+	}
+	unsignedAD.Answer = answer
+
+	for _, r := range []*dns.Msg{signed, unsignedAD} {
+		orig := r.Copy()
+		for i := 0; i < 10; i++ {
+			qCtx := query_context.NewContext(new(dns.Msg))
+			qCtx.SetResponse(r)
+			if err := s.(*Shuffle).Exec(context.Background(), qCtx); err != nil {
+				t.Fatal(err)
+			}
+			for j := range r.Answer {
+				if r.Answer[j].String() != orig.Answer[j].String() {
+					t.Fatalf("signed response should not be shuffled, got %v", r.Answer)
+				}
+			}
+		}
+	}
+
+	if _, err := QuickSetup(nil, "invalid"); err == nil {
+		t.Fatal("expected an error for invalid args")
+	}
+}
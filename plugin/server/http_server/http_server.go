@@ -51,6 +51,10 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// QueryLogSize enables a log of the last QueryLogSize queries, which
+	// can be dumped via the "/recent_queries" api. Zero disables it.
+	QueryLogSize int `yaml:"query_log_size"`
 }
 
 func (a *Args) init() {
@@ -72,12 +76,14 @@ func Init(bp *coremain.BP, args any) (any, error) {
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
+	ql := server_utils.NewQueryLog(bp, args.QueryLogSize)
 	mux := http.NewServeMux()
 	for _, entry := range args.Entries {
 		dh, err := server_utils.NewHandler(bp, entry.Exec)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init dns handler, %w", err)
 		}
+		dh = ql.Wrap(dh)
 		hhOpts := server.HttpHandlerOpts{
 			GetSrcIPFromHeader: args.SrcIPHeader,
 			Logger:             bp.L(),
@@ -47,6 +47,16 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// HandlerTimeout, in seconds, bounds the time that the entry may take
+	// to answer a query. Queries that time out are dropped, or answered
+	// with SERVFAIL if HandlerTimeoutServfail is set. Zero disables it.
+	HandlerTimeout         int  `yaml:"handler_timeout"`
+	HandlerTimeoutServfail bool `yaml:"handler_timeout_servfail"`
+
+	// QueryLogSize enables a log of the last QueryLogSize queries, which
+	// can be dumped via the "/recent_queries" api. Zero disables it.
+	QueryLogSize int `yaml:"query_log_size"`
 }
 
 func (a *Args) init() {
@@ -56,13 +66,21 @@ func (a *Args) init() {
 type QuicServer struct {
 	args *Args
 
-	l *quic.Listener
+	l       *quic.Listener
+	drainer *server.DoQDrainer
 }
 
 func (s *QuicServer) Close() error {
 	return s.l.Close()
 }
 
+// Drain stops accepting new connections and waits for in-flight queries
+// of existing connections to complete, up to the ctx deadline. Then the
+// server is closed.
+func (s *QuicServer) Drain(ctx context.Context) error {
+	return s.drainer.Drain(ctx)
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
@@ -74,6 +92,7 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
+	dh = server_utils.NewQueryLog(bp, args.QueryLogSize).Wrap(dh)
 
 	// Init tls
 	if len(args.Key) == 0 || len(args.Cert) == 0 {
@@ -142,14 +161,26 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	}
 	bp.L().Info("quic server started", zap.Stringer("addr", quicListener.Addr()))
 
+	drainer := server.NewDoQDrainer()
 	go func() {
 		defer quicListener.Close()
-		serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout}
+		serverOpts := server.DoQServerOpts{
+			Logger:                   bp.L(),
+			IdleTimeout:              idleTimeout,
+			Drainer:                  drainer,
+			HandlerTimeout:           time.Duration(args.HandlerTimeout) * time.Second,
+			ServfailOnHandlerTimeout: args.HandlerTimeoutServfail,
+		}
 		err := server.ServeDoQ(quicListener, dh, serverOpts)
+		if errors.Is(err, server.ErrServerDrained) {
+			bp.L().Info("quic server drained")
+			return
+		}
 		bp.M().GetSafeClose().SendCloseSignal(err)
 	}()
 	return &QuicServer{
-		args: args,
-		l:    quicListener,
+		args:    args,
+		l:       quicListener,
+		drainer: drainer,
 	}, nil
 }
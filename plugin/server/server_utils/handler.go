@@ -20,8 +20,11 @@
 package server_utils
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/harlanwei/mosdns-lts/v5/coremain"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/server"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/server_handler"
@@ -41,3 +44,22 @@ func NewHandler(bp *coremain.BP, entry string) (server.Handler, error) {
 	}
 	return server_handler.NewEntryHandler(handlerOpts), nil
 }
+
+// NewQueryLog returns a server.QueryLog that keeps the last size queries
+// and registers its "/recent_queries" api, which responds the records in
+// json. It returns nil if size <= 0, which disables the query log.
+func NewQueryLog(bp *coremain.BP, size int) *server.QueryLog {
+	if size <= 0 {
+		return nil
+	}
+	l := server.NewQueryLog(size, bp.Tag())
+	r := chi.NewRouter()
+	r.Get("/recent_queries", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(l.RecentQueries()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	bp.RegAPI(r)
+	return l
+}
@@ -13,4 +13,10 @@ type ListenerSocketOpts struct {
 	SO_RCVBUF    int
 	SO_SNDBUF    int
 	IPV6_V6ONLY  bool
+
+	// IPTransparent sets IP_TRANSPARENT (IPV6_TRANSPARENT for ipv6 sockets).
+	// It allows the socket to receive packets redirected by TPROXY and to
+	// send packets from non-local addresses. Linux only.
+	// Requires CAP_NET_ADMIN.
+	IPTransparent bool
 }
@@ -38,6 +38,23 @@ func ListenerControl(opt ListenerSocketOpts) ControlFunc {
 				}
 			}
 
+			if opt.IPTransparent {
+				domain, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+				if err != nil {
+					errSyscall = os.NewSyscallError("failed to get SO_DOMAIN", err)
+					return
+				}
+				if domain == unix.AF_INET6 {
+					errSyscall = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				} else {
+					errSyscall = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				}
+				if errSyscall != nil {
+					errSyscall = os.NewSyscallError("failed to set IP_TRANSPARENT, CAP_NET_ADMIN is required", errSyscall)
+					return
+				}
+			}
+
 			if opt.SO_RCVBUF > 0 {
 				errSyscall = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, opt.SO_RCVBUF)
 				if errSyscall != nil {
@@ -0,0 +1,62 @@
+//go:build linux
+
+package server_utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// IP_TRANSPARENT requires CAP_NET_ADMIN, this test is skipped without it.
+// Whether TPROXY redirected packets are actually received and answered can
+// only be verified with root and iptables/nftables rules, which is out of
+// the scope of unit tests.
+func TestListenerControlIPTransparent(t *testing.T) {
+	for _, network := range []string{"udp4", "udp6"} {
+		t.Run(network, func(t *testing.T) {
+			addr := "127.0.0.1:0"
+			if network == "udp6" {
+				addr = "[::1]:0"
+			}
+			lc := net.ListenConfig{Control: ListenerControl(ListenerSocketOpts{IPTransparent: true})}
+			c, err := lc.ListenPacket(context.Background(), network, addr)
+			if err != nil {
+				if errors.Is(err, syscall.EPERM) {
+					t.Skip("CAP_NET_ADMIN is required")
+				}
+				if network == "udp6" && errors.Is(err, syscall.EADDRNOTAVAIL) {
+					t.Skip("ipv6 is not available")
+				}
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			sc, err := c.(*net.UDPConn).SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+			if network == "udp6" {
+				level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+			}
+			var v int
+			var getErr error
+			if err := sc.Control(func(fd uintptr) {
+				v, getErr = unix.GetsockoptInt(int(fd), level, opt)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if getErr != nil {
+				t.Fatal(getErr)
+			}
+			if v != 1 {
+				t.Fatalf("transparent option is not set, got %d", v)
+			}
+		})
+	}
+}
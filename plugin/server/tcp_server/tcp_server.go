@@ -46,6 +46,14 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// See server.TCPServerOpts.
+	MaxQueriesPerConn   int `yaml:"max_queries_per_conn"`
+	MaxPipelinedQueries int `yaml:"max_pipelined_queries"`
+
+	// QueryLogSize enables a log of the last QueryLogSize queries, which
+	// can be dumped via the "/recent_queries" api. Zero disables it.
+	QueryLogSize int `yaml:"query_log_size"`
 }
 
 func (a *Args) init() {
@@ -72,6 +80,7 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
+	dh = server_utils.NewQueryLog(bp, args.QueryLogSize).Wrap(dh)
 
 	// Init tls
 	var tc *tls.Config
@@ -118,7 +127,12 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 
 	go func() {
 		defer l.Close()
-		serverOpts := server.TCPServerOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second}
+		serverOpts := server.TCPServerOpts{
+			Logger:              bp.L(),
+			IdleTimeout:         time.Duration(args.IdleTimeout) * time.Second,
+			MaxQueriesPerConn:   args.MaxQueriesPerConn,
+			MaxPipelinedQueries: args.MaxPipelinedQueries,
+		}
 		err := server.ServeTCP(l, dh, serverOpts)
 		bp.M().GetSafeClose().SendCloseSignal(err)
 	}()
@@ -21,13 +21,17 @@ package udp_server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"time"
 
 	"github.com/harlanwei/mosdns-lts/v5/coremain"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/server"
 	"github.com/harlanwei/mosdns-lts/v5/pkg/utils"
 	"github.com/harlanwei/mosdns-lts/v5/plugin/server/server_utils"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -44,6 +48,70 @@ type Args struct {
 	CPUAffinity bool   `yaml:"cpu_affinity"`
 	SO_RCVBUF   int    `yaml:"so_rcvbuf"`
 	SO_SNDBUF   int    `yaml:"so_sndbuf"`
+
+	// BatchSize, if > 1, reads up to BatchSize packets per syscall
+	// (recvmmsg). Linux only.
+	BatchSize int `yaml:"batch_size"`
+
+	// OOBBufferSize is the size of the buffers for the control messages of
+	// packets. See server.UDPServerOpts. Default is 1024.
+	OOBBufferSize int `yaml:"oob_buffer_size"`
+
+	// AdvertisedUDPSize is the max size of responses, which is also
+	// advertised to EDNS0 clients. Responses are fitted into the smaller
+	// one of it and the client's udp size. Default is 1232.
+	AdvertisedUDPSize int `yaml:"advertised_udp_size"`
+
+	// IPTransparent enables IP_TRANSPARENT for TPROXY setups. Responses are
+	// sent from the original destination of queries. Linux only, requires
+	// CAP_NET_ADMIN.
+	IPTransparent bool `yaml:"ip_transparent"`
+
+	// MaxInFlight limits the number of queries that are being processed.
+	// Queries over the limit get SERVFAIL. Zero means no limit.
+	MaxInFlight int `yaml:"max_in_flight"`
+
+	// HandlerTimeout, in seconds, bounds the time that the entry may take
+	// to answer a query. Queries that time out are dropped, or answered
+	// with SERVFAIL if HandlerTimeoutServfail is set. Zero disables it.
+	HandlerTimeout         int  `yaml:"handler_timeout"`
+	HandlerTimeoutServfail bool `yaml:"handler_timeout_servfail"`
+
+	// FloodDetection logs source prefixes that look like spoofed-source
+	// query floods, e.g. for fail2ban. Queries are not blocked.
+	FloodDetection *FloodDetectionArgs `yaml:"flood_detection"`
+
+	// WorkerImbalance logs when a worker of the worker pool has much more
+	// queued packets than the others, e.g. because it is stuck in slow
+	// queries. Requires worker_pool.
+	WorkerImbalance *WorkerImbalanceArgs `yaml:"worker_imbalance"`
+
+	// DNS Cookies (RFC 7873).
+	EnableCookie  bool   `yaml:"enable_cookie"`
+	RequireCookie bool   `yaml:"require_cookie"`
+	CookieSecret  string `yaml:"cookie_secret"` // Optional. Random if empty.
+
+	// QueryLogSize enables a log of the last QueryLogSize queries, which
+	// can be dumped via the "/recent_queries" api. Zero disables it.
+	QueryLogSize int `yaml:"query_log_size"`
+}
+
+// FloodDetectionArgs are the thresholds of server.FloodDetectorOpts.
+// Zero values use the defaults.
+type FloodDetectionArgs struct {
+	Window          int     `yaml:"window"` // in seconds
+	MinQueries      int     `yaml:"min_queries"`
+	SequentialRatio float64 `yaml:"sequential_ratio"`
+	IPv4PrefixLen   int     `yaml:"ipv4_prefix_len"`
+	IPv6PrefixLen   int     `yaml:"ipv6_prefix_len"`
+}
+
+// WorkerImbalanceArgs are the thresholds of server.ImbalanceMonitorOpts.
+// Zero values use the defaults.
+type WorkerImbalanceArgs struct {
+	Interval  int     `yaml:"interval"` // in seconds
+	Threshold float64 `yaml:"threshold"`
+	MinQueued int     `yaml:"min_queued"`
 }
 
 func (a *Args) init() {
@@ -55,13 +123,20 @@ func (a *Args) init() {
 type UdpServer struct {
 	args *Args
 
-	c net.PacketConn
+	c       net.PacketConn
+	drainer *server.UDPDrainer
 }
 
 func (s *UdpServer) Close() error {
 	return s.c.Close()
 }
 
+// Drain stops reading new queries and waits for in-flight queries to be
+// answered, up to the ctx deadline. Then the server is closed.
+func (s *UdpServer) Drain(ctx context.Context) error {
+	return s.drainer.Drain(ctx)
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
@@ -71,6 +146,61 @@ func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
+	dh = server_utils.NewQueryLog(bp, args.QueryLogSize).Wrap(dh)
+
+	var onShed func()
+	if args.MaxInFlight > 0 {
+		shedTotal := prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "shed_total",
+			Help:        "The total number of queries that were shed because max_in_flight was reached",
+			ConstLabels: map[string]string{"tag": bp.Tag()},
+		})
+		if err := prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg()).Register(shedTotal); err != nil {
+			return nil, fmt.Errorf("failed to register metrics, %w", err)
+		}
+		onShed = shedTotal.Inc
+	}
+
+	var floodOpts *server.FloodDetectorOpts
+	if fa := args.FloodDetection; fa != nil {
+		floodTotal := prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "flood_detected_total",
+			Help:        "The total number of times a source prefix looked like a spoofed-source query flood",
+			ConstLabels: map[string]string{"tag": bp.Tag()},
+		})
+		if err := prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg()).Register(floodTotal); err != nil {
+			return nil, fmt.Errorf("failed to register metrics, %w", err)
+		}
+		floodOpts = &server.FloodDetectorOpts{
+			Window:          time.Duration(fa.Window) * time.Second,
+			MinQueries:      fa.MinQueries,
+			SequentialRatio: fa.SequentialRatio,
+			IPv4PrefixLen:   fa.IPv4PrefixLen,
+			IPv6PrefixLen:   fa.IPv6PrefixLen,
+			OnFlood:         func(netip.Prefix) { floodTotal.Inc() },
+		}
+	}
+
+	var imbalanceOpts *server.ImbalanceMonitorOpts
+	if ia := args.WorkerImbalance; ia != nil {
+		if args.WorkerPool == 0 {
+			return nil, errors.New("worker_imbalance requires worker_pool")
+		}
+		imbalanceTotal := prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "worker_imbalance_total",
+			Help:        "The total number of times the workers of the worker pool were imbalanced",
+			ConstLabels: map[string]string{"tag": bp.Tag()},
+		})
+		if err := prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg()).Register(imbalanceTotal); err != nil {
+			return nil, fmt.Errorf("failed to register metrics, %w", err)
+		}
+		imbalanceOpts = &server.ImbalanceMonitorOpts{
+			Interval:    time.Duration(ia.Interval) * time.Second,
+			Threshold:   ia.Threshold,
+			MinQueued:   ia.MinQueued,
+			OnImbalance: func(server.ImbalanceReport) { imbalanceTotal.Inc() },
+		}
+	}
 
 	host, _, err := net.SplitHostPort(args.Listen)
 	if err != nil {
@@ -89,10 +219,11 @@ func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 	}
 
 	socketOpt := server_utils.ListenerSocketOpts{
-		SO_REUSEPORT: true,
-		SO_RCVBUF:    args.SO_RCVBUF,
-		SO_SNDBUF:    args.SO_SNDBUF,
-		IPV6_V6ONLY:  ipv6only,
+		SO_REUSEPORT:  true,
+		SO_RCVBUF:     args.SO_RCVBUF,
+		SO_SNDBUF:     args.SO_SNDBUF,
+		IPV6_V6ONLY:   ipv6only,
+		IPTransparent: args.IPTransparent,
 	}
 	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
 	c, err := lc.ListenPacket(context.Background(), network, args.Listen)
@@ -101,17 +232,38 @@ func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 	}
 	bp.L().Info("udp server started", zap.Stringer("addr", c.LocalAddr()))
 
+	drainer := server.NewUDPDrainer()
 	go func() {
 		defer c.Close()
 		err := server.ServeUDP(c.(*net.UDPConn), dh, server.UDPServerOpts{
-			Logger:         bp.L(),
-			WorkerPoolSize: args.WorkerPool,
-			CPUAffinity:    args.CPUAffinity,
+			Logger:            bp.L(),
+			WorkerPoolSize:    args.WorkerPool,
+			CPUAffinity:       args.CPUAffinity,
+			EnableCookie:      args.EnableCookie,
+			RequireCookie:     args.RequireCookie,
+			CookieSecret:      []byte(args.CookieSecret),
+			Transparent:       args.IPTransparent,
+			MaxInFlight:       args.MaxInFlight,
+			OnShed:            onShed,
+			FloodDetector:     floodOpts,
+			ImbalanceMonitor:  imbalanceOpts,
+			OOBBufferSize:     args.OOBBufferSize,
+			AdvertisedUDPSize: args.AdvertisedUDPSize,
+
+			HandlerTimeout:           time.Duration(args.HandlerTimeout) * time.Second,
+			ServfailOnHandlerTimeout: args.HandlerTimeoutServfail,
+			Drainer:                  drainer,
+			BatchSize:                args.BatchSize,
 		})
+		if errors.Is(err, server.ErrServerDrained) {
+			bp.L().Info("udp server drained")
+			return
+		}
 		bp.M().GetSafeClose().SendCloseSignal(err)
 	}()
 	return &UdpServer{
-		args: args,
-		c:    c,
+		args:    args,
+		c:       c,
+		drainer: drainer,
 	}, nil
 }